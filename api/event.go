@@ -2,6 +2,7 @@ package api
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
@@ -20,11 +21,16 @@ type EventType string
 const (
 	EventTypeTimerExpired EventType = "TIMER_EXPIRED"
 	EventTypeNoEntryAlarm EventType = "NO_ENTRY_ALARM"
+	// EventTypeDigest selects the channels of the daily digest in NotificationSettings.Channels. It is never sent as an Event
+	EventTypeDigest EventType = "DIGEST"
 )
 
 type Message struct {
 	User    string `json:"user,omitempty"`
 	Message string `json:"message"`
+	// Event and Target allow NotificationServices to format the message and to offer actions, e.g. to extend the activity
+	Event  EventType `json:"event,omitempty"`
+	Target string    `json:"target,omitempty"`
 }
 
 func MakeMessageEvent(name EventType, message, target, user string) cloudevents.Event {
@@ -38,8 +44,37 @@ func MakeMessageEvent(name EventType, message, target, user string) cloudevents.
 	data := Message{
 		User:    fmt.Sprintf("@%s", user),
 		Message: message,
+		Event:   name,
+		Target:  target,
 	}
 	ev.SetData("application/json", &data)
 
 	return ev
 }
+
+// EventId returns the same ID for the same notification, e.g. a timer, that expired at a certain time. Reconcilers send
+// notifications again, receivers use the ID to drop duplicates
+func EventId(user string, name EventType, at time.Time) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(fmt.Sprintf("timerec:%s/%s/%d", user, name, at.Unix()))).String()
+}
+
+// MessageFromEvent returns the Message of an Event created by MakeMessageEvent
+func MessageFromEvent(ev cloudevents.Event) (Message, error) {
+	var msg Message
+	err := ev.DataAs(&msg)
+	return msg, err
+}
+
+// UserName returns the name of the User, the Message is sent to
+func (msg Message) UserName() string {
+	return strings.TrimPrefix(msg.User, "@")
+}
+
+// ActivityName returns the activity of a Target "activity@<name>". Messages, that do not refer to an active activity, return ""
+func (msg Message) ActivityName() string {
+	name := strings.TrimPrefix(msg.Target, "activity@")
+	if name == msg.Target || name == "none" {
+		return ""
+	}
+	return name
+}
@@ -71,7 +71,10 @@ func (t *Job) ConvertToRecords() []Record {
 		}
 
 		records = append(records, Record{
+			Id:          RecordId(t.Owner, t.Name, activity.Start, activity.End),
 			UserName:    t.Owner,
+			JobName:     t.Name,
+			Template:    t.RecordTemplate.TemplateName,
 			Title:       t.Title,
 			Description: desc,
 			Project:     t.RecordTemplate.Project,
@@ -84,6 +87,9 @@ func (t *Job) ConvertToRecords() []Record {
 }
 
 func (t *Job) Update(new Job) error {
+	if new.RecordTemplate.TemplateName != "" {
+		t.RecordTemplate.TemplateName = new.RecordTemplate.TemplateName
+	}
 	if new.RecordTemplate.Title != "" {
 		t.RecordTemplate.Title = new.RecordTemplate.Title
 	}
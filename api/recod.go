@@ -1,15 +1,27 @@
 package api
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
 
 type Record struct {
-	Id          string
-	UserName    string
-	Title       string
-	Description string
-	Project     string
-	Task        string
-
-	Start time.Time
-	End   time.Time
+	Id          string `json:"id"`
+	UserName    string `json:"user"`
+	JobName     string `json:"job,omitempty"`
+	Template    string `json:"template,omitempty"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Project     string `json:"project,omitempty"`
+	Task        string `json:"task,omitempty"`
+
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// RecordId returns a deterministic Id for a Record. Submitting the same Job twice results in the same Ids
+func RecordId(owner, job string, start, end time.Time) string {
+	sum := sha256.Sum256([]byte(owner + "\x00" + job + "\x00" + start.UTC().Format(time.RFC3339Nano) + "\x00" + end.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(sum[:16])
 }
@@ -0,0 +1,20 @@
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+func TestRecordIdIsDeterministic(t *testing.T) {
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	id := api.RecordId("me", "work", start, start.Add(time.Hour))
+
+	if api.RecordId("me", "work", start.In(time.FixedZone("CET", 3600)), start.Add(time.Hour)) != id {
+		t.Fatalf("incorrect id: expected the same id for the same time in another timezone")
+	}
+	if api.RecordId("me", "work", start, start.Add(2*time.Hour)) == id || api.RecordId("you", "work", start, start.Add(time.Hour)) == id {
+		t.Fatalf("incorrect id: expected different ids for different records, got %s", id)
+	}
+}
@@ -5,11 +5,16 @@ import (
 	"time"
 )
 
+// RedactedValue replaces secrets in responses of the user API (see User.Redacted)
+const RedactedValue string = "REDACTED"
+
 type User struct {
 	Name     string
 	Inactive bool
 	Activity Activity
 	Settings Settings
+	// Notified is when each notification (e.g. "digest") was last sent, so notifications are not repeated after a restart
+	Notified map[string]time.Time `yaml:"notified,omitempty" json:"notified,omitempty"`
 }
 type Settings struct {
 	HelloTimer      time.Duration `json:"hello_timer,omitempty"`
@@ -17,6 +22,91 @@ type Settings struct {
 	RoundTo         time.Duration `json:"round_to,omitempty"`
 	MissedWorkAlarm time.Duration `json:"alarm,omitempty"`
 	Weekdays        []string      `json:"weekdays,omitempty"`
+	// Notifications are the channels a User receives notifications on. Channels without configuration are skipped
+	Notifications NotificationSettings `json:"notifications,omitempty"`
+}
+
+type NotificationSettings struct {
+	// Channels select the channels (e.g. "slack", "email") for each EventType. EventTypes without an entry go to the
+	// default channels of the server, an empty list turns the EventType off
+	Channels map[EventType][]string `json:"channels,omitempty"`
+	// QuietHours and DoNotDisturb suppress all notifications. QuietHours and the time of the digest are in Timezone
+	// (e.g. "Europe/Vienna"), the server's timezone is used if it is empty or unknown
+	QuietHours   QuietHours `json:"quiet_hours,omitempty"`
+	DoNotDisturb bool       `json:"do_not_disturb,omitempty"`
+	Timezone     string     `json:"timezone,omitempty"`
+
+	Slack      SlackSettings       `json:"slack,omitempty"`
+	Mattermost ChatWebhookSettings `json:"mattermost,omitempty"`
+	Email      EmailSettings       `json:"email,omitempty"`
+	Ntfy       NtfySettings        `json:"ntfy,omitempty"`
+	Gotify     GotifySettings      `json:"gotify,omitempty"`
+}
+
+// Location returns the Timezone of the User
+func (n NotificationSettings) Location() *time.Location {
+	if n.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(n.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+// Quiet returns true, if the User does not want to be notified at t
+func (n NotificationSettings) Quiet(t time.Time) bool {
+	return n.DoNotDisturb || n.QuietHours.Contains(t.In(n.Location()))
+}
+
+// QuietHours is a daily period in wall clock time, e.g. From 22h To 7h. From and To are the time of day
+type QuietHours struct {
+	From time.Duration `json:"from,omitempty"`
+	To   time.Duration `json:"to,omitempty"`
+}
+
+// Contains returns true, if the time of day of t (in t's Location) is within the QuietHours. Equal From and To disable QuietHours
+func (q QuietHours) Contains(t time.Time) bool {
+	hour, min, sec := t.Clock()
+	offset := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+	if q.From <= q.To {
+		return offset >= q.From && offset < q.To
+	}
+	return offset >= q.From || offset < q.To
+}
+
+// SlackSettings configure a Slack incoming webhook. Slack webhooks always post to the channel they were created for,
+// so there is no channel override. Without WebhookUrl, the webhook of the server is used
+type SlackSettings struct {
+	WebhookUrl string `json:"webhook_url,omitempty"`
+	Mention    string `json:"mention,omitempty"`
+}
+
+// ChatWebhookSettings configure an incoming webhook. Without WebhookUrl, the webhook of the server is used
+type ChatWebhookSettings struct {
+	WebhookUrl string `json:"webhook_url,omitempty"`
+	Channel    string `json:"channel,omitempty"`
+	Mention    string `json:"mention,omitempty"`
+}
+
+// EmailSettings configure email notifications. With Digest, all notifications of a day are sent as one summary
+type EmailSettings struct {
+	Address string `json:"address,omitempty"`
+	Digest  bool   `json:"digest,omitempty"`
+}
+
+// NtfySettings select the ntfy topic of a User. Server and Token default to the server configuration
+type NtfySettings struct {
+	Server string `json:"server,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	Token  string `json:"token,omitempty"`
+}
+
+// GotifySettings hold the application token, Gotify uses to deliver messages to a User
+type GotifySettings struct {
+	Server string `json:"server,omitempty"`
+	Token  string `json:"token,omitempty"`
 }
 
 type Activity struct {
@@ -61,6 +151,22 @@ func NewDefaultUser(name string) User {
 	return new
 }
 
+// Redacted returns a copy of the User without the secrets in its Settings: webhook URLs, tokens and ntfy topics (anyone who
+// knows a topic can read it). Secrets that are set are replaced with RedactedValue
+func (p User) Redacted() User {
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = RedactedValue
+		}
+	}
+	redact(&p.Settings.Notifications.Slack.WebhookUrl)
+	redact(&p.Settings.Notifications.Mattermost.WebhookUrl)
+	redact(&p.Settings.Notifications.Ntfy.Topic)
+	redact(&p.Settings.Notifications.Ntfy.Token)
+	redact(&p.Settings.Notifications.Gotify.Token)
+	return p
+}
+
 func (a *Activity) AddComment(comment string) {
 	if comment == "" {
 		return
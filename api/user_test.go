@@ -87,3 +87,64 @@ func TestClearActivity(t *testing.T) {
 		t.Fatalf("Activity still active after clear: %s", err.Error())
 	}
 }
+
+func TestQuietHoursContains(t *testing.T) {
+	day := time.Date(2022, 3, 1, 0, 0, 0, 0, time.Local)
+	testCases := []struct {
+		desc string
+		api.QuietHours
+		at       time.Duration
+		expected bool
+	}{
+		{desc: "disabled", expected: false, at: 3 * time.Hour, QuietHours: api.QuietHours{}},
+		{desc: "overnight-early", expected: true, at: 3 * time.Hour, QuietHours: api.QuietHours{From: 22 * time.Hour, To: 7 * time.Hour}},
+		{desc: "overnight-late", expected: true, at: 23 * time.Hour, QuietHours: api.QuietHours{From: 22 * time.Hour, To: 7 * time.Hour}},
+		{desc: "overnight-day", expected: false, at: 12 * time.Hour, QuietHours: api.QuietHours{From: 22 * time.Hour, To: 7 * time.Hour}},
+		{desc: "lunch", expected: true, at: 12 * time.Hour, QuietHours: api.QuietHours{From: 12 * time.Hour, To: 13 * time.Hour}},
+		{desc: "lunch-end", expected: false, at: 13 * time.Hour, QuietHours: api.QuietHours{From: 12 * time.Hour, To: 13 * time.Hour}},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if actual := tC.QuietHours.Contains(day.Add(tC.at)); actual != tC.expected {
+				t.Fatalf("incorrect result: got %t expected %t", actual, tC.expected)
+			}
+		})
+	}
+}
+
+func TestQuietHoursUseWallClock(t *testing.T) {
+	settings := api.NotificationSettings{Timezone: "Europe/Vienna", QuietHours: api.QuietHours{From: 22 * time.Hour, To: 7 * time.Hour}}
+	vienna := settings.Location()
+	if vienna == time.Local {
+		t.Skip("timezone database is not available")
+	}
+
+	// The clocks in Vienna were set forward on 2022-03-27, 7:15 is less than 7 hours after midnight
+	morning := time.Date(2022, 3, 27, 7, 15, 0, 0, vienna)
+	if settings.Quiet(morning.UTC()) {
+		t.Fatalf("expected %v to be after the quiet hours", morning)
+	}
+	if !settings.Quiet(morning.Add(-30 * time.Minute).UTC()) {
+		t.Fatalf("expected %v to be within the quiet hours", morning.Add(-30*time.Minute))
+	}
+}
+
+func TestUserRedacted(t *testing.T) {
+	user := api.NewDefaultUser("me")
+	user.Settings.Notifications.Slack.WebhookUrl = "https://hooks.slack.com/services/secret"
+	user.Settings.Notifications.Ntfy = api.NtfySettings{Server: "https://ntfy.example.com", Topic: "timerec-me", Token: "tk_me"}
+	user.Settings.Notifications.Email.Address = "me@example.com"
+
+	redacted := user.Redacted()
+	ntfy := redacted.Settings.Notifications.Ntfy
+	if redacted.Settings.Notifications.Slack.WebhookUrl != api.RedactedValue || ntfy.Topic != api.RedactedValue || ntfy.Token != api.RedactedValue {
+		t.Fatalf("secrets were not redacted: %v", redacted.Settings.Notifications)
+	}
+	if ntfy.Server != "https://ntfy.example.com" || redacted.Settings.Notifications.Email.Address != "me@example.com" || redacted.Settings.Notifications.Gotify.Token != "" {
+		t.Fatalf("incorrect redacted settings: %v", redacted.Settings.Notifications)
+	}
+	if user.Settings.Notifications.Ntfy.Token != "tk_me" {
+		t.Fatal("Redacted changed the User")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thomasbuchinger/timerec/internal/server"
+)
+
+var deadLettersCmd = &cobra.Command{
+	Use:   "dead-letters",
+	Short: "Manages notifications, that could not be delivered",
+}
+
+var deadLettersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists all undelivered notifications",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		letters, err := deadLetterReplayer().DeadLetters()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, letter := range letters {
+			fmt.Printf("%s %s %s (%d attempts): %s\n", letter.FailedAt.Local().Format("2006-01-02 15:04"), letter.Event.ID(), letter.Event.Subject(), letter.Attempts, letter.Error)
+		}
+	},
+}
+
+var deadLettersReplayCmd = &cobra.Command{
+	Use:   "replay",
+	Short: "Sends all undelivered notifications again",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		sent, err := deadLetterReplayer().Replay(context.Background())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Replayed %d notifications\n", sent)
+	},
+}
+
+func deadLetterReplayer() server.DeadLetterReplayer {
+	s := server.NewServer()
+	for _, service := range server.UnwrapNotifiers(s.ChatProvider) {
+		if replayer, ok := service.(server.DeadLetterReplayer); ok {
+			return replayer
+		}
+	}
+	fmt.Fprintln(os.Stderr, "The configured notifications do not keep undelivered events. Enable the webhook to use a dead-letter store")
+	os.Exit(1)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(deadLettersCmd)
+	deadLettersCmd.AddCommand(deadLettersListCmd)
+	deadLettersCmd.AddCommand(deadLettersReplayCmd)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/thomasbuchinger/timerec/internal/server"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manages the keys to encrypt the State file",
+}
+
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate [id]",
+	Short: "Prints a new key",
+	Long: `Prints a new key for the key file or the TIMEREC_STATE_KEY environment variable.
+To rotate keys, add the new key as the first line of the key file, run "keys rotate" and remove the old key afterwards`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		id := time.Now().Format("20060102")
+		if len(args) > 0 {
+			id = args[0]
+		}
+		key, err := providers.GenerateStateKey(id)
+		cobra.CheckErr(err)
+		fmt.Println(key)
+	},
+}
+
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Encrypts the State file with the first configured key",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		s := server.NewServer()
+		file, ok := server.UnwrapState(s.StateProvider).(*providers.FileOrMemoryProvider)
+		if !ok || file.Path == "" {
+			fmt.Fprintln(os.Stderr, "Encryption is only supported by the file State")
+			os.Exit(1)
+		}
+		if len(file.Keys) == 0 {
+			fmt.Fprintf(os.Stderr, "No key configured. Set file.keyfile or %s\n", providers.StateKeyEnv)
+			os.Exit(1)
+		}
+		if err := file.Rewrite(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Encrypted %s with key '%s'\n", file.Path, file.Keys[0].Id)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysGenerateCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+}
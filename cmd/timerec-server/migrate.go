@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thomasbuchinger/timerec/internal/server"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+var migrateDryRun bool
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrates the State to the current schema version",
+	Long: `Rewrites every partition of the State, that was written by an older version of timerec.
+The server migrates old data on every read anyway, migrate makes sure it is also stored in the new format`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		s := server.NewServer()
+		migrations, err := s.MigrateState(migrateDryRun)
+		for _, migration := range migrations {
+			fmt.Println(migration)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		switch {
+		case len(migrations) == 0:
+			fmt.Printf("State is up to date (schema version %d)\n", providers.StateSchemaVersion)
+		case migrateDryRun:
+			fmt.Printf("%d migrations pending, run without --dry-run to apply them\n", len(migrations))
+		default:
+			fmt.Printf("Migrated State to schema version %d\n", providers.StateSchemaVersion)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "Only show the pending migrations")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thomasbuchinger/timerec/internal/server"
+	"go.uber.org/zap"
+)
+
+var migrateStateFrom string
+var migrateStateTo string
+var migrateStateReplace bool
+var migrateStateDryRun bool
+
+var migrateStateCmd = &cobra.Command{
+	Use:   "migrate-state --from STATE --to STATE",
+	Short: "Copies the State to a different provider",
+	Long: `Reads every partition from the source State, writes it to the target State and compares the number of entries.
+States are given as <type>[:<options>]: file:<path>, bolt:<path>, git:<path>, sql:<driver>:<dsn>, kubernetes[:<kubeconfig>] or kubernetes-crd[:<kubeconfig>]`,
+	Example: `
+# Move from the file State to the Kubernetes State
+timerec-server migrate-state --from file:db.yaml --to kubernetes
+	`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		os.Exit(migrateState())
+	},
+}
+
+// migrateState returns the exit code, so the States are closed before exiting
+func migrateState() int {
+	logger, _ := zap.NewDevelopment()
+	source, err := server.OpenState(*logger.Sugar(), migrateStateFrom)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open source: %v\n", err)
+		return 1
+	}
+	defer server.CloseState(source)
+	target, err := server.OpenState(*logger.Sugar(), migrateStateTo)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open target: %v\n", err)
+		return 1
+	}
+	defer server.CloseState(target)
+
+	result, err := server.CopyState(source, target, migrateStateReplace, migrateStateDryRun)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%-16s %-20s %8s %8s\n", "KIND", "OWNER", "SOURCE", "TARGET")
+	for _, c := range result.Counts {
+		fmt.Printf("%-16s %-20s %8d %8d\n", c.Kind, c.Owner, c.Source, c.Target)
+	}
+	if migrateStateDryRun {
+		return 0
+	}
+
+	for _, difference := range result.Differences {
+		fmt.Println(difference)
+	}
+	if len(result.Differences) > 0 {
+		fmt.Printf("Copied State with %d differences\n", len(result.Differences))
+		return 2
+	}
+	fmt.Printf("Copied State from %s to %s\n", migrateStateFrom, migrateStateTo)
+	return 0
+}
+
+func init() {
+	rootCmd.AddCommand(migrateStateCmd)
+	migrateStateCmd.Flags().StringVar(&migrateStateFrom, "from", "", "Source State, e.g. file:db.yaml")
+	migrateStateCmd.Flags().StringVar(&migrateStateTo, "to", "", "Target State, e.g. kubernetes")
+	migrateStateCmd.Flags().BoolVar(&migrateStateReplace, "replace", false, "Overwrite a target, that is not empty")
+	migrateStateCmd.Flags().BoolVar(&migrateStateDryRun, "dry-run", false, "Only count the entries of the source")
+	migrateStateCmd.MarkFlagRequired("from")
+	migrateStateCmd.MarkFlagRequired("to")
+}
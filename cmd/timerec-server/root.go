@@ -27,7 +27,7 @@ var rootCmd = &cobra.Command{
 
 		server := server.NewServer()
 		go server.ReconcileForever(serverContext)
-		restapi.Run(&server)
+		restapi.Run(server)
 	},
 }
 
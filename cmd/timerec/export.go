@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var exportFormat string
+var exportOutput string
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports all Users, Jobs, Templates and Records",
+	Long:  `Writes the whole State as a versioned document. Use "timerec import" to restore it, also with a different State provider`,
+	Example: `
+# Backup the State
+./timerec export -o backup.yaml
+	`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		content := cli.ExportState(exportFormat)
+		if exportOutput == "" || exportOutput == "-" {
+			os.Stdout.Write(content)
+			return
+		}
+		if err := os.WriteFile(exportOutput, content, 0600); err != nil {
+			cli.Panic(1, "Unable to write export", err)
+		}
+		fmt.Fprintf(os.Stderr, "Exported State to %s\n", exportOutput)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVar(&exportFormat, "format", "yaml", "Format of the export: yaml or json")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "Write the export to a file instead of stdout")
+}
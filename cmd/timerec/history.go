@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thomasbuchinger/timerec/internal/server"
+)
+
+var historyLimit int
+var historyPatch bool
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Shows every change to the State",
+	Long:  `Lists the latest changes to the State, newest first. Only available with a State, that keeps a history (e.g. git)`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		embeddedServer := server.NewServer()
+		history, ok := server.UnwrapState(embeddedServer.StateProvider).(server.StateHistory)
+		if !ok {
+			fmt.Println("The configured State does not keep a history. Enable the git State to record every change")
+			return
+		}
+
+		changes, err := history.History(historyLimit, historyPatch)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, change := range changes {
+			fmt.Printf("%s %s %s\n", change.Commit[:8], change.Time.Local().Format("2006-01-02 15:04"), change.Author)
+			for _, line := range strings.Split(change.Message, "\n") {
+				fmt.Printf("    %s\n", line)
+			}
+			if change.Diff != "" {
+				fmt.Println(change.Diff)
+			}
+			fmt.Println()
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(historyCmd)
+	historyCmd.Flags().IntVarP(&historyLimit, "limit", "n", 20, "Number of changes to show")
+	historyCmd.Flags().BoolVarP(&historyPatch, "patch", "p", false, "Show the diff of every change")
+}
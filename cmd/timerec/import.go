@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/thomasbuchinger/timerec/internal/server"
+)
+
+var importMode string
+var importDryRun bool
+
+var importCmd = &cobra.Command{
+	Use:   "import FILE",
+	Short: "Imports a file created by export",
+	Long: `Imports Users, Jobs, Templates and Records. "merge" adds missing entries and reports entries, that differ from existing ones, as conflicts.
+"replace" removes everything, that is not part of the export. Use - to read from stdin`,
+	Example: `
+# Check what would change, before restoring a backup
+./timerec import backup.yaml --mode replace --dry-run
+	`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var content []byte
+		var err error
+		if args[0] == "-" {
+			content, err = io.ReadAll(os.Stdin)
+		} else {
+			content, err = os.ReadFile(args[0])
+		}
+		if err != nil {
+			cli.Panic(1, "Unable to read export", err)
+		}
+
+		resp := cli.ImportState(content, importMode, importDryRun)
+		for _, conflict := range resp.Conflicts {
+			owner := ""
+			if conflict.Owner != "" {
+				owner = fmt.Sprintf(" of user %s", conflict.Owner)
+			}
+			fmt.Printf("%s: %s %s%s already exists with different content\n", conflict.Reason, conflict.Kind, conflict.Name, owner)
+		}
+
+		action := "Imported"
+		if importDryRun {
+			action = "Would import"
+		}
+		fmt.Printf("%s %d entries, %d unchanged, %d conflicts\n", action, resp.Imported, resp.Unchanged, len(resp.Conflicts))
+		if !resp.Success {
+			os.Exit(2)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.Flags().StringVar(&importMode, "mode", server.ImportModeMerge, "merge or replace")
+	importCmd.Flags().BoolVar(&importDryRun, "dry-run", false, "Only report what would be imported")
+}
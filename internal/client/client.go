@@ -13,7 +13,7 @@ import (
 type ClientObject struct {
 	logger *log.Logger
 	// restclient     RestClient
-	embeddedServer server.TimerecServer
+	embeddedServer *server.TimerecServer
 }
 
 func NewClient() ClientObject {
@@ -163,6 +163,9 @@ func (c *ClientObject) CompleteJob(name string) {
 		},
 	)
 	c.exitIfError(err, resp.Success, "Unable to CompleteJob")
+	if resp.Pending > 0 {
+		c.logger.Printf("%d Records of Job '%s' could not be saved yet. Delivery is retried in the background\n", resp.Pending, name)
+	}
 }
 
 func (c *ClientObject) Wait() {
@@ -188,3 +191,26 @@ func (c *ClientObject) ReconcileServer() {
 		})
 	}
 }
+
+func (c *ClientObject) ExportState(format string) []byte {
+	export, err := c.embeddedServer.ExportState(context.TODO())
+	c.exitIfError(err, true, "Unable to ExportState")
+	content, err := server.EncodeExport(export, format)
+	c.exitIfError(err, true, "Unable to encode export")
+	return content
+}
+
+func (c *ClientObject) ImportState(content []byte, mode string, dryRun bool) server.ImportResponse {
+	data, err := server.DecodeExport(content)
+	c.exitIfError(err, true, "Unable to read export")
+	resp, err := c.embeddedServer.ImportState(
+		context.TODO(),
+		server.ImportParams{
+			Mode:   mode,
+			DryRun: dryRun,
+			Data:   data,
+		},
+	)
+	c.exitIfError(err, true, "Unable to ImportState")
+	return resp
+}
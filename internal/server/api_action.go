@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// Actions on the active Activity, that are offered as links or buttons in notifications
+const (
+	ActionExtend string = "extend"
+	ActionFinish string = "finish"
+)
+
+type ActivityActionParams struct {
+	UserName       string `path:"user"`
+	Action         string `path:"action"`
+	EstimateString string `json:"estimate,omitempty"`
+	Expires        string `json:"expires,omitempty"`
+	Signature      string `json:"sig,omitempty"`
+}
+
+// VerifyActivityAction checks, that the params come from a link in a notification of the User and the link is not expired
+func (mgr *TimerecServer) VerifyActivityAction(params ActivityActionParams) error {
+	err := mgr.ActionLinks.Verify(params.UserName, params.Action, params.EstimateString, params.Expires, params.Signature, time.Now())
+	if err != nil {
+		return mgr.MakeNewResponseError(Forbidden, err, "This link is invalid or expired")
+	}
+	return nil
+}
+
+// RunActivityAction extends or finishes the active Activity of a User. Unlike the Activity API, it needs no request body, so
+// chat messages can link to it. Only signed links are accepted (see VerifyActivityAction).
+// Finishing records the Activity on a Job with the same name and completes the Job, like the CLI does. Jobs, that are
+// not valid yet (e.g. without a Title), are kept with the Activity
+func (mgr *TimerecServer) RunActivityAction(ctx context.Context, params ActivityActionParams) (ActivityResponse, error) {
+	if err := mgr.VerifyActivityAction(params); err != nil {
+		return ActivityResponse{}, err
+	}
+	switch params.Action {
+	case ActionExtend:
+		return mgr.ExtendActivity(ctx, ExtendActivityParams{UserName: params.UserName, EstimateString: params.EstimateString})
+	case ActionFinish:
+		resp, err := mgr.GetActivity(ctx, GetUserParams{UserName: params.UserName})
+		if err != nil || resp.Activity.ActivityName == "" {
+			return resp, err
+		}
+		name := resp.Activity.ActivityName
+		_, err = mgr.CreateJobIfMissing(ctx, SearchJobParams{Name: name, Owner: params.UserName, StartedAfter: -24 * time.Hour})
+		if err != nil {
+			return ActivityResponse{}, err
+		}
+		_, err = mgr.FinishActivity(ctx, FinishActivityParams{UserName: params.UserName, JobName: name, ActivityName: name})
+		if err != nil {
+			return ActivityResponse{}, err
+		}
+		_, err = mgr.CompleteJob(ctx, CompleteJobParams{Status: JobStatusFinish, SearchJobParams: SearchJobParams{Name: name, Owner: params.UserName, StartedAfter: -24 * time.Hour}})
+		var respErr ResponseError
+		if errors.As(err, &respErr) && respErr.Type == ValidationError {
+			// The Activity stays on the Job, until the User fills in the Job and completes it
+			mgr.Logger.Warnf("Unable to complete Job '%s' of User '%s': %v", name, params.UserName, err)
+		} else if err != nil {
+			return ActivityResponse{}, err
+		}
+		return resp, nil
+	}
+	return ActivityResponse{}, mgr.MakeNewResponseError(BadRequest, fmt.Errorf("unknown action '%s'", params.Action), "Unknown action '%s'", params.Action)
+}
+
+// UserSettings returns the Settings of a User. NotificationServices use it to find the channels of a User
+func (mgr *TimerecServer) UserSettings(name string) (api.Settings, error) {
+	state, err := mgr.StateProvider.Refresh(name)
+	if err != nil {
+		return api.Settings{}, err
+	}
+	user, proverr := providers.GetUser(&state, api.User{Name: name})
+	if proverr != providers.ProviderOk {
+		return api.Settings{}, proverr
+	}
+	return user.Settings, nil
+}
+
+// NotifiedRetention is how long api.User.Notified keeps an entry
+const NotifiedRetention time.Duration = 48 * time.Hour
+
+// LastNotified returns when a notification was last sent to a User. It implements providers.NotificationLog
+func (mgr *TimerecServer) LastNotified(name, key string) (time.Time, error) {
+	state, err := mgr.StateProvider.Refresh(name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	user, proverr := providers.GetUser(&state, api.User{Name: name})
+	if proverr != providers.ProviderOk {
+		return time.Time{}, proverr
+	}
+	return user.Notified[key], nil
+}
+
+// SetNotified remembers when a notification was sent to a User. Entries older than NotifiedRetention are removed
+func (mgr *TimerecServer) SetNotified(name, key string, at time.Time) error {
+	return mgr.retryOnConflict(func() error {
+		state, err := mgr.StateProvider.Refresh(name)
+		if err != nil {
+			return err
+		}
+		user, proverr := providers.GetUser(&state, api.User{Name: name})
+		if proverr != providers.ProviderOk {
+			return proverr
+		}
+		notified := map[string]time.Time{key: at}
+		for k, t := range user.Notified {
+			if k != key && at.Sub(t) < NotifiedRetention {
+				notified[k] = t
+			}
+		}
+		user.Notified = notified
+		if proverr := providers.UpdateUser(&state, user); proverr != providers.ProviderOk {
+			return proverr
+		}
+		return mgr.StateProvider.Save(state.Partition, state)
+	})
+}
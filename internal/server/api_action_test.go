@@ -0,0 +1,107 @@
+package server_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// signedAction returns the params of an action link in a notification
+func signedAction(links *providers.ActionLinks, user, action, estimate string) server.ActivityActionParams {
+	link, _ := url.Parse(links.Url(user, action, estimate, time.Now().Add(time.Hour)))
+	return server.ActivityActionParams{
+		UserName:       user,
+		Action:         action,
+		EstimateString: link.Query().Get("estimate"),
+		Expires:        link.Query().Get("expires"),
+		Signature:      link.Query().Get("sig"),
+	}
+}
+
+func TestActivityActions(t *testing.T) {
+	mem := providers.NewMemoryProvider()
+	user := api.NewDefaultUser("me")
+	user.SetActivity("work", "", time.Now().Add(-time.Hour), time.Now())
+	providers.CreateUser(&mem.Data, user)
+	mgr := NewTestServer(mem)
+	mgr.ActionLinks, _ = providers.NewActionLinks("https://timerec.example.com", "secret")
+	template := api.RecordTemplate{Title: "work", Description: "desc", Project: "test", Task: "test"}
+	providers.CreateJob(&mem.Data, api.Job{Name: "work", Owner: "me", RecordTemplate: template})
+
+	resp, err := mgr.RunActivityAction(context.TODO(), signedAction(mgr.ActionLinks, "me", server.ActionExtend, "2h"))
+	if err != nil || resp.Activity.ActivityTimer.Before(time.Now().Add(time.Hour)) {
+		t.Fatalf("incorrect extended activity: got %v, %v", resp.Activity, err)
+	}
+
+	resp, err = mgr.RunActivityAction(context.TODO(), signedAction(mgr.ActionLinks, "me", server.ActionFinish, ""))
+	if err != nil || resp.Activity.ActivityName != "work" {
+		t.Fatalf("incorrect finished activity: got %v, %v", resp.Activity, err)
+	}
+	// The Job is completed like the CLI does, so its Record is delivered and the Job is removed
+	if len(mem.Data.Records) != 1 || len(mem.Data.Jobs) != 0 || mem.Data.Users[0].Activity.ActivityName != "" {
+		t.Fatalf("activity was not recorded: got %v, %v and %v", mem.Data.Records, mem.Data.Jobs, mem.Data.Users[0].Activity)
+	}
+
+	// A Job kept with delivered Records only submits the new Activity
+	providers.CreateJob(&mem.Data, api.Job{
+		Name: "work", Owner: "me", RecordTemplate: template,
+		Activities: []api.TimeEntry{{Start: mem.Data.Records[0].Start, End: mem.Data.Records[0].End}},
+	})
+	mem.Data.Users[0].SetActivity("work", "", time.Now().Add(-time.Hour), time.Now())
+	if _, err := mgr.RunActivityAction(context.TODO(), signedAction(mgr.ActionLinks, "me", server.ActionFinish, "")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(mem.Data.Records) != 2 || len(mem.Data.Jobs) != 0 {
+		t.Fatalf("incorrect records: got %v and %v expected 2 records and no jobs", mem.Data.Records, mem.Data.Jobs)
+	}
+
+	// A new Job has no Title and Description yet, so it is kept with the Activity
+	mem.Data.Users[0].SetActivity("work", "", time.Now().Add(-time.Hour), time.Now())
+	if _, err := mgr.RunActivityAction(context.TODO(), signedAction(mgr.ActionLinks, "me", server.ActionFinish, "")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(mem.Data.Records) != 2 || len(mem.Data.Jobs) != 1 || len(mem.Data.Jobs[0].Activities) != 1 {
+		t.Fatalf("incorrect jobs: got %v expected the job with 1 activity", mem.Data.Jobs)
+	}
+
+	if _, err := mgr.RunActivityAction(context.TODO(), signedAction(mgr.ActionLinks, "me", "delete", "")); err == nil {
+		t.Fatal("expected an error for an unknown action")
+	}
+
+	// Links are only valid for the User and action they were signed for
+	params := signedAction(mgr.ActionLinks, "me", server.ActionFinish, "")
+	params.UserName = "other"
+	if _, err := mgr.RunActivityAction(context.TODO(), params); err == nil {
+		t.Fatal("expected an error for a link of another User")
+	}
+	if _, err := mgr.RunActivityAction(context.TODO(), server.ActivityActionParams{UserName: "me", Action: server.ActionExtend, EstimateString: "2h"}); err == nil {
+		t.Fatal("expected an error for an unsigned link")
+	}
+}
+
+func TestNotificationLogIsKeptInState(t *testing.T) {
+	mem := providers.NewMemoryProvider()
+	providers.CreateUser(&mem.Data, api.NewDefaultUser("me"))
+	mgr := NewTestServer(mem)
+
+	now := time.Now()
+	if err := mgr.SetNotified("me", "old", now.Add(-72*time.Hour)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := mgr.SetNotified("me", "email/digest", now); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	last, err := mgr.LastNotified("me", "email/digest")
+	if err != nil || !last.Equal(now) {
+		t.Fatalf("incorrect notification time: got %v, %v expected %v", last, err, now)
+	}
+	user, _ := providers.GetUser(&mem.Data, api.User{Name: "me"})
+	if _, ok := user.Notified["old"]; ok || len(user.Notified) != 1 {
+		t.Fatalf("old entries are not removed: %v", user.Notified)
+	}
+}
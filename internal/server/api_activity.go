@@ -104,7 +104,15 @@ func (mgr *TimerecServer) GetActivity(ctx context.Context, params GetUserParams)
 	return ActivityResponse{}, mgr.MakeNewResponseError(BadRequest, err, "Unexpected Error: %s", params.UserName)
 }
 
-func (mgr *TimerecServer) StartActivity(ctx context.Context, params StartActivityParams) (ActivityResponse, error) {
+func (mgr *TimerecServer) StartActivity(ctx context.Context, params StartActivityParams) (resp ActivityResponse, err error) {
+	err = mgr.retryOnConflict(func() error {
+		resp, err = mgr.startActivity(ctx, params)
+		return err
+	})
+	return resp, err
+}
+
+func (mgr *TimerecServer) startActivity(ctx context.Context, params StartActivityParams) (ActivityResponse, error) {
 	err := params.MakeValid()
 	if err != nil {
 		return ActivityResponse{}, mgr.MakeNewResponseError(ValidationError, err, err.Error())
@@ -144,7 +152,15 @@ func (mgr *TimerecServer) StartActivity(ctx context.Context, params StartActivit
 	return ActivityResponse{Success: true, Activity: user.Activity}, nil
 }
 
-func (mgr *TimerecServer) ExtendActivity(ctx context.Context, params ExtendActivityParams) (ActivityResponse, error) {
+func (mgr *TimerecServer) ExtendActivity(ctx context.Context, params ExtendActivityParams) (resp ActivityResponse, err error) {
+	err = mgr.retryOnConflict(func() error {
+		resp, err = mgr.extendActivity(ctx, params)
+		return err
+	})
+	return resp, err
+}
+
+func (mgr *TimerecServer) extendActivity(ctx context.Context, params ExtendActivityParams) (ActivityResponse, error) {
 	err := params.MakeValid()
 	if err != nil {
 		return ActivityResponse{}, mgr.MakeNewResponseError(ValidationError, err, "Invalid Request: %s", err.Error())
@@ -191,7 +207,15 @@ func (mgr *TimerecServer) ExtendActivity(ctx context.Context, params ExtendActiv
 	return ActivityResponse{Success: true, Activity: user.Activity}, nil
 }
 
-func (mgr *TimerecServer) FinishActivity(ctx context.Context, params FinishActivityParams) (JobResponse, error) {
+func (mgr *TimerecServer) FinishActivity(ctx context.Context, params FinishActivityParams) (resp JobResponse, err error) {
+	err = mgr.retryOnConflict(func() error {
+		resp, err = mgr.finishActivity(ctx, params)
+		return err
+	})
+	return resp, err
+}
+
+func (mgr *TimerecServer) finishActivity(ctx context.Context, params FinishActivityParams) (JobResponse, error) {
 	err := params.MakeValid()
 	if err != nil {
 		return JobResponse{}, mgr.MakeNewResponseError(ValidationError, err, err.Error())
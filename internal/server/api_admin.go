@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+	"gopkg.in/yaml.v2"
+)
+
+// ExportFormatVersion is the version of StateExport. Increment it, if an export can no longer be read by older versions of timerec
+const ExportFormatVersion int = 1
+
+const (
+	ExportFormatJson string = "json"
+	ExportFormatYaml string = "yaml"
+
+	ImportModeMerge   string = "merge"
+	ImportModeReplace string = "replace"
+)
+
+// StateExport contains all data of the State, independent of the State's provider
+type StateExport struct {
+	Version    int                  `json:"version" yaml:"version"`
+	Schema     int                  `json:"schema" yaml:"schema"`
+	ExportedAt time.Time            `json:"exported_at" yaml:"exported_at"`
+	Users      []api.User           `json:"users" yaml:"users"`
+	Jobs       []api.Job            `json:"jobs" yaml:"jobs"`
+	Templates  []api.RecordTemplate `json:"templates" yaml:"templates"`
+	Records    []api.Record         `json:"records" yaml:"records"`
+	// Outbox holds the Records of completed Jobs, that are not delivered yet. They are the only copy of that time
+	Outbox []providers.PendingRecord `json:"outbox,omitempty" yaml:"outbox,omitempty"`
+}
+
+type ImportParams struct {
+	Mode   string
+	DryRun bool
+	Data   StateExport
+}
+
+// ImportConflict is an entry of the import, that differs from an existing entry with the same name. The existing entry is kept
+type ImportConflict struct {
+	Kind   string                       `json:"kind"`
+	Name   string                       `json:"name"`
+	Owner  string                       `json:"owner,omitempty"`
+	Reason providers.ProviderReturnType `json:"reason"`
+}
+
+type ImportResponse struct {
+	Success   bool             `json:"success"`
+	Imported  int              `json:"imported"`
+	Unchanged int              `json:"unchanged"`
+	Conflicts []ImportConflict `json:"conflicts"`
+}
+
+// ExportState returns all Users, Jobs, Templates, Records and pending Records
+func (mgr *TimerecServer) ExportState(ctx context.Context) (StateExport, error) {
+	state, err := refreshAll(mgr.StateProvider)
+	if err != nil {
+		return StateExport{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to query Provider: %s", err.Error())
+	}
+	return StateExport{
+		Version:    ExportFormatVersion,
+		Schema:     providers.StateSchemaVersion,
+		ExportedAt: time.Now().UTC(),
+		Users:      state.Users,
+		Jobs:       state.Jobs,
+		Templates:  state.Templates,
+		Records:    state.Records,
+		Outbox:     state.Outbox,
+	}, nil
+}
+
+// ImportState restores an export. Merge adds missing entries and reports entries, that differ from the existing ones.
+// Replace removes everything, that is not part of the export, including pending Records
+func (mgr *TimerecServer) ImportState(ctx context.Context, params ImportParams) (resp ImportResponse, err error) {
+	err = mgr.retryOnConflict(func() error {
+		resp, err = mgr.importState(ctx, params)
+		return err
+	})
+	return resp, err
+}
+
+func (mgr *TimerecServer) importState(ctx context.Context, params ImportParams) (ImportResponse, error) {
+	data, err := params.Data.migrate()
+	if err != nil {
+		return ImportResponse{}, mgr.MakeNewResponseError(ValidationError, err, "Invalid export: %s", err.Error())
+	}
+	state, err := refreshAll(mgr.StateProvider)
+	if err != nil {
+		return ImportResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to query Provider: %s", err.Error())
+	}
+
+	var resp ImportResponse
+	switch params.Mode {
+	case ImportModeReplace:
+		state.Users, state.Jobs, state.Templates, state.Records, state.Outbox = data.Users, data.Jobs, data.Templates, data.Records, data.Outbox
+		resp = ImportResponse{Imported: len(data.Users) + len(data.Jobs) + len(data.Templates) + len(data.Records) + len(data.Outbox), Conflicts: []ImportConflict{}}
+	case ImportModeMerge, "":
+		resp = mergeExport(&state, data)
+	default:
+		return ImportResponse{}, mgr.MakeNewResponseError(ValidationError, nil, "Invalid import mode '%s'", params.Mode)
+	}
+
+	resp.Success = len(resp.Conflicts) == 0
+	if params.DryRun {
+		return resp, nil
+	}
+	err = mgr.StateProvider.Save(state.Partition, state)
+	if err != nil {
+		return ImportResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to save imported State: %s", err.Error())
+	}
+	return resp, nil
+}
+
+// mergeExport adds all entries of the export to the State. Entries, that already exist with the same content, are unchanged
+func mergeExport(state *providers.StateV2, data StateExport) ImportResponse {
+	resp := ImportResponse{Conflicts: []ImportConflict{}}
+	merge := func(kind, name, owner string, existing interface{}, found bool, imported interface{}, create func() providers.ProviderReturnType) {
+		if found && sameJson(existing, imported) {
+			resp.Unchanged++
+			return
+		}
+		if proverr := create(); proverr != providers.ProviderOk {
+			resp.Conflicts = append(resp.Conflicts, ImportConflict{Kind: kind, Name: name, Owner: owner, Reason: proverr})
+			return
+		}
+		resp.Imported++
+	}
+
+	for _, user := range data.Users {
+		existing, proverr := providers.GetUser(state, user)
+		merge("user", user.Name, "", existing, proverr == providers.ProviderOk, user, func() providers.ProviderReturnType {
+			return providers.CreateUser(state, user)
+		})
+	}
+	for _, template := range data.Templates {
+		existing, proverr := providers.GetTemplate(state, template.TemplateName)
+		merge("template", template.TemplateName, "", existing, proverr == providers.ProviderOk, template, func() providers.ProviderReturnType {
+			if proverr == providers.ProviderOk {
+				return providers.ProviderConflict
+			}
+			state.Templates = append(state.Templates, template)
+			return providers.ProviderOk
+		})
+	}
+	for _, job := range data.Jobs {
+		existing, proverr := providers.GetJob(state, job)
+		merge("job", job.Name, job.Owner, existing, proverr == providers.ProviderOk, job, func() providers.ProviderReturnType {
+			return providers.CreateJob(state, job)
+		})
+	}
+	for _, rec := range data.Records {
+		existing, proverr := providers.GetRecord(state, rec.Id)
+		merge("record", rec.Id, rec.UserName, existing, proverr == providers.ProviderOk, rec, func() providers.ProviderReturnType {
+			return providers.SaveRecord(state, rec)
+		})
+	}
+	for _, p := range data.Outbox {
+		existing, found := providers.PendingRecord{}, false
+		for _, pending := range state.Outbox {
+			if pending.Record.Id == p.Record.Id {
+				existing, found = pending, true
+			}
+		}
+		merge("pending", p.Record.Id, p.Record.UserName, existing, found, p, func() providers.ProviderReturnType {
+			return providers.EnqueueRecord(state, p)
+		})
+	}
+	return resp
+}
+
+// sameJson compares the encoded entries, because decoded timestamps differ in their location
+func sameJson(a, b interface{}) bool {
+	left, _ := json.Marshal(a)
+	right, _ := json.Marshal(b)
+	return bytes.Equal(left, right)
+}
+
+// migrate applies the State's migrations to an export of an older timerec version
+func (export StateExport) migrate() (StateExport, error) {
+	if export.Version > ExportFormatVersion {
+		return export, fmt.Errorf("export version %d was written by a newer version of timerec (supported: %d)", export.Version, ExportFormatVersion)
+	}
+	if export.Schema == 0 {
+		export.Schema = 1
+	}
+	state := providers.StateV2{Users: export.Users, Jobs: export.Jobs, Templates: export.Templates, Records: export.Records, Outbox: export.Outbox}
+	state, err := providers.MigrateState(state, export.Schema)
+	if err != nil {
+		return export, err
+	}
+	export.Users, export.Jobs, export.Templates, export.Records, export.Outbox = state.Users, state.Jobs, state.Templates, state.Records, state.Outbox
+	export.Schema = providers.StateSchemaVersion
+	return export, nil
+}
+
+// EncodeExport encodes an export as JSON or YAML
+func EncodeExport(export StateExport, format string) ([]byte, error) {
+	switch format {
+	case ExportFormatJson:
+		return json.MarshalIndent(export, "", "  ")
+	case ExportFormatYaml, "":
+		return yaml.Marshal(export)
+	}
+	return nil, fmt.Errorf("unsupported export format '%s'", format)
+}
+
+// DecodeExport reads an export in JSON or YAML
+func DecodeExport(content []byte) (StateExport, error) {
+	var export StateExport
+	var err error
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '{' {
+		err = json.Unmarshal(content, &export)
+	} else {
+		err = yaml.Unmarshal(content, &export)
+	}
+	if err == nil && export.Version == 0 {
+		err = fmt.Errorf("not a timerec export: missing version")
+	}
+	return export, err
+}
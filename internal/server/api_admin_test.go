@@ -0,0 +1,156 @@
+package server_test
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// NewTestStates returns an empty State of every provider
+func NewTestStates(t *testing.T) map[string]server.State {
+	logger, _ := zap.NewDevelopment()
+	dir := t.TempDir()
+	states := map[string]server.State{
+		"file":           providers.NewFileProvider(filepath.Join(dir, "db.yaml")),
+		"kubernetes":     providers.NewKubernetesProviderForClient(*logger.Sugar(), fake.NewSimpleClientset(), "timerec"),
+		"kubernetes-crd": providers.NewKubernetesCrdProviderForClient(*logger.Sugar(), dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), providers.KubernetesCrdListKinds), "timerec"),
+	}
+	specs := map[string]string{
+		"bolt": "bolt:" + filepath.Join(dir, "timerec.bolt"),
+		"sql":  "sql:" + providers.SqlDriverSqlite + ":" + filepath.Join(dir, "timerec.db"),
+	}
+	if _, err := exec.LookPath("git"); err == nil {
+		specs["git"] = "git:" + filepath.Join(dir, "git")
+	}
+	for name, spec := range specs {
+		state, err := server.OpenState(*logger.Sugar(), spec)
+		if err != nil {
+			t.Fatalf("unable to open %s: %v", spec, err)
+		}
+		t.Cleanup(func() { server.CloseState(state) })
+		states[name] = state
+	}
+	return states
+}
+
+// createTestUsers saves a default User for every name
+func createTestUsers(t *testing.T, state server.State, names ...string) {
+	for _, name := range names {
+		data, _ := state.Refresh(name)
+		if _, proverr := providers.GetUser(&data, api.User{Name: name}); proverr != providers.ProviderOk {
+			providers.CreateUser(&data, api.NewDefaultUser(name))
+		}
+		if err := state.Save(name, data); err != nil {
+			t.Fatalf("unable to create user %s: %v", name, err)
+		}
+	}
+}
+
+func TestExportAndImportState(t *testing.T) {
+	source := providers.NewMemoryProvider()
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	providers.CreateUser(&source.Data, api.NewDefaultUser("me"))
+	providers.CreateJob(&source.Data, api.Job{Name: "work", Owner: "me", CreatedAt: start})
+	source.SaveRecord(api.Record{UserName: "me", Title: "done", Start: start, End: start.Add(time.Hour)})
+
+	exporter := NewTestServer(source)
+	export, err := exporter.ExportState(context.TODO())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	content, _ := server.EncodeExport(export, server.ExportFormatYaml)
+	data, err := server.DecodeExport(content)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	target := providers.NewMemoryProvider()
+	providers.CreateUser(&target.Data, api.NewDefaultUser("other"))
+	mgr := NewTestServer(target)
+	resp, err := mgr.ImportState(context.TODO(), server.ImportParams{Mode: server.ImportModeMerge, Data: data})
+	if err != nil || !resp.Success || resp.Imported != 3 {
+		t.Fatalf("incorrect import: got %v, %v", resp, err)
+	}
+	resp, _ = mgr.ImportState(context.TODO(), server.ImportParams{Mode: server.ImportModeMerge, Data: data})
+	if resp.Imported != 0 || resp.Unchanged != 3 {
+		t.Fatalf("incorrect repeated import: %v", resp)
+	}
+
+	data.Jobs[0].Title = "changed"
+	resp, _ = mgr.ImportState(context.TODO(), server.ImportParams{Mode: server.ImportModeMerge, Data: data})
+	if len(resp.Conflicts) != 1 || resp.Conflicts[0].Reason != providers.ProviderConflict || resp.Conflicts[0].Name != "work" {
+		t.Fatalf("incorrect conflicts: got %v expected %v", resp.Conflicts, providers.ProviderConflict)
+	}
+
+	resp, _ = mgr.ImportState(context.TODO(), server.ImportParams{Mode: server.ImportModeReplace, Data: data})
+	if !resp.Success || len(target.Data.Users) != 1 || target.Data.Jobs[0].Title != "changed" {
+		t.Fatalf("incorrect state after replace: %v", target.Data)
+	}
+}
+
+func TestImportReplaceDropsUsers(t *testing.T) {
+	for name, state := range NewTestStates(t) {
+		createTestUsers(t, state, "me", "old")
+
+		mgr := NewTestServer(providers.NewMemoryProvider())
+		mgr.StateProvider = state
+		data := server.StateExport{Version: server.ExportFormatVersion, Schema: providers.StateSchemaVersion, Users: []api.User{api.NewDefaultUser("me")}}
+		resp, err := mgr.ImportState(context.TODO(), server.ImportParams{Mode: server.ImportModeReplace, Data: data})
+		if err != nil || !resp.Success {
+			t.Fatalf("%s: incorrect import: got %v, %v", name, resp, err)
+		}
+		global, _ := state.Refresh(providers.ScopeGlobal)
+		if len(global.Users) != 1 || global.Users[0].Name != "me" {
+			t.Fatalf("%s: expected only user me after replace, got %v", name, global.Users)
+		}
+	}
+}
+
+func TestExportKeepsPendingRecords(t *testing.T) {
+	source := providers.NewMemoryProvider()
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	job := api.Job{Name: "work", Owner: "me", Activities: []api.TimeEntry{{Start: start, End: start.Add(time.Hour)}}}
+	providers.CreateJob(&source.Data, job)
+	for _, rec := range job.ConvertToRecords() {
+		providers.EnqueueRecord(&source.Data, providers.PendingRecord{Record: rec, Confirmed: []string{"clockodo"}, Attempts: 2, NextAttempt: start})
+	}
+
+	exporter := NewTestServer(source)
+	export, _ := exporter.ExportState(context.TODO())
+	content, _ := server.EncodeExport(export, server.ExportFormatJson)
+	data, err := server.DecodeExport(content)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, mode := range []string{server.ImportModeMerge, server.ImportModeReplace} {
+		target := providers.NewMemoryProvider()
+		mgr := NewTestServer(target)
+		resp, err := mgr.ImportState(context.TODO(), server.ImportParams{Mode: mode, Data: data})
+		if err != nil || !resp.Success || resp.Imported != 2 {
+			t.Fatalf("incorrect %s import: got %v, %v", mode, resp, err)
+		}
+		if len(target.Data.Outbox) != 1 || target.Data.Outbox[0].Attempts != 2 || target.Data.Outbox[0].Confirmed[0] != "clockodo" {
+			t.Fatalf("incorrect outbox after %s import: %v", mode, target.Data.Outbox)
+		}
+	}
+}
+
+func TestImportRejectsNewerExports(t *testing.T) {
+	mgr := NewTestServer(providers.NewMemoryProvider())
+	_, err := mgr.ImportState(context.TODO(), server.ImportParams{Data: server.StateExport{Version: server.ExportFormatVersion + 1}})
+	if err == nil {
+		t.Fatal("expected an error for an export of a newer version")
+	}
+}
@@ -38,9 +38,11 @@ const (
 )
 
 type JobResponse struct {
-	Success bool    `json:"success"`
-	Created bool    `json:"created"`
-	Job     api.Job `json:"job,omitempty"`
+	Success bool           `json:"success"`
+	Created bool           `json:"created"`
+	Job     api.Job        `json:"job,omitempty"`
+	Records []RecordResult `json:"records,omitempty"`
+	Pending int            `json:"pending,omitempty"`
 }
 
 func (mgr *TimerecServer) GetJob(ctx context.Context, params SearchJobParams) (JobResponse, error) {
@@ -63,23 +65,30 @@ func (mgr *TimerecServer) GetJob(ctx context.Context, params SearchJobParams) (J
 	return JobResponse{}, mgr.MakeNewResponseError(BadRequest, proverr, "Error querying Job '%s'", item.Name)
 }
 
-func (mgr *TimerecServer) CreateJobIfMissing(ctx context.Context, params SearchJobParams) (JobResponse, error) {
+func (mgr *TimerecServer) CreateJobIfMissing(ctx context.Context, params SearchJobParams) (resp JobResponse, err error) {
+	err = mgr.retryOnConflict(func() error {
+		resp, err = mgr.createJobIfMissing(ctx, params)
+		return err
+	})
+	return resp, err
+}
+
+func (mgr *TimerecServer) createJobIfMissing(ctx context.Context, params SearchJobParams) (JobResponse, error) {
 	state, err := mgr.StateProvider.Refresh(params.Owner)
 	if err != nil {
 		return JobResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to query Provider: %s", err.Error())
 	}
 
-	response, err := mgr.GetJob(ctx, params)
-	if err != nil {
-		mgr.Logger.Error(err)
-		return JobResponse{}, err
+	existing, proverr := providers.GetJob(&state, api.Job{Name: params.Name, Owner: params.Owner})
+	if proverr == providers.ProviderOk {
+		return JobResponse{Success: true, Created: false, Job: existing}, nil
 	}
-	if response.Success {
-		return response, nil
+	if proverr != providers.ProviderNotFound {
+		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, proverr, "Error querying Job '%s'", params.Name)
 	}
 
 	new := api.NewJob(params.Name, params.Owner)
-	proverr := providers.CreateJob(&state, new)
+	proverr = providers.CreateJob(&state, new)
 	if proverr != providers.ProviderOk {
 		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, proverr, "Unable to create Job '%s'", params.Name)
 	}
@@ -92,27 +101,31 @@ func (mgr *TimerecServer) CreateJobIfMissing(ctx context.Context, params SearchJ
 	return JobResponse{Success: true, Created: true, Job: new}, nil
 }
 
-func (mgr *TimerecServer) UpdateJob(ctx context.Context, params UpdateJobParams) (JobResponse, error) {
+func (mgr *TimerecServer) UpdateJob(ctx context.Context, params UpdateJobParams) (resp JobResponse, err error) {
+	err = mgr.retryOnConflict(func() error {
+		resp, err = mgr.updateJob(ctx, params)
+		return err
+	})
+	return resp, err
+}
+
+func (mgr *TimerecServer) updateJob(ctx context.Context, params UpdateJobParams) (JobResponse, error) {
 	state, err := mgr.StateProvider.Refresh(params.Owner)
 	if err != nil {
 		return JobResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to query Provider: %s", err.Error())
 	}
 
 	// Check if Job exists
-	response, err := mgr.GetJob(
-		ctx,
-		SearchJobParams{Name: params.Name, Owner: params.Owner, StartedAfter: -24 * time.Hour, StartedBefore: time.Duration(0)},
-	)
-	if err != nil {
-		return JobResponse{}, err
-	}
-	if !response.Success {
+	job, proverr := providers.GetJob(&state, api.Job{Name: params.Name, Owner: params.Owner})
+	if proverr == providers.ProviderNotFound {
 		mgr.Logger.Warnf("Job with name '%s' does not exist", params.Name)
-		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, err, "Job deos not exist")
+		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, proverr, "Job deos not exist")
+	}
+	if proverr != providers.ProviderOk {
+		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, proverr, "Error querying Job '%s'", params.Name)
 	}
 
 	// Update job according to Template
-	job := response.Job
 	if params.Template != "" {
 		templateExists, _ := providers.HasTemplate(&state, params.Template)
 		if templateExists {
@@ -135,7 +148,7 @@ func (mgr *TimerecServer) UpdateJob(ctx context.Context, params UpdateJobParams)
 		},
 	})
 
-	proverr := providers.UpdateJob(&state, job)
+	proverr = providers.UpdateJob(&state, job)
 	if proverr != providers.ProviderOk {
 		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, proverr, "Unable to update Job '%s'", job.Name)
 	}
@@ -148,45 +161,75 @@ func (mgr *TimerecServer) UpdateJob(ctx context.Context, params UpdateJobParams)
 	return JobResponse{Success: true, Created: false, Job: job}, nil
 }
 
-func (mgr *TimerecServer) CompleteJob(ctx context.Context, params CompleteJobParams) (JobResponse, error) {
+func (mgr *TimerecServer) CompleteJob(ctx context.Context, params CompleteJobParams) (resp JobResponse, err error) {
+	err = mgr.retryOnConflict(func() error {
+		resp, err = mgr.completeJob(ctx, params)
+		return err
+	})
+	return resp, err
+}
+
+func (mgr *TimerecServer) completeJob(ctx context.Context, params CompleteJobParams) (JobResponse, error) {
 	state, err := mgr.StateProvider.Refresh(params.Owner)
 	if err != nil {
 		return JobResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to query Provider: %s", err.Error())
 	}
-	response, err := mgr.GetJob(
-		ctx,
-		params.SearchJobParams,
-	)
-	if err != nil {
-		return JobResponse{}, err
+	Job, proverr := providers.GetJob(&state, api.Job{Name: params.Name, Owner: params.Owner})
+	if proverr == providers.ProviderNotFound {
+		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, proverr, "Job does not exist")
 	}
-	if !response.Success {
-		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, err, "Job does not exist")
+	if proverr != providers.ProviderOk {
+		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, proverr, "Error querying Job '%s'", params.Name)
 	}
-	Job := response.Job
 	err = Job.Validate()
 	if err != nil {
 		return JobResponse{}, mgr.MakeNewResponseError(ValidationError, err, "Job not valid: %s", err.Error())
 	}
 
+	// Store Records in the Outbox first. Every Record is enqueued once, Records already in the Outbox are only delivered again,
+	// once their backoff expired. Activities added after an earlier CompleteJob are enqueued as new Records
+	pending, _ := providers.ListPendingRecords(&state, Job)
+	records := []api.Record{}
+	submitted := []api.Record{}
 	for _, rec := range Job.ConvertToRecords() {
-		_, err = mgr.TimeProvider.SaveRecord(rec)
+		if isPending(&state, rec.Id) {
+			continue
+		}
+		if mgr.isSubmitted(&state, rec) {
+			submitted = append(submitted, rec) // Delivered after an earlier CompleteJob of this Job
+			continue
+		}
+		records = append(records, rec)
+	}
+	if len(submitted) > 0 && len(records) == 0 && len(pending) == 0 {
+		rec := submitted[0]
+		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, providers.ProviderConflict, "Record '%s' started at %s was already submitted", rec.Id, rec.Start.Format(time.RFC3339))
+	}
+	if len(records) > 0 {
+		proverr = enqueueRecords(&state, records)
+		if proverr != providers.ProviderOk {
+			return JobResponse{}, mgr.MakeNewResponseError(BadRequest, proverr, "Unable to enqueue Records for Job '%s'", Job.Name)
+		}
+		err = mgr.StateProvider.Save(state.Partition, state)
 		if err != nil {
-			mgr.Logger.Errorw("unable to save Record", "error", err, "record", rec, "title", rec.Title)
-			return JobResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to save Record '%s'", rec.Title)
+			return JobResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to save Records for Job '%s'", Job.Name)
 		}
+		mgr.Logger.Debugf("Enqueued %d Records for Job '%s'", len(records), Job.Name)
 	}
 
-	state, _ = mgr.StateProvider.Refresh(params.Owner) // Refresh State, because the time provider might have changed the state-file
-	deleted, proverr := providers.DeleteJob(&state, Job)
-	if proverr != providers.ProviderOk {
-		return JobResponse{}, mgr.MakeNewResponseError(BadRequest, proverr, "Unable to delete Job")
-	}
-	err = mgr.StateProvider.Save(state.Partition, state)
+	results, remaining, err := mgr.deliverOutbox(params.Owner, func(p providers.PendingRecord) bool {
+		return p.Record.JobName == Job.Name
+	})
 	if err != nil {
-		return JobResponse{}, mgr.MakeNewResponseError(ServerError, err, "Unable to save state")
+		return JobResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to deliver Records for Job '%s'", Job.Name)
 	}
-
-	mgr.Logger.Infof("Completed Job: %s", Job.Name)
-	return JobResponse{Success: true, Created: false, Job: deleted}, nil
+	for _, res := range results {
+		if !res.Success {
+			mgr.Logger.Warnf("Unable to save Record '%s' started at %s to %s: %s", res.Record.Title, res.Record.Start.Format(time.RFC3339), res.Backend, res.Error)
+		}
+	}
+	if remaining > 0 {
+		mgr.Logger.Infof("Job '%s' has %d pending Records, retrying later", Job.Name, remaining)
+	}
+	return JobResponse{Success: true, Created: false, Job: Job, Records: results, Pending: remaining}, nil
 }
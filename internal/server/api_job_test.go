@@ -61,3 +61,64 @@ func TestCreateJobIfMissingIsIdempotent(t *testing.T) {
 		t.Fatalf("incorrect number of Jobs: got %d expected %d", len(mem.Data.Jobs), 1)
 	}
 }
+
+func TestJobApiReadsTheStateOnce(t *testing.T) {
+	state := &countingState{FileOrMemoryProvider: providers.NewMemoryProvider()}
+	mgr := NewTestServer(state.FileOrMemoryProvider)
+	mgr.StateProvider = state
+
+	params := server.SearchJobParams{Name: "testwork", Owner: "me"}
+	for _, call := range []func() error{
+		func() error { _, err := mgr.CreateJobIfMissing(context.TODO(), params); return err },
+		func() error { _, err := mgr.CreateJobIfMissing(context.TODO(), params); return err },
+		func() error {
+			_, err := mgr.UpdateJob(context.TODO(), server.UpdateJobParams{Name: "testwork", Owner: "me", Title: "test"})
+			return err
+		},
+	} {
+		state.refreshes = 0
+		if err := call(); err != nil || state.refreshes != 1 {
+			t.Fatalf("incorrect number of refreshes: got %d expected %d (%v)", state.refreshes, 1, err)
+		}
+	}
+
+	// An invalid Job is rejected before the Outbox is read
+	state.refreshes = 0
+	_, err := mgr.CompleteJob(context.TODO(), server.CompleteJobParams{SearchJobParams: params})
+	if err == nil || state.refreshes != 1 {
+		t.Fatalf("incorrect number of refreshes: got %d expected %d (%v)", state.refreshes, 1, err)
+	}
+}
+
+// racingState changes the State between Refresh and the first Save, like a concurrent request would
+type racingState struct {
+	*providers.FileOrMemoryProvider
+	races int
+}
+
+func (r *racingState) Save(partition string, state providers.StateV2) error {
+	if r.races > 0 {
+		r.races--
+		concurrent, _ := r.FileOrMemoryProvider.Refresh(partition)
+		r.FileOrMemoryProvider.Save(partition, concurrent)
+	}
+	return r.FileOrMemoryProvider.Save(partition, state)
+}
+
+func TestApiRetriesOnConcurrentChanges(t *testing.T) {
+	mem := providers.NewMemoryProvider()
+	mgr := NewTestServer(mem)
+	mgr.StateProvider = &racingState{FileOrMemoryProvider: mem, races: 2}
+
+	res, err := mgr.CreateJobIfMissing(context.TODO(), server.SearchJobParams{
+		Name:          "testwork",
+		StartedAfter:  -24 * time.Hour,
+		StartedBefore: time.Duration(0),
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !res.Created || len(mem.Data.Jobs) != 1 {
+		t.Fatalf("incorrect number of Jobs: got %d expected %d", len(mem.Data.Jobs), 1)
+	}
+}
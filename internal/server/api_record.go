@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+type SearchRecordParams struct {
+	UserName string    `json:"user"`
+	From     time.Time `json:"from,omitempty"`
+	To       time.Time `json:"to,omitempty"`
+}
+
+type UpdateRecordParams struct {
+	UserName    string    `json:"user"`
+	Id          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Project     string    `json:"project,omitempty"`
+	Task        string    `json:"task,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+}
+
+type DeleteRecordParams struct {
+	UserName string `json:"user"`
+	Id       string `json:"id"`
+}
+
+type RecordResponse struct {
+	Success bool       `json:"success"`
+	Record  api.Record `json:"record,omitempty"`
+}
+
+type RecordListResponse struct {
+	Success bool         `json:"success"`
+	Records []api.Record `json:"records"`
+}
+
+func (mgr *TimerecServer) ListRecords(ctx context.Context, params SearchRecordParams) (RecordListResponse, error) {
+	if params.To.IsZero() {
+		params.To = time.Now()
+	}
+	if params.From.IsZero() {
+		params.From = params.To.Add(-7 * 24 * time.Hour)
+	}
+	if params.To.Before(params.From) {
+		return RecordListResponse{}, mgr.MakeNewResponseError(ValidationError, nil, "'from' must be before 'to'")
+	}
+
+	records, err := mgr.TimeProvider.ListRecords(params.UserName, params.From, params.To)
+	if err != nil {
+		return RecordListResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to list Records: %s", err.Error())
+	}
+	return RecordListResponse{Success: true, Records: records}, nil
+}
+
+func (mgr *TimerecServer) UpdateRecord(ctx context.Context, params UpdateRecordParams) (RecordResponse, error) {
+	rec := api.Record{
+		Id:          params.Id,
+		UserName:    params.UserName,
+		Title:       params.Title,
+		Description: params.Description,
+		Project:     params.Project,
+		Task:        params.Task,
+		Start:       params.Start,
+		End:         params.End,
+	}
+	if rec.Id == "" || rec.Title == "" {
+		return RecordResponse{}, mgr.MakeNewResponseError(ValidationError, nil, "id and title cannot be empty")
+	}
+	if !rec.End.After(rec.Start) {
+		return RecordResponse{}, mgr.MakeNewResponseError(ValidationError, nil, "end must be after start")
+	}
+
+	updated, err := mgr.TimeProvider.UpdateRecord(rec)
+	if errors.Is(err, providers.ProviderNotFound) {
+		return RecordResponse{Success: false}, nil
+	}
+	if errors.Is(err, providers.ProviderForbidden) {
+		return RecordResponse{}, mgr.MakeNewResponseError(Forbidden, err, "Record '%s' belongs to another User", rec.Id)
+	}
+	if err != nil {
+		return RecordResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to update Record '%s': %s", rec.Id, err.Error())
+	}
+
+	mgr.Logger.Infof("Updated Record: %s", rec.Id)
+	return RecordResponse{Success: true, Record: updated}, nil
+}
+
+func (mgr *TimerecServer) DeleteRecord(ctx context.Context, params DeleteRecordParams) (RecordResponse, error) {
+	deleted, err := mgr.TimeProvider.DeleteRecord(api.Record{Id: params.Id, UserName: params.UserName})
+	if errors.Is(err, providers.ProviderNotFound) {
+		return RecordResponse{Success: false}, nil
+	}
+	if errors.Is(err, providers.ProviderForbidden) {
+		return RecordResponse{}, mgr.MakeNewResponseError(Forbidden, err, "Record '%s' belongs to another User", params.Id)
+	}
+	if err != nil {
+		return RecordResponse{}, mgr.MakeNewResponseError(ProviderError, err, "Unable to delete Record '%s': %s", params.Id, err.Error())
+	}
+
+	mgr.Logger.Infof("Deleted Record: %s", params.Id)
+	return RecordResponse{Success: true, Record: deleted}, nil
+}
@@ -0,0 +1,66 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+func TestListRecordsFiltersByUserAndTime(t *testing.T) {
+	mem := providers.NewMemoryProvider()
+	mgr := NewTestServer(mem)
+
+	now := time.Now()
+	mem.SaveRecord(api.Record{UserName: "me", Title: "recent", Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour)})
+	mem.SaveRecord(api.Record{UserName: "me", Title: "old", Start: now.Add(-30 * 24 * time.Hour), End: now.Add(-30 * 24 * time.Hour)})
+	mem.SaveRecord(api.Record{UserName: "other", Title: "recent", Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour)})
+
+	res, err := mgr.ListRecords(context.TODO(), server.SearchRecordParams{UserName: "me"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(res.Records) != 1 || res.Records[0].Title != "recent" {
+		t.Fatalf("incorrect Records: %v", res.Records)
+	}
+}
+
+func TestUpdateAndDeleteRecord(t *testing.T) {
+	mem := providers.NewMemoryProvider()
+	mgr := NewTestServer(mem)
+
+	now := time.Now()
+	rec, _ := mem.SaveRecord(api.Record{UserName: "me", Title: "typo", Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour)})
+	if rec.Id == "" {
+		t.Fatal("SaveRecord did not assign an Id")
+	}
+
+	res, err := mgr.UpdateRecord(context.TODO(), server.UpdateRecordParams{UserName: "me", Id: rec.Id, Title: "fixed", Start: rec.Start, End: now})
+	if err != nil || !res.Success {
+		t.Fatalf("UpdateRecord failed: %t %v", res.Success, err)
+	}
+	if mem.Data.Records[0].Title != "fixed" || !mem.Data.Records[0].End.Equal(now) {
+		t.Fatalf("Record not updated: %v", mem.Data.Records[0])
+	}
+
+	res, err = mgr.UpdateRecord(context.TODO(), server.UpdateRecordParams{UserName: "other", Id: rec.Id, Title: "stolen", Start: rec.Start, End: now})
+	if err == nil {
+		t.Fatal("expected error when updating a Record of another user, got nil")
+	}
+
+	res, err = mgr.DeleteRecord(context.TODO(), server.DeleteRecordParams{UserName: "me", Id: rec.Id})
+	if err != nil || !res.Success {
+		t.Fatalf("DeleteRecord failed: %t %v", res.Success, err)
+	}
+	if len(mem.Data.Records) != 0 {
+		t.Fatalf("incorrect number of Records: got %d expected %d", len(mem.Data.Records), 0)
+	}
+
+	res, err = mgr.DeleteRecord(context.TODO(), server.DeleteRecordParams{UserName: "me", Id: rec.Id})
+	if err != nil || res.Success {
+		t.Fatalf("expected unsuccessful response without error, got %t %v", res.Success, err)
+	}
+}
@@ -25,7 +25,7 @@ func (mgr *TimerecServer) GetUser(ctx context.Context, params SearchUserParams)
 	}
 	user, proverr := providers.GetUser(&state, api.User{Name: params.Name})
 	if proverr == providers.ProviderOk {
-		return UserResponse{Success: true, Created: false, User: user}, nil
+		return UserResponse{Success: true, Created: false, User: user.Redacted()}, nil
 	}
 
 	if proverr == providers.ProviderNotFound {
@@ -35,7 +35,15 @@ func (mgr *TimerecServer) GetUser(ctx context.Context, params SearchUserParams)
 	return UserResponse{}, mgr.MakeNewResponseError(ServerError, err, "Error querying User '%s'", params.Name)
 }
 
-func (mgr *TimerecServer) CreateUserIfMissing(ctx context.Context, params SearchUserParams) (UserResponse, error) {
+func (mgr *TimerecServer) CreateUserIfMissing(ctx context.Context, params SearchUserParams) (resp UserResponse, err error) {
+	err = mgr.retryOnConflict(func() error {
+		resp, err = mgr.createUserIfMissing(ctx, params)
+		return err
+	})
+	return resp, err
+}
+
+func (mgr *TimerecServer) createUserIfMissing(ctx context.Context, params SearchUserParams) (UserResponse, error) {
 	resp, err := mgr.GetUser(ctx, params)
 	if err != nil {
 		mgr.Logger.Error(err)
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+	"go.uber.org/zap"
+)
+
+// OpenState creates a State from a description "<type>[:<options>]", e.g. "file:db.yaml", "bolt:timerec.bolt", "git:timerec-state",
+// "sql:postgres:<dsn>", "kubernetes[:<kubeconfig>]", "kubernetes-crd[:<kubeconfig>]" or "memory"
+func OpenState(logger zap.SugaredLogger, spec string) (State, error) {
+	kind, options := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		kind, options = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "memory":
+		return providers.NewMemoryProvider(), nil
+	case "file":
+		if options == "" {
+			return nil, fmt.Errorf("file State requires a path, e.g. file:db.yaml")
+		}
+		keys, err := providers.LoadStateKeys("")
+		if err != nil {
+			return nil, err
+		}
+		return providers.NewEncryptedFileProvider(options, keys), nil
+	case "bolt":
+		return providers.NewBoltProvider(logger, options)
+	case "git":
+		return providers.NewGitProvider(logger, options, "")
+	case "sql":
+		driver, dsn := options, ""
+		if i := strings.Index(options, ":"); i >= 0 {
+			driver, dsn = options[:i], options[i+1:]
+		}
+		return providers.NewSqlProvider(logger, driver, dsn)
+	case "kubernetes":
+		return providers.NewKubernetesProvider(logger, options)
+	case "kubernetes-crd":
+		return providers.NewKubernetesCrdProvider(logger, options)
+	}
+	return nil, fmt.Errorf("unknown State '%s'", kind)
+}
+
+// CloseState releases the resources of a State from OpenState, e.g. the lock on a bolt database
+func CloseState(state State) error {
+	if closer, ok := UnwrapState(state).(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// StateCount compares the number of entries of one kind and owner in two States
+type StateCount struct {
+	Kind   string
+	Owner  string
+	Source int
+	Target int
+}
+
+type CopyStateResult struct {
+	Counts      []StateCount
+	Differences []string
+}
+
+// CopyState writes all partitions of source to target and compares the result. The target must be empty, unless replace is set.
+// With replace, everything in the target, that is not part of the source, is removed, including Users only the target has.
+// With dryRun, only the source is read
+func CopyState(source, target State, replace, dryRun bool) (CopyStateResult, error) {
+	data, err := refreshAll(source)
+	if err != nil {
+		return CopyStateResult{}, fmt.Errorf("unable to read source: %w", err)
+	}
+	if dryRun {
+		return compareStates(data, providers.StateV2{}, false), nil
+	}
+
+	for attempt := 1; attempt <= StateSaveAttempts; attempt++ {
+		err = copyState(data, target, replace)
+		if !errors.As(err, &providers.VersionConflictError{}) {
+			break
+		}
+	}
+	if err != nil {
+		return CopyStateResult{}, err
+	}
+
+	copied, err := refreshAll(target)
+	if err != nil {
+		return CopyStateResult{}, fmt.Errorf("unable to verify target: %w", err)
+	}
+	return compareStates(data, copied, true), nil
+}
+
+func copyState(data providers.StateV2, target State, replace bool) error {
+	existing, err := refreshAll(target)
+	if err != nil {
+		return fmt.Errorf("unable to read target: %w", err)
+	}
+	if !replace && len(existing.Users)+len(existing.Jobs)+len(existing.Templates)+len(existing.Records)+len(existing.Outbox) > 0 {
+		return fmt.Errorf("target is not empty, use replace to overwrite it")
+	}
+
+	existing.Users, existing.Jobs, existing.Templates, existing.Records, existing.Outbox = data.Users, data.Jobs, data.Templates, data.Records, data.Outbox
+	return target.Save(providers.ScopeGlobal, existing)
+}
+
+// refreshAll reads the global scope of a State including all Users (see CompleteState)
+func refreshAll(state State) (providers.StateV2, error) {
+	if complete, ok := UnwrapState(state).(CompleteState); ok {
+		return complete.RefreshAll()
+	}
+	return state.Refresh(providers.ScopeGlobal)
+}
+
+// compareStates counts the entries of every owner. With verify, different counts and Records missing in the target are reported
+func compareStates(source, target providers.StateV2, verify bool) CopyStateResult {
+	counts := map[StateCount]StateCount{}
+	count := func(kind, owner string, source, target int) {
+		key := StateCount{Kind: kind, Owner: owner}
+		c := counts[key]
+		c.Kind, c.Owner = kind, owner
+		c.Source += source
+		c.Target += target
+		counts[key] = c
+	}
+	for i, state := range []providers.StateV2{source, target} {
+		s, t := 1-i, i
+		for _, user := range state.Users {
+			count("users", user.Name, s, t)
+		}
+		for _, job := range state.Jobs {
+			count("jobs", job.Owner, s, t)
+		}
+		for range state.Templates {
+			count("templates", providers.ScopeGlobal, s, t)
+		}
+		for _, rec := range state.Records {
+			count("records", rec.UserName, s, t)
+		}
+		for _, p := range state.Outbox {
+			count("pending records", p.Record.UserName, s, t)
+		}
+	}
+
+	result := CopyStateResult{Counts: []StateCount{}, Differences: []string{}}
+	for _, c := range counts {
+		result.Counts = append(result.Counts, c)
+	}
+	sort.Slice(result.Counts, func(i, j int) bool {
+		if result.Counts[i].Owner != result.Counts[j].Owner {
+			return result.Counts[i].Owner < result.Counts[j].Owner
+		}
+		return result.Counts[i].Kind < result.Counts[j].Kind
+	})
+	if !verify {
+		return result
+	}
+
+	for _, c := range result.Counts {
+		if c.Source != c.Target {
+			result.Differences = append(result.Differences, fmt.Sprintf("%s of %s: %d in source, %d in target", c.Kind, c.Owner, c.Source, c.Target))
+		}
+	}
+	for _, rec := range source.Records {
+		if _, proverr := providers.GetRecord(&target, rec.Id); proverr != providers.ProviderOk {
+			result.Differences = append(result.Differences, fmt.Sprintf("record %s of %s is missing in target", rec.Id, rec.UserName))
+		}
+	}
+	return result
+}
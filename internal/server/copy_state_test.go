@@ -0,0 +1,110 @@
+package server_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+func TestCopyStateToFile(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	source, _ := server.OpenState(*logger.Sugar(), "memory")
+	state, _ := source.Refresh(providers.ScopeGlobal)
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	for _, name := range []string{"me", "other"} {
+		providers.CreateUser(&state, api.NewDefaultUser(name))
+		providers.CreateJob(&state, api.Job{Name: "work-" + name, Owner: name})
+		providers.SaveRecord(&state, api.Record{Id: "rec-" + name, UserName: name, Start: start, End: start.Add(time.Hour)})
+	}
+	state.Templates = append(state.Templates, api.RecordTemplate{TemplateName: "meeting"})
+	providers.EnqueueRecord(&state, providers.PendingRecord{Record: api.Record{Id: "pending", UserName: "me"}})
+	source.Save(state.Partition, state)
+
+	target, err := server.OpenState(*logger.Sugar(), "file:"+filepath.Join(t.TempDir(), "db.yaml"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	result, err := server.CopyState(source, target, false, false)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(result.Differences) != 0 {
+		t.Fatalf("incorrect differences: got %v expected none", result.Differences)
+	}
+	for _, c := range result.Counts {
+		if c.Kind == "records" && c.Owner == "other" && c.Target != 1 {
+			t.Fatalf("incorrect record count: got %d expected %d", c.Target, 1)
+		}
+	}
+
+	copied, _ := target.Refresh("me")
+	if len(copied.Users) != 1 || len(copied.Jobs) != 1 || len(copied.Records) != 1 || len(copied.Outbox) != 1 {
+		t.Fatalf("incorrect partition in target: %v", copied)
+	}
+
+	if _, err := server.CopyState(source, target, false, false); err == nil {
+		t.Fatal("expected an error for a target, that is not empty")
+	}
+	if _, err := server.CopyState(source, target, true, false); err != nil {
+		t.Fatalf("expected no error with replace, got %v", err)
+	}
+}
+
+func TestOpenStateRejectsUnknownStates(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	for _, spec := range []string{"unknown:db.yaml", "file"} {
+		if _, err := server.OpenState(*logger.Sugar(), spec); err == nil {
+			t.Fatalf("expected an error for %s", spec)
+		}
+	}
+}
+
+func TestCopyStateIncludesPausedUsers(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	source := providers.NewKubernetesProviderForClient(*logger.Sugar(), fake.NewSimpleClientset(), "timerec")
+	for _, name := range []string{"me", "paused"} {
+		state, _ := source.Refresh(name)
+		state.Users[0].Inactive = name == "paused"
+		providers.SaveRecord(&state, api.Record{Id: "rec-" + name, UserName: name})
+		source.Save(name, state)
+	}
+	if global, _ := source.Refresh(providers.ScopeGlobal); len(global.Users) != 1 {
+		t.Fatalf("expected the global scope to skip paused Users, got %v", global.Users)
+	}
+
+	target := providers.NewMemoryProvider()
+	result, err := server.CopyState(source, target, false, false)
+	if err != nil || len(result.Differences) != 0 {
+		t.Fatalf("expected no differences, got %v, %v", result.Differences, err)
+	}
+	if len(target.Data.Users) != 2 || len(target.Data.Records) != 2 {
+		t.Fatalf("incorrect target: got %d users and %d records expected 2 and 2", len(target.Data.Users), len(target.Data.Records))
+	}
+	if paused, _ := providers.GetUser(&target.Data, api.User{Name: "paused"}); !paused.Inactive {
+		t.Fatalf("expected the paused User to stay paused, got %v", paused)
+	}
+}
+
+func TestCopyStateReplaceDropsUsers(t *testing.T) {
+	for name, target := range NewTestStates(t) {
+		createTestUsers(t, target, "me", "old")
+
+		source := providers.NewMemoryProvider()
+		providers.CreateUser(&source.Data, api.NewDefaultUser("me"))
+		result, err := server.CopyState(source, target, true, false)
+		if err != nil || len(result.Differences) != 0 {
+			t.Fatalf("%s: expected no differences, got %v, %v", name, result.Differences, err)
+		}
+		global, _ := target.Refresh(providers.ScopeGlobal)
+		if len(global.Users) != 1 || global.Users[0].Name != "me" {
+			t.Fatalf("%s: expected only user me after replace, got %v", name, global.Users)
+		}
+	}
+}
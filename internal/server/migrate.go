@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// MigrateState rewrites every partition, that was stored with an older schema version. Refresh migrates the data, Save writes it
+// with the current schema version. With dryRun, only the pending migrations are returned
+func (mgr *TimerecServer) MigrateState(dryRun bool) ([]string, error) {
+	versioned, ok := UnwrapState(mgr.StateProvider).(SchemaVersioned)
+	if !ok {
+		return []string{}, fmt.Errorf("the configured State does not store a schema version")
+	}
+	versions, err := versioned.SchemaVersions()
+	if err != nil {
+		return []string{}, err
+	}
+
+	partitions := []string{}
+	for partition := range versions {
+		partitions = append(partitions, partition)
+	}
+	sort.Strings(partitions)
+
+	report := []string{}
+	for _, partition := range partitions {
+		pending, err := providers.PendingMigrations(versions[partition])
+		if err != nil {
+			return report, fmt.Errorf("partition %s: %w", partition, err)
+		}
+		for _, migration := range pending {
+			report = append(report, fmt.Sprintf("%s: %s", partition, migration))
+		}
+		if len(pending) == 0 || dryRun {
+			continue
+		}
+
+		err = mgr.retryOnConflict(func() error {
+			state, err := mgr.StateProvider.Refresh(partition)
+			if err != nil {
+				return err
+			}
+			return mgr.StateProvider.Save(partition, state)
+		})
+		if err != nil {
+			return report, fmt.Errorf("unable to migrate partition %s: %w", partition, err)
+		}
+		mgr.Logger.Infof("Migrated partition %s to schema version %d", partition, providers.StateSchemaVersion)
+	}
+	return report, nil
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// NotificationRouter is a NotificationService, that sends each Event to the channels a User selected for its EventType
+// (see api.NotificationSettings). Users without a selection get the Default channels. Events are dropped during a User's
+// quiet hours and while do-not-disturb is set, the reconcilers notify again later
+type NotificationRouter struct {
+	Channels map[string]NotificationService
+	Default  []string
+
+	settings providers.SettingsLookup
+	logger   *zap.SugaredLogger
+}
+
+func NewNotificationRouter(logger zap.SugaredLogger, channels map[string]NotificationService, defaults []string, settings providers.SettingsLookup) (*NotificationRouter, error) {
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("routing requires at least one notification channel")
+	}
+	if len(defaults) == 0 {
+		for name := range channels {
+			defaults = append(defaults, name)
+		}
+		sort.Strings(defaults)
+	}
+	for _, name := range defaults {
+		if _, ok := channels[name]; !ok {
+			return nil, fmt.Errorf("notification channel '%s' is not configured", name)
+		}
+	}
+	return &NotificationRouter{
+		Channels: channels,
+		Default:  defaults,
+		settings: settings,
+		logger:   logger.Named("Notifications"),
+	}, nil
+}
+
+// UnwrapNotifiers returns the NotificationServices behind a NotificationRouter, e.g. to check for optional interfaces like DeadLetterReplayer
+func UnwrapNotifiers(ns NotificationService) []NotificationService {
+	router, ok := ns.(*NotificationRouter)
+	if !ok {
+		return []NotificationService{ns}
+	}
+	names := []string{}
+	for name := range router.Channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	services := []NotificationService{}
+	for _, name := range names {
+		services = append(services, router.Channels[name])
+	}
+	return services
+}
+
+func (router *NotificationRouter) NotifyUser(ev cloudevents.Event) error {
+	msg, err := api.MessageFromEvent(ev)
+	if err != nil {
+		return fmt.Errorf("unable to read Message of Event %s: %w", ev.ID(), err)
+	}
+	settings, err := router.settings(msg.UserName())
+	if err != nil {
+		return fmt.Errorf("unable to read Settings of User '%s': %w", msg.UserName(), err)
+	}
+
+	notifications := settings.Notifications
+	if notifications.Quiet(time.Now()) {
+		router.logger.Debugf("User '%s' does not want to be disturbed, dropping Event %s", msg.UserName(), ev.ID())
+		return nil
+	}
+	channels, ok := notifications.Channels[msg.Event]
+	if !ok {
+		channels = router.Default
+	}
+
+	failed := []string{}
+	for _, name := range channels {
+		service, ok := router.Channels[name]
+		if !ok {
+			router.logger.Warnf("User '%s' selected notification channel '%s', which is not configured", msg.UserName(), name)
+			continue
+		}
+		if err := service.NotifyUser(ev); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d channels failed (%s)", len(failed), len(channels), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// SendDigest sends the digest through the channels the User selected for api.EventTypeDigest. Without a selection, the digest
+// goes to the default channels and every channel the User selected for other EventTypes. Channels, that do not collect Events,
+// are skipped. During quiet hours and do-not-disturb, the digest is postponed
+func (router *NotificationRouter) SendDigest(user api.User, jobs []api.Job, now time.Time) (time.Time, error) {
+	notifications := user.Settings.Notifications
+	if notifications.Quiet(now) {
+		return now.Add(ReconcileInterval), nil
+	}
+	channels, ok := notifications.Channels[api.EventTypeDigest]
+	if !ok {
+		selected := map[string]bool{}
+		for _, names := range notifications.Channels {
+			for _, name := range names {
+				selected[name] = true
+			}
+		}
+		for _, name := range router.Default {
+			selected[name] = true
+		}
+		channels = sortedKeys(selected)
+	}
+
+	next := now.AddDate(0, 0, 1)
+	for _, name := range channels {
+		digest, ok := router.Channels[name].(DigestSender)
+		if !ok {
+			continue
+		}
+		due, err := digest.SendDigest(user, jobs, now)
+		if err != nil {
+			return now.Add(ReconcileInterval), fmt.Errorf("%s: %w", name, err)
+		}
+		if due.Before(next) {
+			next = due
+		}
+	}
+	return next, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := []string{}
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,121 @@
+package server_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server"
+)
+
+// recordingNotifier keeps every Event and fails, if err is set
+type recordingNotifier struct {
+	events []cloudevents.Event
+	err    error
+}
+
+func (n *recordingNotifier) NotifyUser(ev cloudevents.Event) error {
+	n.events = append(n.events, ev)
+	return n.err
+}
+
+func TestNotificationRouterRespectsUserSettings(t *testing.T) {
+	users := map[string]api.Settings{
+		"default": {},
+		"chat":    {Notifications: api.NotificationSettings{Channels: map[api.EventType][]string{api.EventTypeTimerExpired: {"slack", "missing"}, api.EventTypeNoEntryAlarm: {}}}},
+		"dnd":     {Notifications: api.NotificationSettings{DoNotDisturb: true}},
+		"night":   {Notifications: api.NotificationSettings{QuietHours: api.QuietHours{From: 0, To: 24 * time.Hour}}},
+	}
+	slack, email := &recordingNotifier{}, &recordingNotifier{}
+	logger, _ := zap.NewDevelopment()
+	router, err := server.NewNotificationRouter(*logger.Sugar(), map[string]server.NotificationService{"slack": slack, "email": email}, []string{"email"}, func(user string) (api.Settings, error) {
+		return users[user], nil
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	testCases := []struct {
+		user          string
+		event         api.EventType
+		slack, emails int
+	}{
+		{user: "default", event: api.EventTypeTimerExpired, slack: 0, emails: 1},
+		{user: "chat", event: api.EventTypeTimerExpired, slack: 1, emails: 0},
+		{user: "chat", event: api.EventTypeNoEntryAlarm, slack: 0, emails: 0},
+		{user: "dnd", event: api.EventTypeTimerExpired, slack: 0, emails: 0},
+		{user: "night", event: api.EventTypeTimerExpired, slack: 0, emails: 0},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.user+"/"+string(tC.event), func(t *testing.T) {
+			slack.events, email.events = nil, nil
+			if err := router.NotifyUser(api.MakeMessageEvent(tC.event, "message", "activity@work", tC.user)); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if len(slack.events) != tC.slack || len(email.events) != tC.emails {
+				t.Fatalf("incorrect notifications: got %d/%d expected %d/%d", len(slack.events), len(email.events), tC.slack, tC.emails)
+			}
+		})
+	}
+
+	email.err = errors.New("smtp unavailable")
+	if err := router.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "message", "", "default")); err == nil {
+		t.Fatal("expected an error for a failed channel")
+	}
+	if services := server.UnwrapNotifiers(router); len(services) != 2 || services[0] != email {
+		t.Fatalf("incorrect notifiers: %v", services)
+	}
+}
+
+func TestNotificationRouterRequiresDefaultChannels(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	_, err := server.NewNotificationRouter(*logger.Sugar(), map[string]server.NotificationService{"email": &recordingNotifier{}}, []string{"slack"}, nil)
+	if err == nil {
+		t.Fatal("expected an error for an unknown default channel")
+	}
+}
+
+// digestNotifier counts the digests it was asked to send
+type digestNotifier struct {
+	recordingNotifier
+	digests int
+}
+
+func (n *digestNotifier) SendDigest(user api.User, jobs []api.Job, now time.Time) (time.Time, error) {
+	n.digests++
+	return now.Add(time.Hour), nil
+}
+
+func TestNotificationRouterSendsDigestToUserChannels(t *testing.T) {
+	slack, email := &digestNotifier{}, &digestNotifier{}
+	logger, _ := zap.NewDevelopment()
+	router, _ := server.NewNotificationRouter(*logger.Sugar(), map[string]server.NotificationService{"slack": slack, "email": email}, []string{"email"}, nil)
+
+	testCases := []struct {
+		desc          string
+		settings      api.NotificationSettings
+		slack, emails int
+	}{
+		{desc: "default", settings: api.NotificationSettings{}, slack: 0, emails: 1},
+		{desc: "selected", settings: api.NotificationSettings{Channels: map[api.EventType][]string{api.EventTypeTimerExpired: {"slack"}}}, slack: 1, emails: 1},
+		{desc: "digest", settings: api.NotificationSettings{Channels: map[api.EventType][]string{api.EventTypeDigest: {"slack"}}}, slack: 1, emails: 0},
+		{desc: "quiet", settings: api.NotificationSettings{QuietHours: api.QuietHours{From: 0, To: 24 * time.Hour}}, slack: 0, emails: 0},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			slack.digests, email.digests = 0, 0
+			user := api.User{Name: "me", Settings: api.Settings{Notifications: tC.settings}}
+			next, err := router.SendDigest(user, []api.Job{}, time.Now())
+			if err != nil || next.Before(time.Now()) {
+				t.Fatalf("incorrect next digest: got %v, %v", next, err)
+			}
+			if slack.digests != tC.slack || email.digests != tC.emails {
+				t.Fatalf("incorrect digests: got %d/%d expected %d/%d", slack.digests, email.digests, tC.slack, tC.emails)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+const (
+	OutboxInitialBackoff time.Duration = time.Minute
+	OutboxMaxBackoff     time.Duration = 6 * time.Hour
+)
+
+// OutboxBackoff returns the delay before the next delivery attempt. The delay doubles with every attempt
+func OutboxBackoff(attempts int) time.Duration {
+	backoff := float64(OutboxInitialBackoff) * math.Pow(2, float64(attempts-1))
+	if attempts < 1 || backoff > float64(OutboxMaxBackoff) {
+		return OutboxMaxBackoff
+	}
+	return time.Duration(backoff)
+}
+
+// enqueueRecords stores Records as pending, so they are delivered right away. The Record Id stays the same for all delivery attempts
+func enqueueRecords(state *providers.StateV2, records []api.Record) providers.ProviderReturnType {
+	for _, rec := range records {
+		proverr := providers.EnqueueRecord(state, providers.PendingRecord{Record: rec, NextAttempt: time.Now()})
+		if proverr != providers.ProviderOk {
+			return proverr
+		}
+	}
+	return providers.ProviderOk
+}
+
+func isPending(state *providers.StateV2, id string) bool {
+	for _, p := range state.Outbox {
+		if p.Record.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubmitted returns true, if the Record is stored in the State. States, that do not read Records in Refresh, are asked for the Records
+// that started at the same time
+func (mgr *TimerecServer) isSubmitted(state *providers.StateV2, rec api.Record) bool {
+	if !state.RecordsOmitted {
+		_, proverr := providers.GetRecord(state, rec.Id)
+		return proverr == providers.ProviderOk
+	}
+	ts, ok := UnwrapState(mgr.StateProvider).(TimeService)
+	if !ok {
+		return false
+	}
+	records, err := ts.ListRecords(rec.UserName, rec.Start, rec.Start)
+	if err != nil {
+		mgr.Logger.Warnf("Unable to list Records of User '%s': %v", rec.UserName, err)
+	}
+	for _, r := range records {
+		if r.Id == rec.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// allDelivered returns true, if every Record of the Job was confirmed in this delivery or was delivered before
+func (mgr *TimerecServer) allDelivered(state *providers.StateV2, job api.Job, confirmed map[string]bool) bool {
+	for _, rec := range job.ConvertToRecords() {
+		if !confirmed[rec.Id] && !mgr.isDelivered(state, rec) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDelivered returns true, if the Record is in the State or the TimeService lists it
+func (mgr *TimerecServer) isDelivered(state *providers.StateV2, rec api.Record) bool {
+	if _, proverr := providers.GetRecord(state, rec.Id); proverr == providers.ProviderOk {
+		return true
+	}
+	records, err := mgr.TimeProvider.ListRecords(rec.UserName, rec.Start, rec.Start)
+	if err != nil {
+		mgr.Logger.Warnf("Unable to list Records of User '%s': %v", rec.UserName, err)
+	}
+	for _, r := range records {
+		if r.Id == rec.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverOutbox tries to send all pending Records of a user, that match filter and are due. Jobs are deleted once all their Records are confirmed.
+// Activities finished after the last CompleteJob were never enqueued, their Jobs are kept until CompleteJob is called again.
+// Returns the results of all delivery attempts and the number of Records, that match filter and are still pending
+func (mgr *TimerecServer) deliverOutbox(user string, filter func(providers.PendingRecord) bool) ([]RecordResult, int, error) {
+	state, err := mgr.StateProvider.Refresh(user)
+	if err != nil {
+		return []RecordResult{}, 0, err
+	}
+
+	// Deliver without holding on to the state, because the TimeService might write to the same state
+	now := time.Now()
+	results := []RecordResult{}
+	attempted := []providers.PendingRecord{}
+	remaining := 0
+	for _, p := range state.Outbox {
+		if p.Record.UserName != user || !filter(p) {
+			continue
+		}
+		if p.NextAttempt.After(now) {
+			remaining++
+			continue
+		}
+		p.LastError = ""
+		for _, res := range mgr.saveRecord(p.Record, p.Confirmed) {
+			results = append(results, res)
+			if res.Success {
+				p.Confirmed = append(p.Confirmed, res.Backend)
+			} else {
+				p.LastError = res.Backend + ": " + res.Error
+			}
+		}
+		attempted = append(attempted, p)
+	}
+	if len(attempted) == 0 {
+		return results, remaining, nil
+	}
+
+	// Update outbox and remove completed Jobs. Only this step is retried on conflicts, the delivery already happened
+	err = mgr.retryOnConflict(func() error {
+		state, err := mgr.StateProvider.Refresh(user)
+		if err != nil {
+			return err
+		}
+		jobs := map[string]bool{}
+		confirmed := map[string]bool{}
+		for _, p := range attempted {
+			jobs[p.Record.JobName] = true
+			if p.LastError == "" {
+				confirmed[p.Record.Id] = true
+				providers.DeletePendingRecord(&state, p)
+				continue
+			}
+			p.Attempts++
+			p.NextAttempt = time.Now().Add(OutboxBackoff(p.Attempts))
+			mgr.Logger.Warnf("Delivery of Record '%s' failed (attempt %d, retry at %s): %s", p.Record.Id, p.Attempts, p.NextAttempt.Format(time.RFC3339), p.LastError)
+			providers.UpdatePendingRecord(&state, p)
+		}
+		for name := range jobs {
+			job, proverr := providers.GetJob(&state, api.Job{Name: name, Owner: user})
+			if proverr != providers.ProviderOk {
+				continue
+			}
+			if pending, _ := providers.ListPendingRecords(&state, job); len(pending) > 0 {
+				continue
+			}
+			if !mgr.allDelivered(&state, job, confirmed) {
+				mgr.Logger.Infof("Job '%s' has Activities, that were not submitted yet, keeping it", name)
+				continue
+			}
+			providers.DeleteJob(&state, job)
+			mgr.Logger.Infof("Completed Job: %s", name)
+		}
+		err = mgr.StateProvider.Save(state.Partition, state)
+		if err != nil {
+			return err
+		}
+
+		remaining = 0
+		for _, p := range state.Outbox {
+			if p.Record.UserName == user && filter(p) {
+				remaining++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return results, len(attempted), err
+	}
+	return results, remaining, nil
+}
+
+// reconcileOutbox retries the delivery of all pending Records, that are due. A failing User does not stop the delivery for other Users
+func (mgr *TimerecServer) reconcileOutbox(ctx context.Context) ReconcileResult {
+	state, err := mgr.StateProvider.Refresh(providers.ScopeGlobal)
+	if err != nil {
+		return ReconcileResult{Error: err}
+	}
+
+	now := time.Now()
+	users := map[string]bool{}
+	for _, p := range state.Outbox {
+		if !p.NextAttempt.After(now) {
+			users[p.Record.UserName] = true
+		}
+	}
+	var deliveryErr error
+	for user := range users {
+		_, _, err := mgr.deliverOutbox(user, func(p providers.PendingRecord) bool { return true })
+		if err != nil {
+			mgr.Logger.Warnf("Unable to deliver pending Records of User '%s': %v", user, err)
+			deliveryErr = err
+		}
+	}
+
+	// Requeue for the next pending Record
+	state, err = mgr.StateProvider.Refresh(providers.ScopeGlobal)
+	if err != nil {
+		return ReconcileResult{Error: err}
+	}
+	if len(state.Outbox) == 0 {
+		return ReconcileResult{Ok: deliveryErr == nil, Error: deliveryErr}
+	}
+	next := state.Outbox[0].NextAttempt
+	for _, p := range state.Outbox {
+		if p.NextAttempt.Before(next) {
+			next = p.NextAttempt
+		}
+	}
+	return ReconcileResult{Ok: deliveryErr == nil, Requeue: true, RetryAfter: time.Until(next), Error: deliveryErr}
+}
@@ -0,0 +1,151 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+func TestOutboxBackoffIsCapped(t *testing.T) {
+	if server.OutboxBackoff(1) != server.OutboxInitialBackoff {
+		t.Fatalf("incorrect backoff: got %v expected %v", server.OutboxBackoff(1), server.OutboxInitialBackoff)
+	}
+	if server.OutboxBackoff(3) != 4*server.OutboxInitialBackoff {
+		t.Fatalf("incorrect backoff: got %v expected %v", server.OutboxBackoff(3), 4*server.OutboxInitialBackoff)
+	}
+	if server.OutboxBackoff(100) != server.OutboxMaxBackoff {
+		t.Fatalf("incorrect backoff: got %v expected %v", server.OutboxBackoff(100), server.OutboxMaxBackoff)
+	}
+}
+
+func TestReconcileDeliversDueRecords(t *testing.T) {
+	mem, backend := providers.NewMemoryProvider(), providers.NewMemoryProvider()
+	mgr := NewTestServer(mem)
+	mgr.TimeProvider = failingTimeService{backend}
+
+	start := time.Now().Add(-time.Hour)
+	providers.CreateJob(&mem.Data, api.Job{
+		Name:           "testwork",
+		RecordTemplate: api.RecordTemplate{Title: "test", Description: "desc", Project: "test", Task: "test"},
+		Activities:     []api.TimeEntry{{Start: start, End: start.Add(time.Hour)}},
+	})
+	res, err := mgr.CompleteJob(context.TODO(), server.CompleteJobParams{SearchJobParams: server.SearchJobParams{Name: "testwork"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if res.Pending != 1 || mem.Data.Outbox[0].Attempts != 1 || mem.Data.Outbox[0].LastError == "" {
+		t.Fatalf("incorrect outbox: got %v expected 1 failed attempt", mem.Data.Outbox)
+	}
+
+	// Not yet due
+	mgr.TimeProvider = backend
+	result := mgr.ReconcileOnce(context.TODO())
+	if !result.Requeue || len(backend.Data.Records) != 0 {
+		t.Fatalf("record delivered before it was due: got %d records", len(backend.Data.Records))
+	}
+
+	mem.Data.Outbox[0].NextAttempt = time.Now().Add(-time.Second)
+	mgr.ReconcileOnce(context.TODO())
+	if len(backend.Data.Records) != 1 {
+		t.Fatalf("incorrect number of records: got %d expected %d", len(backend.Data.Records), 1)
+	}
+	if len(mem.Data.Outbox) != 0 || len(mem.Data.Jobs) != 0 {
+		t.Fatalf("incorrect state: got %d pending records and %d jobs expected 0 and 0", len(mem.Data.Outbox), len(mem.Data.Jobs))
+	}
+}
+
+func TestCompleteJobEnqueuesNewActivities(t *testing.T) {
+	mem, backend := providers.NewMemoryProvider(), providers.NewMemoryProvider()
+	mgr := NewTestServer(mem)
+	mgr.TimeProvider = failingTimeService{backend}
+
+	start := time.Now().Add(-3 * time.Hour)
+	providers.CreateJob(&mem.Data, api.Job{
+		Name:           "testwork",
+		RecordTemplate: api.RecordTemplate{Title: "test", Description: "desc", Project: "test", Task: "test"},
+		Activities:     []api.TimeEntry{{Start: start, End: start.Add(time.Hour)}},
+	})
+	params := server.CompleteJobParams{SearchJobParams: server.SearchJobParams{Name: "testwork"}}
+	mgr.CompleteJob(context.TODO(), params)
+
+	// The Job gets another Activity, while the first Record is still pending
+	mem.Data.Jobs[0].Activities = append(mem.Data.Jobs[0].Activities, api.TimeEntry{Start: start.Add(2 * time.Hour), End: start.Add(3 * time.Hour)})
+	res, err := mgr.CompleteJob(context.TODO(), params)
+	if err != nil || res.Pending != 2 || len(mem.Data.Outbox) != 2 {
+		t.Fatalf("incorrect outbox: got %d pending (%v), %v", res.Pending, mem.Data.Outbox, err)
+	}
+	if mem.Data.Outbox[0].Attempts != 1 {
+		t.Fatalf("pending record was delivered before its backoff expired: got %d attempts expected %d", mem.Data.Outbox[0].Attempts, 1)
+	}
+
+	mgr.TimeProvider = backend
+	for i := range mem.Data.Outbox {
+		mem.Data.Outbox[i].NextAttempt = time.Now().Add(-time.Second)
+	}
+	mgr.ReconcileOnce(context.TODO())
+	if len(backend.Data.Records) != 2 || len(mem.Data.Jobs) != 0 {
+		t.Fatalf("incorrect delivery: got %d records and %d jobs expected 2 and 0", len(backend.Data.Records), len(mem.Data.Jobs))
+	}
+}
+
+func TestOutboxKeepsJobsWithActivitiesFinishedLater(t *testing.T) {
+	mem, backend := providers.NewMemoryProvider(), providers.NewMemoryProvider()
+	mgr := NewTestServer(mem)
+	mgr.TimeProvider = failingTimeService{backend}
+
+	start := time.Now().Add(-3 * time.Hour)
+	providers.CreateJob(&mem.Data, api.Job{
+		Name:           "testwork",
+		RecordTemplate: api.RecordTemplate{Title: "test", Description: "desc", Project: "test", Task: "test"},
+		Activities:     []api.TimeEntry{{Start: start, End: start.Add(time.Hour)}},
+	})
+	params := server.CompleteJobParams{SearchJobParams: server.SearchJobParams{Name: "testwork"}}
+	mgr.CompleteJob(context.TODO(), params)
+
+	// Another Activity is finished on the Job between two outbox runs, without a new CompleteJob
+	mem.Data.Jobs[0].Activities = append(mem.Data.Jobs[0].Activities, api.TimeEntry{Start: start.Add(2 * time.Hour), End: start.Add(3 * time.Hour)})
+	mgr.TimeProvider = backend
+	mem.Data.Outbox[0].NextAttempt = time.Now().Add(-time.Second)
+	mgr.ReconcileOnce(context.TODO())
+	if len(backend.Data.Records) != 1 || len(mem.Data.Jobs) != 1 || len(mem.Data.Jobs[0].Activities) != 2 {
+		t.Fatalf("incorrect delivery: got %d records and jobs %v expected 1 record and the job with 2 activities", len(backend.Data.Records), mem.Data.Jobs)
+	}
+
+	res, err := mgr.CompleteJob(context.TODO(), params)
+	if err != nil || res.Pending != 0 || len(backend.Data.Records) != 2 || len(mem.Data.Jobs) != 0 {
+		t.Fatalf("incorrect delivery: got %d records and %d jobs (%v) expected 2 and 0", len(backend.Data.Records), len(mem.Data.Jobs), err)
+	}
+}
+
+func TestCompleteJobRejectsSubmittedRecords(t *testing.T) {
+	mem := providers.NewMemoryProvider()
+	mgr := NewTestServer(mem)
+
+	start := time.Now().Add(-time.Hour)
+	job := api.Job{
+		Name:           "testwork",
+		RecordTemplate: api.RecordTemplate{Title: "test", Description: "desc", Project: "test", Task: "test"},
+		Activities:     []api.TimeEntry{{Start: start, End: start.Add(time.Hour)}},
+	}
+	providers.CreateJob(&mem.Data, job)
+	_, err := mgr.CompleteJob(context.TODO(), server.CompleteJobParams{SearchJobParams: server.SearchJobParams{Name: "testwork"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// Submitting the same Activities again would create a double booking
+	providers.CreateJob(&mem.Data, job)
+	_, err = mgr.CompleteJob(context.TODO(), server.CompleteJobParams{SearchJobParams: server.SearchJobParams{Name: "testwork"}})
+	var respErr server.ResponseError
+	if !errors.As(err, &respErr) || respErr.Cause != providers.ProviderConflict {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+	if len(mem.Data.Records) != 1 {
+		t.Fatalf("incorrect number of records: got %d expected %d", len(mem.Data.Records), 1)
+	}
+}
@@ -0,0 +1,104 @@
+package providers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+// ActionLinkTtl is how long the links in a notification can be used
+const ActionLinkTtl time.Duration = 24 * time.Hour
+
+// ErrActionLinkInvalid is returned for links with a wrong signature and for expired links
+var ErrActionLinkInvalid = errors.New("invalid or expired link")
+
+// ActionLinks creates and verifies the links in notifications, that extend or finish an Activity (see server.RunActivityAction).
+// Links are signed with Secret for a single User and action and expire after Ttl
+type ActionLinks struct {
+	BaseUrl string
+	Secret  []byte
+	Ttl     time.Duration
+}
+
+// NewActionLinks returns nil without baseUrl, so notifications have no actions. Without a secret, a random secret is used,
+// links from notifications sent before a restart are invalid then
+func NewActionLinks(baseUrl, secret string) (*ActionLinks, error) {
+	if baseUrl == "" {
+		return nil, nil
+	}
+	if err := validateUrl("public url", baseUrl); err != nil {
+		return nil, err
+	}
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &ActionLinks{BaseUrl: strings.TrimSuffix(baseUrl, "/"), Secret: key, Ttl: ActionLinkTtl}, nil
+}
+
+// chatAction is a link to an action on the active Activity
+type chatAction struct {
+	Id    string
+	Label string
+	Url   string
+}
+
+// Actions returns the links for a Message, that refers to an active Activity
+func (links *ActionLinks) Actions(msg api.Message, settings api.Settings) []chatAction {
+	if links == nil || msg.ActivityName() == "" {
+		return []chatAction{}
+	}
+	extension := settings.DefaultEstimate
+	if extension <= 0 {
+		extension = ChatDefaultExtension
+	}
+	expires := time.Now().Add(links.Ttl)
+	return []chatAction{
+		{Id: "extend", Label: fmt.Sprintf("Extend %s", shortDuration(extension)), Url: links.Url(msg.UserName(), "extend", extension.String(), expires)},
+		{Id: "finish", Label: "Finish", Url: links.Url(msg.UserName(), "finish", "", expires)},
+	}
+}
+
+// Url returns a signed link to an action
+func (links *ActionLinks) Url(user, action, estimate string, expires time.Time) string {
+	query := url.Values{}
+	if estimate != "" {
+		query.Set("estimate", estimate)
+	}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", links.sign(user, action, estimate, expires.Unix()))
+	return fmt.Sprintf("%s/actions/%s/activity/%s?%s", links.BaseUrl, url.PathEscape(user), action, query.Encode())
+}
+
+// Verify checks the signature and expiry of a link
+func (links *ActionLinks) Verify(user, action, estimate, expires, signature string, now time.Time) error {
+	if links == nil {
+		return ErrActionLinkInvalid
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > unix {
+		return ErrActionLinkInvalid
+	}
+	if !hmac.Equal([]byte(signature), []byte(links.sign(user, action, estimate, unix))) {
+		return ErrActionLinkInvalid
+	}
+	return nil
+}
+
+func (links *ActionLinks) sign(user, action, estimate string, expires int64) string {
+	mac := hmac.New(sha256.New, links.Secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", user, action, estimate, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
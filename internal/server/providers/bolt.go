@@ -0,0 +1,634 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+const BoltDefaultPath string = "timerec.bolt"
+
+var (
+	boltBucketUsers     = []byte("users")
+	boltBucketTemplates = []byte("templates")
+	boltBucketJobs      = []byte("jobs")
+	boltBucketRecords   = []byte("records")
+	boltBucketOutbox    = []byte("outbox")
+	boltBucketStarts    = []byte("starts")
+	boltBucketMeta      = []byte("meta")
+	boltBucketVersions  = []byte("versions")
+	boltKeyUser         = []byte("user")
+	boltKeyVersion      = []byte("version")
+	boltKeySchema       = []byte("schema")
+)
+
+// boltStartFormat has a fixed width, so the keys in the starts bucket sort by time
+const boltStartFormat = "2006-01-02T15:04:05.000000000Z"
+
+// BoltProvider stores the State in a local bbolt database. Every User has a bucket with nested buckets for Jobs, Records and pending Records,
+// so only changed entries are written. Templates are shared by all Users.
+// Records are indexed by their start time. Refresh does not read them, ListRecords only decodes the requested range (see StateV2.RecordsOmitted).
+// Every write increments a global counter in the meta bucket, that is also the new version of the changed Users. Versions are never reused,
+// not even after a User was deleted.
+// bbolt locks the database file, so it can only be opened by one process at a time
+type BoltProvider struct {
+	Path string
+
+	db     *bolt.DB
+	logger *zap.SugaredLogger
+}
+
+func NewBoltProvider(logger zap.SugaredLogger, path string) (*BoltProvider, error) {
+	if path == "" {
+		path = BoltDefaultPath
+	}
+	store := &BoltProvider{
+		Path:   path,
+		logger: logger.Named("Bolt"),
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	store.db = db
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBucketUsers, boltBucketTemplates, boltBucketMeta, boltBucketVersions} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return upgradeBoltLayout(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// upgradeBoltLayout moves the versions of databases, that kept a version in every User's bucket, to the versions bucket
+// and indexes Records, that were saved without start time index
+func upgradeBoltLayout(tx *bolt.Tx) error {
+	users := tx.Bucket(boltBucketUsers)
+	versions := tx.Bucket(boltBucketVersions)
+	sum := 0
+	err := users.ForEach(func(name, _ []byte) error {
+		bucket := users.Bucket(name)
+		if legacy := bucket.Get(boltKeyVersion); legacy != nil {
+			n, _ := strconv.Atoi(string(legacy))
+			sum += n
+			if versions.Get(name) == nil {
+				if err := versions.Put(name, legacy); err != nil {
+					return err
+				}
+			}
+			if err := bucket.Delete(boltKeyVersion); err != nil {
+				return err
+			}
+		}
+
+		records := bucket.Bucket(boltBucketRecords)
+		if records == nil || bucket.Bucket(boltBucketStarts) != nil {
+			return nil
+		}
+		starts, err := bucket.CreateBucket(boltBucketStarts)
+		if err != nil {
+			return err
+		}
+		return records.ForEach(func(id, value []byte) error {
+			var rec api.Record
+			if err := json.Unmarshal(value, &rec); err != nil {
+				return err
+			}
+			return starts.Put(boltStartKey(rec), id)
+		})
+	})
+	if err != nil || sum == 0 {
+		return err
+	}
+	// The global version was the sum of all User versions, the counter continues above all of them
+	meta := tx.Bucket(boltBucketMeta)
+	current, _ := strconv.Atoi(string(meta.Get(boltKeyVersion)))
+	return meta.Put(boltKeyVersion, []byte(strconv.Itoa(current+sum)))
+}
+
+func (store *BoltProvider) Close() error {
+	return store.db.Close()
+}
+
+// Refresh reads the partition without Records, unless their schema version is outdated
+func (store *BoltProvider) Refresh(partition string) (StateV2, error) {
+	return store.refresh(partition, false)
+}
+
+// RefreshAll reads the global scope including all Records, e.g. to export or copy the whole State
+func (store *BoltProvider) RefreshAll() (StateV2, error) {
+	return store.refresh(ScopeGlobal, true)
+}
+
+func (store *BoltProvider) refresh(partition string, withRecords bool) (StateV2, error) {
+	state := StateV2{
+		Partition: partition,
+		Users:     []api.User{},
+		Jobs:      []api.Job{},
+		Templates: []api.RecordTemplate{},
+		Records:   []api.Record{},
+		Outbox:    []PendingRecord{},
+	}
+
+	schema := StateSchemaVersion
+	err := store.db.View(func(tx *bolt.Tx) error {
+		state.Version = boltVersion(tx, partition)
+
+		err := forEachBoltValue(tx.Bucket(boltBucketTemplates), func(value []byte) error {
+			var t api.RecordTemplate
+			err := json.Unmarshal(value, &t)
+			state.Templates = append(state.Templates, t)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		users := tx.Bucket(boltBucketUsers)
+		users.ForEach(func(name, _ []byte) error {
+			if version := boltSchemaVersion(users.Bucket(name)); inScope(string(name), partition) && version < schema {
+				schema = version
+			}
+			return nil
+		})
+		// Records of an outdated schema are read, so they are migrated with the rest of the partition
+		withRecords = withRecords || schema < StateSchemaVersion
+		return users.ForEach(func(name, _ []byte) error {
+			if !inScope(string(name), partition) {
+				return nil
+			}
+			return loadBoltPartition(users.Bucket(name), &state, withRecords)
+		})
+	})
+	if err != nil {
+		store.logger.Errorf("Error refreshing State: %v", err)
+		return StateV2{}, err
+	}
+	state, err = MigrateState(state, schema)
+	state.RecordsOmitted = !withRecords
+	return state, err
+}
+
+// SchemaVersions returns the schema version of every User
+func (store *BoltProvider) SchemaVersions() (map[string]int, error) {
+	versions := map[string]int{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucketUsers).ForEach(func(name, _ []byte) error {
+			versions[string(name)] = boltSchemaVersion(tx.Bucket(boltBucketUsers).Bucket(name))
+			return nil
+		})
+	})
+	return versions, err
+}
+
+// Save writes the partition in a single transaction. Every Save increments the global version, only Users, whose data changed, get a new version.
+// Without Records (see StateV2.RecordsOmitted), Records in the State are added or updated, but stored Records are not deleted
+func (store *BoltProvider) Save(partition string, state StateV2) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		if current := boltVersion(tx, partition); current != state.Version {
+			return VersionConflictError{Partition: partition, Expected: state.Version, Actual: current}
+		}
+
+		users := tx.Bucket(boltBucketUsers)
+		split := SplitByOwner(state)
+		changed := []string{}
+		if partition == ScopeGlobal {
+			// Users missing from the global scope are deleted, like in every other State. Users, whose Records were not read, keep their Records
+			deleted := [][]byte{}
+			users.ForEach(func(name, _ []byte) error {
+				if _, ok := split[string(name)]; ok {
+					return nil
+				}
+				if records := users.Bucket(name).Bucket(boltBucketRecords); state.RecordsOmitted && records != nil && hasBoltKeys(records) {
+					split[string(name)] = &StateV2{Partition: string(name)}
+					return nil
+				}
+				deleted = append(deleted, append([]byte{}, name...))
+				return nil
+			})
+			for _, name := range deleted {
+				if err := users.DeleteBucket(name); err != nil {
+					return err
+				}
+				changed = append(changed, string(name))
+			}
+		} else if _, ok := split[partition]; !ok {
+			split[partition] = &StateV2{Partition: partition}
+		}
+
+		for owner, data := range split {
+			if !inScope(owner, partition) {
+				continue
+			}
+			bucket, err := users.CreateBucketIfNotExists([]byte(owner))
+			if err != nil {
+				return err
+			}
+			ownerChanged, err := saveBoltPartition(bucket, *data, !state.RecordsOmitted)
+			if err != nil {
+				return err
+			}
+			if ownerChanged || owner == partition {
+				changed = append(changed, owner)
+			}
+		}
+
+		templates := map[string]interface{}{}
+		for _, t := range state.Templates {
+			templates[t.TemplateName] = t
+		}
+		if _, err := syncBoltBucket(tx.Bucket(boltBucketTemplates), templates); err != nil {
+			return err
+		}
+		return incrementBoltVersion(tx, changed...)
+	})
+	if err != nil {
+		store.logger.Errorf("Error saving State: %v", err)
+	}
+	return err
+}
+
+func (store *BoltProvider) SaveRecord(rec api.Record) (api.Record, error) {
+	if rec.Id == "" {
+		rec.Id = api.RecordId(rec.UserName, rec.JobName, rec.Start, rec.End)
+	}
+
+	saved := rec
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		user, err := createBoltUser(tx, rec.UserName)
+		if err != nil {
+			return err
+		}
+		if records := user.Bucket(boltBucketRecords); records != nil && records.Get([]byte(rec.Id)) != nil {
+			store.logger.Debugf("Record '%s' already saved", rec.Id)
+			return json.Unmarshal(records.Get([]byte(rec.Id)), &saved)
+		}
+		if _, err := putBoltRecord(user, rec); err != nil {
+			return err
+		}
+		return incrementBoltVersion(tx, rec.UserName)
+	})
+	if err != nil {
+		return api.Record{}, err
+	}
+	return saved, nil
+}
+
+// ListRecords decodes only the Records, that started between from and to, using the start time index
+func (store *BoltProvider) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	records := []api.Record{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucketUsers).Bucket([]byte(user))
+		if bucket == nil || bucket.Bucket(boltBucketStarts) == nil {
+			return nil
+		}
+		end := []byte(to.UTC().Format(boltStartFormat))
+		cursor := bucket.Bucket(boltBucketStarts).Cursor()
+		key, id := cursor.First()
+		if !from.IsZero() {
+			key, id = cursor.Seek([]byte(from.UTC().Format(boltStartFormat)))
+		}
+		for ; key != nil; key, id = cursor.Next() {
+			if !to.IsZero() && bytes.Compare(key[:len(end)], end) > 0 {
+				break
+			}
+			var rec api.Record
+			if err := json.Unmarshal(bucket.Bucket(boltBucketRecords).Get(id), &rec); err != nil {
+				return err
+			}
+			records = append(records, rec)
+		}
+		return nil
+	})
+	if err != nil {
+		return []api.Record{}, err
+	}
+	return records, nil
+}
+
+func (store *BoltProvider) UpdateRecord(rec api.Record) (api.Record, error) {
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		user, err := checkBoltRecordOwner(tx, rec)
+		if err != nil {
+			return err
+		}
+		if _, err := putBoltRecord(user, rec); err != nil {
+			return err
+		}
+		return incrementBoltVersion(tx, rec.UserName)
+	})
+	if err != nil {
+		return api.Record{}, err
+	}
+	return rec, nil
+}
+
+func (store *BoltProvider) DeleteRecord(rec api.Record) (api.Record, error) {
+	var deleted api.Record
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		user, err := checkBoltRecordOwner(tx, rec)
+		if err != nil {
+			return err
+		}
+		if deleted, err = deleteBoltRecord(user, []byte(rec.Id)); err != nil {
+			return err
+		}
+		return incrementBoltVersion(tx, rec.UserName)
+	})
+	if err != nil {
+		return api.Record{}, err
+	}
+	return deleted, nil
+}
+
+// checkBoltRecordOwner returns the bucket of the User, that owns the Record
+func checkBoltRecordOwner(tx *bolt.Tx, rec api.Record) (*bolt.Bucket, error) {
+	var owner *bolt.Bucket
+	var ownerName []byte
+	tx.Bucket(boltBucketUsers).ForEach(func(name, _ []byte) error {
+		records := tx.Bucket(boltBucketUsers).Bucket(name).Bucket(boltBucketRecords)
+		if records != nil && records.Get([]byte(rec.Id)) != nil {
+			owner = tx.Bucket(boltBucketUsers).Bucket(name)
+			ownerName = name
+		}
+		return nil
+	})
+	if owner == nil {
+		return nil, ProviderNotFound
+	}
+	if string(ownerName) != rec.UserName {
+		return nil, ProviderForbidden
+	}
+	return owner, nil
+}
+
+// boltVersion returns the version of a partition. The version of the global scope is the counter, that changes with every write
+func boltVersion(tx *bolt.Tx, partition string) string {
+	if partition == ScopeGlobal {
+		return string(tx.Bucket(boltBucketMeta).Get(boltKeyVersion))
+	}
+	return string(tx.Bucket(boltBucketVersions).Get([]byte(partition)))
+}
+
+// boltSchemaVersion returns the schema version of a User's bucket. Buckets written before schema versions were introduced have version 1
+func boltSchemaVersion(bucket *bolt.Bucket) int {
+	version, err := strconv.Atoi(string(bucket.Get(boltKeySchema)))
+	if err != nil || version < 1 {
+		return 1
+	}
+	return version
+}
+
+// incrementBoltVersion increments the global counter and sets it as the version of the changed Users
+func incrementBoltVersion(tx *bolt.Tx, users ...string) error {
+	meta := tx.Bucket(boltBucketMeta)
+	version := []byte(NextVersion(string(meta.Get(boltKeyVersion))))
+	if err := meta.Put(boltKeyVersion, version); err != nil {
+		return err
+	}
+	for _, name := range users {
+		if err := tx.Bucket(boltBucketVersions).Put([]byte(name), version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createBoltUser returns the bucket of a User. New buckets have the current schema version
+func createBoltUser(tx *bolt.Tx, name string) (*bolt.Bucket, error) {
+	if bucket := tx.Bucket(boltBucketUsers).Bucket([]byte(name)); bucket != nil {
+		return bucket, nil
+	}
+	bucket, err := tx.Bucket(boltBucketUsers).CreateBucket([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	return bucket, bucket.Put(boltKeySchema, []byte(strconv.Itoa(StateSchemaVersion)))
+}
+
+func hasBoltKeys(bucket *bolt.Bucket) bool {
+	key, _ := bucket.Cursor().First()
+	return key != nil
+}
+
+func boltStartKey(rec api.Record) []byte {
+	return []byte(rec.Start.UTC().Format(boltStartFormat) + "/" + rec.Id)
+}
+
+// putBoltRecord writes a Record and its start time index entry. It returns true, if the Record changed
+func putBoltRecord(user *bolt.Bucket, rec api.Record) (bool, error) {
+	records, err := user.CreateBucketIfNotExists(boltBucketRecords)
+	if err != nil {
+		return false, err
+	}
+	starts, err := user.CreateBucketIfNotExists(boltBucketStarts)
+	if err != nil {
+		return false, err
+	}
+	encoded, err := json.Marshal(rec)
+	if err != nil {
+		return false, err
+	}
+	existing := records.Get([]byte(rec.Id))
+	if bytes.Equal(existing, encoded) {
+		return false, nil
+	}
+	if existing != nil {
+		var previous api.Record
+		if err := json.Unmarshal(existing, &previous); err != nil {
+			return false, err
+		}
+		if err := starts.Delete(boltStartKey(previous)); err != nil {
+			return false, err
+		}
+	}
+	if err := starts.Put(boltStartKey(rec), []byte(rec.Id)); err != nil {
+		return false, err
+	}
+	return true, records.Put([]byte(rec.Id), encoded)
+}
+
+// deleteBoltRecord removes a Record and its start time index entry
+func deleteBoltRecord(user *bolt.Bucket, id []byte) (api.Record, error) {
+	var rec api.Record
+	if err := json.Unmarshal(user.Bucket(boltBucketRecords).Get(id), &rec); err != nil {
+		return rec, err
+	}
+	if err := user.Bucket(boltBucketStarts).Delete(boltStartKey(rec)); err != nil {
+		return rec, err
+	}
+	return rec, user.Bucket(boltBucketRecords).Delete(id)
+}
+
+// syncBoltRecords writes the Records of a User. With complete, stored Records, that are missing in records, are deleted.
+// It returns true, if anything changed
+func syncBoltRecords(user *bolt.Bucket, records []api.Record, complete bool) (bool, error) {
+	changed := false
+	if stored := user.Bucket(boltBucketRecords); complete && stored != nil {
+		keep := map[string]bool{}
+		for _, rec := range records {
+			keep[rec.Id] = true
+		}
+		deleted := [][]byte{}
+		stored.ForEach(func(id, _ []byte) error {
+			if !keep[string(id)] {
+				deleted = append(deleted, append([]byte{}, id...))
+			}
+			return nil
+		})
+		for _, id := range deleted {
+			changed = true
+			if _, err := deleteBoltRecord(user, id); err != nil {
+				return changed, err
+			}
+		}
+	}
+	for _, rec := range records {
+		recChanged, err := putBoltRecord(user, rec)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || recChanged
+	}
+	return changed, nil
+}
+
+func loadBoltPartition(bucket *bolt.Bucket, state *StateV2, withRecords bool) error {
+	if value := bucket.Get(boltKeyUser); value != nil {
+		var user api.User
+		if err := json.Unmarshal(value, &user); err != nil {
+			return err
+		}
+		state.Users = append(state.Users, user)
+	}
+
+	err := forEachBoltValue(bucket.Bucket(boltBucketJobs), func(value []byte) error {
+		var job api.Job
+		err := json.Unmarshal(value, &job)
+		state.Jobs = append(state.Jobs, job)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if withRecords {
+		err = forEachBoltValue(bucket.Bucket(boltBucketRecords), func(value []byte) error {
+			var rec api.Record
+			err := json.Unmarshal(value, &rec)
+			state.Records = append(state.Records, rec)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return forEachBoltValue(bucket.Bucket(boltBucketOutbox), func(value []byte) error {
+		var p PendingRecord
+		err := json.Unmarshal(value, &p)
+		state.Outbox = append(state.Outbox, p)
+		return err
+	})
+}
+
+// forEachBoltValue calls decode for every value in the bucket. A missing bucket has no values
+func forEachBoltValue(bucket *bolt.Bucket, decode func([]byte) error) error {
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(func(_, value []byte) error { return decode(value) })
+}
+
+// saveBoltPartition writes the data of a single User and returns true, if anything changed. Without completeRecords, no Records are deleted
+func saveBoltPartition(bucket *bolt.Bucket, data StateV2, completeRecords bool) (bool, error) {
+	changed := false
+	if boltSchemaVersion(bucket) != StateSchemaVersion {
+		changed = true
+		if err := bucket.Put(boltKeySchema, []byte(strconv.Itoa(StateSchemaVersion))); err != nil {
+			return changed, err
+		}
+	}
+	if len(data.Users) > 0 {
+		value, _ := json.Marshal(data.Users[0])
+		if !bytes.Equal(bucket.Get(boltKeyUser), value) {
+			changed = true
+			if err := bucket.Put(boltKeyUser, value); err != nil {
+				return changed, err
+			}
+		}
+	} else if bucket.Get(boltKeyUser) != nil {
+		changed = true
+		if err := bucket.Delete(boltKeyUser); err != nil {
+			return changed, err
+		}
+	}
+
+	jobs := map[string]interface{}{}
+	for _, j := range data.Jobs {
+		jobs[j.Name] = j
+	}
+	outbox := map[string]interface{}{}
+	for _, p := range data.Outbox {
+		outbox[p.Record.Id] = p
+	}
+
+	for name, values := range map[string]map[string]interface{}{string(boltBucketJobs): jobs, string(boltBucketOutbox): outbox} {
+		nested, err := bucket.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return changed, err
+		}
+		bucketChanged, err := syncBoltBucket(nested, values)
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || bucketChanged
+	}
+	recordsChanged, err := syncBoltRecords(bucket, data.Records, completeRecords)
+	return changed || recordsChanged, err
+}
+
+// syncBoltBucket writes changed values and deletes all keys, that are not in values. It returns true, if anything changed
+func syncBoltBucket(bucket *bolt.Bucket, values map[string]interface{}) (bool, error) {
+	changed := false
+	deleted := [][]byte{}
+	bucket.ForEach(func(key, _ []byte) error {
+		if _, ok := values[string(key)]; !ok {
+			deleted = append(deleted, append([]byte{}, key...))
+		}
+		return nil
+	})
+	for _, key := range deleted {
+		changed = true
+		if err := bucket.Delete(key); err != nil {
+			return changed, err
+		}
+	}
+
+	for key, value := range values {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return changed, err
+		}
+		if bytes.Equal(bucket.Get([]byte(key)), encoded) {
+			continue
+		}
+		changed = true
+		if err := bucket.Put([]byte(key), encoded); err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
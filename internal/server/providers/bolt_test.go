@@ -0,0 +1,216 @@
+package providers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+func NewBoltTestProvider(t *testing.T) *providers.BoltProvider {
+	logger, _ := zap.NewDevelopment()
+	store, err := providers.NewBoltProvider(*logger.Sugar(), filepath.Join(t.TempDir(), "timerec.bolt"))
+	if err != nil {
+		t.Fatalf("unable to create bolt provider: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestBoltStateRoundTrip(t *testing.T) {
+	store := NewBoltTestProvider(t)
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	state, _ := store.Refresh("me")
+	providers.CreateUser(&state, api.NewDefaultUser("me"))
+	providers.CreateJob(&state, api.Job{Name: "work", Owner: "me", Activities: []api.TimeEntry{{Comment: "first", Start: start, End: start.Add(time.Hour)}}})
+	state.Templates = append(state.Templates, api.RecordTemplate{TemplateName: "meeting", Title: "Meeting"})
+	providers.EnqueueRecord(&state, providers.PendingRecord{Record: api.Record{Id: "def", UserName: "me"}, Attempts: 1})
+	err := store.Save(state.Partition, state)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	other, _ := store.Refresh("other")
+	if len(other.Users) != 0 || len(other.Jobs) != 0 || len(other.Templates) != 1 {
+		t.Fatalf("incorrect state for other user: %v", other)
+	}
+
+	loaded, _ := store.Refresh("me")
+	if len(loaded.Users) != 1 || loaded.Users[0].Settings.RoundTo != state.Users[0].Settings.RoundTo {
+		t.Fatalf("incorrect users: got %v expected %v", loaded.Users, state.Users)
+	}
+	if len(loaded.Jobs) != 1 || !loaded.Jobs[0].Activities[0].Start.Equal(start) || len(loaded.Outbox) != 1 {
+		t.Fatalf("incorrect state: %v", loaded)
+	}
+
+	providers.DeleteJob(&loaded, api.Job{Name: "work", Owner: "me"})
+	store.Save(loaded.Partition, loaded)
+	global, _ := store.Refresh(providers.ScopeGlobal)
+	if len(global.Users) != 1 || len(global.Jobs) != 0 {
+		t.Fatalf("incorrect global state: %v", global)
+	}
+}
+
+func TestBoltRecords(t *testing.T) {
+	store := NewBoltTestProvider(t)
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	rec := api.Record{Id: "abc", UserName: "me", Title: "title", Start: start, End: start.Add(time.Hour)}
+	store.SaveRecord(rec)
+	store.SaveRecord(rec)
+
+	records, err := store.ListRecords("me", start.Add(-time.Hour), start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(records) != 1 || !records[0].Start.Equal(start) {
+		t.Fatalf("incorrect records: %v", records)
+	}
+
+	_, err = store.UpdateRecord(api.Record{Id: "abc", UserName: "other", Title: "stolen"})
+	if !errors.Is(err, providers.ProviderForbidden) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderForbidden)
+	}
+	deleted, err := store.DeleteRecord(api.Record{Id: "abc", UserName: "me"})
+	if err != nil || deleted.Title != "title" {
+		t.Fatalf("incorrect delete: got %v, %v", deleted, err)
+	}
+	_, err = store.DeleteRecord(api.Record{Id: "abc", UserName: "me"})
+	if !errors.Is(err, providers.ProviderNotFound) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderNotFound)
+	}
+}
+
+func TestBoltDetectsConcurrentChanges(t *testing.T) {
+	store := NewBoltTestProvider(t)
+
+	first, _ := store.Refresh("me")
+	second, _ := store.Refresh("me")
+	providers.CreateUser(&first, api.NewDefaultUser("me"))
+	if err := store.Save(first.Partition, first); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err := store.Save(second.Partition, second)
+	if !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+
+	// Changes through the global scope change the version of the User as well
+	loaded, _ := store.Refresh("me")
+	global, _ := store.Refresh(providers.ScopeGlobal)
+	providers.CreateJob(&global, api.Job{Name: "work", Owner: "me"})
+	store.Save(global.Partition, global)
+	if err := store.Save(loaded.Partition, loaded); !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+}
+
+func TestBoltVersionsAreNeverReused(t *testing.T) {
+	store := NewBoltTestProvider(t)
+
+	stale, _ := store.Refresh("me")
+	created, _ := store.Refresh("me")
+	providers.CreateUser(&created, api.NewDefaultUser("me"))
+	store.Save(created.Partition, created)
+
+	// Deleting the User must not bring back the version, that stale was read with
+	global, _ := store.Refresh(providers.ScopeGlobal)
+	global.Users = []api.User{}
+	if err := store.Save(global.Partition, global); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := store.Save(stale.Partition, stale); !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+
+	staleGlobal, _ := store.Refresh(providers.ScopeGlobal)
+	store.SaveRecord(api.Record{Id: "abc", UserName: "me"})
+	store.DeleteRecord(api.Record{Id: "abc", UserName: "me"})
+	if err := store.Save(staleGlobal.Partition, staleGlobal); !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+}
+
+func TestBoltRefreshOmitsRecords(t *testing.T) {
+	store := NewBoltTestProvider(t)
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	store.SaveRecord(api.Record{Id: "march", UserName: "me", Start: start, End: start.Add(time.Hour)})
+	store.SaveRecord(api.Record{Id: "april", UserName: "me", Start: start.AddDate(0, 1, 0), End: start.AddDate(0, 1, 0).Add(time.Hour)})
+
+	state, _ := store.Refresh("me")
+	if len(state.Records) != 0 || !state.RecordsOmitted {
+		t.Fatalf("expected no records, got %v", state.Records)
+	}
+	providers.CreateUser(&state, api.NewDefaultUser("me"))
+	if err := store.Save(state.Partition, state); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	global, _ := store.Refresh(providers.ScopeGlobal)
+	global.Users = []api.User{}
+	store.Save(global.Partition, global)
+
+	records, _ := store.ListRecords("me", start.Add(-time.Hour), start.AddDate(0, 0, 7))
+	if len(records) != 1 || records[0].Id != "march" {
+		t.Fatalf("incorrect records: %v", records)
+	}
+	records, _ = store.ListRecords("me", time.Time{}, time.Time{})
+	if len(records) != 2 || records[0].Id != "march" {
+		t.Fatalf("incorrect records: %v", records)
+	}
+
+	// A complete State replaces the stored Records
+	all, _ := store.RefreshAll()
+	if len(all.Records) != 2 || all.RecordsOmitted {
+		t.Fatalf("incorrect records: %v", all.Records)
+	}
+	all.Records = all.Records[:1]
+	all.Records[0].Start = all.Records[0].Start.AddDate(1, 0, 0)
+	if err := store.Save(all.Partition, all); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	records, _ = store.ListRecords("me", time.Time{}, time.Time{})
+	if len(records) != 1 || !records[0].Start.Equal(all.Records[0].Start) {
+		t.Fatalf("incorrect records: %v", records)
+	}
+}
+
+func TestBoltUpgradesLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "timerec.bolt")
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	db, _ := bolt.Open(path, 0600, nil)
+	db.Update(func(tx *bolt.Tx) error {
+		users, _ := tx.CreateBucket([]byte("users"))
+		me, _ := users.CreateBucket([]byte("me"))
+		me.Put([]byte("version"), []byte("3"))
+		me.Put([]byte("schema"), []byte("2"))
+		records, _ := me.CreateBucket([]byte("records"))
+		encoded, _ := json.Marshal(api.Record{Id: "abc", UserName: "me", Start: start, End: start.Add(time.Hour)})
+		return records.Put([]byte("abc"), encoded)
+	})
+	db.Close()
+
+	logger, _ := zap.NewDevelopment()
+	store, err := providers.NewBoltProvider(*logger.Sugar(), path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer store.Close()
+
+	state, _ := store.Refresh("me")
+	global, _ := store.Refresh(providers.ScopeGlobal)
+	if state.Version != "3" || global.Version != "3" {
+		t.Fatalf("incorrect versions: got %s and %s expected 3", state.Version, global.Version)
+	}
+	records, _ := store.ListRecords("me", start, start)
+	if len(records) != 1 {
+		t.Fatalf("incorrect records: %v", records)
+	}
+}
@@ -0,0 +1,83 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+// ChatDefaultExtension is how long the "Extend" action extends an Activity, unless the User has a DefaultEstimate
+const ChatDefaultExtension time.Duration = 30 * time.Minute
+
+// SettingsLookup returns the Settings of a User. NotificationServices use it to find the channels of a User
+type SettingsLookup func(user string) (api.Settings, error)
+
+// chatTitle is the headline of a Message
+func chatTitle(msg api.Message) string {
+	switch msg.Event {
+	case api.EventTypeTimerExpired:
+		if name := msg.ActivityName(); name != "" {
+			return fmt.Sprintf("Timer expired: %s", name)
+		}
+		return "Timer expired"
+	case api.EventTypeNoEntryAlarm:
+		return "Nothing recorded yet"
+	}
+	return "Timerec"
+}
+
+// shortDuration formats a duration without zero units, e.g. "1h30m" instead of "1h30m0s"
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// postJson sends a JSON payload, e.g. to an incoming webhook. header is added to the request
+func postJson(client *http.Client, target string, header http.Header, payload interface{}) error {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func validateUrl(kind, raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid %s '%s'", kind, raw)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package providers_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// chatSink records the JSON payloads posted to an incoming webhook
+type chatSink struct {
+	payloads []map[string]interface{}
+	requests []*http.Request
+}
+
+func (sink *chatSink) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var payload map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		rw.WriteHeader(400)
+		return
+	}
+	sink.payloads = append(sink.payloads, payload)
+	sink.requests = append(sink.requests, r)
+	rw.Write([]byte("ok"))
+}
+
+func chatSettings(settings api.Settings) providers.SettingsLookup {
+	return func(user string) (api.Settings, error) {
+		if user != "me" {
+			return api.Settings{}, providers.ProviderNotFound
+		}
+		return settings, nil
+	}
+}
+
+func testActionLinks() *providers.ActionLinks {
+	links, _ := providers.NewActionLinks("https://timerec.example.com/", "secret")
+	return links
+}
+
+func TestActionLinksAreSigned(t *testing.T) {
+	links := testActionLinks()
+	expires := time.Now().Add(time.Hour)
+	link, _ := url.Parse(links.Url("me", "extend", "30m0s", expires))
+	query := link.Query()
+	if link.Path != "/actions/me/activity/extend" || query.Get("estimate") != "30m0s" {
+		t.Fatalf("incorrect link: %s", link)
+	}
+	if err := links.Verify("me", "extend", "30m0s", query.Get("expires"), query.Get("sig"), time.Now()); err != nil {
+		t.Fatalf("expected a valid link, got %v", err)
+	}
+
+	tests := map[string][]string{
+		"other user":     {"other", "extend", "30m0s", query.Get("expires")},
+		"other action":   {"me", "finish", "30m0s", query.Get("expires")},
+		"other estimate": {"me", "extend", "8h", query.Get("expires")},
+		"later expiry":   {"me", "extend", "30m0s", fmt.Sprint(expires.Add(time.Hour).Unix())},
+	}
+	for name, params := range tests {
+		if err := links.Verify(params[0], params[1], params[2], params[3], query.Get("sig"), time.Now()); err != providers.ErrActionLinkInvalid {
+			t.Errorf("%s: expected an invalid link, got %v", name, err)
+		}
+	}
+	if err := links.Verify("me", "extend", "30m0s", query.Get("expires"), query.Get("sig"), expires.Add(time.Minute)); err != providers.ErrActionLinkInvalid {
+		t.Errorf("expected an expired link, got %v", err)
+	}
+}
+
+func TestSlackRendersActions(t *testing.T) {
+	sink := &chatSink{}
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	settings := api.NewDefaultUser("me").Settings
+	settings.Notifications.Slack = api.SlackSettings{WebhookUrl: server.URL, Mention: "U123"}
+	logger, _ := zap.NewDevelopment()
+	slack, err := providers.NewSlackProvider(*logger.Sugar(), "", testActionLinks(), chatSettings(settings))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	err = slack.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@work", "me"))
+	if err != nil || len(sink.payloads) != 1 {
+		t.Fatalf("expected one message, got %v, %v", sink.payloads, err)
+	}
+	payload := sink.payloads[0]
+	if _, ok := payload["channel"]; ok {
+		t.Fatalf("unexpected channel: %v", payload["channel"])
+	}
+	blocks := payload["blocks"].([]interface{})
+	text := blocks[0].(map[string]interface{})["text"].(map[string]interface{})["text"].(string)
+	if !strings.HasPrefix(text, "<@U123> *Timer expired: work*") {
+		t.Fatalf("incorrect text: %q", text)
+	}
+	buttons := blocks[1].(map[string]interface{})["elements"].([]interface{})
+	extend := buttons[0].(map[string]interface{})
+	if !strings.HasPrefix(extend["url"].(string), "https://timerec.example.com/actions/me/activity/extend?estimate=1h0m0s&expires=") {
+		t.Fatalf("incorrect extend url: %v", extend["url"])
+	}
+
+	// Messages without an Activity have no actions
+	slack.NotifyUser(api.MakeMessageEvent(api.EventTypeNoEntryAlarm, "No entry today", "activity@none", "me"))
+	if blocks := sink.payloads[1]["blocks"].([]interface{}); len(blocks) != 1 {
+		t.Fatalf("incorrect number of blocks: got %d expected %d", len(blocks), 1)
+	}
+}
+
+func TestMattermostUsesServerWebhook(t *testing.T) {
+	sink := &chatSink{}
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	mattermost, _ := providers.NewMattermostProvider(*logger.Sugar(), server.URL, testActionLinks(), chatSettings(api.Settings{}))
+	err := mattermost.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@work", "me"))
+	if err != nil || len(sink.payloads) != 1 {
+		t.Fatalf("expected one message, got %v, %v", sink.payloads, err)
+	}
+	attachment := sink.payloads[0]["attachments"].([]interface{})[0].(map[string]interface{})
+	actions := attachment["actions"].([]interface{})
+	finish := actions[1].(map[string]interface{})["integration"].(map[string]interface{})
+	if attachment["title"] != "Timer expired: work" || !strings.HasPrefix(finish["url"].(string), "https://timerec.example.com/actions/me/activity/finish?expires=") {
+		t.Fatalf("incorrect attachment: %v", attachment)
+	}
+
+	if err := mattermost.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "expired", "", "other")); err == nil {
+		t.Fatal("expected an error for an unknown User")
+	}
+}
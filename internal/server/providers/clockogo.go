@@ -1,4 +1,365 @@
 package providers
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+const (
+	ClockodoDefaultUrl    string = "https://my.clockodo.com"
+	ClockodoHeaderUser    string = "X-ClockodoApiUser"
+	ClockodoHeaderKey     string = "X-ClockodoApiKey"
+	ClockodoHeaderAppName string = "X-Clockodo-External-Application"
+)
+
+// Clockodo is a TimeService writing Records as time entries to the Clockodo REST API.
+// Record.Project is mapped to a Clockodo customer, Record.Task to a service
 type Clockodo struct {
+	Url    string
+	User   string
+	ApiKey string
+
+	client *http.Client
+	logger *zap.SugaredLogger
+}
+
+type clockodoNamedItem struct {
+	Id     int    `json:"id"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+type clockodoEntry struct {
+	Id          int    `json:"id,omitempty"`
+	CustomersId int    `json:"customers_id"`
+	ServicesId  int    `json:"services_id"`
+	Billable    int    `json:"billable"`
+	TimeSince   string `json:"time_since"`
+	TimeUntil   string `json:"time_until"`
+	Text        string `json:"text,omitempty"`
+}
+
+type clockodoError struct {
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func NewClockodoProvider(logger zap.SugaredLogger, url, user, apiKey string) (*Clockodo, error) {
+	if user == "" || apiKey == "" {
+		return nil, fmt.Errorf("clockodo requires an api user and key")
+	}
+	if url == "" {
+		url = ClockodoDefaultUrl
+	}
+
+	return &Clockodo{
+		Url:    strings.TrimSuffix(url, "/"),
+		User:   user,
+		ApiKey: apiKey,
+		client: &http.Client{Timeout: 30 * time.Second},
+		logger: logger.Named("Clockodo"),
+	}, nil
+}
+
+func (c *Clockodo) SaveRecord(rec api.Record) (api.Record, error) {
+	existing, err := c.findExisting(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	if existing != 0 {
+		c.logger.Infof("Entry %d for '%s' already exists", existing, rec.Title)
+		return rec, nil
+	}
+
+	entry, err := c.entryFromRecord(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	entry.Text = RecordTextWithId(rec)
+	var created struct {
+		Entry clockodoEntry `json:"entry"`
+	}
+	err = c.request(http.MethodPost, "/api/v2/entries", entry, &created)
+	if err != nil {
+		return api.Record{}, err
+	}
+
+	c.logger.Infof("Created entry %d for '%s'", created.Entry.Id, rec.Title)
+	return rec, nil
+}
+
+// ListRecords returns the entries of the Clockodo api user, that were saved for the User. Record.Id is the Id in the marker of the entry
+func (c *Clockodo) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	customers, err := c.listNamed("/api/v2/customers", "customers")
+	if err != nil {
+		return []api.Record{}, err
+	}
+	services, err := c.listNamed("/api/v2/services", "services")
+	if err != nil {
+		return []api.Record{}, err
+	}
+
+	entries, err := c.listEntries(from, to)
+	if err != nil {
+		return []api.Record{}, err
+	}
+
+	records := []api.Record{}
+	for _, entry := range entries {
+		if RecordOwnerFromText(entry.Text) != user {
+			continue
+		}
+		start, _ := time.Parse(time.RFC3339, entry.TimeSince)
+		end, _ := time.Parse(time.RFC3339, entry.TimeUntil)
+		title, desc := SplitRecordText(entry.Text)
+		records = append(records, api.Record{
+			Id:          RecordIdFromText(entry.Text),
+			UserName:    user,
+			Title:       title,
+			Description: desc,
+			Project:     customers[entry.CustomersId],
+			Task:        services[entry.ServicesId],
+			Start:       start,
+			End:         end,
+		})
+	}
+	return records, nil
+}
+
+func (c *Clockodo) listEntries(from, to time.Time) ([]clockodoEntry, error) {
+	entries := []clockodoEntry{}
+	for page, pageCount := 1, 1; page <= pageCount; page++ {
+		var list struct {
+			Entries []clockodoEntry `json:"entries"`
+			Paging  struct {
+				CountPages int `json:"count_pages"`
+			} `json:"paging"`
+		}
+		query := url.Values{}
+		query.Set("time_since", from.UTC().Format(time.RFC3339))
+		query.Set("time_until", to.UTC().Format(time.RFC3339))
+		query.Set("page", strconv.Itoa(page))
+		err := c.request(http.MethodGet, "/api/v2/entries?"+query.Encode(), nil, &list)
+		if err != nil {
+			return []clockodoEntry{}, err
+		}
+		pageCount = list.Paging.CountPages
+		entries = append(entries, list.Entries...)
+	}
+	return entries, nil
+}
+
+// findExisting returns the ID of an entry, that was already created for the Record or 0
+func (c *Clockodo) findExisting(rec api.Record) (int, error) {
+	if rec.Id == "" {
+		return 0, nil
+	}
+	entries, err := c.listEntries(rec.Start, rec.End)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if RecordIdFromText(entry.Text) == rec.Id {
+			return entry.Id, nil
+		}
+	}
+	return 0, nil
+}
+
+// entryId returns the ID of the Clockodo entry of a Record. The entry is found by the Id in its marker, IDs of Clockodo entries
+// (e.g. of Records listed by older versions) are used directly
+func (c *Clockodo) entryId(rec api.Record) (string, error) {
+	if rec.Id == "" {
+		return "", fmt.Errorf("clockodo entry of a record without id: %w", ProviderNotFound)
+	}
+	entries, err := c.listEntries(RecordLookupRange(rec))
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if RecordIdFromText(entry.Text) == rec.Id {
+			return strconv.Itoa(entry.Id), nil
+		}
+	}
+	return rec.Id, nil
+}
+
+// checkOwner returns the entry of the Record, if it belongs to the User of the Record
+func (c *Clockodo) checkOwner(id string, rec api.Record) (clockodoEntry, error) {
+	var existing struct {
+		Entry clockodoEntry `json:"entry"`
+	}
+	err := c.request(http.MethodGet, "/api/v2/entries/"+url.PathEscape(id), nil, &existing)
+	if err != nil {
+		return clockodoEntry{}, err
+	}
+	return existing.Entry, CheckRecordOwner(existing.Entry.Text, rec)
+}
+
+func (c *Clockodo) UpdateRecord(rec api.Record) (api.Record, error) {
+	id, err := c.entryId(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	existing, err := c.checkOwner(id, rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	entry, err := c.entryFromRecord(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	entry.Text = KeepRecordMarker(entry.Text, existing.Text)
+	err = c.request(http.MethodPut, "/api/v2/entries/"+url.PathEscape(id), entry, nil)
+	if err != nil {
+		return api.Record{}, err
+	}
+	c.logger.Infof("Updated entry %s for '%s'", id, rec.Title)
+	return rec, nil
+}
+
+func (c *Clockodo) DeleteRecord(rec api.Record) (api.Record, error) {
+	id, err := c.entryId(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	if _, err := c.checkOwner(id, rec); err != nil {
+		return api.Record{}, err
+	}
+	err = c.request(http.MethodDelete, "/api/v2/entries/"+url.PathEscape(id), nil, nil)
+	if err != nil {
+		return api.Record{}, err
+	}
+	c.logger.Infof("Deleted entry %s", id)
+	return rec, nil
+}
+
+func (c *Clockodo) entryFromRecord(rec api.Record) (clockodoEntry, error) {
+	customer, err := c.findByName("/api/v2/customers", "customers", rec.Project)
+	if err != nil {
+		return clockodoEntry{}, err
+	}
+	service, err := c.findByName("/api/v2/services", "services", rec.Task)
+	if err != nil {
+		return clockodoEntry{}, err
+	}
+
+	return clockodoEntry{
+		CustomersId: customer.Id,
+		ServicesId:  service.Id,
+		Billable:    1,
+		TimeSince:   rec.Start.UTC().Format(time.RFC3339),
+		TimeUntil:   rec.End.UTC().Format(time.RFC3339),
+		Text:        RecordText(rec),
+	}, nil
+}
+
+func (c *Clockodo) findByName(path, key, name string) (clockodoNamedItem, error) {
+	items, err := c.listItems(path, key)
+	if err != nil {
+		return clockodoNamedItem{}, err
+	}
+
+	for _, item := range items {
+		if item.Active && strings.EqualFold(item.Name, name) {
+			return item, nil
+		}
+	}
+	return clockodoNamedItem{}, fmt.Errorf("clockodo %s '%s': %w", key, name, ProviderNotFound)
+}
+
+// listNamed returns a lookup table from ID to name
+func (c *Clockodo) listNamed(path, key string) (map[int]string, error) {
+	items, err := c.listItems(path, key)
+	if err != nil {
+		return map[int]string{}, err
+	}
+
+	names := map[int]string{}
+	for _, item := range items {
+		names[item.Id] = item.Name
+	}
+	return names, nil
+}
+
+// listItems returns the customers or services from all pages of the list
+func (c *Clockodo) listItems(path, key string) ([]clockodoNamedItem, error) {
+	items := []clockodoNamedItem{}
+	for page, pageCount := 1, 1; page <= pageCount; page++ {
+		var list map[string]json.RawMessage
+		err := c.request(http.MethodGet, path+"?page="+strconv.Itoa(page), nil, &list)
+		if err != nil {
+			return []clockodoNamedItem{}, err
+		}
+		var pageItems []clockodoNamedItem
+		var paging struct {
+			CountPages int `json:"count_pages"`
+		}
+		if raw, ok := list[key]; ok {
+			if err := json.Unmarshal(raw, &pageItems); err != nil {
+				return []clockodoNamedItem{}, fmt.Errorf("clockodo %s: %w", key, err)
+			}
+		}
+		if raw, ok := list["paging"]; ok {
+			json.Unmarshal(raw, &paging)
+		}
+		pageCount = paging.CountPages
+		items = append(items, pageItems...)
+	}
+	return items, nil
+}
+
+func (c *Clockodo) request(method, path string, body interface{}, out interface{}) error {
+	var payload bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&payload).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, c.Url+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ClockodoHeaderUser, c.User)
+	req.Header.Set(ClockodoHeaderKey, c.ApiKey)
+	req.Header.Set(ClockodoHeaderAppName, "timerec;"+c.User)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.logger.Warnf("Request %s %s failed: %v", method, path, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var clockodoErr clockodoError
+		json.Unmarshal(content, &clockodoErr)
+		c.logger.Warnf("Request %s %s returned %s: %s", method, path, resp.Status, string(content))
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("clockodo returned %s: %w", resp.Status, ProviderNotFound)
+		}
+		return fmt.Errorf("clockodo returned %s: %s", resp.Status, clockodoErr.Error.Message)
+	}
+
+	if out == nil || len(content) == 0 {
+		return nil
+	}
+	return json.Unmarshal(content, out)
 }
@@ -0,0 +1,201 @@
+package providers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+	"go.uber.org/zap"
+)
+
+func NewClockodoTestServer(entries *[]map[string]interface{}) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/customers", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(providers.ClockodoHeaderKey) != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			rw.Write([]byte(`{"error": {"message": "invalid credentials"}}`))
+			return
+		}
+		// Customers are split over two pages, services are not paged
+		if r.URL.Query().Get("page") == "2" {
+			rw.Write([]byte(`{"customers": [{"id": 2, "name": "ACME", "active": true}], "paging": {"count_pages": 2}}`))
+			return
+		}
+		rw.Write([]byte(`{"customers": [{"id": 1, "name": "Inactive", "active": false}], "paging": {"count_pages": 2}}`))
+	})
+	mux.HandleFunc("/api/v2/services", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`{"services": [{"id": 7, "name": "Development", "active": true}]}`))
+	})
+	mux.HandleFunc("/api/v2/entries", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			rw.Write([]byte(`{"entries": [` + clockodoTestEntries[99] + `, ` + clockodoTestEntries[98] + `, ` + clockodoTestEntries[97] + `], "paging": {"count_pages": 1}}`))
+			return
+		}
+		entry := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&entry)
+		*entries = append(*entries, entry)
+		rw.Write([]byte(`{"entry": {"id": 99}}`))
+	})
+	mux.HandleFunc("/api/v2/entries/", func(rw http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/v2/entries/"))
+		entry, ok := clockodoTestEntries[id]
+		if !ok {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			rw.Write([]byte(`{"entry": ` + entry + `}`))
+			return
+		}
+		change := map[string]interface{}{"method": r.Method, "id": float64(id)}
+		json.NewDecoder(r.Body).Decode(&change)
+		*entries = append(*entries, change)
+		rw.Write([]byte(`{"entry": ` + entry + `}`))
+	})
+	return httptest.NewServer(mux)
+}
+
+// clockodoTestEntries are saved by the Users "me" and "other" and created in Clockodo directly
+var clockodoTestEntries = map[int]string{
+	99: `{"id": 99, "customers_id": 2, "services_id": 7, "time_since": "2022-03-01T09:00:00Z", "time_until": "2022-03-01T10:00:00Z", "text": "TICKET-13\nfixed it\ntimerec:me/abc"}`,
+	98: `{"id": 98, "customers_id": 2, "services_id": 7, "time_since": "2022-03-01T10:00:00Z", "time_until": "2022-03-01T11:00:00Z", "text": "TICKET-14\ntimerec:other/def"}`,
+	97: `{"id": 97, "customers_id": 2, "services_id": 7, "time_since": "2022-03-01T11:00:00Z", "time_until": "2022-03-01T12:00:00Z", "text": "Meeting"}`,
+}
+
+func TestClockodoSaveRecord(t *testing.T) {
+	entries := []map[string]interface{}{}
+	srv := NewClockodoTestServer(&entries)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	clockodo, _ := providers.NewClockodoProvider(*logger.Sugar(), srv.URL, "me@example.com", "secret")
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	_, err := clockodo.SaveRecord(api.Record{
+		Title:       "TICKET-13",
+		Description: "fixed it",
+		Project:     "acme",
+		Task:        "Development",
+		Start:       start,
+		End:         start.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("incorrect number of entries: got %d expected %d", len(entries), 1)
+	}
+	if entries[0]["customers_id"] != float64(2) || entries[0]["services_id"] != float64(7) {
+		t.Fatalf("incorrect customer/service mapping: %v", entries[0])
+	}
+	if entries[0]["time_since"] != "2022-03-01T09:00:00Z" || entries[0]["text"] != "TICKET-13\nfixed it" {
+		t.Fatalf("incorrect entry: %v", entries[0])
+	}
+}
+
+func TestClockodoSaveRecordUnknownCustomer(t *testing.T) {
+	entries := []map[string]interface{}{}
+	srv := NewClockodoTestServer(&entries)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	clockodo, _ := providers.NewClockodoProvider(*logger.Sugar(), srv.URL, "me@example.com", "secret")
+
+	_, err := clockodo.SaveRecord(api.Record{Title: "TICKET-13", Project: "Inactive", Task: "Development"})
+	if err == nil {
+		t.Fatal("expected error for inactive customer, got nil")
+	}
+	if len(entries) != 0 {
+		t.Fatalf("incorrect number of entries: got %d expected %d", len(entries), 0)
+	}
+}
+
+func TestClockodoReportsApiError(t *testing.T) {
+	entries := []map[string]interface{}{}
+	srv := NewClockodoTestServer(&entries)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	clockodo, _ := providers.NewClockodoProvider(*logger.Sugar(), srv.URL, "me@example.com", "wrong")
+
+	_, err := clockodo.SaveRecord(api.Record{Title: "TICKET-13", Project: "ACME", Task: "Development"})
+	if err == nil {
+		t.Fatal("expected error for invalid credentials, got nil")
+	}
+}
+
+func TestClockodoListRecords(t *testing.T) {
+	entries := []map[string]interface{}{}
+	srv := NewClockodoTestServer(&entries)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	clockodo, _ := providers.NewClockodoProvider(*logger.Sugar(), srv.URL, "me@example.com", "secret")
+
+	records, err := clockodo.ListRecords("me", time.Now().Add(-time.Hour), time.Now())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("incorrect number of records: got %d expected %d", len(records), 1)
+	}
+	rec := records[0]
+	if rec.Id != "abc" || rec.Project != "ACME" || rec.Task != "Development" || rec.Title != "TICKET-13" || rec.Description != "fixed it" {
+		t.Fatalf("incorrect record: %v", rec)
+	}
+}
+
+func TestClockodoSkipsSavedRecord(t *testing.T) {
+	entries := []map[string]interface{}{}
+	srv := NewClockodoTestServer(&entries)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	clockodo, _ := providers.NewClockodoProvider(*logger.Sugar(), srv.URL, "me@example.com", "secret")
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	rec, err := clockodo.SaveRecord(api.Record{Id: "abc", UserName: "me", Title: "TICKET-13", Project: "ACME", Task: "Development", Start: start, End: start.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(entries) != 0 || rec.Id != "abc" {
+		t.Fatalf("incorrect save: got %d new entries and id %s expected 0 and abc", len(entries), rec.Id)
+	}
+}
+
+func TestClockodoChecksRecordOwner(t *testing.T) {
+	entries := []map[string]interface{}{}
+	srv := NewClockodoTestServer(&entries)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	clockodo, _ := providers.NewClockodoProvider(*logger.Sugar(), srv.URL, "me@example.com", "secret")
+
+	start := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	for _, id := range []string{"98", "97", "def"} {
+		_, err := clockodo.UpdateRecord(api.Record{Id: id, UserName: "me", Title: "TICKET-14", Project: "ACME", Task: "Development", Start: start, End: start.Add(time.Hour)})
+		if !errors.Is(err, providers.ProviderForbidden) {
+			t.Fatalf("expected %v updating entry %s, got %v", providers.ProviderForbidden, id, err)
+		}
+		if _, err := clockodo.DeleteRecord(api.Record{Id: id, UserName: "me"}); !errors.Is(err, providers.ProviderForbidden) {
+			t.Fatalf("expected %v deleting entry %s, got %v", providers.ProviderForbidden, id, err)
+		}
+	}
+	if len(entries) != 0 {
+		t.Fatalf("entries of other Users were changed: %v", entries)
+	}
+
+	// Records are identified by the Id in the marker, the ID of the entry is accepted as well
+	for i, id := range []string{"abc", "99"} {
+		if _, err := clockodo.DeleteRecord(api.Record{Id: id, UserName: "me"}); err != nil || len(entries) != i+1 || entries[i]["method"] != http.MethodDelete || entries[i]["id"] != float64(99) {
+			t.Fatalf("expected the entry of the User to be deleted, got %v, %v", entries, err)
+		}
+	}
+}
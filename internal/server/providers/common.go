@@ -1,6 +1,11 @@
 package providers
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/thomasbuchinger/timerec/api"
 )
 
@@ -19,12 +24,109 @@ func (prov ProviderReturnType) Error() string {
 	return string(prov)
 }
 
+// StateV2 is the State of a single partition. Version is set by Refresh and checked by Save, to detect concurrent changes
 type StateV2 struct {
 	Partition string
+	Version   string
 	Users     []api.User
 	Jobs      []api.Job
 	Templates []api.RecordTemplate
 	Records   []api.Record
+	Outbox    []PendingRecord
+	// Schema is the schema version of a stored partition (see StateSchemaVersion). It is only used by providers, that store partitions as documents
+	Schema int `yaml:",omitempty" json:",omitempty"`
+	// RecordsOmitted is set by providers, that do not read Records in Refresh (see BoltProvider). Their Records are read with ListRecords
+	// and Save keeps stored Records, that are missing in the State
+	RecordsOmitted bool `yaml:"-" json:"-"`
+}
+
+// DeepCopy returns a copy, that shares no slices with the original. Callers modify the State in place
+func (state StateV2) DeepCopy() StateV2 {
+	copied := state
+	copied.Users = append([]api.User(nil), state.Users...)
+	for i, user := range copied.Users {
+		copied.Users[i].Settings.Weekdays = append([]string(nil), user.Settings.Weekdays...)
+		if user.Settings.Notifications.Channels != nil {
+			channels := map[api.EventType][]string{}
+			for event, names := range user.Settings.Notifications.Channels {
+				channels[event] = append([]string{}, names...)
+			}
+			copied.Users[i].Settings.Notifications.Channels = channels
+		}
+		if user.Notified != nil {
+			notified := map[string]time.Time{}
+			for key, at := range user.Notified {
+				notified[key] = at
+			}
+			copied.Users[i].Notified = notified
+		}
+	}
+	copied.Jobs = append([]api.Job(nil), state.Jobs...)
+	for i, job := range copied.Jobs {
+		copied.Jobs[i].Activities = append([]api.TimeEntry(nil), job.Activities...)
+	}
+	copied.Templates = append([]api.RecordTemplate(nil), state.Templates...)
+	copied.Records = append([]api.Record(nil), state.Records...)
+	copied.Outbox = append([]PendingRecord(nil), state.Outbox...)
+	for i, p := range copied.Outbox {
+		copied.Outbox[i].Confirmed = append([]string(nil), p.Confirmed...)
+	}
+	return copied
+}
+
+// VersionConflictError is returned by Save, if the partition was changed since the State was refreshed
+type VersionConflictError struct {
+	Partition string
+	Expected  string
+	Actual    string
+}
+
+func (e VersionConflictError) Error() string {
+	return fmt.Sprintf("partition '%s' was changed concurrently (expected version '%s', found '%s')", e.Partition, e.Expected, e.Actual)
+}
+
+func (e VersionConflictError) Unwrap() error {
+	return ProviderConflict
+}
+
+// NextVersion increments a version counter. An empty version means the partition was never saved
+func NextVersion(version string) string {
+	n, _ := strconv.Atoi(version)
+	return strconv.Itoa(n + 1)
+}
+
+// SplitByOwner assigns Users, Jobs, Records and pending Records to the partition of their owner. Templates are not assigned to any partition
+func SplitByOwner(state StateV2) map[string]*StateV2 {
+	split := map[string]*StateV2{}
+	get := func(owner string) *StateV2 {
+		if _, ok := split[owner]; !ok {
+			split[owner] = &StateV2{Partition: owner}
+		}
+		return split[owner]
+	}
+
+	for _, u := range state.Users {
+		get(u.Name).Users = append(get(u.Name).Users, u)
+	}
+	for _, j := range state.Jobs {
+		get(j.Owner).Jobs = append(get(j.Owner).Jobs, j)
+	}
+	for _, r := range state.Records {
+		get(r.UserName).Records = append(get(r.UserName).Records, r)
+	}
+	for _, p := range state.Outbox {
+		get(p.Record.UserName).Outbox = append(get(p.Record.UserName).Outbox, p)
+	}
+	return split
+}
+
+// PendingRecord is a Record, that is not yet confirmed by every TimeService it is routed to
+type PendingRecord struct {
+	Record      api.Record `yaml:"record" json:"record"`
+	Confirmed   []string   `yaml:"confirmed,omitempty" json:"confirmed,omitempty"`
+	Attempts    int        `yaml:"attempts" json:"attempts"`
+	NextAttempt time.Time  `yaml:"next_attempt" json:"next_attempt"`
+	LastError   string     `yaml:"last_error,omitempty" json:"last_error,omitempty"`
 }
 
 func ListUsers(data *StateV2) ([]api.User, ProviderReturnType) {
@@ -130,7 +232,192 @@ func DeleteJob(data *StateV2, del api.Job) (api.Job, ProviderReturnType) {
 	return api.Job{}, ProviderNotFound
 }
 
+func GetRecord(data *StateV2, id string) (api.Record, ProviderReturnType) {
+	for _, rec := range data.Records {
+		if rec.Id == id {
+			return rec, ProviderOk
+		}
+	}
+	return api.Record{}, ProviderNotFound
+}
+
+// SaveRecord stores a Record. Records with an Id, that is already stored, are rejected
 func SaveRecord(data *StateV2, rec api.Record) ProviderReturnType {
+	if _, proverr := GetRecord(data, rec.Id); rec.Id != "" && proverr == ProviderOk {
+		return ProviderConflict
+	}
 	data.Records = append(data.Records, rec)
 	return ProviderOk
 }
+
+func ListPendingRecords(data *StateV2, job api.Job) ([]PendingRecord, ProviderReturnType) {
+	pending := []PendingRecord{}
+	for _, p := range data.Outbox {
+		if p.Record.JobName == job.Name && p.Record.UserName == job.Owner {
+			pending = append(pending, p)
+		}
+	}
+	return pending, ProviderOk
+}
+
+func EnqueueRecord(data *StateV2, new PendingRecord) ProviderReturnType {
+	for _, p := range data.Outbox {
+		if p.Record.Id == new.Record.Id {
+			return ProviderConflict
+		}
+	}
+	data.Outbox = append(data.Outbox, new)
+	return ProviderOk
+}
+
+func UpdatePendingRecord(data *StateV2, updated PendingRecord) ProviderReturnType {
+	for i, p := range data.Outbox {
+		if p.Record.Id == updated.Record.Id {
+			data.Outbox[i] = updated
+			return ProviderOk
+		}
+	}
+	return ProviderNotFound
+}
+
+func DeletePendingRecord(data *StateV2, del PendingRecord) ProviderReturnType {
+	for i, p := range data.Outbox {
+		if p.Record.Id == del.Record.Id {
+			data.Outbox = append(data.Outbox[:i], data.Outbox[i+1:]...)
+			return ProviderOk
+		}
+	}
+	return ProviderNotFound
+}
+
+// RecordText combines Title and Description for backends, that only have a single text field
+func RecordText(rec api.Record) string {
+	if rec.Description == "" {
+		return rec.Title
+	}
+	return rec.Title + "\n" + rec.Description
+}
+
+// RecordIdMarker prefixes the owner and Id of the Record in the text of remote TimeServices ("timerec:<user>/<id>"). It is
+// used to detect Records, that were already saved, and to find the User of an entry in an account shared by all Users
+const RecordIdMarker string = "timerec:"
+
+// RecordTextWithId appends the User and Id of the Record to RecordText, so the Record can be found again
+func RecordTextWithId(rec api.Record) string {
+	if rec.Id == "" {
+		return RecordText(rec)
+	}
+	return RecordText(rec) + "\n" + RecordIdMarker + rec.UserName + "/" + rec.Id
+}
+
+// recordMarker returns the text after RecordIdMarker or an empty string
+func recordMarker(text string) string {
+	i := strings.LastIndex(text, "\n"+RecordIdMarker)
+	if i < 0 {
+		return ""
+	}
+	return text[i+1+len(RecordIdMarker):]
+}
+
+// KeepRecordMarker appends the marker of the existing text of a remote entry to text, so updates do not lose it
+func KeepRecordMarker(text, existing string) string {
+	if marker := recordMarker(existing); marker != "" {
+		return text + "\n" + RecordIdMarker + marker
+	}
+	return text
+}
+
+// RecordIdFromText returns the Id added by RecordTextWithId or an empty string
+func RecordIdFromText(text string) string {
+	marker := recordMarker(text)
+	return marker[strings.LastIndex(marker, "/")+1:]
+}
+
+// RecordLookupWindow is how far back remote TimeServices search for the entry of a Record, that is only known by its Id
+const RecordLookupWindow time.Duration = 90 * 24 * time.Hour
+
+// RecordLookupRange returns the time range, in which remote TimeServices search for the entry of a Record by the Id in its
+// marker. Updates might move a Record, so the range covers RecordLookupWindow as well as the times of the Record
+func RecordLookupRange(rec api.Record) (time.Time, time.Time) {
+	from, to := time.Now().Add(-RecordLookupWindow), time.Now().Add(24*time.Hour)
+	if !rec.Start.IsZero() && rec.Start.Add(-24*time.Hour).Before(from) {
+		from = rec.Start.Add(-24 * time.Hour)
+	}
+	if rec.End.Add(24 * time.Hour).After(to) {
+		to = rec.End.Add(24 * time.Hour)
+	}
+	return from, to
+}
+
+// RecordOwnerFromText returns the User added by RecordTextWithId or an empty string
+func RecordOwnerFromText(text string) string {
+	marker := recordMarker(text)
+	if i := strings.LastIndex(marker, "/"); i >= 0 {
+		return marker[:i]
+	}
+	return ""
+}
+
+// CheckRecordOwner returns ProviderForbidden, unless the text of a remote entry belongs to the User of the Record. The remote
+// TimeServices use one account for all Users, entries without an owner (e.g. created in the web interface) belong to nobody
+func CheckRecordOwner(text string, rec api.Record) error {
+	if owner := RecordOwnerFromText(text); owner == "" || owner != rec.UserName {
+		return fmt.Errorf("record '%s' does not belong to User '%s': %w", rec.Id, rec.UserName, ProviderForbidden)
+	}
+	return nil
+}
+
+// SplitRecordText is the reverse of RecordText: The first line is the Title, the remaining lines are the Description
+func SplitRecordText(text string) (string, string) {
+	if i := strings.LastIndex(text, "\n"+RecordIdMarker); i >= 0 {
+		text = text[:i]
+	}
+	lines := strings.SplitN(text, "\n", 2)
+	if len(lines) == 1 {
+		return lines[0], ""
+	}
+	return lines[0], lines[1]
+}
+
+func ListRecords(data *StateV2, user string, from, to time.Time) ([]api.Record, ProviderReturnType) {
+	records := []api.Record{}
+	for _, rec := range data.Records {
+		if rec.UserName != user {
+			continue
+		}
+		if !from.IsZero() && rec.Start.Before(from) {
+			continue
+		}
+		if !to.IsZero() && rec.Start.After(to) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records, ProviderOk
+}
+
+func UpdateRecord(data *StateV2, updated api.Record) ProviderReturnType {
+	for i, rec := range data.Records {
+		if rec.Id == updated.Id {
+			if rec.UserName != updated.UserName {
+				return ProviderForbidden
+			}
+			data.Records[i] = updated
+			return ProviderOk
+		}
+	}
+	return ProviderNotFound
+}
+
+func DeleteRecord(data *StateV2, del api.Record) (api.Record, ProviderReturnType) {
+	for i, rec := range data.Records {
+		if rec.Id == del.Id {
+			if rec.UserName != del.UserName {
+				return api.Record{}, ProviderForbidden
+			}
+			data.Records = append(data.Records[:i], data.Records[i+1:]...)
+			return rec, ProviderOk
+		}
+	}
+	return api.Record{}, ProviderNotFound
+}
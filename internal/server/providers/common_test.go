@@ -22,3 +22,25 @@ func TestAppendUser(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRecordMarker(t *testing.T) {
+	rec := api.Record{Id: "abc", UserName: "me@example.com", Title: "TICKET-13", Description: "fixed it"}
+	text := providers.RecordTextWithId(rec)
+	if providers.RecordIdFromText(text) != "abc" || providers.RecordOwnerFromText(text) != "me@example.com" {
+		t.Fatalf("incorrect marker in %q", text)
+	}
+	if title, desc := providers.SplitRecordText(text); title != "TICKET-13" || desc != "fixed it" {
+		t.Fatalf("incorrect text: got %q and %q", title, desc)
+	}
+
+	if err := providers.CheckRecordOwner(text, rec); err != nil {
+		t.Fatalf("expected no error for the owner, got %v", err)
+	}
+	rec.UserName = "other"
+	if err := providers.CheckRecordOwner(text, rec); err == nil {
+		t.Fatal("expected an error for another User")
+	}
+	if err := providers.CheckRecordOwner("Meeting", api.Record{UserName: ""}); err == nil {
+		t.Fatal("expected an error for an entry without owner")
+	}
+}
@@ -0,0 +1,257 @@
+package providers
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+const (
+	EmailDefaultPort     int           = 587
+	EmailDefaultDigestAt time.Duration = 17 * time.Hour
+)
+
+// EmailProvider sends notifications through an SMTP server. STARTTLS is used, if the server supports it.
+// Every notification is sent once per day, reconcilers repeat them until the User reacts.
+// Users with Settings.Notifications.Email.Digest get one summary per day instead. Their Events are kept in memory until
+// the digest is sent, so a restart loses them. When notifications and digests were sent is kept in Log
+type EmailProvider struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	Actions  *ActionLinks
+	// DigestAt is the time of day, when digests are sent
+	DigestAt time.Duration
+	Log      NotificationLog
+
+	settings SettingsLookup
+	logger   *zap.SugaredLogger
+
+	mu      sync.Mutex
+	pending map[string][]digestEntry
+}
+
+// emailDigestKey is the NotificationLog key of the digest
+const emailDigestKey string = "email/digest"
+
+// NotificationLog remembers when a notification was last sent to a User. The server keeps it in the State (api.User.Notified),
+// so restarts don't repeat notifications
+type NotificationLog interface {
+	LastNotified(user, key string) (time.Time, error)
+	SetNotified(user, key string, at time.Time) error
+}
+
+// memoryNotificationLog is the NotificationLog, until a persistent one is set. It is lost on restart
+type memoryNotificationLog struct {
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func (log *memoryNotificationLog) LastNotified(user, key string) (time.Time, error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	return log.sent[user+"/"+key], nil
+}
+
+func (log *memoryNotificationLog) SetNotified(user, key string, at time.Time) error {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	log.sent[user+"/"+key] = at
+	return nil
+}
+
+type digestEntry struct {
+	Time    time.Time
+	Message api.Message
+}
+
+func NewEmailProvider(logger zap.SugaredLogger, host string, port int, username, password, from string, actions *ActionLinks, settings SettingsLookup) (*EmailProvider, error) {
+	if host == "" || from == "" {
+		return nil, fmt.Errorf("email requires a host and a from address")
+	}
+	if port == 0 {
+		port = EmailDefaultPort
+	}
+	return &EmailProvider{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+		Actions:  actions,
+		DigestAt: EmailDefaultDigestAt,
+		Log:      &memoryNotificationLog{sent: map[string]time.Time{}},
+		settings: settings,
+		logger:   logger.Named("Email"),
+		pending:  map[string][]digestEntry{},
+	}, nil
+}
+
+// NotifyUser sends TIMER_EXPIRED and NO_ENTRY_ALARM Events as an email or adds them to the User's digest
+func (prov *EmailProvider) NotifyUser(ev cloudevents.Event) error {
+	msg, err := api.MessageFromEvent(ev)
+	if err != nil {
+		return fmt.Errorf("unable to read Message of Event %s: %w", ev.ID(), err)
+	}
+	if msg.Event != api.EventTypeTimerExpired && msg.Event != api.EventTypeNoEntryAlarm {
+		return nil
+	}
+	settings, err := prov.settings(msg.UserName())
+	if err != nil {
+		return fmt.Errorf("unable to read Settings of User '%s': %w", msg.UserName(), err)
+	}
+	email := settings.Notifications.Email
+	if email.Address == "" {
+		prov.logger.Debugf("No email address for User '%s', skipping Event %s", msg.UserName(), ev.ID())
+		return nil
+	}
+
+	if email.Digest {
+		prov.addToDigest(msg.UserName(), digestEntry{Time: ev.Time(), Message: msg})
+		prov.logger.Debugf("Added Event %s to the digest of User '%s'", ev.ID(), msg.UserName())
+		return nil
+	}
+
+	now := time.Now()
+	key := fmt.Sprintf("email/%s/%s", msg.Event, msg.ActivityName())
+	last, err := prov.Log.LastNotified(msg.UserName(), key)
+	if err != nil {
+		return fmt.Errorf("unable to read notifications of User '%s': %w", msg.UserName(), err)
+	}
+	if sameDay(last, now) {
+		prov.logger.Debugf("Event %s was already sent to User '%s' today", ev.ID(), msg.UserName())
+		return nil
+	}
+
+	body := msg.Message + "\n"
+	for _, action := range prov.Actions.Actions(msg, settings) {
+		body += fmt.Sprintf("\n%s: %s", action.Label, action.Url)
+	}
+	if err := prov.send(email.Address, "[timerec] "+chatTitle(msg), body); err != nil {
+		prov.logger.Warnf("Failed to send Event %s by email: %v", ev.ID(), err)
+		return err
+	}
+	prov.logger.Debugf("Event %s sent to %s", ev.ID(), email.Address)
+	if err := prov.Log.SetNotified(msg.UserName(), key, now); err != nil {
+		prov.logger.Warnf("Unable to remember Event %s of User '%s', it might be sent again: %v", ev.ID(), msg.UserName(), err)
+	}
+	return nil
+}
+
+func sameDay(a, b time.Time) bool {
+	a, b = a.Local(), b.Local()
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
+
+// addToDigest skips Messages, that are already part of the digest. Reconcilers repeat notifications until the User reacts
+func (prov *EmailProvider) addToDigest(user string, entry digestEntry) {
+	prov.mu.Lock()
+	defer prov.mu.Unlock()
+	for _, pending := range prov.pending[user] {
+		if pending.Message == entry.Message && pending.Time.YearDay() == entry.Time.YearDay() {
+			return
+		}
+	}
+	prov.pending[user] = append(prov.pending[user], entry)
+}
+
+// SendDigest sends the collected Events and the open Jobs of a User, once per day after DigestAt. It returns when the next digest is due
+func (prov *EmailProvider) SendDigest(user api.User, jobs []api.Job, now time.Time) (time.Time, error) {
+	// DigestAt is the wall clock time in now's Location, also on days with a daylight saving time change
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	due := time.Date(now.Year(), now.Month(), now.Day(), int(prov.DigestAt/time.Hour), int(prov.DigestAt%time.Hour/time.Minute), 0, 0, now.Location())
+	email := user.Settings.Notifications.Email
+	if !email.Digest || email.Address == "" {
+		return due.AddDate(0, 0, 1), nil
+	}
+	if now.Before(due) {
+		return due, nil
+	}
+
+	last, err := prov.Log.LastNotified(user.Name, emailDigestKey)
+	if err != nil {
+		return due, err
+	}
+	prov.mu.Lock()
+	entries := prov.pending[user.Name]
+	prov.mu.Unlock()
+	if !last.Before(day) || (len(entries) == 0 && len(jobs) == 0) {
+		return due.AddDate(0, 0, 1), nil
+	}
+
+	subject := fmt.Sprintf("[timerec] Summary for %s", now.Format("Monday, 2 January"))
+	if err := prov.send(email.Address, subject, formatDigest(entries, jobs)); err != nil {
+		return due, err
+	}
+
+	prov.mu.Lock()
+	prov.pending[user.Name] = prov.pending[user.Name][len(entries):]
+	prov.mu.Unlock()
+	if err := prov.Log.SetNotified(user.Name, emailDigestKey, now); err != nil {
+		prov.logger.Warnf("Unable to remember the digest of User '%s', it might be sent again: %v", user.Name, err)
+	}
+	prov.logger.Infof("Sent digest with %d notifications and %d open Jobs to %s", len(entries), len(jobs), email.Address)
+	return due.AddDate(0, 0, 1), nil
+}
+
+func formatDigest(entries []digestEntry, jobs []api.Job) string {
+	var b strings.Builder
+	b.WriteString("Notifications:\n")
+	if len(entries) == 0 {
+		b.WriteString("  none\n")
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "  %s  %s - %s\n", entry.Time.Local().Format("15:04"), chatTitle(entry.Message), entry.Message.Message)
+	}
+
+	b.WriteString("\nOpen Jobs:\n")
+	if len(jobs) == 0 {
+		b.WriteString("  none\n")
+	}
+	for _, job := range jobs {
+		var worked time.Duration
+		for _, activity := range job.Activities {
+			worked += activity.End.Sub(activity.Start)
+		}
+		title := job.Name
+		if job.Title != "" {
+			title = fmt.Sprintf("%s (%s)", job.Name, job.Title)
+		}
+		fmt.Fprintf(&b, "  %s: %s in %d activities\n", title, shortDuration(worked), len(job.Activities))
+	}
+	return b.String()
+}
+
+func (prov *EmailProvider) send(to, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", prov.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qp.Close()
+
+	var auth smtp.Auth
+	if prov.Username != "" {
+		auth = smtp.PlainAuth("", prov.Username, prov.Password, prov.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(prov.Host, strconv.Itoa(prov.Port)), auth, prov.From, []string{to}, msg.Bytes())
+}
@@ -0,0 +1,165 @@
+package providers_test
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// smtpSink is a minimal SMTP server, that keeps the data of every mail
+type smtpSink struct {
+	listener net.Listener
+	mu       sync.Mutex
+	mails    []string
+}
+
+func newSmtpSink(t *testing.T) *smtpSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	sink := &smtpSink{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go sink.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return sink
+}
+
+func (sink *smtpSink) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			sink.mu.Lock()
+			sink.mails = append(sink.mails, data.String())
+			sink.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func (sink *smtpSink) provider(t *testing.T, settings api.Settings) *providers.EmailProvider {
+	host, port, _ := net.SplitHostPort(sink.listener.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+	logger, _ := zap.NewDevelopment()
+	email, err := providers.NewEmailProvider(*logger.Sugar(), host, portNumber, "", "", "timerec@example.com", testActionLinks(), chatSettings(settings))
+	if err != nil {
+		t.Fatalf("unable to create email provider: %v", err)
+	}
+	return email
+}
+
+func TestEmailSendsNotifications(t *testing.T) {
+	sink := newSmtpSink(t)
+	settings := api.NewDefaultUser("me").Settings
+	settings.Notifications.Email.Address = "me@example.com"
+	email := sink.provider(t, settings)
+
+	if err := email.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@work", "me")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(sink.mails) != 1 {
+		t.Fatalf("incorrect number of mails: got %d expected %d", len(sink.mails), 1)
+	}
+	for _, expected := range []string{"To: me@example.com", "Subject: [timerec] Timer expired: work", "/actions/me/activity/finish"} {
+		if !strings.Contains(sink.mails[0], expected) {
+			t.Fatalf("mail does not contain %q: %s", expected, sink.mails[0])
+		}
+	}
+}
+
+func TestEmailSendsDailyDigest(t *testing.T) {
+	sink := newSmtpSink(t)
+	user := api.NewDefaultUser("me")
+	user.Settings.Notifications.Email = api.EmailSettings{Address: "me@example.com", Digest: true}
+	email := sink.provider(t, user.Settings)
+
+	for i := 0; i < 3; i++ {
+		email.NotifyUser(api.MakeMessageEvent(api.EventTypeNoEntryAlarm, "No work logged today!", "activity@none", "me"))
+	}
+	if len(sink.mails) != 0 {
+		t.Fatalf("expected no mails before the digest, got %d", len(sink.mails))
+	}
+
+	morning := time.Date(2022, 3, 1, 9, 0, 0, 0, time.Local)
+	jobs := []api.Job{{Name: "work", Owner: "me", Activities: []api.TimeEntry{{Start: morning, End: morning.Add(90 * time.Minute)}}}}
+	next, err := email.SendDigest(user, jobs, morning)
+	if err != nil || !next.Equal(morning.Add(8*time.Hour)) || len(sink.mails) != 0 {
+		t.Fatalf("incorrect digest before DigestAt: got %v, %v", next, err)
+	}
+
+	evening := morning.Add(9 * time.Hour)
+	next, err = email.SendDigest(user, jobs, evening)
+	if err != nil || !next.Equal(morning.Add(32*time.Hour)) || len(sink.mails) != 1 {
+		t.Fatalf("incorrect digest: got %v, %v and %d mails", next, err, len(sink.mails))
+	}
+	if strings.Count(sink.mails[0], "No work logged today!") != 1 || !strings.Contains(sink.mails[0], "work: 1h30m in 1 activities") {
+		t.Fatalf("incorrect digest: %s", sink.mails[0])
+	}
+
+	// Only one digest per day, also after a restart
+	email.SendDigest(user, jobs, evening.Add(time.Hour))
+	restarted := sink.provider(t, user.Settings)
+	restarted.Log = email.Log
+	restarted.SendDigest(user, jobs, evening.Add(time.Hour))
+	if len(sink.mails) != 1 {
+		t.Fatalf("incorrect number of mails: got %d expected %d", len(sink.mails), 1)
+	}
+}
+
+func TestEmailSendsNotificationsOncePerDay(t *testing.T) {
+	sink := newSmtpSink(t)
+	settings := api.NewDefaultUser("me").Settings
+	settings.Notifications.Email.Address = "me@example.com"
+	email := sink.provider(t, settings)
+
+	for i := 0; i < 3; i++ {
+		email.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@work", "me"))
+	}
+	if len(sink.mails) != 1 {
+		t.Fatalf("incorrect number of mails: got %d expected %d", len(sink.mails), 1)
+	}
+
+	email.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@other", "me"))
+	email.NotifyUser(api.MakeMessageEvent(api.EventTypeNoEntryAlarm, "No work logged today!", "activity@none", "me"))
+	if len(sink.mails) != 3 {
+		t.Fatalf("incorrect number of mails: got %d expected %d", len(sink.mails), 3)
+	}
+}
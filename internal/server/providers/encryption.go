@@ -0,0 +1,169 @@
+package providers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// StateKeyEnv contains the keys to encrypt the State file, if no key file is configured
+const StateKeyEnv string = "TIMEREC_STATE_KEY"
+
+const encryptedFormat string = "aes-256-gcm"
+
+var ErrStateKeyMissing = errors.New("no key configured to decrypt the State")
+
+// StateKey is a 256 bit AES key. The Id is stored with the encrypted file, so the right key is used after a rotation
+type StateKey struct {
+	Id  string
+	Key []byte
+}
+
+// StateKeys are all known keys. The first key encrypts, all keys decrypt. To rotate keys, add a new key in front of the old one.
+// The file is re-encrypted on the next write, after that the old key can be removed
+type StateKeys []StateKey
+
+// encryptedFile is written instead of the State, if encryption is enabled
+type encryptedFile struct {
+	Encrypted string `yaml:"encrypted"`
+	Key       string `yaml:"key"`
+	Data      string `yaml:"data"`
+}
+
+// ParseStateKeys parses keys in the format "<id>:<base64 key>", separated by newlines or commas. Keys without id get an id derived from the key
+func ParseStateKeys(content string) (StateKeys, error) {
+	keys := StateKeys{}
+	for _, line := range strings.FieldsFunc(content, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		id, encoded := "", line
+		if i := strings.LastIndex(line, ":"); i >= 0 {
+			id, encoded = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return StateKeys{}, fmt.Errorf("invalid key '%s': %w", id, err)
+		}
+		if len(key) != 32 {
+			return StateKeys{}, fmt.Errorf("invalid key '%s': expected 32 bytes, got %d", id, len(key))
+		}
+		if id == "" {
+			sum := sha256.Sum256(key)
+			id = hex.EncodeToString(sum[:4])
+		}
+		keys = append(keys, StateKey{Id: id, Key: key})
+	}
+	return keys, nil
+}
+
+// LoadStateKeys reads the keys from keyFile or from the environment variable TIMEREC_STATE_KEY. No keys disables encryption
+func LoadStateKeys(keyFile string) (StateKeys, error) {
+	if keyFile == "" {
+		return ParseStateKeys(os.Getenv(StateKeyEnv))
+	}
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return StateKeys{}, fmt.Errorf("unable to read key file: %w", err)
+	}
+	keys, err := ParseStateKeys(string(content))
+	if err == nil && len(keys) == 0 {
+		err = fmt.Errorf("key file %s contains no keys", keyFile)
+	}
+	return keys, err
+}
+
+// GenerateStateKey returns a new random key in the format of ParseStateKeys
+func GenerateStateKey(id string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// IsEncrypted returns true, if the content was written by Encrypt
+func IsEncrypted(content []byte) bool {
+	return bytes.HasPrefix(content, []byte("encrypted: "+encryptedFormat))
+}
+
+// Encrypt encrypts the content with the first key
+func (keys StateKeys) Encrypt(content []byte) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, ErrStateKeyMissing
+	}
+	gcm, err := newGcm(keys[0].Key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, content, []byte(keys[0].Id))
+	return yaml.Marshal(encryptedFile{
+		Encrypted: encryptedFormat,
+		Key:       keys[0].Id,
+		Data:      base64.StdEncoding.EncodeToString(sealed),
+	})
+}
+
+// Decrypt decrypts content written by Encrypt, with the key it was encrypted with
+func (keys StateKeys) Decrypt(content []byte) ([]byte, error) {
+	var file encryptedFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("encrypted with key '%s', set %s or a key file: %w", file.Key, StateKeyEnv, ErrStateKeyMissing)
+	}
+
+	var key *StateKey
+	for i := range keys {
+		if keys[i].Id == file.Key {
+			key = &keys[i]
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("encrypted with key '%s', which is not configured: %w", file.Key, ErrStateKeyMissing)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(file.Data)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGcm(key.Key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is truncated")
+	}
+	content, err = gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(key.Id))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt with key '%s': %w", key.Id, err)
+	}
+	return content, nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,78 @@
+package providers_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+func newTestKeys(t *testing.T, ids ...string) providers.StateKeys {
+	keys := providers.StateKeys{}
+	for _, id := range ids {
+		line, _ := providers.GenerateStateKey(id)
+		parsed, err := providers.ParseStateKeys(line)
+		if err != nil {
+			t.Fatalf("unable to parse key: %v", err)
+		}
+		keys = append(keys, parsed...)
+	}
+	return keys
+}
+
+func TestFileEncryptsState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.yaml")
+	keys := newTestKeys(t, "old")
+	file := providers.NewEncryptedFileProvider(path, keys)
+
+	state, _ := file.Refresh("me")
+	providers.CreateJob(&state, api.Job{Name: "work", Owner: "me", RecordTemplate: api.RecordTemplate{Title: "Customer Project"}})
+	if err := file.Save(state.Partition, state); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	content, _ := os.ReadFile(path)
+	if !providers.IsEncrypted(content) || bytes.Contains(content, []byte("Customer Project")) {
+		t.Fatalf("expected encrypted file, got %s", content)
+	}
+
+	loaded, err := file.Refresh("me")
+	if err != nil || len(loaded.Jobs) != 1 || loaded.Jobs[0].Title != "Customer Project" {
+		t.Fatalf("incorrect state: got %v, %v", loaded, err)
+	}
+
+	_, err = providers.NewFileProvider(path).Refresh("me")
+	if !errors.Is(err, providers.ErrStateKeyMissing) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ErrStateKeyMissing)
+	}
+}
+
+func TestFileRotatesKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.yaml")
+	old := newTestKeys(t, "old")
+	file := providers.NewFileProvider(path)
+	state, _ := file.Refresh("me")
+	providers.CreateUser(&state, api.NewDefaultUser("me"))
+	file.Save(state.Partition, state)
+
+	// Unencrypted files are encrypted with the first key
+	if err := providers.NewEncryptedFileProvider(path, old).Rewrite(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	rotated := append(newTestKeys(t, "new"), old...)
+	if err := providers.NewEncryptedFileProvider(path, rotated).Rewrite(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	loaded, err := providers.NewEncryptedFileProvider(path, rotated[:1]).Refresh("me")
+	if err != nil || len(loaded.Users) != 1 {
+		t.Fatalf("incorrect state: got %v, %v", loaded, err)
+	}
+	_, err = providers.NewEncryptedFileProvider(path, old).Refresh("me")
+	if !errors.Is(err, providers.ErrStateKeyMissing) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ErrStateKeyMissing)
+	}
+}
@@ -1,20 +1,34 @@
 package providers
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/thomasbuchinger/timerec/api"
 	"gopkg.in/yaml.v2"
 )
 
+// FileOrMemoryProvider stores the State in a YAML file, with one partition per User. Templates are kept in the global partition
+// and are part of every User's partition.
+// The file is shared between the CLI and the server: Every access takes an advisory lock and the file is replaced atomically.
+// Save checks the version of the partition, the TimeService methods hold the lock for the whole read-modify-write.
+// With Keys, the file is encrypted. Unencrypted files are still read and encrypted on the next write
 type FileOrMemoryProvider struct {
 	Path string
 	Data StateV2
+	Keys StateKeys
 }
 type FileDiskFormat map[string]StateV2
 
+// FileLegacyPartition is the partition older versions kept the whole State in. It is split by owner, when the file is read
+const FileLegacyPartition string = "file"
+
 func NewMemoryProvider() *FileOrMemoryProvider {
 	mem := FileOrMemoryProvider{}
 	mem.Data = StateV2{
@@ -26,64 +40,432 @@ func NewMemoryProvider() *FileOrMemoryProvider {
 func NewFileProvider(path string) *FileOrMemoryProvider {
 	file := &FileOrMemoryProvider{
 		Path: path,
-		Data: StateV2{
-			Partition: "file",
-		},
 	}
-	file.Refresh("file")
 	return file
 }
 
+func NewEncryptedFileProvider(path string, keys StateKeys) *FileOrMemoryProvider {
+	file := NewFileProvider(path)
+	file.Keys = keys
+	return file
+}
+
+// Rewrite reads and writes the file without changes, e.g. to encrypt it with a new key
+func (store *FileOrMemoryProvider) Rewrite() error {
+	if store.Path == "" {
+		return nil
+	}
+	return store.withLock(true, func() error {
+		data, err := store.read()
+		if err != nil {
+			return err
+		}
+		return store.write(data)
+	})
+}
+
+// Refresh returns the partition of a single User. The global scope merges all partitions
 func (store *FileOrMemoryProvider) Refresh(partition string) (StateV2, error) {
 	if store.Path == "" {
 		return store.Data, nil
 	}
 
 	var data FileDiskFormat
-	content, err := os.ReadFile(store.Path)
+	err := store.withLock(false, func() error {
+		var err error
+		data, err = store.read()
+		return err
+	})
 	if err != nil {
-		fmt.Println(err)
 		return StateV2{}, err
 	}
 
+	if partition == ScopeGlobal {
+		return mergePartitions(data), nil
+	}
+	return userPartition(data, partition), nil
+}
+
+// userPartition returns the partition of a User with the global Templates
+func userPartition(data FileDiskFormat, partition string) StateV2 {
+	state := data[partition]
+	state.Partition = partition
+	state.Templates = data[ScopeGlobal].Templates
+	return state
+}
+
+// Save replaces a single partition and keeps all other partitions. Saving the global scope splits the State by owner
+func (store *FileOrMemoryProvider) Save(partition string, state StateV2) error {
+	if store.Path == "" {
+		if state.Version != store.Data.Version {
+			return VersionConflictError{Partition: partition, Expected: state.Version, Actual: store.Data.Version}
+		}
+		state.Version = NextVersion(state.Version)
+		store.Data = state
+		return nil
+	}
+
+	return store.withLock(true, func() error {
+		data, err := store.read()
+		if err != nil {
+			return err
+		}
+		if partition == ScopeGlobal {
+			if current := globalVersion(data); state.Version != current {
+				return VersionConflictError{Partition: partition, Expected: state.Version, Actual: current}
+			}
+			splitPartitions(data, state)
+		} else {
+			if current := data[partition].Version; state.Version != current {
+				return VersionConflictError{Partition: partition, Expected: state.Version, Actual: current}
+			}
+			state.Partition = partition
+			state.Version = NextVersion(state.Version)
+			state.Templates = nil // Templates are only saved with the global scope
+			data[partition] = state
+		}
+		return store.write(data)
+	})
+}
+
+// update runs f on a partition and saves it, while holding the lock. Unlike Refresh and Save, concurrent changes cannot conflict
+func (store *FileOrMemoryProvider) update(partition string, f func(state *StateV2) error) error {
+	if store.Path == "" {
+		state := store.Data.DeepCopy()
+		if err := f(&state); err != nil {
+			return err
+		}
+		state.Version = NextVersion(state.Version)
+		store.Data = state
+		return nil
+	}
+
+	return store.withLock(true, func() error {
+		data, err := store.read()
+		if err != nil {
+			return err
+		}
+		state := userPartition(data, partition)
+		if err := f(&state); err != nil {
+			return err
+		}
+		state.Version = NextVersion(state.Version)
+		state.Templates = nil
+		data[partition] = state
+		return store.write(data)
+	})
+}
+
+// globalVersion is the sum of all partition versions. It changes with every write to any partition
+func globalVersion(data FileDiskFormat) string {
+	sum := 0
+	for _, partition := range data {
+		n, _ := strconv.Atoi(partition.Version)
+		sum += n
+	}
+	if sum == 0 {
+		return ""
+	}
+	return strconv.Itoa(sum)
+}
+
+// read parses the file and migrates partitions with an older schema version. Migrated partitions are written on the next Save
+func (store *FileOrMemoryProvider) read() (FileDiskFormat, error) {
+	data := FileDiskFormat{}
+	raw, content, err := store.readRaw()
+	if err != nil || len(raw) == 0 {
+		return data, err
+	}
+
+	migrated := false
+	for name, partition := range raw {
+		schema := fileSchemaVersion(partition)
+		if schema == StateSchemaVersion {
+			continue
+		}
+		if err := MigratePartition(partition, schema); err != nil {
+			return data, fmt.Errorf("unable to migrate partition '%s' in %s: %w", name, store.Path, err)
+		}
+		partition["schema"] = StateSchemaVersion
+		migrated = true
+	}
+	if migrated {
+		content, err = yaml.Marshal(raw)
+		if err != nil {
+			return data, err
+		}
+	}
+
 	err = yaml.Unmarshal(content, &data)
 	if err != nil {
-		fmt.Println(err)
-		return StateV2{}, err
+		return FileDiskFormat{}, fmt.Errorf("unable to parse %s: %w", store.Path, err)
+	}
+	splitLegacyPartitions(data)
+	return data, nil
+}
+
+// splitLegacyPartitions moves the content of FileLegacyPartition to the partitions of the owners and all Templates to the global
+// partition. The file is rewritten on the next Save
+func splitLegacyPartitions(data FileDiskFormat) {
+	global := data[ScopeGlobal]
+	moveTemplates := func(templates []api.RecordTemplate) {
+		for _, t := range templates {
+			if ok, _ := HasTemplate(&global, t.TemplateName); !ok {
+				global.Templates = append(global.Templates, t)
+			}
+		}
 	}
-	return data[partition], nil
 
+	if legacy, ok := data[FileLegacyPartition]; ok {
+		delete(data, FileLegacyPartition)
+		for name, split := range SplitByOwner(legacy) {
+			partition := data[name]
+			partition.Users = append(partition.Users, split.Users...)
+			partition.Jobs = append(partition.Jobs, split.Jobs...)
+			partition.Records = append(partition.Records, split.Records...)
+			partition.Outbox = append(partition.Outbox, split.Outbox...)
+			data[name] = partition
+		}
+		moveTemplates(legacy.Templates)
+	}
+	for name, partition := range data {
+		if name != ScopeGlobal && len(partition.Templates) > 0 {
+			moveTemplates(partition.Templates)
+			partition.Templates = nil
+			data[name] = partition
+		}
+	}
+	if len(global.Templates) > 0 {
+		data[ScopeGlobal] = global
+	}
 }
-func (store *FileOrMemoryProvider) Save(partition string, state StateV2) error {
-	store.Data = state
+
+// readRaw parses the file without decoding the partitions, so they can be migrated
+func (store *FileOrMemoryProvider) readRaw() (map[string]map[string]interface{}, []byte, error) {
+	raw := map[string]map[string]interface{}{}
+	content, err := os.ReadFile(store.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return raw, content, nil
+	}
+	if err != nil {
+		return raw, content, err
+	}
+	if IsEncrypted(content) {
+		content, err = store.Keys.Decrypt(content)
+		if err != nil {
+			return raw, content, fmt.Errorf("unable to read %s: %w", store.Path, err)
+		}
+	}
+
+	err = yaml.Unmarshal(content, &raw)
+	if err != nil {
+		return raw, content, fmt.Errorf("unable to parse %s: %w", store.Path, err)
+	}
+	return raw, content, nil
+}
+
+func fileSchemaVersion(partition map[string]interface{}) int {
+	schema, ok := partition["schema"].(int)
+	if !ok || schema < 1 {
+		return 1
+	}
+	return schema
+}
+
+// SchemaVersions returns the stored schema version of every partition. FileLegacyPartition is reported as the partitions it is
+// split into (see splitLegacyPartitions), which get its schema version, unless their own is older
+func (store *FileOrMemoryProvider) SchemaVersions() (map[string]int, error) {
+	versions := map[string]int{}
 	if store.Path == "" {
-		// Nothing more to do for Memory Providers
+		return versions, nil
+	}
+	err := store.withLock(false, func() error {
+		raw, _, err := store.readRaw()
+		if err != nil {
+			return err
+		}
+		data, err := store.read()
+		if err != nil {
+			return err
+		}
+		for name := range data {
+			version := StateSchemaVersion
+			if partition, ok := raw[name]; ok {
+				version = fileSchemaVersion(partition)
+			}
+			if legacy, ok := raw[FileLegacyPartition]; ok && fileSchemaVersion(legacy) < version {
+				version = fileSchemaVersion(legacy)
+			}
+			versions[name] = version
+		}
 		return nil
+	})
+	return versions, err
+}
+
+// write replaces the file with a temporary file, so readers never see a partially written file
+func (store *FileOrMemoryProvider) write(data FileDiskFormat) error {
+	for name, partition := range data {
+		partition.Schema = StateSchemaVersion
+		data[name] = partition
+	}
+	content, err := yaml.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if len(store.Keys) > 0 {
+		content, err = store.Keys.Encrypt(content)
+		if err != nil {
+			return err
+		}
 	}
 
-	yamlData := FileDiskFormat{}
-	yamlData[partition] = state
-	content, err := yaml.Marshal(yamlData)
+	tmp, err := os.CreateTemp(filepath.Dir(store.Path), "."+filepath.Base(store.Path)+".*")
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-	err = os.WriteFile(store.Path, content, os.ModeType)
+	defer os.Remove(tmp.Name()) // no-op after a successful rename
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), store.Path)
+}
+
+// withLock runs f while holding an advisory lock on a separate lock file. The data file itself cannot be locked, because it is replaced on every write
+func (store *FileOrMemoryProvider) withLock(exclusive bool, f func() error) error {
+	lock, err := os.OpenFile(store.Path+".lock", os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
+	defer lock.Close()
 
-	return nil
+	if err := lockFile(lock, exclusive); err != nil {
+		return fmt.Errorf("unable to lock %s: %w", lock.Name(), err)
+	}
+	defer unlockFile(lock)
+	return f()
+}
+
+func mergePartitions(data FileDiskFormat) StateV2 {
+	merged := StateV2{Partition: ScopeGlobal, Version: globalVersion(data)}
+	names := []string{}
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		partition := data[name]
+		merged.Users = append(merged.Users, partition.Users...)
+		merged.Jobs = append(merged.Jobs, partition.Jobs...)
+		merged.Records = append(merged.Records, partition.Records...)
+		merged.Outbox = append(merged.Outbox, partition.Outbox...)
+		for _, t := range partition.Templates {
+			if ok, _ := HasTemplate(&merged, t.TemplateName); !ok {
+				merged.Templates = append(merged.Templates, t)
+			}
+		}
+	}
+	return merged
+}
+
+// splitPartitions stores every entity in the partition of its owner. Templates are stored in the global partition
+func splitPartitions(data FileDiskFormat, state StateV2) {
+	split := SplitByOwner(state)
+
+	// Every existing partition is replaced, even if the State contains nothing for it anymore
+	for name := range data {
+		if _, ok := split[name]; !ok {
+			split[name] = &StateV2{Partition: name}
+		}
+	}
+	if _, ok := split[ScopeGlobal]; !ok {
+		split[ScopeGlobal] = &StateV2{Partition: ScopeGlobal}
+	}
+	for name, partition := range split {
+		existing := data[name]
+		partition.Version = NextVersion(existing.Version)
+		partition.Templates = existing.Templates
+	}
+	split[ScopeGlobal].Templates = state.Templates
+
+	for name, partition := range split {
+		data[name] = *partition
+	}
 }
 
 func (store *FileOrMemoryProvider) SaveRecord(rec api.Record) (api.Record, error) {
-	data, _ := store.Refresh("file")
-	data.Records = append(data.Records, rec)
-	store.Save("file", data)
+	if rec.Id == "" {
+		rec.Id = api.RecordId(rec.UserName, rec.JobName, rec.Start, rec.End)
+	}
+	saved := rec
+	err := store.update(rec.UserName, func(state *StateV2) error {
+		if SaveRecord(state, rec) == ProviderConflict {
+			saved, _ = GetRecord(state, rec.Id)
+			return errAlreadySaved
+		}
+		return nil
+	})
+	if err == errAlreadySaved {
+		return saved, nil
+	}
+	return saved, err
+}
+
+// errAlreadySaved stops update without writing the file
+var errAlreadySaved = errors.New("record already saved")
+
+func (store *FileOrMemoryProvider) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	data, err := store.Refresh(user)
+	if err != nil {
+		return []api.Record{}, err
+	}
+	records, _ := ListRecords(&data, user, from, to)
+	return records, nil
+}
+
+func (store *FileOrMemoryProvider) UpdateRecord(rec api.Record) (api.Record, error) {
+	err := store.update(rec.UserName, func(state *StateV2) error {
+		if proverr := UpdateRecord(state, rec); proverr != ProviderOk {
+			return proverr
+		}
+		return nil
+	})
+	if err != nil {
+		return api.Record{}, err
+	}
 	return rec, nil
 }
 
+func (store *FileOrMemoryProvider) DeleteRecord(rec api.Record) (api.Record, error) {
+	var deleted api.Record
+	err := store.update(rec.UserName, func(state *StateV2) error {
+		var proverr ProviderReturnType
+		deleted, proverr = DeleteRecord(state, rec)
+		if proverr != ProviderOk {
+			return proverr
+		}
+		return nil
+	})
+	if err != nil {
+		return api.Record{}, err
+	}
+	return deleted, nil
+}
+
 func (store *FileOrMemoryProvider) NotifyUser(event cloudevents.Event) error {
 
 	fmt.Printf("Event: %s\n", event.String())
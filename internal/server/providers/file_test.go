@@ -0,0 +1,188 @@
+package providers_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+func TestFileKeepsAllPartitions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.yaml")
+	file := providers.NewFileProvider(path)
+
+	for _, name := range []string{"alice", "bob"} {
+		state, err := file.Refresh(name)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		providers.CreateUser(&state, api.NewDefaultUser(name))
+		providers.CreateJob(&state, api.Job{Name: "work", Owner: name})
+		file.Save(state.Partition, state)
+	}
+
+	alice, _ := file.Refresh("alice")
+	if len(alice.Users) != 1 || alice.Users[0].Name != "alice" || alice.Partition != "alice" {
+		t.Fatalf("incorrect partition: %v", alice)
+	}
+	global, _ := file.Refresh(providers.ScopeGlobal)
+	if len(global.Users) != 2 || len(global.Jobs) != 2 {
+		t.Fatalf("incorrect global scope: got %d users and %d jobs expected 2 and 2", len(global.Users), len(global.Jobs))
+	}
+
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("incorrect permissions: got %v expected %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+}
+
+func TestFileSavesGlobalScopeByOwner(t *testing.T) {
+	file := providers.NewFileProvider(filepath.Join(t.TempDir(), "db.yaml"))
+
+	global, _ := file.Refresh(providers.ScopeGlobal)
+	providers.CreateUser(&global, api.NewDefaultUser("alice"))
+	providers.CreateUser(&global, api.NewDefaultUser("bob"))
+	providers.CreateJob(&global, api.Job{Name: "work", Owner: "bob"})
+	file.Save(global.Partition, global)
+
+	bob, _ := file.Refresh("bob")
+	if len(bob.Users) != 1 || len(bob.Jobs) != 1 {
+		t.Fatalf("incorrect partition: got %d users and %d jobs expected 1 and 1", len(bob.Users), len(bob.Jobs))
+	}
+}
+
+func TestFileConcurrentWritersKeepPartitions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.yaml")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			// Separate providers, like the CLI and the server
+			file := providers.NewFileProvider(path)
+			state, _ := file.Refresh(name)
+			providers.CreateUser(&state, api.NewDefaultUser(name))
+			file.Save(state.Partition, state)
+		}(fmt.Sprintf("user%d", i))
+	}
+	wg.Wait()
+
+	global, err := providers.NewFileProvider(path).Refresh(providers.ScopeGlobal)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(global.Users) != 10 {
+		t.Fatalf("incorrect number of users: got %d expected %d", len(global.Users), 10)
+	}
+}
+
+func TestFileDetectsConcurrentChanges(t *testing.T) {
+	file := providers.NewFileProvider(filepath.Join(t.TempDir(), "db.yaml"))
+
+	first, _ := file.Refresh("me")
+	second, _ := file.Refresh("me")
+	providers.CreateUser(&first, api.NewDefaultUser("me"))
+	if err := file.Save(first.Partition, first); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	providers.CreateJob(&second, api.Job{Name: "work", Owner: "me"})
+	err := file.Save(second.Partition, second)
+	if !errors.Is(err, providers.ProviderConflict) || !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+
+	loaded, _ := file.Refresh("me")
+	if len(loaded.Users) != 1 || len(loaded.Jobs) != 0 {
+		t.Fatalf("incorrect state: got %d users and %d jobs expected 1 and 0", len(loaded.Users), len(loaded.Jobs))
+	}
+}
+
+func TestFileConcurrentRecordsAreNotLost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.yaml")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if _, err := providers.NewFileProvider(path).SaveRecord(api.Record{Id: id, UserName: "me"}); err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		}(fmt.Sprintf("rec%d", i))
+	}
+	wg.Wait()
+
+	me, _ := providers.NewFileProvider(path).Refresh("me")
+	if len(me.Records) != 10 {
+		t.Fatalf("incorrect number of records: got %d expected %d", len(me.Records), 10)
+	}
+}
+
+func TestFileSharesTemplatesAndReadsLegacyPartition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.yaml")
+	legacy := `file:
+  users:
+  - name: me
+  - name: other
+  jobs:
+  - name: work
+    owner: me
+  templates:
+  - template_name: default
+`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	file := providers.NewFileProvider(path)
+
+	me, _ := file.Refresh("me")
+	if len(me.Users) != 1 || len(me.Jobs) != 1 || len(me.Templates) != 1 {
+		t.Fatalf("incorrect partition: got %d users, %d jobs and %d templates expected 1, 1 and 1", len(me.Users), len(me.Jobs), len(me.Templates))
+	}
+	if err := file.Save(me.Partition, me); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	global, _ := file.Refresh(providers.ScopeGlobal)
+	if len(global.Users) != 2 || len(global.Templates) != 1 {
+		t.Fatalf("incorrect global scope: got %d users and %d templates expected 2 and 1", len(global.Users), len(global.Templates))
+	}
+	other, _ := file.Refresh("other")
+	if len(other.Users) != 1 || len(other.Templates) != 1 {
+		t.Fatalf("incorrect partition: got %d users and %d templates expected 1 and 1", len(other.Users), len(other.Templates))
+	}
+}
+
+func TestSaveRecordDerivesMissingIds(t *testing.T) {
+	kube, _ := NewKubernetesTestProvider()
+	services := map[string]interface {
+		SaveRecord(api.Record) (api.Record, error)
+		ListRecords(string, time.Time, time.Time) ([]api.Record, error)
+	}{
+		"file":       providers.NewFileProvider(filepath.Join(t.TempDir(), "db.yaml")),
+		"git":        NewGitTestProvider(t, t.TempDir()),
+		"kubernetes": kube,
+	}
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	rec := api.Record{UserName: "me", JobName: "work", Start: start, End: start.Add(time.Hour)}
+	for name, ts := range services {
+		// A retried SaveRecord must not create a second Record
+		ts.SaveRecord(rec)
+		saved, err := ts.SaveRecord(rec)
+		if err != nil || saved.Id != api.RecordId("me", "work", start, start.Add(time.Hour)) {
+			t.Fatalf("%s: incorrect record: got %v, %v", name, saved, err)
+		}
+		if records, _ := ts.ListRecords("me", start, start); len(records) != 1 {
+			t.Fatalf("%s: incorrect number of records: got %d expected 1", name, len(records))
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package providers
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+// GitStateFile is the name of the State file inside the git repository
+const GitStateFile string = "timerec.yaml"
+const GitDefaultPath string = "timerec-state"
+
+// GitProvider keeps the State in a file inside a git repository and commits every Save.
+// The commit message describes what changed, so `git log` is an audit trail of all time data.
+// If a remote is configured, it is pulled on startup and before every Save, and every commit is pushed. The remote is the
+// source of truth: a Save fails, while the remote is unreachable, and a rejected push drops the commit and returns a
+// VersionConflictError, so the caller retries with the remote's State. Requires the git binary
+type GitProvider struct {
+	Path   string
+	Remote string
+	file   *FileOrMemoryProvider
+	logger *zap.SugaredLogger
+
+	// mu serializes Save and commit within this process only. Other processes, that use the same repository, are serialized by
+	// the lock of the State file (see FileOrMemoryProvider). Other clones of the remote are not locked at all, they are
+	// detected by the version check after pulling and by rejected pushes
+	mu sync.Mutex
+	// identity is passed to every git command, if git has no user configured
+	identity []string
+}
+
+// StateChange is a single commit in the history of the State
+type StateChange struct {
+	Commit  string    `yaml:"commit" json:"commit"`
+	Author  string    `yaml:"author" json:"author"`
+	Time    time.Time `yaml:"time" json:"time"`
+	Message string    `yaml:"message" json:"message"`
+	Diff    string    `yaml:"diff,omitempty" json:"diff,omitempty"`
+}
+
+func NewGitProvider(logger zap.SugaredLogger, path, remote string) (*GitProvider, error) {
+	if path == "" {
+		path = GitDefaultPath
+	}
+	store := &GitProvider{
+		Path:   path,
+		Remote: remote,
+		file:   NewFileProvider(filepath.Join(path, GitStateFile)),
+		logger: logger.Named("Git"),
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	_, err := os.Stat(filepath.Join(path, ".git"))
+	switch {
+	case os.IsNotExist(err) && remote != "":
+		if _, err := store.git("clone", "--quiet", remote, "."); err != nil {
+			return nil, err
+		}
+		store.logger.Infof("Cloned %s into %s", remote, path)
+	case os.IsNotExist(err):
+		if _, err := store.git("init", "--quiet"); err != nil {
+			return nil, err
+		}
+		store.logger.Infof("Initialized git repository in %s", path)
+	case remote != "":
+		if _, err := store.git("pull", "--quiet", "--ff-only"); err != nil {
+			store.logger.Warnf("Unable to pull from %s: %v", remote, err)
+		}
+	}
+
+	// Commits need an identity, even if git is not configured on this machine
+	if _, err := store.git("config", "user.email"); err != nil {
+		store.identity = []string{"-c", "user.name=timerec", "-c", "user.email=timerec@localhost"}
+	}
+	return store, store.ignoreTemporaryFiles()
+}
+
+// ignoreTemporaryFiles adds the lock file and the temporary files of FileOrMemoryProvider to .gitignore
+func (store *GitProvider) ignoreTemporaryFiles() error {
+	path := filepath.Join(store.Path, ".gitignore")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	content := GitStateFile + ".lock\n." + GitStateFile + ".*\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		return err
+	}
+	if _, err := store.git("add", ".gitignore"); err != nil {
+		return err
+	}
+	_, err := store.git("commit", "--quiet", "-m", "ignore temporary files")
+	return err
+}
+
+func (store *GitProvider) Refresh(partition string) (StateV2, error) {
+	return store.file.Refresh(partition)
+}
+
+func (store *GitProvider) SchemaVersions() (map[string]int, error) {
+	return store.file.SchemaVersions()
+}
+
+// Save writes the State file and commits it. Saving a State without changes does not create a commit
+func (store *GitProvider) Save(partition string, state StateV2) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	// Changes from other clones are pulled first, so the version check of the State file notices them
+	if err := store.file.withLock(true, store.pull); err != nil {
+		return err
+	}
+	previous, err := store.file.Refresh(partition)
+	if err != nil {
+		return err
+	}
+	changes := DescribeChanges(previous, state)
+	if versions, _ := store.file.SchemaVersions(); versions[partition] != 0 && versions[partition] < StateSchemaVersion {
+		changes = append(changes, fmt.Sprintf("migrate partition %s to schema version %d", partition, StateSchemaVersion))
+	}
+	if len(changes) == 0 {
+		return nil // Saving would only increment the version
+	}
+	err = store.file.Save(partition, state)
+	if err != nil {
+		return err
+	}
+
+	return store.file.withLock(true, func() error {
+		if err := store.commit(changes); err != nil {
+			return err
+		}
+		return store.push(partition, state.Version)
+	})
+}
+
+// pull rebases local commits onto the remote. Without a remote, or if the remote has no commits yet, there is nothing to pull
+func (store *GitProvider) pull() error {
+	if store.Remote == "" {
+		return nil
+	}
+	if _, err := store.git("fetch", "--quiet"); err != nil {
+		return fmt.Errorf("unable to pull from %s: %w", store.Remote, err)
+	}
+	if _, err := store.git("rev-parse", "--verify", "--quiet", "@{upstream}"); err != nil {
+		return nil
+	}
+	if _, err := store.git("rebase", "--quiet", "@{upstream}"); err != nil {
+		store.git("rebase", "--abort")
+		return fmt.Errorf("unable to pull from %s: %w", store.Remote, err)
+	}
+	return nil
+}
+
+// push pushes the commits of a Save. If the push fails, the commit is dropped, because the remote is the source of truth
+func (store *GitProvider) push(partition, version string) error {
+	if store.Remote == "" {
+		return nil
+	}
+	_, err := store.git("push", "--quiet")
+	if err == nil {
+		return nil
+	}
+	store.logger.Warnf("Unable to push to %s: %v", store.Remote, err)
+	if _, resetErr := store.git("reset", "--quiet", "--hard", "@{upstream}"); resetErr != nil {
+		return fmt.Errorf("unable to push to %s, the commit is kept locally: %w", store.Remote, err)
+	}
+	return fmt.Errorf("unable to push to %s: %v: %w", store.Remote, err, VersionConflictError{Partition: partition, Expected: version, Actual: "unknown"})
+}
+
+func (store *GitProvider) commit(changes []string) error {
+	if _, err := store.git("add", GitStateFile); err != nil {
+		return err
+	}
+	if _, err := store.git("diff", "--cached", "--quiet"); err == nil {
+		return nil // Nothing changed
+	}
+
+	subject := changes[0]
+	if len(changes) > 1 {
+		subject = fmt.Sprintf("%s and %d more changes", changes[0], len(changes)-1)
+	}
+	message := subject
+	if len(changes) > 1 {
+		message += "\n\n- " + strings.Join(changes, "\n- ")
+	}
+	if _, err := store.git("commit", "--quiet", "-m", message); err != nil {
+		return err
+	}
+	store.logger.Debugf("Committed: %s", subject)
+	return nil
+}
+
+func (store *GitProvider) SaveRecord(rec api.Record) (api.Record, error) {
+	if rec.Id == "" {
+		rec.Id = api.RecordId(rec.UserName, rec.JobName, rec.Start, rec.End)
+	}
+	data, err := store.Refresh(rec.UserName)
+	if err != nil {
+		return api.Record{}, err
+	}
+	if SaveRecord(&data, rec) == ProviderConflict {
+		existing, _ := GetRecord(&data, rec.Id)
+		return existing, nil // already saved
+	}
+	err = store.Save(data.Partition, data)
+	return rec, err
+}
+
+func (store *GitProvider) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	return store.file.ListRecords(user, from, to)
+}
+
+func (store *GitProvider) UpdateRecord(rec api.Record) (api.Record, error) {
+	data, err := store.Refresh(rec.UserName)
+	if err != nil {
+		return api.Record{}, err
+	}
+	proverr := UpdateRecord(&data, rec)
+	if proverr != ProviderOk {
+		return api.Record{}, proverr
+	}
+	return rec, store.Save(data.Partition, data)
+}
+
+func (store *GitProvider) DeleteRecord(rec api.Record) (api.Record, error) {
+	data, err := store.Refresh(rec.UserName)
+	if err != nil {
+		return api.Record{}, err
+	}
+	deleted, proverr := DeleteRecord(&data, rec)
+	if proverr != ProviderOk {
+		return api.Record{}, proverr
+	}
+	return deleted, store.Save(data.Partition, data)
+}
+
+// History returns the latest commits, newest first. With patch, every StateChange contains the diff of the State file
+func (store *GitProvider) History(limit int, patch bool) ([]StateChange, error) {
+	out, err := store.git("log", "-n", strconv.Itoa(limit), "--format=%H%x1f%an%x1f%aI%x1f%B%x1e", "--", GitStateFile)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not have any commits") {
+			return []StateChange{}, nil
+		}
+		return []StateChange{}, err
+	}
+
+	changes := []StateChange{}
+	for _, entry := range strings.Split(out, "\x1e") {
+		fields := strings.Split(strings.TrimSpace(entry), "\x1f")
+		if len(fields) != 4 {
+			continue
+		}
+		commitTime, _ := time.Parse(time.RFC3339, fields[2])
+		change := StateChange{Commit: fields[0], Author: fields[1], Time: commitTime, Message: strings.TrimSpace(fields[3])}
+		if patch {
+			change.Diff, err = store.git("show", "--format=", change.Commit, "--", GitStateFile)
+			if err != nil {
+				return changes, err
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// git runs a git command in the repository
+func (store *GitProvider) git(args ...string) (string, error) {
+	cmd := exec.Command("git", append(append([]string{}, store.identity...), args...)...)
+	cmd.Dir = store.Path
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// DescribeChanges lists the changes between two States in words, e.g. "start activity X for user me"
+func DescribeChanges(previous, current StateV2) []string {
+	changes := []string{}
+
+	oldUsers := map[string]api.User{}
+	for _, u := range previous.Users {
+		oldUsers[u.Name] = u
+	}
+	for _, u := range current.Users {
+		old, ok := oldUsers[u.Name]
+		delete(oldUsers, u.Name)
+		if !ok {
+			changes = append(changes, fmt.Sprintf("create user %s", u.Name))
+			continue
+		}
+		changes = append(changes, describeActivity(u.Name, old.Activity, u.Activity)...)
+		if !reflect.DeepEqual(old.Settings, u.Settings) || old.Inactive != u.Inactive {
+			changes = append(changes, fmt.Sprintf("update settings for user %s", u.Name))
+		}
+	}
+
+	for _, name := range sortedKeys(oldUsers) {
+		changes = append(changes, fmt.Sprintf("delete user %s", name))
+	}
+
+	oldJobs := map[string]api.Job{}
+	for _, j := range previous.Jobs {
+		oldJobs[j.Owner+"/"+j.Name] = j
+	}
+	for _, j := range current.Jobs {
+		old, ok := oldJobs[j.Owner+"/"+j.Name]
+		delete(oldJobs, j.Owner+"/"+j.Name)
+		if !ok {
+			changes = append(changes, fmt.Sprintf("create job %s for user %s", j.Name, j.Owner))
+		} else if !reflect.DeepEqual(old, j) {
+			changes = append(changes, fmt.Sprintf("update job %s for user %s", j.Name, j.Owner))
+		}
+	}
+	for _, key := range sortedKeys(oldJobs) {
+		changes = append(changes, fmt.Sprintf("complete job %s for user %s", oldJobs[key].Name, oldJobs[key].Owner))
+	}
+
+	oldTemplates := map[string]api.RecordTemplate{}
+	for _, t := range previous.Templates {
+		oldTemplates[t.TemplateName] = t
+	}
+	for _, t := range current.Templates {
+		old, ok := oldTemplates[t.TemplateName]
+		delete(oldTemplates, t.TemplateName)
+		if !ok {
+			changes = append(changes, fmt.Sprintf("create template %s", t.TemplateName))
+		} else if old != t {
+			changes = append(changes, fmt.Sprintf("update template %s", t.TemplateName))
+		}
+	}
+	for _, name := range sortedKeys(oldTemplates) {
+		changes = append(changes, fmt.Sprintf("delete template %s", name))
+	}
+
+	oldRecords := map[string]api.Record{}
+	for _, r := range previous.Records {
+		oldRecords[r.Id] = r
+	}
+	for _, r := range current.Records {
+		old, ok := oldRecords[r.Id]
+		delete(oldRecords, r.Id)
+		if !ok {
+			changes = append(changes, fmt.Sprintf("save record '%s' for user %s", r.Title, r.UserName))
+		} else if !reflect.DeepEqual(old, r) {
+			changes = append(changes, fmt.Sprintf("update record '%s' for user %s", r.Title, r.UserName))
+		}
+	}
+	for _, id := range sortedKeys(oldRecords) {
+		changes = append(changes, fmt.Sprintf("delete record '%s' for user %s", oldRecords[id].Title, oldRecords[id].UserName))
+	}
+
+	oldOutbox := map[string]PendingRecord{}
+	for _, p := range previous.Outbox {
+		oldOutbox[p.Record.Id] = p
+	}
+	queued, retried := 0, 0
+	for _, p := range current.Outbox {
+		old, ok := oldOutbox[p.Record.Id]
+		delete(oldOutbox, p.Record.Id)
+		if !ok {
+			queued++
+		} else if !reflect.DeepEqual(old, p) {
+			retried++
+		}
+	}
+	if queued > 0 {
+		changes = append(changes, fmt.Sprintf("queue %d records for delivery", queued))
+	}
+	if retried > 0 {
+		changes = append(changes, fmt.Sprintf("retry delivery of %d records", retried))
+	}
+	if len(oldOutbox) > 0 {
+		changes = append(changes, fmt.Sprintf("deliver %d records", len(oldOutbox)))
+	}
+	return changes
+}
+
+func describeActivity(user string, old, current api.Activity) []string {
+	switch {
+	case old.ActivityName == "" && current.ActivityName != "":
+		return []string{fmt.Sprintf("start activity %s for user %s", current.ActivityName, user)}
+	case old.ActivityName != "" && current.ActivityName == "":
+		return []string{fmt.Sprintf("finish activity %s for user %s", old.ActivityName, user)}
+	case old.ActivityName != current.ActivityName:
+		return []string{fmt.Sprintf("finish activity %s for user %s", old.ActivityName, user), fmt.Sprintf("start activity %s for user %s", current.ActivityName, user)}
+	case old != current:
+		return []string{fmt.Sprintf("extend activity %s for user %s", current.ActivityName, user)}
+	}
+	return []string{}
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
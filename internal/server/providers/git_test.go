@@ -0,0 +1,137 @@
+package providers_test
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+func NewGitTestProvider(t *testing.T, path string) *providers.GitProvider {
+	return NewGitTestProviderWithRemote(t, path, "")
+}
+
+func NewGitTestProviderWithRemote(t *testing.T, path, remote string) *providers.GitProvider {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	logger, _ := zap.NewDevelopment()
+	store, err := providers.NewGitProvider(*logger.Sugar(), path, remote)
+	if err != nil {
+		t.Fatalf("unable to create git provider: %v", err)
+	}
+	return store
+}
+
+func TestGitCommitsEverySave(t *testing.T) {
+	store := NewGitTestProvider(t, t.TempDir())
+
+	state, _ := store.Refresh("me")
+	providers.CreateUser(&state, api.NewDefaultUser("me"))
+	store.Save(state.Partition, state)
+
+	state, _ = store.Refresh("me")
+	state.Users[0].Activity = api.Activity{ActivityName: "OPS-1", ActivityStart: time.Now()}
+	store.Save(state.Partition, state)
+
+	// Saving without changes does not create a commit
+	state, _ = store.Refresh("me")
+	store.Save(state.Partition, state)
+
+	history, err := store.History(10, true)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("incorrect number of commits: got %d expected %d", len(history), 2)
+	}
+	if history[0].Message != "start activity OPS-1 for user me" {
+		t.Fatalf("incorrect message: got %q expected %q", history[0].Message, "start activity OPS-1 for user me")
+	}
+	if !strings.Contains(history[0].Diff, "+      activity_name: OPS-1") {
+		t.Fatalf("expected diff of the State file, got %s", history[0].Diff)
+	}
+}
+
+func TestGitKeepsFileSemantics(t *testing.T) {
+	path := t.TempDir()
+	store := NewGitTestProvider(t, path)
+
+	first, _ := store.Refresh("me")
+	second, _ := store.Refresh("me")
+	providers.CreateUser(&first, api.NewDefaultUser("me"))
+	store.Save(first.Partition, first)
+	providers.CreateJob(&second, api.Job{Name: "work", Owner: "me"})
+	err := store.Save(second.Partition, second)
+	if !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+
+	// An existing repository is reused
+	loaded, _ := NewGitTestProvider(t, path).Refresh("me")
+	if len(loaded.Users) != 1 {
+		t.Fatalf("incorrect number of users: got %d expected %d", len(loaded.Users), 1)
+	}
+}
+
+func TestGitPullsBeforeSave(t *testing.T) {
+	remote := t.TempDir()
+	if out, err := exec.Command("git", "init", "--quiet", "--bare", remote).CombinedOutput(); err != nil {
+		t.Skipf("unable to create remote: %v: %s", err, out)
+	}
+	first := NewGitTestProviderWithRemote(t, t.TempDir(), remote)
+	state, _ := first.Refresh("me")
+	providers.CreateUser(&state, api.NewDefaultUser("me"))
+	if err := first.Save(state.Partition, state); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	second := NewGitTestProviderWithRemote(t, t.TempDir(), remote)
+	stale, _ := first.Refresh("me")
+	state, _ = second.Refresh("me")
+	providers.CreateJob(&state, api.Job{Name: "work", Owner: "me"})
+	if err := second.Save(state.Partition, state); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// The first clone has not seen the Job yet. The pull before Save notices the conflict
+	providers.CreateJob(&stale, api.Job{Name: "other", Owner: "me"})
+	err := first.Save(stale.Partition, stale)
+	if !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+	fresh, _ := first.Refresh("me")
+	providers.CreateJob(&fresh, api.Job{Name: "other", Owner: "me"})
+	if err := first.Save(fresh.Partition, fresh); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	second.Save(state.Partition, state) // only pulls, the State is outdated
+	loaded, _ := second.Refresh("me")
+	if len(loaded.Jobs) != 2 {
+		t.Fatalf("incorrect number of jobs: got %d expected %d", len(loaded.Jobs), 2)
+	}
+}
+
+func TestDescribeChanges(t *testing.T) {
+	previous := providers.StateV2{
+		Users: []api.User{{Name: "me", Activity: api.Activity{ActivityName: "OPS-1"}}},
+		Jobs:  []api.Job{{Name: "OPS-1", Owner: "me"}},
+	}
+	current := providers.StateV2{
+		Users:   []api.User{{Name: "me"}},
+		Records: []api.Record{{Id: "abc", UserName: "me", Title: "Fix"}},
+	}
+
+	changes := providers.DescribeChanges(previous, current)
+	expected := []string{"finish activity OPS-1 for user me", "complete job OPS-1 for user me", "save record 'Fix' for user me"}
+	if strings.Join(changes, ";") != strings.Join(expected, ";") {
+		t.Fatalf("incorrect changes: got %v expected %v", changes, expected)
+	}
+}
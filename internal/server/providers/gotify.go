@@ -0,0 +1,106 @@
+package providers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+// gotifyPriorities map EventTypes to the priority of a Gotify message. The Android app alerts from priority 8 on
+var gotifyPriorities = map[api.EventType]int{
+	api.EventTypeTimerExpired: 8,
+	api.EventTypeNoEntryAlarm: 5,
+}
+
+// GotifyProvider sends Messages to a Gotify server. Every User has their own application token in Settings.Notifications.Gotify,
+// Users without a token are skipped. Gotify has no buttons, so actions are links in a markdown message
+type GotifyProvider struct {
+	Server  string
+	Actions *ActionLinks
+
+	settings SettingsLookup
+	client   *http.Client
+	logger   *zap.SugaredLogger
+}
+
+func NewGotifyProvider(logger zap.SugaredLogger, server string, actions *ActionLinks, settings SettingsLookup) (*GotifyProvider, error) {
+	if err := validateUrl("Gotify server", server); err != nil {
+		return nil, err
+	}
+	return &GotifyProvider{
+		Server:   server,
+		Actions:  actions,
+		settings: settings,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger.Named("Gotify"),
+	}, nil
+}
+
+func (prov *GotifyProvider) NotifyUser(ev cloudevents.Event) error {
+	msg, err := api.MessageFromEvent(ev)
+	if err != nil {
+		return fmt.Errorf("unable to read Message of Event %s: %w", ev.ID(), err)
+	}
+	settings, err := prov.settings(msg.UserName())
+	if err != nil {
+		return fmt.Errorf("unable to read Settings of User '%s': %w", msg.UserName(), err)
+	}
+
+	gotify := settings.Notifications.Gotify
+	if gotify.Server == "" {
+		gotify.Server = prov.Server
+	}
+	if gotify.Token == "" || gotify.Server == "" {
+		prov.logger.Debugf("No Gotify token for User '%s', skipping Event %s", msg.UserName(), ev.ID())
+		return nil
+	}
+	header := http.Header{}
+	header.Set("X-Gotify-Key", gotify.Token)
+
+	payload := gotifyMessage(msg, prov.Actions.Actions(msg, settings))
+	if err := postJson(prov.client, strings.TrimSuffix(gotify.Server, "/")+"/message", header, payload); err != nil {
+		prov.logger.Warnf("Failed to send Event %s to Gotify: %v", ev.ID(), err)
+		return err
+	}
+	prov.logger.Debugf("Event %s sent to Gotify", ev.ID())
+	return nil
+}
+
+// gotifyPayload is a message for the Gotify API. Extras tell the clients to render markdown
+type gotifyPayload struct {
+	Title    string                            `json:"title"`
+	Message  string                            `json:"message"`
+	Priority int                               `json:"priority"`
+	Extras   map[string]map[string]interface{} `json:"extras,omitempty"`
+}
+
+func gotifyMessage(msg api.Message, actions []chatAction) gotifyPayload {
+	priority, ok := gotifyPriorities[msg.Event]
+	if !ok {
+		priority = 5
+	}
+	payload := gotifyPayload{
+		Title:    chatTitle(msg),
+		Message:  msg.Message,
+		Priority: priority,
+	}
+	if len(actions) == 0 {
+		return payload
+	}
+
+	links := []string{}
+	for _, action := range actions {
+		links = append(links, fmt.Sprintf("[%s](%s)", action.Label, action.Url))
+	}
+	payload.Message = fmt.Sprintf("%s\n\n%s", msg.Message, strings.Join(links, " | "))
+	payload.Extras = map[string]map[string]interface{}{
+		"client::display": {"contentType": "text/markdown"},
+	}
+	return payload
+}
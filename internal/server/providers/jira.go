@@ -0,0 +1,392 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+// JiraTimeFormat is the format Jira expects for the "started" field of a worklog
+const JiraTimeFormat string = "2006-01-02T15:04:05.000-0700"
+
+var JiraIssueKeyPattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]+-[0-9]+$`)
+
+// JiraProvider is a TimeService writing Records as worklogs to Jira issues (which is also where Tempo reads them from).
+// The issue is taken from Record.Task if it is an issue key, otherwise from the name of the Job
+type JiraProvider struct {
+	Url   string
+	User  string
+	Token string
+
+	client *http.Client
+	logger *zap.SugaredLogger
+}
+
+type jiraUser struct {
+	AccountId string `json:"accountId,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+// Is compares users by accountId on Jira Cloud and by name on Jira Server/DataCenter
+func (u jiraUser) Is(other jiraUser) bool {
+	if u.AccountId != "" || other.AccountId != "" {
+		return u.AccountId == other.AccountId
+	}
+	return u.Name == other.Name
+}
+
+type jiraWorklog struct {
+	Id               string    `json:"id,omitempty"`
+	Author           *jiraUser `json:"author,omitempty"`
+	Comment          string    `json:"comment,omitempty"`
+	Started          string    `json:"started"`
+	TimeSpentSeconds int       `json:"timeSpentSeconds"`
+}
+
+// JiraError is returned for every non-2xx response and reports which worklog could not be written
+type JiraError struct {
+	Issue      string
+	Start      time.Time
+	StatusCode int
+	Messages   []string
+}
+
+func (e JiraError) Error() string {
+	return fmt.Sprintf("worklog on %s started at %s failed with status %d: %s", e.Issue, e.Start.Format(time.RFC3339), e.StatusCode, strings.Join(e.Messages, ", "))
+}
+
+// Unwrap maps the HTTP status to the matching ProviderReturnType
+func (e JiraError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return ProviderNotFound
+	case http.StatusForbidden:
+		return ProviderForbidden
+	case http.StatusConflict:
+		return ProviderConflict
+	}
+	return nil
+}
+
+func NewJiraProvider(logger zap.SugaredLogger, url, user, token string) (*JiraProvider, error) {
+	if url == "" || token == "" {
+		return nil, fmt.Errorf("jira requires an url and a token")
+	}
+
+	return &JiraProvider{
+		Url:    strings.TrimSuffix(url, "/"),
+		User:   user,
+		Token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+		logger: logger.Named("Jira"),
+	}, nil
+}
+
+// JiraIssueForRecord returns the issue key a Record should be logged on
+func JiraIssueForRecord(rec api.Record) (string, error) {
+	if JiraIssueKeyPattern.MatchString(rec.Task) {
+		return rec.Task, nil
+	}
+	if JiraIssueKeyPattern.MatchString(rec.JobName) {
+		return rec.JobName, nil
+	}
+	return "", fmt.Errorf("neither task '%s' nor job '%s' is a jira issue key", rec.Task, rec.JobName)
+}
+
+func (jira *JiraProvider) SaveRecord(rec api.Record) (api.Record, error) {
+	issue, err := JiraIssueForRecord(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+
+	existing, err := jira.findExisting(issue, rec)
+	if err != nil {
+		return api.Record{}, withWorklog(err, issue, rec.Start)
+	}
+	if existing != "" {
+		jira.logger.Infof("Worklog %s on %s already exists", existing, issue)
+		return rec, nil
+	}
+
+	worklog := worklogFromRecord(rec)
+	worklog.Comment = RecordTextWithId(rec)
+	var created jiraWorklog
+	err = jira.request(http.MethodPost, "/rest/api/2/issue/"+issue+"/worklog", worklog, &created)
+	if err != nil {
+		err = withWorklog(err, issue, rec.Start)
+		jira.logger.Warn(err)
+		return api.Record{}, err
+	}
+
+	jira.logger.Infof("Created worklog %s on %s", created.Id, issue)
+	return rec, nil
+}
+
+// jiraRecord is a Record read from a worklog and the location of that worklog
+type jiraRecord struct {
+	api.Record
+	Issue     string
+	WorklogId string
+}
+
+// ListRecords returns the worklogs of the current Jira user, that were saved for the User and started in the given time range.
+// Record.Id is the Id in the marker of the worklog
+func (jira *JiraProvider) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	list, err := jira.listRecords(user, from, to)
+	if err != nil {
+		return []api.Record{}, err
+	}
+	records := []api.Record{}
+	for _, rec := range list {
+		records = append(records, rec.Record)
+	}
+	return records, nil
+}
+
+func (jira *JiraProvider) listRecords(user string, from, to time.Time) ([]jiraRecord, error) {
+	var myself jiraUser
+	err := jira.request(http.MethodGet, "/rest/api/2/myself", nil, &myself)
+	if err != nil {
+		return []jiraRecord{}, err
+	}
+
+	var search struct {
+		Issues []struct {
+			Key string `json:"key"`
+		} `json:"issues"`
+	}
+	query := url.Values{}
+	query.Set("jql", fmt.Sprintf(`worklogAuthor = currentUser() AND worklogDate >= "%s" AND worklogDate <= "%s"`, from.Format("2006-01-02"), to.Format("2006-01-02")))
+	query.Set("fields", "key")
+	query.Set("maxResults", "1000")
+	err = jira.request(http.MethodGet, "/rest/api/2/search?"+query.Encode(), nil, &search)
+	if err != nil {
+		return []jiraRecord{}, err
+	}
+
+	records := []jiraRecord{}
+	for _, issue := range search.Issues {
+		worklogs, err := jira.listWorklogs(issue.Key)
+		if err != nil {
+			return []jiraRecord{}, err
+		}
+
+		for _, worklog := range worklogs {
+			start, _ := time.Parse(JiraTimeFormat, worklog.Started)
+			if worklog.Author == nil || !worklog.Author.Is(myself) || RecordOwnerFromText(worklog.Comment) != user || start.Before(from) || start.After(to) {
+				continue
+			}
+			title, desc := SplitRecordText(worklog.Comment)
+			records = append(records, jiraRecord{
+				Record: api.Record{
+					Id:          RecordIdFromText(worklog.Comment),
+					UserName:    user,
+					JobName:     issue.Key,
+					Title:       title,
+					Description: desc,
+					Project:     strings.SplitN(issue.Key, "-", 2)[0],
+					Task:        issue.Key,
+					Start:       start,
+					End:         start.Add(time.Duration(worklog.TimeSpentSeconds) * time.Second),
+				},
+				Issue:     issue.Key,
+				WorklogId: worklog.Id,
+			})
+		}
+	}
+	return records, nil
+}
+
+func (jira *JiraProvider) listWorklogs(issue string) ([]jiraWorklog, error) {
+	var list struct {
+		Worklogs []jiraWorklog `json:"worklogs"`
+	}
+	err := jira.request(http.MethodGet, "/rest/api/2/issue/"+issue+"/worklog", nil, &list)
+	if err != nil {
+		return []jiraWorklog{}, err
+	}
+	return list.Worklogs, nil
+}
+
+// findExisting returns the ID of a worklog on the issue, that was already created for the Record or an empty string
+func (jira *JiraProvider) findExisting(issue string, rec api.Record) (string, error) {
+	if rec.Id == "" {
+		return "", nil
+	}
+	worklogs, err := jira.listWorklogs(issue)
+	if err != nil {
+		return "", err
+	}
+	for _, worklog := range worklogs {
+		if RecordIdFromText(worklog.Comment) == rec.Id {
+			return worklog.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// worklogOf returns the issue and ID of the worklog of a Record. The worklog is found by the Id in its marker, IDs in the format
+// ISSUE:WORKLOG_ID (e.g. of Records listed by older versions) are used directly
+func (jira *JiraProvider) worklogOf(rec api.Record) (string, string, error) {
+	if issue, worklogId, err := splitJiraRecordId(rec.Id); err == nil {
+		return issue, worklogId, nil
+	}
+	if rec.Id == "" {
+		return "", "", fmt.Errorf("jira worklog of a record without id: %w", ProviderNotFound)
+	}
+	from, to := RecordLookupRange(rec)
+	records, err := jira.listRecords(rec.UserName, from, to)
+	if err != nil {
+		return "", "", err
+	}
+	for _, r := range records {
+		if r.Id == rec.Id {
+			return r.Issue, r.WorklogId, nil
+		}
+	}
+	return "", "", fmt.Errorf("jira worklog of record '%s': %w", rec.Id, ProviderNotFound)
+}
+
+// checkOwner returns the worklog of the Record, if it belongs to the User of the Record
+func (jira *JiraProvider) checkOwner(issue, worklogId string, rec api.Record) (jiraWorklog, error) {
+	var existing jiraWorklog
+	err := jira.request(http.MethodGet, "/rest/api/2/issue/"+issue+"/worklog/"+worklogId, nil, &existing)
+	if err != nil {
+		return jiraWorklog{}, withWorklog(err, issue, rec.Start)
+	}
+	return existing, CheckRecordOwner(existing.Comment, rec)
+}
+
+func (jira *JiraProvider) UpdateRecord(rec api.Record) (api.Record, error) {
+	issue, worklogId, err := jira.worklogOf(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	existing, err := jira.checkOwner(issue, worklogId, rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+
+	worklog := worklogFromRecord(rec)
+	worklog.Comment = KeepRecordMarker(worklog.Comment, existing.Comment)
+	err = jira.request(http.MethodPut, "/rest/api/2/issue/"+issue+"/worklog/"+worklogId, worklog, nil)
+	if err != nil {
+		return api.Record{}, withWorklog(err, issue, rec.Start)
+	}
+	jira.logger.Infof("Updated worklog %s on %s", worklogId, issue)
+	return rec, nil
+}
+
+func (jira *JiraProvider) DeleteRecord(rec api.Record) (api.Record, error) {
+	issue, worklogId, err := jira.worklogOf(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	if _, err := jira.checkOwner(issue, worklogId, rec); err != nil {
+		return api.Record{}, err
+	}
+
+	err = jira.request(http.MethodDelete, "/rest/api/2/issue/"+issue+"/worklog/"+worklogId, nil, nil)
+	if err != nil {
+		return api.Record{}, withWorklog(err, issue, rec.Start)
+	}
+	jira.logger.Infof("Deleted worklog %s on %s", worklogId, issue)
+	return rec, nil
+}
+
+func worklogFromRecord(rec api.Record) jiraWorklog {
+	return jiraWorklog{
+		Comment:          RecordText(rec),
+		Started:          rec.Start.Format(JiraTimeFormat),
+		TimeSpentSeconds: int(rec.End.Sub(rec.Start).Seconds()),
+	}
+}
+
+func splitJiraRecordId(id string) (string, string, error) {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 || !JiraIssueKeyPattern.MatchString(parts[0]) {
+		return "", "", fmt.Errorf("invalid jira record id '%s': %w", id, ProviderNotFound)
+	}
+	return parts[0], parts[1], nil
+}
+
+// withWorklog adds issue and start time to errors returned by Jira
+func withWorklog(err error, issue string, start time.Time) error {
+	if jiraErr, ok := err.(JiraError); ok {
+		jiraErr.Issue = issue
+		jiraErr.Start = start
+		return jiraErr
+	}
+	return err
+}
+
+func (jira *JiraProvider) request(method, path string, body interface{}, out interface{}) error {
+	var payload bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&payload).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, jira.Url+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if jira.User != "" {
+		// Jira Cloud uses E-Mail + API-Token
+		req.SetBasicAuth(jira.User, jira.Token)
+	} else {
+		// Jira Server/DataCenter uses Personal Access Tokens
+		req.Header.Set("Authorization", "Bearer "+jira.Token)
+	}
+
+	resp, err := jira.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return parseJiraError(resp, content)
+	}
+
+	if out == nil || len(content) == 0 {
+		return nil
+	}
+	return json.Unmarshal(content, out)
+}
+
+func parseJiraError(resp *http.Response, content []byte) JiraError {
+	var body struct {
+		ErrorMessages []string          `json:"errorMessages"`
+		Errors        map[string]string `json:"errors"`
+	}
+	jiraErr := JiraError{StatusCode: resp.StatusCode}
+
+	if json.Unmarshal(content, &body) != nil {
+		jiraErr.Messages = []string{resp.Status}
+		return jiraErr
+	}
+	jiraErr.Messages = append(jiraErr.Messages, body.ErrorMessages...)
+	for field, message := range body.Errors {
+		jiraErr.Messages = append(jiraErr.Messages, field+": "+message)
+	}
+	if len(jiraErr.Messages) == 0 {
+		jiraErr.Messages = []string{resp.Status}
+	}
+	return jiraErr
+}
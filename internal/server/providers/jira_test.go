@@ -0,0 +1,125 @@
+package providers_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+	"go.uber.org/zap"
+)
+
+func TestJiraIssueForRecord(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		rec      api.Record
+		expected string
+	}{
+		{desc: "task", rec: api.Record{Task: "OPS-1", JobName: "TICKET-13"}, expected: "OPS-1"},
+		{desc: "job", rec: api.Record{Task: "Development", JobName: "TICKET-13"}, expected: "TICKET-13"},
+		{desc: "none", rec: api.Record{Task: "Development", JobName: "meeting"}, expected: ""},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			actual, _ := providers.JiraIssueForRecord(tC.rec)
+			if actual != tC.expected {
+				t.Fatalf("incorrect issue: got %s expected %s", actual, tC.expected)
+			}
+		})
+	}
+}
+
+func TestJiraSaveRecord(t *testing.T) {
+	worklogs := map[string]map[string]interface{}{}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/rest/api/2/issue/TICKET-13/worklog" {
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte(`{"errorMessages": ["Issue does not exist or you do not have permission to see it."], "errors": {}}`))
+			return
+		}
+		worklog := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&worklog)
+		worklogs[r.URL.Path] = worklog
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write([]byte(`{"id": "10001"}`))
+	}))
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	jira, _ := providers.NewJiraProvider(*logger.Sugar(), srv.URL, "", "secret")
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	_, err := jira.SaveRecord(api.Record{JobName: "TICKET-13", Task: "Development", Title: "Fix", Start: start, End: start.Add(90 * time.Minute)})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	worklog := worklogs["/rest/api/2/issue/TICKET-13/worklog"]
+	if worklog["timeSpentSeconds"] != float64(5400) || worklog["started"] != "2022-03-01T09:00:00.000+0000" {
+		t.Fatalf("incorrect worklog: %v", worklog)
+	}
+
+	_, err = jira.SaveRecord(api.Record{JobName: "OTHER-1", Task: "Development", Title: "Fix", Start: start, End: start.Add(time.Hour)})
+	var jiraErr providers.JiraError
+	if !errors.As(err, &jiraErr) {
+		t.Fatalf("expected JiraError, got %v", err)
+	}
+	if jiraErr.Issue != "OTHER-1" || jiraErr.StatusCode != http.StatusNotFound || len(jiraErr.Messages) != 1 {
+		t.Fatalf("incorrect error: %v", jiraErr)
+	}
+}
+
+func TestJiraRecordsKeepTheirId(t *testing.T) {
+	deleted := []string{}
+	worklog := `{"id": "10001", "author": {"name": "me"}, "comment": "Fix\ntimerec:me/abc", "started": "%s", "timeSpentSeconds": 3600}`
+	started := time.Now().Add(-time.Hour).Format(providers.JiraTimeFormat)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rest/api/2/myself", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`{"name": "me"}`))
+	})
+	mux.HandleFunc("/rest/api/2/search", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`{"issues": [{"key": "TICKET-13"}]}`))
+	})
+	mux.HandleFunc("/rest/api/2/issue/TICKET-13/worklog", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`{"worklogs": [` + fmt.Sprintf(worklog, started) + `]}`))
+	})
+	mux.HandleFunc("/rest/api/2/issue/TICKET-13/worklog/10001", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			deleted = append(deleted, r.URL.Path)
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		rw.Write([]byte(fmt.Sprintf(worklog, started)))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	jira, _ := providers.NewJiraProvider(*logger.Sugar(), srv.URL, "", "secret")
+
+	saved, err := jira.SaveRecord(api.Record{Id: "abc", UserName: "me", JobName: "TICKET-13", Title: "Fix", Start: time.Now().Add(-time.Hour), End: time.Now()})
+	if err != nil || saved.Id != "abc" {
+		t.Fatalf("expected the id of the record, got %v, %v", saved.Id, err)
+	}
+	records, err := jira.ListRecords("me", time.Now().Add(-2*time.Hour), time.Now())
+	if err != nil || len(records) != 1 || records[0].Id != "abc" {
+		t.Fatalf("incorrect records: got %v, %v", records, err)
+	}
+
+	// The worklog is found by the Id in its marker
+	if _, err := jira.DeleteRecord(api.Record{Id: "abc", UserName: "me"}); err != nil || len(deleted) != 1 {
+		t.Fatalf("expected the worklog to be deleted, got %v, %v", deleted, err)
+	}
+	if _, err := jira.DeleteRecord(api.Record{Id: "xyz", UserName: "me"}); !errors.Is(err, providers.ProviderNotFound) {
+		t.Fatalf("expected %v, got %v", providers.ProviderNotFound, err)
+	}
+}
@@ -0,0 +1,318 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+// KimaiTimeFormat is the (timezone-less) format Kimai expects for begin and end of a timesheet
+const KimaiTimeFormat string = "2006-01-02T15:04:05"
+
+// KimaiResponseTimeFormat is the format Kimai uses in responses
+const KimaiResponseTimeFormat string = "2006-01-02T15:04:05-0700"
+
+// KimaiProvider is a TimeService writing Records as timesheets to a self-hosted Kimai instance.
+// Record.Project is mapped to a Kimai project, Record.Task to an activity
+type KimaiProvider struct {
+	Url   string
+	User  string
+	Token string
+
+	client *http.Client
+	logger *zap.SugaredLogger
+}
+
+type kimaiNamedItem struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type kimaiTimesheet struct {
+	Id          int    `json:"id,omitempty"`
+	Begin       string `json:"begin"`
+	End         string `json:"end"`
+	Project     int    `json:"project"`
+	Activity    int    `json:"activity"`
+	Description string `json:"description,omitempty"`
+}
+
+// kimaiTimesheetDetails is the expanded timesheet returned by the list endpoint
+type kimaiTimesheetDetails struct {
+	Id          int            `json:"id"`
+	Begin       string         `json:"begin"`
+	End         string         `json:"end"`
+	Description string         `json:"description"`
+	Project     kimaiNamedItem `json:"project"`
+	Activity    kimaiNamedItem `json:"activity"`
+}
+
+type kimaiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func NewKimaiProvider(logger zap.SugaredLogger, url, user, token string) (*KimaiProvider, error) {
+	if url == "" || token == "" {
+		return nil, fmt.Errorf("kimai requires an url and an api token")
+	}
+
+	return &KimaiProvider{
+		Url:    strings.TrimSuffix(url, "/"),
+		User:   user,
+		Token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+		logger: logger.Named("Kimai"),
+	}, nil
+}
+
+func (kimai *KimaiProvider) SaveRecord(rec api.Record) (api.Record, error) {
+	existing, err := kimai.findExisting(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	if existing != 0 {
+		kimai.logger.Infof("Timesheet %d for '%s' already exists", existing, rec.Title)
+		return rec, nil
+	}
+
+	timesheet, err := kimai.timesheetFromRecord(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	timesheet.Description = RecordTextWithId(rec)
+
+	var created kimaiTimesheet
+	err = kimai.request(http.MethodPost, "/api/timesheets", timesheet, &created)
+	if err != nil {
+		return api.Record{}, err
+	}
+
+	kimai.logger.Infof("Created timesheet %d for '%s'", created.Id, rec.Title)
+	return rec, nil
+}
+
+// ListRecords returns the timesheets of the Kimai user, that were saved for the User. Record.Id is the Id in the marker of the timesheet
+func (kimai *KimaiProvider) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	timesheets, err := kimai.listTimesheets(from, to)
+	if err != nil {
+		return []api.Record{}, err
+	}
+
+	records := []api.Record{}
+	for _, timesheet := range timesheets {
+		if timesheet.End == "" {
+			continue // timesheet still running
+		}
+		if RecordOwnerFromText(timesheet.Description) != user {
+			continue
+		}
+		begin, _ := time.Parse(KimaiResponseTimeFormat, timesheet.Begin)
+		end, _ := time.Parse(KimaiResponseTimeFormat, timesheet.End)
+		title, desc := SplitRecordText(timesheet.Description)
+		records = append(records, api.Record{
+			Id:          RecordIdFromText(timesheet.Description),
+			UserName:    user,
+			Title:       title,
+			Description: desc,
+			Project:     timesheet.Project.Name,
+			Task:        timesheet.Activity.Name,
+			Start:       begin,
+			End:         end,
+		})
+	}
+	return records, nil
+}
+
+func (kimai *KimaiProvider) listTimesheets(from, to time.Time) ([]kimaiTimesheetDetails, error) {
+	var timesheets []kimaiTimesheetDetails
+	query := url.Values{}
+	query.Set("begin", from.Local().Format(KimaiTimeFormat))
+	query.Set("end", to.Local().Format(KimaiTimeFormat))
+	query.Set("full", "true")
+	query.Set("size", "1000")
+	err := kimai.request(http.MethodGet, "/api/timesheets?"+query.Encode(), nil, &timesheets)
+	if err != nil {
+		return []kimaiTimesheetDetails{}, err
+	}
+	return timesheets, nil
+}
+
+// findExisting returns the ID of a timesheet, that was already created for the Record or 0
+func (kimai *KimaiProvider) findExisting(rec api.Record) (int, error) {
+	if rec.Id == "" {
+		return 0, nil
+	}
+	timesheets, err := kimai.listTimesheets(rec.Start, rec.End)
+	if err != nil {
+		return 0, err
+	}
+	for _, timesheet := range timesheets {
+		if RecordIdFromText(timesheet.Description) == rec.Id {
+			return timesheet.Id, nil
+		}
+	}
+	return 0, nil
+}
+
+// timesheetId returns the ID of the timesheet of a Record. The timesheet is found by the Id in its marker, IDs of timesheets
+// (e.g. of Records listed by older versions) are used directly
+func (kimai *KimaiProvider) timesheetId(rec api.Record) (string, error) {
+	if rec.Id == "" {
+		return "", fmt.Errorf("kimai timesheet of a record without id: %w", ProviderNotFound)
+	}
+	timesheets, err := kimai.listTimesheets(RecordLookupRange(rec))
+	if err != nil {
+		return "", err
+	}
+	for _, timesheet := range timesheets {
+		if RecordIdFromText(timesheet.Description) == rec.Id {
+			return strconv.Itoa(timesheet.Id), nil
+		}
+	}
+	return rec.Id, nil
+}
+
+// checkOwner returns the timesheet of the Record, if it belongs to the User of the Record
+func (kimai *KimaiProvider) checkOwner(id string, rec api.Record) (kimaiTimesheet, error) {
+	var existing kimaiTimesheet
+	err := kimai.request(http.MethodGet, "/api/timesheets/"+url.PathEscape(id), nil, &existing)
+	if err != nil {
+		return kimaiTimesheet{}, err
+	}
+	return existing, CheckRecordOwner(existing.Description, rec)
+}
+
+func (kimai *KimaiProvider) UpdateRecord(rec api.Record) (api.Record, error) {
+	id, err := kimai.timesheetId(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	existing, err := kimai.checkOwner(id, rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	timesheet, err := kimai.timesheetFromRecord(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	timesheet.Description = KeepRecordMarker(timesheet.Description, existing.Description)
+
+	err = kimai.request(http.MethodPatch, "/api/timesheets/"+url.PathEscape(id), timesheet, nil)
+	if err != nil {
+		return api.Record{}, err
+	}
+	kimai.logger.Infof("Updated timesheet %s for '%s'", id, rec.Title)
+	return rec, nil
+}
+
+func (kimai *KimaiProvider) DeleteRecord(rec api.Record) (api.Record, error) {
+	id, err := kimai.timesheetId(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	if _, err := kimai.checkOwner(id, rec); err != nil {
+		return api.Record{}, err
+	}
+	err = kimai.request(http.MethodDelete, "/api/timesheets/"+url.PathEscape(id), nil, nil)
+	if err != nil {
+		return api.Record{}, err
+	}
+	kimai.logger.Infof("Deleted timesheet %s", id)
+	return rec, nil
+}
+
+func (kimai *KimaiProvider) timesheetFromRecord(rec api.Record) (kimaiTimesheet, error) {
+	project, err := kimai.findId("/api/projects?visible=1", rec.Project)
+	if err != nil {
+		return kimaiTimesheet{}, fmt.Errorf("kimai project '%s': %w", rec.Project, err)
+	}
+	activity, err := kimai.findId(fmt.Sprintf("/api/activities?visible=1&project=%d", project), rec.Task)
+	if err != nil {
+		return kimaiTimesheet{}, fmt.Errorf("kimai activity '%s': %w", rec.Task, err)
+	}
+
+	return kimaiTimesheet{
+		Begin:       rec.Start.Local().Format(KimaiTimeFormat),
+		End:         rec.End.Local().Format(KimaiTimeFormat),
+		Project:     project,
+		Activity:    activity,
+		Description: RecordText(rec),
+	}, nil
+}
+
+// findId returns the ID of a visible item by name. Numeric names are used as ID directly
+func (kimai *KimaiProvider) findId(path, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	var items []kimaiNamedItem
+	err := kimai.request(http.MethodGet, path, nil, &items)
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		if strings.EqualFold(item.Name, name) {
+			return item.Id, nil
+		}
+	}
+	return 0, ProviderNotFound
+}
+
+func (kimai *KimaiProvider) request(method, path string, body interface{}, out interface{}) error {
+	var payload bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&payload).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, kimai.Url+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if kimai.User != "" {
+		// Kimai < 2.0 uses username + API password
+		req.Header.Set("X-AUTH-USER", kimai.User)
+		req.Header.Set("X-AUTH-TOKEN", kimai.Token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+kimai.Token)
+	}
+
+	resp, err := kimai.client.Do(req)
+	if err != nil {
+		kimai.logger.Warnf("Request %s %s failed: %v", method, path, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var kimaiErr kimaiError
+		json.Unmarshal(content, &kimaiErr)
+		kimai.logger.Warnf("Request %s %s returned %s: %s", method, path, resp.Status, string(content))
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("kimai returned %s: %w", resp.Status, ProviderNotFound)
+		}
+		return fmt.Errorf("kimai returned %s: %s", resp.Status, kimaiErr.Message)
+	}
+
+	if out == nil || len(content) == 0 {
+		return nil
+	}
+	return json.Unmarshal(content, out)
+}
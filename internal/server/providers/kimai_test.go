@@ -0,0 +1,56 @@
+package providers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+	"go.uber.org/zap"
+)
+
+func TestKimaiSaveRecord(t *testing.T) {
+	timesheets := []map[string]interface{}{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/projects", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`[{"id": 3, "name": "ACME"}]`))
+	})
+	mux.HandleFunc("/api/activities", func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("project") != "3" {
+			rw.Write([]byte(`[]`))
+			return
+		}
+		rw.Write([]byte(`[{"id": 11, "name": "Development"}]`))
+	})
+	mux.HandleFunc("/api/timesheets", func(rw http.ResponseWriter, r *http.Request) {
+		timesheet := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&timesheet)
+		timesheets = append(timesheets, timesheet)
+		rw.Write([]byte(`{"id": 500}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	kimai, _ := providers.NewKimaiProvider(*logger.Sugar(), srv.URL, "", "secret")
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.Local)
+	_, err := kimai.SaveRecord(api.Record{Title: "Fix", Project: "ACME", Task: "development", Start: start, End: start.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(timesheets) != 1 {
+		t.Fatalf("incorrect number of timesheets: got %d expected %d", len(timesheets), 1)
+	}
+	if timesheets[0]["project"] != float64(3) || timesheets[0]["activity"] != float64(11) || timesheets[0]["begin"] != "2022-03-01T09:00:00" {
+		t.Fatalf("incorrect timesheet: %v", timesheets[0])
+	}
+
+	_, err = kimai.SaveRecord(api.Record{Title: "Fix", Project: "ACME", Task: "Meeting", Start: start, End: start.Add(time.Hour)})
+	if err == nil {
+		t.Fatal("expected error for unknown activity, got nil")
+	}
+}
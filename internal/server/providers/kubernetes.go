@@ -5,7 +5,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
@@ -22,23 +25,30 @@ import (
 )
 
 const (
-	KubernetesLabelScope        string = "timerec.buc.sh/scope"
-	KubernetesLabelPause        string = "timerec.buc.sh/pause"
-	KubernetesLabelType         string = "timerec.buc.sh/type"
-	KubernetesLabelAppName      string = "app.kubernetes.io/name"
-	KubernetesLabelAppManagedBy string = "app.kubernetes.io/managed-by"
-	KubernetesAnnotationSchema  string = "timerec.buc.sh/schema"
-	KubernetesDataTypeDatastore string = "datastore"
-	KubernetesDataAppName       string = "timerec"
-	ConfigMapNamePrefix         string = "timerec-"
+	KubernetesLabelScope         string = "timerec.buc.sh/scope"
+	KubernetesLabelPause         string = "timerec.buc.sh/pause"
+	KubernetesLabelType          string = "timerec.buc.sh/type"
+	KubernetesLabelAppName       string = "app.kubernetes.io/name"
+	KubernetesLabelAppManagedBy  string = "app.kubernetes.io/managed-by"
+	KubernetesAnnotationSchema   string = "timerec.buc.sh/schema"
+	KubernetesAnnotationRevision string = "timerec.buc.sh/revision"
+	KubernetesDataTypeDatastore  string = "datastore"
+	KubernetesDataTypeTemplates  string = "templates"
+	KubernetesDataAppName        string = "timerec"
+	ConfigMapNamePrefix          string = "timerec-"
+	ConfigMapNameTemplates       string = ConfigMapNamePrefix + "global-templates"
 )
 
 var KubernetesDataPauseValues []string = []string{"true", "yes", "t", "y"}
 
+// KubernetesProvider stores every User in its own ConfigMap. Templates are shared between all Users and stored in a separate ConfigMap
 type KubernetesProvider struct {
-	client    *kubernetes.Clientset
+	client    kubernetes.Interface
 	Namespace string
 	logger    *zap.SugaredLogger
+
+	// cache is set by StartCache
+	cache *kubernetesCache
 }
 
 func NewKubernetesProvider(logger zap.SugaredLogger, kubeconfig string) (*KubernetesProvider, error) {
@@ -46,18 +56,7 @@ func NewKubernetesProvider(logger zap.SugaredLogger, kubeconfig string) (*Kubern
 		logger: logger.Named("KubernetesProvider"),
 	}
 
-	var config *rest.Config
-	var err error
-	// Configure Kubernetes client
-	if _, ok := os.LookupEnv("KUBERNETES_SERVICE_HOST"); ok {
-		config, err = rest.InClusterConfig()
-		logger.Info("Using kubeconfig : InCluster")
-	} else if kubeconfig != "" {
-		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
-		logger.Infof("Using kubeconfig : %s/%s\n", kubeconfig, config.Host)
-	} else {
-		return nil, fmt.Errorf("cannot discover kube config")
-	}
+	config, err := KubernetesRestConfig(new.logger, kubeconfig)
 	if err != nil {
 		return nil, err
 	}
@@ -77,12 +76,41 @@ func NewKubernetesProvider(logger zap.SugaredLogger, kubeconfig string) (*Kubern
 	return &new, nil
 }
 
+// NewKubernetesProviderForClient uses an existing client, e.g. a fake client in tests
+func NewKubernetesProviderForClient(logger zap.SugaredLogger, client kubernetes.Interface, namespace string) *KubernetesProvider {
+	return &KubernetesProvider{
+		client:    client,
+		Namespace: namespace,
+		logger:    logger.Named("KubernetesProvider"),
+	}
+}
+
+// KubernetesRestConfig uses the InCluster config when running in a Pod, otherwise the given kubeconfig file
+func KubernetesRestConfig(logger *zap.SugaredLogger, kubeconfig string) (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	if _, ok := os.LookupEnv("KUBERNETES_SERVICE_HOST"); ok {
+		config, err = rest.InClusterConfig()
+		logger.Info("Using kubeconfig : InCluster")
+	} else if kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err == nil {
+			logger.Infof("Using kubeconfig : %s/%s\n", kubeconfig, config.Host)
+		}
+	} else {
+		return nil, fmt.Errorf("cannot discover kube config")
+	}
+	return config, err
+}
+
+// KubernetesConfigMapFromState serializes the partition of a single User. Templates are stored by KubernetesTemplatesConfigMap
 func KubernetesConfigMapFromState(state StateV2) corev1.ConfigMap {
 	settingsBytes, _ := yaml.Marshal(state.Users[0].Settings)
 	activityBytes, _ := yaml.Marshal(state.Users[0].Activity)
-	templatesBytes, _ := yaml.Marshal(state.Templates)
 	jobsBytes, _ := yaml.Marshal(state.Jobs)
 	recordsBytes, _ := yaml.Marshal(state.Records)
+	outboxBytes, _ := yaml.Marshal(state.Outbox)
+	notifiedBytes, _ := yaml.Marshal(state.Users[0].Notified)
 
 	return corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
@@ -95,21 +123,44 @@ func KubernetesConfigMapFromState(state StateV2) corev1.ConfigMap {
 				KubernetesLabelPause:        fmt.Sprint(state.Users[0].Inactive),
 			},
 			Annotations: map[string]string{
-				KubernetesAnnotationSchema: "v1",
+				KubernetesAnnotationSchema: SchemaAnnotation(StateSchemaVersion),
 			},
 			// OwnerReferences: , // At some point a owner reference would probably be a good idea? Maybe?
 		},
 		Data: map[string]string{
-			"Name":      state.Users[0].Name,
-			"Settings":  string(settingsBytes),
-			"Activity":  string(activityBytes),
-			"Templates": string(templatesBytes),
-			"Jobs":      string(jobsBytes),
-			"Records":   string(recordsBytes),
+			"Name":     state.Users[0].Name,
+			"Settings": string(settingsBytes),
+			"Activity": string(activityBytes),
+			"Jobs":     string(jobsBytes),
+			"Records":  string(recordsBytes),
+			"Outbox":   string(outboxBytes),
+			"Notified": string(notifiedBytes),
 		},
 	}
+}
+
+func KubernetesTemplatesConfigMap(templates []api.RecordTemplate) corev1.ConfigMap {
+	templatesBytes, _ := yaml.Marshal(templates)
 
+	return corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: ConfigMapNameTemplates,
+			Labels: map[string]string{
+				KubernetesLabelScope:        ScopeGlobal,
+				KubernetesLabelType:         KubernetesDataTypeTemplates,
+				KubernetesLabelAppName:      KubernetesDataAppName,
+				KubernetesLabelAppManagedBy: KubernetesDataAppName,
+			},
+			Annotations: map[string]string{
+				KubernetesAnnotationSchema: SchemaAnnotation(StateSchemaVersion),
+			},
+		},
+		Data: map[string]string{
+			"Templates": string(templatesBytes),
+		},
+	}
 }
+
 func KubernetesConfigMapToState(state *StateV2, cm corev1.ConfigMap) error {
 	var settings api.Settings
 	yaml.Unmarshal([]byte(cm.Data["Settings"]), &settings)
@@ -117,17 +168,20 @@ func KubernetesConfigMapToState(state *StateV2, cm corev1.ConfigMap) error {
 	var activity api.Activity
 	yaml.Unmarshal([]byte(cm.Data["Activity"]), &activity)
 
+	var notified map[string]time.Time
+	yaml.Unmarshal([]byte(cm.Data["Notified"]), &notified)
+
 	user := api.User{
 		Name:     cm.Labels[KubernetesLabelScope],
-		Inactive: false, // Inactive Users are filtered my LabelSelectors
+		Inactive: kubernetesPaused(cm),
 		Activity: activity,
 		Settings: settings,
+		Notified: notified,
 	}
 	state.Users = append(state.Users, user)
 
-	var templates []api.RecordTemplate
-	yaml.Unmarshal([]byte(cm.Data["Templates"]), &templates)
-	state.Templates = append(state.Templates, templates...)
+	// Templates in a User's ConfigMap are from older versions. They are moved to the global ConfigMap on the next Save
+	KubernetesConfigMapToTemplates(state, cm)
 
 	var jobs []api.Job
 	yaml.Unmarshal([]byte(cm.Data["Jobs"]), &jobs)
@@ -137,28 +191,124 @@ func KubernetesConfigMapToState(state *StateV2, cm corev1.ConfigMap) error {
 	yaml.Unmarshal([]byte(cm.Data["Records"]), &records)
 	state.Records = append(state.Records, records...)
 
+	var outbox []PendingRecord
+	yaml.Unmarshal([]byte(cm.Data["Outbox"]), &outbox)
+	state.Outbox = append(state.Outbox, outbox...)
+
 	return nil
 }
 
+// kubernetesPaused returns if a ConfigMap has the pause label. Paused Users are filtered by LabelSelectors, except in RefreshAll
+func kubernetesPaused(cm corev1.ConfigMap) bool {
+	for _, value := range KubernetesDataPauseValues {
+		if cm.Labels[KubernetesLabelPause] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// kubernetesConfigMapKeys maps the keys of a ConfigMap to the keys of a partition in StateMigrations
+var kubernetesConfigMapKeys = map[string]string{"Templates": "templates", "Jobs": "jobs", "Records": "records", "Outbox": "outbox"}
+
+// MigrateConfigMap migrates the data of a ConfigMap with an older schema version. The migrated ConfigMap is written on the next Save
+func MigrateConfigMap(cm corev1.ConfigMap) (corev1.ConfigMap, error) {
+	schema := ParseSchemaAnnotation(cm.Annotations[KubernetesAnnotationSchema])
+	if schema == StateSchemaVersion {
+		return cm, nil
+	}
+
+	partition := map[string]interface{}{}
+	for key, name := range kubernetesConfigMapKeys {
+		if content, ok := cm.Data[key]; ok {
+			var value interface{}
+			yaml.Unmarshal([]byte(content), &value)
+			partition[name] = value
+		}
+	}
+	user := map[interface{}]interface{}{"name": cm.Labels[KubernetesLabelScope]}
+	for key, name := range map[string]string{"Settings": "settings", "Activity": "activity"} {
+		var value interface{}
+		yaml.Unmarshal([]byte(cm.Data[key]), &value)
+		user[name] = value
+	}
+	if cm.Labels[KubernetesLabelType] == KubernetesDataTypeDatastore {
+		partition["users"] = []interface{}{user}
+	}
+
+	if err := MigratePartition(partition, schema); err != nil {
+		return cm, fmt.Errorf("unable to migrate ConfigMap %s: %w", cm.Name, err)
+	}
+
+	migrated := cm.DeepCopy()
+	for key, name := range kubernetesConfigMapKeys {
+		if value, ok := partition[name]; ok {
+			content, _ := yaml.Marshal(value)
+			migrated.Data[key] = string(content)
+		}
+	}
+	if users, ok := partition["users"].([]interface{}); ok && len(users) > 0 {
+		if user, ok := users[0].(map[interface{}]interface{}); ok {
+			settings, _ := yaml.Marshal(user["settings"])
+			activity, _ := yaml.Marshal(user["activity"])
+			migrated.Data["Settings"] = string(settings)
+			migrated.Data["Activity"] = string(activity)
+		}
+	}
+	return *migrated, nil
+}
+
+// SchemaVersions returns the schema version of every ConfigMap, by partition
+func (kube *KubernetesProvider) SchemaVersions() (map[string]int, error) {
+	versions := map[string]int{}
+	cms, err := kube.getConfigMap(PartitionToSelector(ScopeGlobal), kube.Namespace)
+	if err != nil {
+		return versions, err
+	}
+	for _, cm := range cms {
+		versions[cm.Labels[KubernetesLabelScope]] = ParseSchemaAnnotation(cm.Annotations[KubernetesAnnotationSchema])
+	}
+
+	templates, found, err := kube.getConfigMapByName(ConfigMapNameTemplates)
+	if found {
+		versions[ScopeGlobal] = ParseSchemaAnnotation(templates.Annotations[KubernetesAnnotationSchema])
+	}
+	return versions, err
+}
+
+// KubernetesConfigMapToTemplates adds all Templates, that are not yet in the State
+func KubernetesConfigMapToTemplates(state *StateV2, cm corev1.ConfigMap) {
+	var templates []api.RecordTemplate
+	yaml.Unmarshal([]byte(cm.Data["Templates"]), &templates)
+	for _, t := range templates {
+		if ok, _ := HasTemplate(state, t.TemplateName); !ok {
+			state.Templates = append(state.Templates, t)
+		}
+	}
+}
+
 func (kube *KubernetesProvider) RefreshNamespace() error {
+	kube.Namespace = KubernetesNamespace(kube.logger)
+	return nil
+}
+
+// KubernetesNamespace returns WATCH_NAMESPACE or the Namespace of the ServiceAccount. An empty string means all namespaces
+func KubernetesNamespace(logger *zap.SugaredLogger) string {
 	ns, ok := os.LookupEnv("WATCH_NAMESPACE")
 	if ok {
-		kube.Namespace = ns
-		kube.logger.Debugf("Using WATCH_NAMESPACE: %s\n", ns)
-		return nil
+		logger.Debugf("Using WATCH_NAMESPACE: %s\n", ns)
+		return ns
 	}
 
 	data, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
 	ns = strings.TrimSpace(string(data))
 	if err == nil && len(ns) > 0 {
-		kube.Namespace = ns
-		kube.logger.Debugf("Using ServiceAccount Namespace: %s\n")
-		return nil
+		logger.Debugf("Using ServiceAccount Namespace: %s\n", ns)
+		return ns
 	}
 
-	kube.logger.Info("No Namespace configured. Using all namespaces")
-	kube.Namespace = ""
-	return nil
+	logger.Info("No Namespace configured. Using all namespaces")
+	return ""
 }
 
 func PartitionToName(partition string) string {
@@ -167,6 +317,10 @@ func PartitionToName(partition string) string {
 }
 
 func (kube *KubernetesProvider) getConfigMap(sel labels.Selector, ns string) ([]corev1.ConfigMap, error) {
+	if kube.cache != nil {
+		return kube.cache.list(kube.Namespace, sel)
+	}
+
 	cmList, err := kube.client.CoreV1().ConfigMaps(kube.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: sel.String()})
 
 	if err != nil {
@@ -177,28 +331,40 @@ func (kube *KubernetesProvider) getConfigMap(sel labels.Selector, ns string) ([]
 	return cmList.Items, nil
 }
 
-func (kube *KubernetesProvider) createOrUpdateConfigMap(cm corev1.ConfigMap, exists bool) error {
-	var err error = nil
-	ns := kube.Namespace
+// writeNamespace is the Namespace for new ConfigMaps. When watching all namespaces, they are created in the default namespace
+func (kube *KubernetesProvider) writeNamespace() string {
 	if kube.Namespace == "" {
-		ns = "default"
+		return "default"
 	}
+	return kube.Namespace
+}
+
+func (kube *KubernetesProvider) createOrUpdateConfigMap(cm corev1.ConfigMap, exists bool) (corev1.ConfigMap, error) {
+	var err error = nil
+	var result *corev1.ConfigMap
+	ns := kube.writeNamespace()
 
 	if exists {
-		_, err = kube.client.CoreV1().ConfigMaps(ns).Update(context.TODO(), &cm, metav1.UpdateOptions{})
+		result, err = kube.client.CoreV1().ConfigMaps(ns).Update(context.TODO(), &cm, metav1.UpdateOptions{})
 	} else {
-		_, err = kube.client.CoreV1().ConfigMaps(ns).Create(context.TODO(), &cm, metav1.CreateOptions{})
+		result, err = kube.client.CoreV1().ConfigMaps(ns).Create(context.TODO(), &cm, metav1.CreateOptions{})
 	}
 
 	if statusError, isStatus := err.(*errors.StatusError); isStatus {
 		kube.logger.Warnf("Error create/update ConfigMap %v\n", statusError.ErrStatus.Message)
-		return err
+		if errors.IsConflict(err) {
+			return cm, VersionConflictError{Partition: cm.Labels[KubernetesLabelScope], Expected: cm.ResourceVersion}
+		}
+		return cm, err
 	} else if err != nil {
 		kube.logger.Warn(err)
-		return err
+		return cm, err
 	}
 
-	return nil
+	if kube.cache != nil {
+		kube.cache.wrote(result)
+	}
+	return *result, nil
 }
 
 func PartitionToSelector(partition string) labels.Selector {
@@ -216,14 +382,57 @@ func PartitionToSelector(partition string) labels.Selector {
 	return selector
 }
 
+// AllPartitionsSelector selects the ConfigMaps of all Users. Unlike PartitionToSelector(ScopeGlobal), it includes paused Users
+func AllPartitionsSelector() labels.Selector {
+	scopeLabel, _ := labels.NewRequirement(KubernetesLabelScope, selection.Exists, []string{})
+	typeLabel, _ := labels.NewRequirement(KubernetesLabelType, selection.Equals, []string{KubernetesDataTypeDatastore})
+	return labels.NewSelector().Add(*scopeLabel, *typeLabel)
+}
+
 func (kube *KubernetesProvider) SaveRecord(rec api.Record) (api.Record, error) {
+	if rec.Id == "" {
+		rec.Id = api.RecordId(rec.UserName, rec.JobName, rec.Start, rec.End)
+	}
+	state, err := kube.Refresh(rec.UserName)
+	if err != nil {
+		kube.logger.Errorf("Error refreshing Record: %v", err)
+		return api.Record{}, err
+	}
+
+	if SaveRecord(&state, rec) == ProviderConflict {
+		kube.logger.Debugf("Record '%s' already saved", rec.Id)
+		existing, _ := GetRecord(&state, rec.Id)
+		return existing, nil
+	}
+	err = kube.Save(rec.UserName, state)
+	if err != nil {
+		kube.logger.Errorf("Error saving Record: %v", err)
+		return api.Record{}, err
+	}
+	return rec, nil
+}
+
+func (kube *KubernetesProvider) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	state, err := kube.Refresh(user)
+	if err != nil {
+		kube.logger.Errorf("Error refreshing Records: %v", err)
+		return []api.Record{}, err
+	}
+	records, _ := ListRecords(&state, user, from, to)
+	return records, nil
+}
+
+func (kube *KubernetesProvider) UpdateRecord(rec api.Record) (api.Record, error) {
 	state, err := kube.Refresh(rec.UserName)
 	if err != nil {
 		kube.logger.Errorf("Error refreshing Record: %v", err)
 		return api.Record{}, err
 	}
 
-	state.Records = append(state.Records, rec)
+	proverr := UpdateRecord(&state, rec)
+	if proverr != ProviderOk {
+		return api.Record{}, proverr
+	}
 	err = kube.Save(rec.UserName, state)
 	if err != nil {
 		kube.logger.Errorf("Error saving Record: %v", err)
@@ -232,21 +441,52 @@ func (kube *KubernetesProvider) SaveRecord(rec api.Record) (api.Record, error) {
 	return rec, nil
 }
 
+func (kube *KubernetesProvider) DeleteRecord(rec api.Record) (api.Record, error) {
+	state, err := kube.Refresh(rec.UserName)
+	if err != nil {
+		kube.logger.Errorf("Error refreshing Record: %v", err)
+		return api.Record{}, err
+	}
+
+	deleted, proverr := DeleteRecord(&state, rec)
+	if proverr != ProviderOk {
+		return api.Record{}, proverr
+	}
+	err = kube.Save(rec.UserName, state)
+	if err != nil {
+		kube.logger.Errorf("Error saving Record: %v", err)
+		return api.Record{}, err
+	}
+	return deleted, nil
+}
+
+// Refresh reads the ConfigMaps of the partition and the global Templates. The global scope contains all active Users
 func (kube *KubernetesProvider) Refresh(partition string) (StateV2, error) {
-	selector := PartitionToSelector(partition)
-	cms, _ := kube.getConfigMap(selector, kube.Namespace)
+	return kube.refresh(partition, PartitionToSelector(partition))
+}
+
+// RefreshAll reads the global scope including paused Users, e.g. to copy the whole State
+func (kube *KubernetesProvider) RefreshAll() (StateV2, error) {
+	return kube.refresh(ScopeGlobal, AllPartitionsSelector())
+}
+
+func (kube *KubernetesProvider) refresh(partition string, selector labels.Selector) (StateV2, error) {
+	cms, err := kube.getConfigMap(selector, kube.Namespace)
+	if err != nil {
+		return StateV2{}, err
+	}
 	defaultState := StateV2{
 		Partition: partition,
 		Users:     []api.User{},
 		Jobs:      []api.Job{},
 		Templates: []api.RecordTemplate{},
 		Records:   []api.Record{},
+		Outbox:    []PendingRecord{},
 	}
 
 	if len(cms) == 0 && partition != ScopeGlobal {
 		defaultState.Users = append(defaultState.Users, api.NewDefaultUser(partition))
-		cm := KubernetesConfigMapFromState(defaultState)
-		err := kube.createOrUpdateConfigMap(cm, false)
+		cm, err := kube.createOrUpdateConfigMap(KubernetesConfigMapFromState(defaultState), false)
 		if err != nil {
 			return defaultState, err
 		}
@@ -254,15 +494,161 @@ func (kube *KubernetesProvider) Refresh(partition string) (StateV2, error) {
 		cms = append(cms, cm)
 	}
 
+	templates, found, err := kube.getConfigMapByName(ConfigMapNameTemplates)
+	if err != nil {
+		return defaultState, err
+	}
+	if found {
+		cms = append(cms, templates)
+	}
+
 	for _, cm := range cms {
-		KubernetesConfigMapToState(&defaultState, cm)
+		migrated, err := MigrateConfigMap(cm)
+		if err != nil {
+			return defaultState, err
+		}
+		if cm.Name == ConfigMapNameTemplates {
+			KubernetesConfigMapToTemplates(&defaultState, migrated)
+		}
 	}
+	for _, cm := range cms {
+		migrated, _ := MigrateConfigMap(cm)
+		if cm.Name != ConfigMapNameTemplates {
+			KubernetesConfigMapToState(&defaultState, migrated)
+		}
+	}
+	defaultState.Version = KubernetesVersion(cms)
 
 	return defaultState, nil
 }
 
+// Save splits the State by owner and writes one ConfigMap per User and the global Templates. A Save of the global scope deletes the
+// ConfigMaps of Users, that were read with the State but are missing now. ConfigMaps are only updated if their content changed. Each update is checked against the resourceVersion in the State,
+// but the updates are not atomic: A conflict in one ConfigMap does not revert the ConfigMaps, that were already written
 func (kube *KubernetesProvider) Save(partition string, data StateV2) error {
-	cm := KubernetesConfigMapFromState(data)
+	versions := ParseKubernetesVersion(data.Version)
+
+	split := SplitByOwner(data)
+	owners := []string{}
+	for owner := range split {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	written := map[string]bool{ConfigMapNameTemplates: true}
+	for _, owner := range owners {
+		userState := split[owner]
+		if len(userState.Users) == 0 {
+			kube.logger.Warnf("State contains data for user '%s', but not the user itself. Creating default user", owner)
+			userState.Users = append(userState.Users, api.NewDefaultUser(owner))
+		}
+		cm := KubernetesConfigMapFromState(*userState)
+		written[cm.Name] = true
+		err := kube.applyConfigMap(cm, versions)
+		if err != nil {
+			return err
+		}
+	}
+
+	if partition == ScopeGlobal {
+		for name, version := range versions {
+			if written[name] {
+				continue
+			}
+			if err := kube.deleteConfigMap(name, version); err != nil {
+				return err
+			}
+		}
+	}
+	return kube.applyConfigMap(KubernetesTemplatesConfigMap(data.Templates), versions)
+}
+
+// deleteConfigMap deletes a User's ConfigMap, unless it was changed since it was read with the given resourceVersion
+func (kube *KubernetesProvider) deleteConfigMap(name, version string) error {
+	current, found, err := kube.getConfigMapByName(name)
+	if err != nil || !found {
+		return err
+	}
+	if current.ResourceVersion != version {
+		return VersionConflictError{Partition: current.Labels[KubernetesLabelScope], Expected: version, Actual: current.ResourceVersion}
+	}
+
+	err = kube.client.CoreV1().ConfigMaps(kube.writeNamespace()).Delete(context.TODO(), name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{ResourceVersion: &version}})
+	if errors.IsConflict(err) {
+		return VersionConflictError{Partition: current.Labels[KubernetesLabelScope], Expected: version}
+	}
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	kube.logger.Infof("Deleted ConfigMap of User '%s'", current.Labels[KubernetesLabelScope])
+	if kube.cache != nil {
+		kube.cache.deleted(&current)
+	}
+	return nil
+}
+
+// KubernetesVersion combines the resourceVersions of all ConfigMaps in a State
+func KubernetesVersion(cms []corev1.ConfigMap) string {
+	versions := []string{}
+	for _, cm := range cms {
+		versions = append(versions, cm.Name+"="+cm.ResourceVersion)
+	}
+	sort.Strings(versions)
+	return strings.Join(versions, ",")
+}
 
-	return kube.createOrUpdateConfigMap(cm, true)
+// ParseKubernetesVersion returns the resourceVersion of every ConfigMap in the version
+func ParseKubernetesVersion(version string) map[string]string {
+	versions := map[string]string{}
+	for _, v := range strings.Split(version, ",") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) == 2 {
+			versions[parts[0]] = parts[1]
+		}
+	}
+	return versions
+}
+
+func (kube *KubernetesProvider) getConfigMapByName(name string) (corev1.ConfigMap, bool, error) {
+	var cm *corev1.ConfigMap
+	var err error
+	if kube.cache != nil {
+		cm, err = kube.cache.get(kube.writeNamespace(), name)
+	} else {
+		cm, err = kube.client.CoreV1().ConfigMaps(kube.writeNamespace()).Get(context.TODO(), name, metav1.GetOptions{})
+	}
+	if errors.IsNotFound(err) {
+		return corev1.ConfigMap{}, false, nil
+	}
+	if err != nil {
+		kube.logger.Error(err)
+		return corev1.ConfigMap{}, false, err
+	}
+	return *cm, true, nil
+}
+
+// applyConfigMap creates or updates a ConfigMap, unless it already has the same content
+func (kube *KubernetesProvider) applyConfigMap(cm corev1.ConfigMap, versions map[string]string) error {
+	current, found, err := kube.getConfigMapByName(cm.Name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		_, err = kube.createOrUpdateConfigMap(cm, false)
+		if errors.IsAlreadyExists(err) {
+			return VersionConflictError{Partition: cm.Labels[KubernetesLabelScope]}
+		}
+		return err
+	}
+	if reflect.DeepEqual(current.Data, cm.Data) && sameLabels(current.Labels, cm.Labels) && sameLabels(current.Annotations, cm.Annotations) {
+		return nil
+	}
+
+	expected, ok := versions[cm.Name]
+	if !ok || expected != current.ResourceVersion {
+		return VersionConflictError{Partition: cm.Labels[KubernetesLabelScope], Expected: expected, Actual: current.ResourceVersion}
+	}
+	cm.ResourceVersion = expected
+	_, err = kube.createOrUpdateConfigMap(cm, true)
+	return err
 }
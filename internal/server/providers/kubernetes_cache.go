@@ -0,0 +1,234 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// KubernetesCacheResync is how often the informer replays all cached ConfigMaps. Replays do not count as changes
+const KubernetesCacheResync time.Duration = 10 * time.Minute
+
+// KubernetesCacheWriteTimeout is how long a ConfigMap written by timerec is preferred over the informer's copy,
+// in case the informer never receives that exact version (e.g. because it was updated again in the meantime)
+const KubernetesCacheWriteTimeout time.Duration = 30 * time.Second
+
+// KubernetesCacheSyncTimeout is how long the server waits for the initial list of ConfigMaps on startup
+const KubernetesCacheSyncTimeout time.Duration = time.Minute
+
+// kubernetesCache serves ConfigMaps from an informer. ConfigMaps written by timerec are kept until the informer
+// has received them, so a Refresh right after a Save does not return the previous version
+type kubernetesCache struct {
+	informer cache.SharedIndexInformer
+	lister   listersv1.ConfigMapLister
+	// stop ends the informer
+	stop context.CancelFunc
+
+	mu      sync.Mutex
+	written map[string]writtenConfigMap
+}
+
+type writtenConfigMap struct {
+	cm *corev1.ConfigMap
+	at time.Time
+	// deleted hides the informer's copy, until the informer notices the deletion
+	deleted bool
+}
+
+// StartCache starts an informer for all ConfigMaps managed by timerec. Once the cache is synced, Refresh is served from memory
+// and only writes go to the API server. If the cache is not synced within timeout, the informer is stopped and Refresh keeps reading
+// from the API server
+func (kube *KubernetesProvider) StartCache(ctx context.Context, timeout time.Duration) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(kube.client, KubernetesCacheResync,
+		informers.WithNamespace(kube.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = labels.Set{KubernetesLabelAppManagedBy: KubernetesDataAppName}.String()
+		}),
+	)
+	configMaps := factory.Core().V1().ConfigMaps()
+	c := &kubernetesCache{
+		informer: configMaps.Informer(),
+		lister:   configMaps.Lister(),
+		written:  map[string]writtenConfigMap{},
+	}
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.received,
+		UpdateFunc: func(_, obj interface{}) { c.received(obj) },
+		DeleteFunc: c.removed,
+	})
+	informerCtx, stop := context.WithCancel(ctx)
+	c.stop = stop
+	factory.Start(informerCtx.Done())
+
+	syncCtx, cancel := context.WithTimeout(informerCtx, timeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(syncCtx.Done(), c.informer.HasSynced) {
+		c.stop()
+		return fmt.Errorf("unable to sync ConfigMap cache within %v", timeout)
+	}
+	kube.logger.Infof("ConfigMap cache synced: %d ConfigMaps", len(c.informer.GetStore().List()))
+	kube.cache = c
+	return nil
+}
+
+// Watch calls onChange with the User's partition, whenever a User's ConfigMap is created, changed or deleted. This includes paused
+// Users, so pausing or resuming a User is noticed. Changes to the Templates, which are part of every partition, are reported as ScopeGlobal
+func (kube *KubernetesProvider) Watch(ctx context.Context, onChange func(partition string)) error {
+	if kube.cache == nil {
+		return fmt.Errorf("ConfigMap cache is not started")
+	}
+
+	notify := func(old, new interface{}) {
+		if tombstone, ok := new.(cache.DeletedFinalStateUnknown); ok {
+			new = tombstone.Obj
+		}
+		cm, ok := new.(*corev1.ConfigMap)
+		if !ok || ctx.Err() != nil {
+			return
+		}
+		if old == new {
+			return // Periodic resync replays the cached object
+		}
+		switch {
+		case cm.Labels[KubernetesLabelType] == KubernetesDataTypeTemplates:
+			onChange(ScopeGlobal)
+		case AllPartitionsSelector().Matches(labels.Set(cm.Labels)):
+			onChange(cm.Labels[KubernetesLabelScope])
+		}
+	}
+	kube.cache.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { notify(nil, obj) },
+		UpdateFunc: notify,
+		DeleteFunc: func(obj interface{}) { notify(nil, obj) },
+	})
+	return nil
+}
+
+func cacheKey(cm *corev1.ConfigMap) string {
+	return cm.Namespace + "/" + cm.Name
+}
+
+// wrote remembers a ConfigMap, that was just written to the API server
+func (c *kubernetesCache) wrote(cm *corev1.ConfigMap) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written[cacheKey(cm)] = writtenConfigMap{cm: cm.DeepCopy(), at: time.Now()}
+}
+
+// deleted remembers a ConfigMap, that was just deleted on the API server
+func (c *kubernetesCache) deleted(cm *corev1.ConfigMap) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.written[cacheKey(cm)] = writtenConfigMap{cm: cm.DeepCopy(), at: time.Now(), deleted: true}
+}
+
+// removed forgets a deleted ConfigMap, as soon as the informer has noticed the deletion
+func (c *kubernetesCache) removed(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w, ok := c.written[cacheKey(cm)]; ok && (w.deleted || w.cm.ResourceVersion == cm.ResourceVersion) {
+		delete(c.written, cacheKey(cm))
+	}
+}
+
+// received forgets a written ConfigMap, as soon as the informer has the same version
+func (c *kubernetesCache) received(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w, ok := c.written[cacheKey(cm)]; ok && w.cm.ResourceVersion == cm.ResourceVersion {
+		delete(c.written, cacheKey(cm))
+	}
+}
+
+// pending returns all written ConfigMaps, that the informer has not received yet. Deleted ConfigMaps are nil
+func (c *kubernetesCache) pending() map[string]*corev1.ConfigMap {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := map[string]*corev1.ConfigMap{}
+	for key, w := range c.written {
+		if time.Since(w.at) > KubernetesCacheWriteTimeout {
+			delete(c.written, key)
+			continue
+		}
+		pending[key] = w.cm
+		if w.deleted {
+			pending[key] = nil
+		}
+	}
+	return pending
+}
+
+func (c *kubernetesCache) list(namespace string, sel labels.Selector) ([]corev1.ConfigMap, error) {
+	var cached []*corev1.ConfigMap
+	var err error
+	if namespace == "" {
+		cached, err = c.lister.List(labels.Everything())
+	} else {
+		cached, err = c.lister.ConfigMaps(namespace).List(labels.Everything())
+	}
+	if err != nil {
+		return []corev1.ConfigMap{}, err
+	}
+
+	merged := map[string]*corev1.ConfigMap{}
+	for _, cm := range cached {
+		merged[cacheKey(cm)] = cm
+	}
+	for key, cm := range c.pending() {
+		if cm == nil {
+			delete(merged, key)
+		} else if namespace == "" || cm.Namespace == namespace {
+			merged[key] = cm
+		}
+	}
+
+	cms := []corev1.ConfigMap{}
+	for _, cm := range merged {
+		if sel.Matches(labels.Set(cm.Labels)) {
+			cms = append(cms, *cm.DeepCopy())
+		}
+	}
+	sort.Slice(cms, func(i, j int) bool { return cacheKey(&cms[i]) < cacheKey(&cms[j]) })
+	return cms, nil
+}
+
+func (c *kubernetesCache) get(namespace, name string) (*corev1.ConfigMap, error) {
+	if cm, ok := c.pending()[namespace+"/"+name]; ok {
+		if cm == nil {
+			return nil, errors.NewNotFound(corev1.Resource("configmaps"), name)
+		}
+		return cm.DeepCopy(), nil
+	}
+	cm, err := c.lister.ConfigMaps(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return cm.DeepCopy(), nil
+}
@@ -0,0 +1,597 @@
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+const (
+	KubernetesCrdGroup   string = "timerec.buc.sh"
+	KubernetesCrdVersion string = "v1alpha1"
+
+	RecordPhaseSaved   string = "Saved"
+	RecordPhasePending string = "Pending"
+)
+
+var (
+	TimerecUserResource    = schema.GroupVersionResource{Group: KubernetesCrdGroup, Version: KubernetesCrdVersion, Resource: "timerecusers"}
+	TimerecJobResource     = schema.GroupVersionResource{Group: KubernetesCrdGroup, Version: KubernetesCrdVersion, Resource: "timerecjobs"}
+	RecordTemplateResource = schema.GroupVersionResource{Group: KubernetesCrdGroup, Version: KubernetesCrdVersion, Resource: "recordtemplates"}
+	RecordResource         = schema.GroupVersionResource{Group: KubernetesCrdGroup, Version: KubernetesCrdVersion, Resource: "records"}
+
+	// KubernetesCrdListKinds is needed to set up a fake dynamic client
+	KubernetesCrdListKinds = map[schema.GroupVersionResource]string{
+		TimerecUserResource:    "TimerecUserList",
+		TimerecJobResource:     "TimerecJobList",
+		RecordTemplateResource: "RecordTemplateList",
+		RecordResource:         "RecordList",
+	}
+
+	invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+	validLabelValue  = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?$`)
+)
+
+// KubernetesCrdProvider stores every User, Job, RecordTemplate and Record as a separate custom resource. Jobs are TimerecJobs,
+// so they are not mistaken for batch/v1 Jobs. The TimerecUser object of a partition is updated on every Save, its resourceVersion
+// is used to detect concurrent changes. Global Saves check the resourceVersions of all TimerecUsers
+type KubernetesCrdProvider struct {
+	client    dynamic.Interface
+	Namespace string
+	logger    *zap.SugaredLogger
+
+	// templates are the object names of the RecordTemplates, that the last Refresh of a partition returned. RecordTemplates are shared
+	// by all partitions, so a Save of a single partition only deletes RecordTemplates, that were removed from the State since
+	mu        sync.Mutex
+	templates map[string]crdTemplateSnapshot
+}
+
+type crdTemplateSnapshot struct {
+	version string
+	names   map[string]bool
+}
+
+type timerecUserSpec struct {
+	Name     string       `json:"name"`
+	Inactive bool         `json:"inactive,omitempty"`
+	Settings api.Settings `json:"settings"`
+}
+
+type timerecUserStatus struct {
+	Activity api.Activity         `json:"activity"`
+	Notified map[string]time.Time `json:"notified,omitempty"`
+}
+
+type jobStatus struct {
+	PendingRecords int `json:"pendingRecords"`
+}
+
+type recordStatus struct {
+	Phase       string     `json:"phase"`
+	Confirmed   []string   `json:"confirmed,omitempty"`
+	Attempts    int        `json:"attempts,omitempty"`
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+}
+
+func NewKubernetesCrdProvider(logger zap.SugaredLogger, kubeconfig string) (*KubernetesCrdProvider, error) {
+	named := logger.Named("KubernetesCrdProvider")
+	config, err := KubernetesRestConfig(named, kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewKubernetesCrdProviderForClient(logger, client, KubernetesNamespace(named)), nil
+}
+
+func NewKubernetesCrdProviderForClient(logger zap.SugaredLogger, client dynamic.Interface, namespace string) *KubernetesCrdProvider {
+	return &KubernetesCrdProvider{
+		client:    client,
+		Namespace: namespace,
+		logger:    logger.Named("KubernetesCrdProvider"),
+		templates: map[string]crdTemplateSnapshot{},
+	}
+}
+
+// Refresh reads all objects of a User. Like the ConfigMap provider, a default User is created if it does not exist
+func (kube *KubernetesCrdProvider) Refresh(partition string) (StateV2, error) {
+	state := StateV2{
+		Partition: partition,
+		Users:     []api.User{},
+		Jobs:      []api.Job{},
+		Templates: []api.RecordTemplate{},
+		Records:   []api.Record{},
+		Outbox:    []PendingRecord{},
+	}
+
+	users, err := kube.list(TimerecUserResource, partition)
+	if err != nil {
+		return StateV2{}, err
+	}
+	if len(users) == 0 && partition != ScopeGlobal {
+		created, err := kube.create(TimerecUserResource, kube.userObject(api.NewDefaultUser(partition)))
+		if err != nil {
+			return StateV2{}, err
+		}
+		users = append(users, created)
+	}
+	schema := StateSchemaVersion
+	for _, obj := range users {
+		if version := ParseSchemaAnnotation(obj.GetAnnotations()[KubernetesAnnotationSchema]); version < schema {
+			schema = version
+		}
+		var spec timerecUserSpec
+		var status timerecUserStatus
+		decodeField(obj, "spec", &spec)
+		decodeField(obj, "status", &status)
+		state.Users = append(state.Users, api.User{Name: spec.Name, Inactive: spec.Inactive, Settings: spec.Settings, Activity: status.Activity, Notified: status.Notified})
+		if partition != ScopeGlobal {
+			state.Version = obj.GetResourceVersion()
+		}
+	}
+	if partition == ScopeGlobal {
+		state.Version = crdVersion(users)
+	}
+
+	jobs, err := kube.list(TimerecJobResource, partition)
+	if err != nil {
+		return StateV2{}, err
+	}
+	for _, obj := range jobs {
+		var job api.Job
+		decodeField(obj, "spec", &job)
+		state.Jobs = append(state.Jobs, job)
+	}
+
+	templates, err := kube.list(RecordTemplateResource, ScopeGlobal)
+	if err != nil {
+		return StateV2{}, err
+	}
+	snapshot := crdTemplateSnapshot{version: state.Version, names: map[string]bool{}}
+	for _, obj := range templates {
+		var template api.RecordTemplate
+		decodeField(obj, "spec", &template)
+		state.Templates = append(state.Templates, template)
+		snapshot.names[obj.GetName()] = true
+	}
+	kube.mu.Lock()
+	if previous, ok := kube.templates[partition]; ok && previous.version == snapshot.version {
+		// Another Refresh returned the same version, only RecordTemplates both have seen can be deleted
+		for name := range snapshot.names {
+			snapshot.names[name] = previous.names[name]
+		}
+	}
+	kube.templates[partition] = snapshot
+	kube.mu.Unlock()
+
+	records, err := kube.list(RecordResource, partition)
+	if err != nil {
+		return StateV2{}, err
+	}
+	for _, obj := range records {
+		var rec api.Record
+		var status recordStatus
+		decodeField(obj, "spec", &rec)
+		decodeField(obj, "status", &status)
+		if status.Phase != RecordPhasePending {
+			state.Records = append(state.Records, rec)
+			continue
+		}
+		pending := PendingRecord{Record: rec, Confirmed: status.Confirmed, Attempts: status.Attempts, LastError: status.LastError}
+		if status.NextAttempt != nil {
+			pending.NextAttempt = *status.NextAttempt
+		}
+		state.Outbox = append(state.Outbox, pending)
+	}
+
+	return MigrateState(state, schema)
+}
+
+// SchemaVersions returns the schema version of every TimerecUser
+func (kube *KubernetesCrdProvider) SchemaVersions() (map[string]int, error) {
+	versions := map[string]int{}
+	users, err := kube.list(TimerecUserResource, ScopeGlobal)
+	for _, obj := range users {
+		var spec timerecUserSpec
+		decodeField(obj, "spec", &spec)
+		versions[spec.Name] = ParseSchemaAnnotation(obj.GetAnnotations()[KubernetesAnnotationSchema])
+	}
+	return versions, err
+}
+
+// Save creates, updates and deletes objects, until they match the State. The partition's TimerecUser is written first,
+// so a concurrent change fails with a conflict before anything else is changed
+func (kube *KubernetesCrdProvider) Save(partition string, state StateV2) error {
+	desired := map[schema.GroupVersionResource][]*unstructured.Unstructured{}
+	for _, user := range state.Users {
+		if inScope(user.Name, partition) {
+			desired[TimerecUserResource] = append(desired[TimerecUserResource], kube.userObject(user))
+		}
+	}
+	for _, job := range state.Jobs {
+		if inScope(job.Owner, partition) {
+			pending, _ := ListPendingRecords(&state, job)
+			desired[TimerecJobResource] = append(desired[TimerecJobResource], kube.jobObject(job, len(pending)))
+		}
+	}
+	for _, template := range state.Templates {
+		desired[RecordTemplateResource] = append(desired[RecordTemplateResource], kube.templateObject(template))
+	}
+	for _, rec := range state.Records {
+		if inScope(rec.UserName, partition) {
+			desired[RecordResource] = append(desired[RecordResource], kube.recordObject(rec, recordStatus{Phase: RecordPhaseSaved}))
+		}
+	}
+	for _, p := range state.Outbox {
+		if inScope(p.Record.UserName, partition) {
+			next := p.NextAttempt
+			status := recordStatus{Phase: RecordPhasePending, Confirmed: p.Confirmed, Attempts: p.Attempts, NextAttempt: &next, LastError: p.LastError}
+			desired[RecordResource] = append(desired[RecordResource], kube.recordObject(p.Record, status))
+		}
+	}
+
+	if partition == ScopeGlobal {
+		if err := kube.lockGlobal(state.Version); err != nil {
+			return err
+		}
+	} else if err := kube.lockPartition(partition, state.Version); err != nil {
+		return err
+	}
+	for _, resource := range []schema.GroupVersionResource{TimerecUserResource, TimerecJobResource, RecordResource} {
+		if err := kube.apply(resource, partition, desired[resource], nil); err != nil {
+			return err
+		}
+	}
+	return kube.apply(RecordTemplateResource, ScopeGlobal, desired[RecordTemplateResource], kube.removedTemplates(partition, state))
+}
+
+// removedTemplates returns a filter for apply, that only deletes RecordTemplates, which the last Refresh of the partition returned
+// and which are not part of the State anymore. Saving the global scope deletes every RecordTemplate, that is not part of the State
+func (kube *KubernetesCrdProvider) removedTemplates(partition string, state StateV2) func(name string) bool {
+	if partition == ScopeGlobal {
+		return nil
+	}
+	kube.mu.Lock()
+	snapshot, ok := kube.templates[partition]
+	kube.mu.Unlock()
+	return func(name string) bool {
+		return ok && snapshot.version == state.Version && snapshot.names[name]
+	}
+}
+
+func (kube *KubernetesCrdProvider) SaveRecord(rec api.Record) (api.Record, error) {
+	if rec.Id == "" {
+		rec.Id = api.RecordId(rec.UserName, rec.JobName, rec.Start, rec.End)
+	}
+	state, err := kube.Refresh(rec.UserName)
+	if err != nil {
+		return api.Record{}, err
+	}
+	if SaveRecord(&state, rec) == ProviderConflict {
+		existing, _ := GetRecord(&state, rec.Id)
+		return existing, nil
+	}
+	return rec, kube.Save(state.Partition, state)
+}
+
+func (kube *KubernetesCrdProvider) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	state, err := kube.Refresh(user)
+	if err != nil {
+		return []api.Record{}, err
+	}
+	records, _ := ListRecords(&state, user, from, to)
+	return records, nil
+}
+
+func (kube *KubernetesCrdProvider) UpdateRecord(rec api.Record) (api.Record, error) {
+	state, err := kube.Refresh(rec.UserName)
+	if err != nil {
+		return api.Record{}, err
+	}
+	if proverr := UpdateRecord(&state, rec); proverr != ProviderOk {
+		return api.Record{}, proverr
+	}
+	return rec, kube.Save(state.Partition, state)
+}
+
+func (kube *KubernetesCrdProvider) DeleteRecord(rec api.Record) (api.Record, error) {
+	state, err := kube.Refresh(rec.UserName)
+	if err != nil {
+		return api.Record{}, err
+	}
+	deleted, proverr := DeleteRecord(&state, rec)
+	if proverr != ProviderOk {
+		return api.Record{}, proverr
+	}
+	return deleted, kube.Save(state.Partition, state)
+}
+
+// lockPartition bumps the revision annotation of the TimerecUser. The update fails, if the object was changed since Refresh.
+// An empty version means, that the TimerecUser must not exist yet. It is created by apply then, which fails, if it was created concurrently
+func (kube *KubernetesCrdProvider) lockPartition(partition, version string) error {
+	obj, err := kube.resource(TimerecUserResource).Get(context.TODO(), objectName(partition), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		if version == "" {
+			return nil
+		}
+		return VersionConflictError{Partition: partition, Expected: version}
+	}
+	if err != nil {
+		return err
+	}
+	if obj.GetResourceVersion() != version {
+		return VersionConflictError{Partition: partition, Expected: version, Actual: obj.GetResourceVersion()}
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[KubernetesAnnotationRevision] = NextVersion(annotations[KubernetesAnnotationRevision])
+	obj.SetAnnotations(annotations)
+	_, err = kube.resource(TimerecUserResource).Update(context.TODO(), obj, metav1.UpdateOptions{})
+	if errors.IsConflict(err) {
+		return VersionConflictError{Partition: partition, Expected: version}
+	}
+	return err
+}
+
+// lockGlobal locks every TimerecUser with lockPartition. The version is the one returned by Refresh(ScopeGlobal), so TimerecUsers
+// created or deleted since then are a conflict as well
+func (kube *KubernetesCrdProvider) lockGlobal(version string) error {
+	users, err := kube.list(TimerecUserResource, ScopeGlobal)
+	if err != nil {
+		return err
+	}
+	if current := crdVersion(users); current != version {
+		return VersionConflictError{Partition: ScopeGlobal, Expected: version, Actual: current}
+	}
+	for _, obj := range users {
+		var spec timerecUserSpec
+		decodeField(obj, "spec", &spec)
+		if err := kube.lockPartition(spec.Name, obj.GetResourceVersion()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// crdVersion combines the resourceVersions of the TimerecUsers like KubernetesVersion does for ConfigMaps
+func crdVersion(users []*unstructured.Unstructured) string {
+	versions := []string{}
+	for _, obj := range users {
+		versions = append(versions, obj.GetName()+"="+obj.GetResourceVersion())
+	}
+	sort.Strings(versions)
+	return strings.Join(versions, ",")
+}
+
+// apply creates, updates and deletes objects, until they match desired. With deletable, only objects it returns true for are deleted
+func (kube *KubernetesCrdProvider) apply(resource schema.GroupVersionResource, partition string, desired []*unstructured.Unstructured, deletable func(name string) bool) error {
+	list, err := kube.list(resource, partition)
+	if err != nil {
+		return err
+	}
+	existing := map[string]*unstructured.Unstructured{}
+	for _, obj := range list {
+		existing[obj.GetName()] = obj
+	}
+
+	for _, obj := range desired {
+		current, ok := existing[obj.GetName()]
+		delete(existing, obj.GetName())
+		if !ok {
+			_, err := kube.create(resource, obj)
+			if errors.IsAlreadyExists(err) && resource == TimerecUserResource {
+				return VersionConflictError{Partition: partition}
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := kube.update(resource, current, obj); err != nil {
+			return err
+		}
+	}
+
+	for name := range existing {
+		if deletable != nil && !deletable(name) {
+			continue
+		}
+		err := kube.resource(resource).Delete(context.TODO(), name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// create creates the object and sets the status, which is ignored by the API server on create
+func (kube *KubernetesCrdProvider) create(resource schema.GroupVersionResource, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	created, err := kube.resource(resource).Create(context.TODO(), obj, metav1.CreateOptions{})
+	if err != nil {
+		kube.logger.Warnf("Error creating %s/%s: %v", resource.Resource, obj.GetName(), err)
+		return nil, err
+	}
+	if status, ok := obj.Object["status"]; ok {
+		created.Object["status"] = status
+		created, err = kube.resource(resource).UpdateStatus(context.TODO(), created, metav1.UpdateOptions{})
+	}
+	return created, err
+}
+
+// update writes spec and status separately, and only if they changed
+func (kube *KubernetesCrdProvider) update(resource schema.GroupVersionResource, current, desired *unstructured.Unstructured) error {
+	var err error
+	if !sameField(current, desired, "spec") || !sameLabels(current.GetLabels(), desired.GetLabels()) || !sameLabels(current.GetAnnotations(), desired.GetAnnotations()) {
+		updated := current.DeepCopy()
+		updated.Object["spec"] = desired.Object["spec"]
+		updated.SetLabels(desired.GetLabels())
+		annotations := updated.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		for key, value := range desired.GetAnnotations() {
+			annotations[key] = value
+		}
+		updated.SetAnnotations(annotations)
+		current, err = kube.resource(resource).Update(context.TODO(), updated, metav1.UpdateOptions{})
+		if err != nil {
+			kube.logger.Warnf("Error updating %s/%s: %v", resource.Resource, desired.GetName(), err)
+			return err
+		}
+	}
+	if _, ok := desired.Object["status"]; ok && !sameField(current, desired, "status") {
+		updated := current.DeepCopy()
+		updated.Object["status"] = desired.Object["status"]
+		_, err = kube.resource(resource).UpdateStatus(context.TODO(), updated, metav1.UpdateOptions{})
+		if err != nil {
+			kube.logger.Warnf("Error updating status of %s/%s: %v", resource.Resource, desired.GetName(), err)
+		}
+	}
+	return err
+}
+
+func (kube *KubernetesCrdProvider) list(resource schema.GroupVersionResource, partition string) ([]*unstructured.Unstructured, error) {
+	selector := KubernetesLabelAppManagedBy + "=" + KubernetesDataAppName
+	if partition != ScopeGlobal {
+		selector += "," + KubernetesLabelScope + "=" + labelValue(partition)
+	}
+	list, err := kube.client.Resource(resource).Namespace(kube.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		kube.logger.Errorf("Error listing %s: %v", resource.Resource, err)
+		return []*unstructured.Unstructured{}, err
+	}
+
+	objects := []*unstructured.Unstructured{}
+	for i := range list.Items {
+		objects = append(objects, &list.Items[i])
+	}
+	return objects, nil
+}
+
+func (kube *KubernetesCrdProvider) resource(resource schema.GroupVersionResource) dynamic.ResourceInterface {
+	ns := kube.Namespace
+	if ns == "" {
+		ns = "default"
+	}
+	return kube.client.Resource(resource).Namespace(ns)
+}
+
+// userObject returns the TimerecUser. It carries the schema version of all objects of the User
+func (kube *KubernetesCrdProvider) userObject(user api.User) *unstructured.Unstructured {
+	obj := newCrdObject("TimerecUser", objectName(user.Name), user.Name,
+		timerecUserSpec{Name: user.Name, Inactive: user.Inactive, Settings: user.Settings},
+		timerecUserStatus{Activity: user.Activity, Notified: user.Notified})
+	obj.SetAnnotations(map[string]string{KubernetesAnnotationSchema: SchemaAnnotation(StateSchemaVersion)})
+	return obj
+}
+
+func (kube *KubernetesCrdProvider) jobObject(job api.Job, pending int) *unstructured.Unstructured {
+	return newCrdObject("TimerecJob", objectName(job.Owner, job.Name), job.Owner, job, jobStatus{PendingRecords: pending})
+}
+
+func (kube *KubernetesCrdProvider) templateObject(template api.RecordTemplate) *unstructured.Unstructured {
+	return newCrdObject("RecordTemplate", objectName(template.TemplateName), "", template, nil)
+}
+
+func (kube *KubernetesCrdProvider) recordObject(rec api.Record, status recordStatus) *unstructured.Unstructured {
+	prefix := "record"
+	if status.Phase == RecordPhasePending {
+		prefix = "pending"
+	}
+	return newCrdObject("Record", objectName(prefix, rec.Id), rec.UserName, rec, status)
+}
+
+func newCrdObject(kind, name, owner string, spec, status interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	obj.SetAPIVersion(KubernetesCrdGroup + "/" + KubernetesCrdVersion)
+	obj.SetKind(kind)
+	obj.SetName(name)
+	labels := map[string]string{
+		KubernetesLabelAppName:      KubernetesDataAppName,
+		KubernetesLabelAppManagedBy: KubernetesDataAppName,
+	}
+	if owner != "" {
+		labels[KubernetesLabelScope] = labelValue(owner)
+	}
+	obj.SetLabels(labels)
+	obj.Object["spec"] = toUnstructured(spec)
+	if status != nil {
+		obj.Object["status"] = toUnstructured(status)
+	}
+	return obj
+}
+
+func toUnstructured(v interface{}) map[string]interface{} {
+	content, _ := json.Marshal(v)
+	m := map[string]interface{}{}
+	json.Unmarshal(content, &m)
+	return runtime.DeepCopyJSON(m)
+}
+
+func decodeField(obj *unstructured.Unstructured, field string, out interface{}) {
+	content, _ := json.Marshal(obj.Object[field])
+	json.Unmarshal(content, out)
+}
+
+func sameField(a, b *unstructured.Unstructured, field string) bool {
+	left, _ := json.Marshal(a.Object[field])
+	right, _ := json.Marshal(b.Object[field])
+	return string(left) == string(right)
+}
+
+// sameLabels returns true, if a has all labels of b. Additional labels in a are ignored
+func sameLabels(a, b map[string]string) bool {
+	for key, value := range b {
+		if a[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// objectName returns a valid object name. A hash of the original values keeps names unique, after invalid characters were replaced
+func objectName(parts ...string) string {
+	joined := strings.Join(parts, "/")
+	sum := sha256.Sum256([]byte(joined))
+	name := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(strings.Join(parts, "-")), "-"), "-")
+	if len(name) > 40 {
+		name = strings.Trim(name[:40], "-")
+	}
+	return fmt.Sprintf("%s-%s", name, hex.EncodeToString(sum[:4]))
+}
+
+// labelValue returns a valid label value for a User name. Names, that are not valid label values, get a hash suffix to keep them unique
+func labelValue(value string) string {
+	if len(value) <= 63 && validLabelValue.MatchString(value) {
+		return value
+	}
+	sum := sha256.Sum256([]byte(value))
+	sanitized := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(value), "-"), "-")
+	if len(sanitized) > 54 {
+		sanitized = strings.Trim(sanitized[:54], "-")
+	}
+	return fmt.Sprintf("%s-%s", sanitized, hex.EncodeToString(sum[:4]))
+}
@@ -0,0 +1,181 @@
+package providers_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+func NewCrdTestProvider() (*providers.KubernetesCrdProvider, *dynamicfake.FakeDynamicClient) {
+	logger, _ := zap.NewDevelopment()
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), providers.KubernetesCrdListKinds)
+
+	// The fake tracker does not maintain resourceVersions like the API server does
+	revision := 0
+	bumpResourceVersion := func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if obj, ok := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured); ok {
+			revision++
+			obj.SetResourceVersion(strconv.Itoa(revision))
+		}
+		return false, nil, nil
+	}
+	client.PrependReactor("create", "*", bumpResourceVersion)
+	client.PrependReactor("update", "*", bumpResourceVersion)
+	return providers.NewKubernetesCrdProviderForClient(*logger.Sugar(), client, "timerec"), client
+}
+
+func TestCrdStoresObjectsSeparately(t *testing.T) {
+	kube, client := NewCrdTestProvider()
+
+	state, err := kube.Refresh("me@example.com")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(state.Users) != 1 || state.Users[0].Name != "me@example.com" {
+		t.Fatalf("expected default user, got %v", state.Users)
+	}
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	providers.CreateJob(&state, api.Job{Name: "OPS-1", Owner: "me@example.com", Activities: []api.TimeEntry{{Start: start, End: start.Add(time.Hour)}}})
+	state.Templates = append(state.Templates, api.RecordTemplate{TemplateName: "meeting", Title: "Meeting"})
+	state.Records = append(state.Records, api.Record{Id: "abc", UserName: "me@example.com", Title: "done", Start: start, End: start.Add(time.Hour)})
+	providers.EnqueueRecord(&state, providers.PendingRecord{Record: api.Record{Id: "def", UserName: "me@example.com", JobName: "OPS-1"}, Attempts: 2})
+	err = kube.Save(state.Partition, state)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for resource, count := range map[schema.GroupVersionResource]int{
+		providers.TimerecUserResource:    1,
+		providers.TimerecJobResource:     1,
+		providers.RecordTemplateResource: 1,
+		providers.RecordResource:         2,
+	} {
+		list, _ := client.Resource(resource).Namespace("timerec").List(context.TODO(), metav1.ListOptions{})
+		if len(list.Items) != count {
+			t.Fatalf("incorrect number of %s: got %d expected %d", resource.Resource, len(list.Items), count)
+		}
+	}
+
+	loaded, _ := kube.Refresh("me@example.com")
+	if len(loaded.Jobs) != 1 || !loaded.Jobs[0].Activities[0].Start.Equal(start) {
+		t.Fatalf("incorrect jobs: %v", loaded.Jobs)
+	}
+	if len(loaded.Records) != 1 || len(loaded.Outbox) != 1 || loaded.Outbox[0].Attempts != 2 {
+		t.Fatalf("incorrect records: got %v and outbox %v", loaded.Records, loaded.Outbox)
+	}
+
+	// Removed objects are deleted
+	providers.DeleteJob(&loaded, api.Job{Name: "OPS-1", Owner: "me@example.com"})
+	kube.Save(loaded.Partition, loaded)
+	list, _ := client.Resource(providers.TimerecJobResource).Namespace("timerec").List(context.TODO(), metav1.ListOptions{})
+	if len(list.Items) != 0 {
+		t.Fatalf("incorrect number of jobs: got %d expected %d", len(list.Items), 0)
+	}
+}
+
+func TestCrdDetectsConcurrentChanges(t *testing.T) {
+	kube, _ := NewCrdTestProvider()
+
+	first, _ := kube.Refresh("me")
+	second, _ := kube.Refresh("me")
+	providers.CreateJob(&first, api.Job{Name: "work", Owner: "me"})
+	if err := kube.Save(first.Partition, first); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	err := kube.Save(second.Partition, second)
+	if !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+}
+
+func TestCrdGlobalSaveDetectsConcurrentChanges(t *testing.T) {
+	kube, _ := NewCrdTestProvider()
+	kube.Refresh("me")
+
+	global, _ := kube.Refresh(providers.ScopeGlobal)
+	user, _ := kube.Refresh("me")
+	providers.CreateJob(&user, api.Job{Name: "work", Owner: "me"})
+	if err := kube.Save(user.Partition, user); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := kube.Save(providers.ScopeGlobal, global); !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+
+	// A global Save locks every partition as well
+	global, _ = kube.Refresh(providers.ScopeGlobal)
+	user, _ = kube.Refresh("me")
+	if err := kube.Save(providers.ScopeGlobal, global); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := kube.Save(user.Partition, user); !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+}
+
+func TestCrdMapsApiConflicts(t *testing.T) {
+	kube, client := NewCrdTestProvider()
+	state, _ := kube.Refresh("me")
+
+	client.PrependReactor("update", "timerecusers", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewConflict(providers.TimerecUserResource.GroupResource(), "me", errors.New("object was modified"))
+	})
+	err := kube.Save(state.Partition, state)
+	if !errors.Is(err, providers.ProviderConflict) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+}
+
+func TestCrdSaveKeepsTemplatesOfOtherStates(t *testing.T) {
+	kube, client := NewCrdTestProvider()
+	templates := func() int {
+		list, _ := client.Resource(providers.RecordTemplateResource).Namespace("timerec").List(context.TODO(), metav1.ListOptions{})
+		return len(list.Items)
+	}
+
+	// RecordTemplates are shared by all partitions, another partition adds one
+	stale, _ := kube.Refresh("me")
+	other, _ := kube.Refresh("other")
+	other.Templates = append(other.Templates, api.RecordTemplate{TemplateName: "meeting"})
+	if err := kube.Save(other.Partition, other); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	providers.CreateJob(&stale, api.Job{Name: "work", Owner: "me"})
+	if err := kube.Save(stale.Partition, stale); err != nil || templates() != 1 {
+		t.Fatalf("expected the template to be kept, got %d templates and %v", templates(), err)
+	}
+
+	fresh, _ := kube.Refresh("me")
+	fresh.Templates = []api.RecordTemplate{}
+	if err := kube.Save(fresh.Partition, fresh); err != nil || templates() != 0 {
+		t.Fatalf("expected the template to be deleted, got %d templates and %v", templates(), err)
+	}
+}
+
+func TestCrdEmptyVersionMustNotExist(t *testing.T) {
+	kube, _ := NewCrdTestProvider()
+	state := providers.StateV2{Partition: "new", Users: []api.User{api.NewDefaultUser("new")}}
+	if err := kube.Save(state.Partition, state); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err := kube.Save(state.Partition, state)
+	if !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+}
@@ -0,0 +1,216 @@
+package providers_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+func NewKubernetesTestProvider(objects ...runtime.Object) (*providers.KubernetesProvider, *fake.Clientset) {
+	logger, _ := zap.NewDevelopment()
+	client := fake.NewSimpleClientset(objects...)
+
+	// The fake tracker does not maintain resourceVersions like the API server does
+	revision := 0
+	bumpResourceVersion := func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if cm, ok := action.(k8stesting.CreateAction).GetObject().(*corev1.ConfigMap); ok {
+			revision++
+			cm.ResourceVersion = strconv.Itoa(revision)
+		}
+		return false, nil, nil
+	}
+	client.PrependReactor("create", "configmaps", bumpResourceVersion)
+	client.PrependReactor("update", "configmaps", bumpResourceVersion)
+	return providers.NewKubernetesProviderForClient(*logger.Sugar(), client, "timerec"), client
+}
+
+func getTestConfigMap(t *testing.T, client *fake.Clientset, name string) corev1.ConfigMap {
+	cm, err := client.CoreV1().ConfigMaps("timerec").Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected ConfigMap %s, got %v", name, err)
+	}
+	return *cm
+}
+
+func TestKubernetesSavesGlobalScopeByOwner(t *testing.T) {
+	kube, client := NewKubernetesTestProvider()
+	kube.Refresh("alice")
+	kube.Refresh("bob")
+
+	global, err := kube.Refresh(providers.ScopeGlobal)
+	if err != nil || len(global.Users) != 2 {
+		t.Fatalf("incorrect global scope: got %v, %v", global.Users, err)
+	}
+	providers.CreateJob(&global, api.Job{Name: "alice-job", Owner: "alice"})
+	providers.CreateJob(&global, api.Job{Name: "bob-job", Owner: "bob"})
+	global.Templates = append(global.Templates, api.RecordTemplate{TemplateName: "meeting", Title: "Meeting"})
+	err = kube.Save(global.Partition, global)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, name := range []string{"alice", "bob"} {
+		var jobs []api.Job
+		yaml.Unmarshal([]byte(getTestConfigMap(t, client, providers.ConfigMapNamePrefix+name).Data["Jobs"]), &jobs)
+		if len(jobs) != 1 || jobs[0].Owner != name {
+			t.Fatalf("incorrect jobs for %s: %v", name, jobs)
+		}
+	}
+	getTestConfigMap(t, client, providers.ConfigMapNameTemplates)
+
+	alice, _ := kube.Refresh("alice")
+	if len(alice.Users) != 1 || len(alice.Jobs) != 1 || len(alice.Templates) != 1 {
+		t.Fatalf("incorrect partition: got %d users, %d jobs and %d templates expected 1, 1 and 1", len(alice.Users), len(alice.Jobs), len(alice.Templates))
+	}
+}
+
+func TestKubernetesMovesTemplatesToGlobalConfigMap(t *testing.T) {
+	legacy := providers.KubernetesConfigMapFromState(providers.StateV2{Users: []api.User{api.NewDefaultUser("me")}})
+	legacy.Namespace = "timerec"
+	legacy.Data["Templates"] = "- template_name: meeting\n  title: Meeting\n"
+	kube, client := NewKubernetesTestProvider(&legacy)
+
+	state, _ := kube.Refresh("me")
+	if len(state.Templates) != 1 {
+		t.Fatalf("incorrect number of templates: got %d expected %d", len(state.Templates), 1)
+	}
+	err := kube.Save(state.Partition, state)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if _, ok := getTestConfigMap(t, client, legacy.Name).Data["Templates"]; ok {
+		t.Fatalf("expected templates to be removed from the user's ConfigMap")
+	}
+	other, _ := kube.Refresh("other")
+	if len(other.Templates) != 1 {
+		t.Fatalf("incorrect number of templates for other user: got %d expected %d", len(other.Templates), 1)
+	}
+}
+
+func TestKubernetesDetectsConcurrentChanges(t *testing.T) {
+	kube, _ := NewKubernetesTestProvider()
+
+	first, _ := kube.Refresh("me")
+	second, _ := kube.Refresh("me")
+	providers.CreateJob(&first, api.Job{Name: "first", Owner: "me"})
+	if err := kube.Save(first.Partition, first); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	providers.CreateJob(&second, api.Job{Name: "second", Owner: "me"})
+	err := kube.Save(second.Partition, second)
+	if !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+}
+
+func TestKubernetesCacheServesRefreshAndWatchesChanges(t *testing.T) {
+	kube, client := NewKubernetesTestProvider()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := kube.StartCache(ctx, providers.KubernetesCacheSyncTimeout)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	changes := make(chan string, 10)
+	kube.Watch(ctx, func(partition string) { changes <- partition })
+
+	state, _ := kube.Refresh("me")
+	providers.CreateJob(&state, api.Job{Name: "work", Owner: "me"})
+	err = kube.Save(state.Partition, state)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	select {
+	case partition := <-changes:
+		if partition != "me" {
+			t.Fatalf("incorrect partition: got %s expected %s", partition, "me")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a change notification")
+	}
+
+	calls := len(client.Actions())
+	loaded, _ := kube.Refresh("me")
+	if len(loaded.Jobs) != 1 {
+		t.Fatalf("incorrect number of jobs: got %d expected %d", len(loaded.Jobs), 1)
+	}
+	if len(client.Actions()) != calls {
+		t.Fatalf("expected Refresh to be served from the cache, got %v", client.Actions()[calls:])
+	}
+
+	// Pausing a User and changing Templates are noticed as well
+	loaded.Users[0].Inactive = true
+	kube.Save(loaded.Partition, loaded)
+	global, _ := kube.Refresh(providers.ScopeGlobal)
+	global.Templates = append(global.Templates, api.RecordTemplate{TemplateName: "default"})
+	kube.Save(providers.ScopeGlobal, global)
+	for _, expected := range []string{"me", providers.ScopeGlobal} {
+		select {
+		case partition := <-changes:
+			if partition != expected {
+				t.Fatalf("incorrect partition: got %s expected %s", partition, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected a change notification for %s", expected)
+		}
+	}
+}
+
+func TestKubernetesGlobalSaveDeletesMissingUsers(t *testing.T) {
+	kube, client := NewKubernetesTestProvider()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := kube.StartCache(ctx, providers.KubernetesCacheSyncTimeout); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	kube.Refresh("me")
+	kube.Refresh("old")
+
+	global, _ := kube.Refresh(providers.ScopeGlobal)
+	for i, user := range global.Users {
+		if user.Name == "old" {
+			global.Users = append(global.Users[:i], global.Users[i+1:]...)
+			break
+		}
+	}
+	if err := kube.Save(global.Partition, global); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := client.CoreV1().ConfigMaps("timerec").Get(context.TODO(), providers.ConfigMapNamePrefix+"old", metav1.GetOptions{}); err == nil {
+		t.Fatal("expected the ConfigMap of the deleted user to be removed")
+	}
+	// The cache must not return the deleted ConfigMap, before the informer noticed the deletion
+	if loaded, _ := kube.Refresh(providers.ScopeGlobal); len(loaded.Users) != 1 || loaded.Users[0].Name != "me" {
+		t.Fatalf("incorrect users: %v", loaded.Users)
+	}
+}
+
+func TestKubernetesCacheSyncTimesOut(t *testing.T) {
+	kube, client := NewKubernetesTestProvider()
+	client.PrependReactor("list", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("api server unavailable")
+	})
+
+	if err := kube.StartCache(context.Background(), 100*time.Millisecond); err == nil {
+		t.Fatal("expected an error, if the cache does not sync")
+	}
+	if err := kube.Watch(context.Background(), func(string) {}); err == nil {
+		t.Fatal("expected no watch without cache")
+	}
+}
@@ -0,0 +1,112 @@
+package providers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+// MattermostProvider posts Messages to a Mattermost incoming webhook. Actions are interactive buttons, Mattermost sends a POST
+// request to the action url, when they are clicked
+type MattermostProvider struct {
+	Webhook string
+	Actions *ActionLinks
+
+	settings SettingsLookup
+	client   *http.Client
+	logger   *zap.SugaredLogger
+}
+
+func NewMattermostProvider(logger zap.SugaredLogger, webhook string, actions *ActionLinks, settings SettingsLookup) (*MattermostProvider, error) {
+	if err := validateUrl("Mattermost webhook", webhook); err != nil {
+		return nil, err
+	}
+	return &MattermostProvider{
+		Webhook:  webhook,
+		Actions:  actions,
+		settings: settings,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger.Named("Mattermost"),
+	}, nil
+}
+
+func (prov *MattermostProvider) NotifyUser(ev cloudevents.Event) error {
+	msg, err := api.MessageFromEvent(ev)
+	if err != nil {
+		return fmt.Errorf("unable to read Message of Event %s: %w", ev.ID(), err)
+	}
+	settings, err := prov.settings(msg.UserName())
+	if err != nil {
+		return fmt.Errorf("unable to read Settings of User '%s': %w", msg.UserName(), err)
+	}
+
+	channel := settings.Notifications.Mattermost
+	if channel.WebhookUrl == "" {
+		channel.WebhookUrl = prov.Webhook
+	}
+	if channel.WebhookUrl == "" {
+		prov.logger.Debugf("No Mattermost webhook for User '%s', skipping Event %s", msg.UserName(), ev.ID())
+		return nil
+	}
+
+	payload := mattermostMessage(msg, channel, prov.Actions.Actions(msg, settings))
+	if err := postJson(prov.client, channel.WebhookUrl, nil, payload); err != nil {
+		prov.logger.Warnf("Failed to send Event %s to Mattermost: %v", ev.ID(), err)
+		return err
+	}
+	prov.logger.Debugf("Event %s sent to Mattermost", ev.ID())
+	return nil
+}
+
+// mattermostPayload is the body of an incoming webhook with a message attachment
+type mattermostPayload struct {
+	Channel     string                 `json:"channel,omitempty"`
+	Text        string                 `json:"text,omitempty"`
+	Attachments []mattermostAttachment `json:"attachments"`
+}
+
+type mattermostAttachment struct {
+	Fallback string             `json:"fallback"`
+	Color    string             `json:"color,omitempty"`
+	Title    string             `json:"title"`
+	Text     string             `json:"text"`
+	Actions  []mattermostAction `json:"actions,omitempty"`
+}
+
+type mattermostAction struct {
+	Id          string                `json:"id"`
+	Name        string                `json:"name"`
+	Integration mattermostIntegration `json:"integration"`
+}
+
+type mattermostIntegration struct {
+	Url     string            `json:"url"`
+	Context map[string]string `json:"context,omitempty"`
+}
+
+func mattermostMessage(msg api.Message, channel api.ChatWebhookSettings, actions []chatAction) mattermostPayload {
+	attachment := mattermostAttachment{
+		Fallback: fmt.Sprintf("%s: %s", chatTitle(msg), msg.Message),
+		Color:    "#e8a33d",
+		Title:    chatTitle(msg),
+		Text:     msg.Message,
+	}
+	for _, action := range actions {
+		attachment.Actions = append(attachment.Actions, mattermostAction{
+			Id:          action.Id,
+			Name:        action.Label,
+			Integration: mattermostIntegration{Url: action.Url, Context: map[string]string{"event": string(msg.Event)}},
+		})
+	}
+
+	payload := mattermostPayload{Channel: channel.Channel, Attachments: []mattermostAttachment{attachment}}
+	if channel.Mention != "" {
+		payload.Text = fmt.Sprintf("@%s", channel.Mention)
+	}
+	return payload
+}
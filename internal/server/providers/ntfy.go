@@ -0,0 +1,122 @@
+package providers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+const NtfyDefaultServer string = "https://ntfy.sh"
+
+// ntfyPriorities map EventTypes to the priority (1-5) and tags (emoji shortcodes) of a ntfy message
+var ntfyPriorities = map[api.EventType]struct {
+	Priority int
+	Tags     []string
+}{
+	api.EventTypeTimerExpired: {Priority: 4, Tags: []string{"alarm_clock"}},
+	api.EventTypeNoEntryAlarm: {Priority: 3, Tags: []string{"memo"}},
+}
+
+// NtfyProvider publishes Messages to the ntfy topic of a User. Topics are set in Settings.Notifications.Ntfy, Users without
+// a topic are skipped. Server and Token are used, unless the User sets their own. Token is only used for Server
+type NtfyProvider struct {
+	Server  string
+	Token   string
+	Actions *ActionLinks
+
+	settings SettingsLookup
+	client   *http.Client
+	logger   *zap.SugaredLogger
+}
+
+func NewNtfyProvider(logger zap.SugaredLogger, server, token string, actions *ActionLinks, settings SettingsLookup) (*NtfyProvider, error) {
+	if server == "" {
+		server = NtfyDefaultServer
+	}
+	if err := validateUrl("ntfy server", server); err != nil {
+		return nil, err
+	}
+	return &NtfyProvider{
+		Server:   server,
+		Token:    token,
+		Actions:  actions,
+		settings: settings,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger.Named("Ntfy"),
+	}, nil
+}
+
+func (prov *NtfyProvider) NotifyUser(ev cloudevents.Event) error {
+	msg, err := api.MessageFromEvent(ev)
+	if err != nil {
+		return fmt.Errorf("unable to read Message of Event %s: %w", ev.ID(), err)
+	}
+	settings, err := prov.settings(msg.UserName())
+	if err != nil {
+		return fmt.Errorf("unable to read Settings of User '%s': %w", msg.UserName(), err)
+	}
+
+	ntfy := settings.Notifications.Ntfy
+	if ntfy.Topic == "" {
+		prov.logger.Debugf("No ntfy topic for User '%s', skipping Event %s", msg.UserName(), ev.ID())
+		return nil
+	}
+	if ntfy.Server == "" {
+		ntfy.Server = prov.Server
+	}
+	// The Token of the server is only sent to its own server, never to a server a User configured
+	if ntfy.Token == "" && strings.TrimSuffix(ntfy.Server, "/") == strings.TrimSuffix(prov.Server, "/") {
+		ntfy.Token = prov.Token
+	}
+	header := http.Header{}
+	if ntfy.Token != "" {
+		header.Set("Authorization", "Bearer "+ntfy.Token)
+	}
+
+	payload := ntfyMessage(msg, ntfy.Topic, prov.Actions.Actions(msg, settings))
+	if err := postJson(prov.client, strings.TrimSuffix(ntfy.Server, "/"), header, payload); err != nil {
+		prov.logger.Warnf("Failed to publish Event %s to ntfy: %v", ev.ID(), err)
+		return err
+	}
+	prov.logger.Debugf("Event %s published to ntfy", ev.ID())
+	return nil
+}
+
+// ntfyPayload is a message for the JSON publish API of ntfy
+type ntfyPayload struct {
+	Topic    string       `json:"topic"`
+	Title    string       `json:"title"`
+	Message  string       `json:"message"`
+	Priority int          `json:"priority,omitempty"`
+	Tags     []string     `json:"tags,omitempty"`
+	Actions  []ntfyAction `json:"actions,omitempty"`
+}
+
+// ntfyAction is a "http" action. The phone sends the request without opening a browser
+type ntfyAction struct {
+	Action string `json:"action"`
+	Label  string `json:"label"`
+	Url    string `json:"url"`
+	Method string `json:"method"`
+	Clear  bool   `json:"clear"`
+}
+
+func ntfyMessage(msg api.Message, topic string, actions []chatAction) ntfyPayload {
+	payload := ntfyPayload{
+		Topic:    topic,
+		Title:    chatTitle(msg),
+		Message:  msg.Message,
+		Priority: ntfyPriorities[msg.Event].Priority,
+		Tags:     ntfyPriorities[msg.Event].Tags,
+	}
+	for _, action := range actions {
+		payload.Actions = append(payload.Actions, ntfyAction{Action: "http", Label: action.Label, Url: action.Url, Method: http.MethodPost, Clear: true})
+	}
+	return payload
+}
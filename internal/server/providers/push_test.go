@@ -0,0 +1,97 @@
+package providers_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+func TestNtfyPublishesToUserTopic(t *testing.T) {
+	sink := &chatSink{}
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	settings := api.NewDefaultUser("me").Settings
+	settings.Notifications.Ntfy = api.NtfySettings{Topic: "timerec-me", Token: "tk_me"}
+	logger, _ := zap.NewDevelopment()
+	ntfy, err := providers.NewNtfyProvider(*logger.Sugar(), server.URL, "tk_server", testActionLinks(), chatSettings(settings))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if err := ntfy.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@work", "me")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	payload := sink.payloads[0]
+	if payload["topic"] != "timerec-me" || payload["priority"] != float64(4) || payload["tags"].([]interface{})[0] != "alarm_clock" {
+		t.Fatalf("incorrect payload: %v", payload)
+	}
+	if auth := sink.requests[0].Header.Get("Authorization"); auth != "Bearer tk_me" {
+		t.Fatalf("incorrect authorization: got %q expected %q", auth, "Bearer tk_me")
+	}
+	if actions := payload["actions"].([]interface{}); len(actions) != 2 || actions[0].(map[string]interface{})["method"] != "POST" {
+		t.Fatalf("incorrect actions: %v", actions)
+	}
+
+	if err := ntfy.NotifyUser(api.MakeMessageEvent(api.EventTypeNoEntryAlarm, "No entry", "activity@none", "me")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if payload := sink.payloads[1]; payload["priority"] != float64(3) || payload["actions"] != nil {
+		t.Fatalf("incorrect payload: %v", payload)
+	}
+}
+
+func TestNtfySendsServerTokenOnlyToServer(t *testing.T) {
+	sink := &chatSink{}
+	server := httptest.NewServer(sink)
+	defer server.Close()
+	userSink := &chatSink{}
+	userServer := httptest.NewServer(userSink)
+	defer userServer.Close()
+
+	settings := api.NewDefaultUser("me").Settings
+	settings.Notifications.Ntfy = api.NtfySettings{Topic: "timerec-me"}
+	logger, _ := zap.NewDevelopment()
+	ntfy, _ := providers.NewNtfyProvider(*logger.Sugar(), server.URL, "tk_server", nil, chatSettings(settings))
+	ntfy.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@work", "me"))
+	if len(sink.requests) != 1 || sink.requests[0].Header.Get("Authorization") != "Bearer tk_server" {
+		t.Fatalf("expected the server token on the server, got %v", sink.requests)
+	}
+
+	settings.Notifications.Ntfy.Server = userServer.URL
+	ntfy, _ = providers.NewNtfyProvider(*logger.Sugar(), server.URL, "tk_server", nil, chatSettings(settings))
+	ntfy.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@work", "me"))
+	if len(userSink.requests) != 1 || userSink.requests[0].Header.Get("Authorization") != "" {
+		t.Fatalf("expected no token on the server of the User, got %v", userSink.requests)
+	}
+}
+
+func TestGotifySkipsUsersWithoutToken(t *testing.T) {
+	sink := &chatSink{}
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	gotify, _ := providers.NewGotifyProvider(*logger.Sugar(), server.URL, testActionLinks(), chatSettings(api.Settings{}))
+	if err := gotify.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@work", "me")); err != nil || len(sink.payloads) != 0 {
+		t.Fatalf("expected the message to be skipped, got %v, %v", sink.payloads, err)
+	}
+
+	settings := api.Settings{Notifications: api.NotificationSettings{Gotify: api.GotifySettings{Token: "app-token"}}}
+	gotify, _ = providers.NewGotifyProvider(*logger.Sugar(), server.URL, testActionLinks(), chatSettings(settings))
+	if err := gotify.NotifyUser(api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@work", "me")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	payload := sink.payloads[0]
+	if sink.requests[0].URL.Path != "/message" || sink.requests[0].Header.Get("X-Gotify-Key") != "app-token" {
+		t.Fatalf("incorrect request: %s %v", sink.requests[0].URL.Path, sink.requests[0].Header)
+	}
+	if payload["priority"] != float64(8) || !strings.Contains(payload["message"].(string), "[Finish](https://timerec.example.com/actions/me/activity/finish?expires=") {
+		t.Fatalf("incorrect payload: %v", payload)
+	}
+}
@@ -0,0 +1,99 @@
+package providers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// StateSchemaVersion is the version of the stored State, that is written by this version of timerec.
+// Data written before schema versions were introduced has version 1
+const StateSchemaVersion int = 2
+
+// StateMigration converts a single partition from schema version From to From+1.
+// Partitions are passed in the YAML format of the file provider, e.g. partition["jobs"] is a list of Jobs with "job_name", "owner", ...
+type StateMigration struct {
+	From        int
+	Description string
+	Migrate     func(partition map[string]interface{}) error
+}
+
+// StateMigrations must contain one entry for every schema version. Never change an existing entry, add a new one and increment StateSchemaVersion
+var StateMigrations = []StateMigration{
+	{From: 1, Description: "store the schema version with every partition", Migrate: func(map[string]interface{}) error { return nil }},
+}
+
+// PendingMigrations returns the descriptions of all migrations, that are applied to data with the given schema version
+func PendingMigrations(from int) ([]string, error) {
+	if from > StateSchemaVersion {
+		return []string{}, fmt.Errorf("schema version %d was written by a newer version of timerec (supported: %d)", from, StateSchemaVersion)
+	}
+	pending := []string{}
+	for _, m := range StateMigrations {
+		if m.From >= from {
+			pending = append(pending, fmt.Sprintf("%d -> %d: %s", m.From, m.From+1, m.Description))
+		}
+	}
+	return pending, nil
+}
+
+// MigratePartition applies all migrations to a partition, that was stored with schema version from
+func MigratePartition(partition map[string]interface{}, from int) error {
+	if _, err := PendingMigrations(from); err != nil {
+		return err
+	}
+	for _, m := range StateMigrations {
+		if m.From < from {
+			continue
+		}
+		if err := m.Migrate(partition); err != nil {
+			return fmt.Errorf("migration %d -> %d failed: %w", m.From, m.From+1, err)
+		}
+	}
+	return nil
+}
+
+// MigrateState applies all migrations to a State, that was already decoded. Providers, that do not store the State as a single document, use it
+// after loading a partition with an older schema version
+func MigrateState(state StateV2, from int) (StateV2, error) {
+	if from == StateSchemaVersion {
+		return state, nil
+	}
+	content, err := yaml.Marshal(state)
+	if err != nil {
+		return state, err
+	}
+	partition := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &partition); err != nil {
+		return state, err
+	}
+	if err := MigratePartition(partition, from); err != nil {
+		return state, err
+	}
+
+	content, err = yaml.Marshal(partition)
+	if err != nil {
+		return state, err
+	}
+	migrated := StateV2{}
+	err = yaml.Unmarshal(content, &migrated)
+	migrated.Partition = state.Partition
+	migrated.Version = state.Version
+	return migrated, err
+}
+
+// SchemaAnnotation is the value of the schema annotation of Kubernetes objects
+func SchemaAnnotation(version int) string {
+	return "v" + strconv.Itoa(version)
+}
+
+// ParseSchemaAnnotation returns the schema version of a Kubernetes object. Objects without annotation are from version 1
+func ParseSchemaAnnotation(annotation string) int {
+	version, err := strconv.Atoi(strings.TrimPrefix(annotation, "v"))
+	if err != nil || version < 1 {
+		return 1
+	}
+	return version
+}
@@ -0,0 +1,98 @@
+package providers_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+const legacyStateFile = `me:
+  partition: me
+  version: "3"
+  users:
+  - name: me
+  jobs:
+  - job_name: work
+    owner: me
+    title: Old Title
+`
+
+// replaceMigration swaps the migration from schema version 1, until the test finished
+func replaceMigration(t *testing.T, migrate func(map[string]interface{}) error) {
+	original := providers.StateMigrations[0].Migrate
+	providers.StateMigrations[0].Migrate = migrate
+	t.Cleanup(func() { providers.StateMigrations[0].Migrate = original })
+}
+
+func TestFileMigratesLegacyState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.yaml")
+	os.WriteFile(path, []byte(legacyStateFile), 0600)
+	replaceMigration(t, func(partition map[string]interface{}) error {
+		for _, job := range partition["jobs"].([]interface{}) {
+			job.(map[interface{}]interface{})["title"] = "New Title"
+		}
+		return nil
+	})
+
+	file := providers.NewFileProvider(path)
+	versions, _ := file.SchemaVersions()
+	if versions["me"] != 1 {
+		t.Fatalf("incorrect schema version: got %d expected %d", versions["me"], 1)
+	}
+
+	state, err := file.Refresh("me")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(state.Jobs) != 1 || state.Jobs[0].Title != "New Title" || state.Version != "3" {
+		t.Fatalf("incorrect migrated state: %v", state)
+	}
+
+	file.Save(state.Partition, state)
+	versions, _ = file.SchemaVersions()
+	if versions["me"] != providers.StateSchemaVersion {
+		t.Fatalf("incorrect schema version: got %d expected %d", versions["me"], providers.StateSchemaVersion)
+	}
+}
+
+func TestFileSchemaVersionsSplitLegacyPartition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.yaml")
+	os.WriteFile(path, []byte(strings.Replace(legacyStateFile, "me:\n  partition: me", "file:\n  partition: file", 1)), 0600)
+
+	file := providers.NewFileProvider(path)
+	versions, err := file.SchemaVersions()
+	if _, ok := versions[providers.FileLegacyPartition]; ok || versions["me"] != 1 || err != nil {
+		t.Fatalf("incorrect schema versions: got %v, %v expected me: 1", versions, err)
+	}
+
+	state, _ := file.Refresh("me")
+	file.Save(state.Partition, state)
+	versions, _ = file.SchemaVersions()
+	if len(versions) != 1 || versions["me"] != providers.StateSchemaVersion {
+		t.Fatalf("incorrect schema versions: got %v expected me: %d", versions, providers.StateSchemaVersion)
+	}
+}
+
+func TestFileRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.yaml")
+	os.WriteFile(path, []byte(strings.Replace(legacyStateFile, "  version:", "  schema: 99\n  version:", 1)), 0600)
+
+	_, err := providers.NewFileProvider(path).Refresh("me")
+	if err == nil || !strings.Contains(err.Error(), "newer version of timerec") {
+		t.Fatalf("incorrect error: got %v expected newer schema version", err)
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	pending, err := providers.PendingMigrations(1)
+	if err != nil || len(pending) != providers.StateSchemaVersion-1 {
+		t.Fatalf("incorrect pending migrations: got %v, %v", pending, err)
+	}
+	pending, _ = providers.PendingMigrations(providers.StateSchemaVersion)
+	if len(pending) != 0 {
+		t.Fatalf("incorrect pending migrations: got %v expected none", pending)
+	}
+}
@@ -0,0 +1,115 @@
+package providers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+// SlackProvider posts Messages to a Slack incoming webhook. Every User can configure their own webhook in Settings.Notifications,
+// Users without one are notified on the webhook of the server, if there is one
+type SlackProvider struct {
+	Webhook string
+	Actions *ActionLinks
+
+	settings SettingsLookup
+	client   *http.Client
+	logger   *zap.SugaredLogger
+}
+
+func NewSlackProvider(logger zap.SugaredLogger, webhook string, actions *ActionLinks, settings SettingsLookup) (*SlackProvider, error) {
+	if err := validateUrl("Slack webhook", webhook); err != nil {
+		return nil, err
+	}
+	return &SlackProvider{
+		Webhook:  webhook,
+		Actions:  actions,
+		settings: settings,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger.Named("Slack"),
+	}, nil
+}
+
+func (prov *SlackProvider) NotifyUser(ev cloudevents.Event) error {
+	msg, err := api.MessageFromEvent(ev)
+	if err != nil {
+		return fmt.Errorf("unable to read Message of Event %s: %w", ev.ID(), err)
+	}
+	settings, err := prov.settings(msg.UserName())
+	if err != nil {
+		return fmt.Errorf("unable to read Settings of User '%s': %w", msg.UserName(), err)
+	}
+
+	channel := settings.Notifications.Slack
+	if channel.WebhookUrl == "" {
+		channel.WebhookUrl = prov.Webhook
+	}
+	if channel.WebhookUrl == "" {
+		prov.logger.Debugf("No Slack webhook for User '%s', skipping Event %s", msg.UserName(), ev.ID())
+		return nil
+	}
+
+	payload := slackMessage(msg, channel, prov.Actions.Actions(msg, settings))
+	if err := postJson(prov.client, channel.WebhookUrl, nil, payload); err != nil {
+		prov.logger.Warnf("Failed to send Event %s to Slack: %v", ev.ID(), err)
+		return err
+	}
+	prov.logger.Debugf("Event %s sent to Slack", ev.ID())
+	return nil
+}
+
+// slackPayload is the body of an incoming webhook with Block Kit blocks. Text is the fallback for notifications
+type slackPayload struct {
+	Text   string       `json:"text"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackBlock struct {
+	Type     string         `json:"type"`
+	Text     *slackText     `json:"text,omitempty"`
+	Elements []slackElement `json:"elements,omitempty"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackElement struct {
+	Type     string    `json:"type"`
+	ActionId string    `json:"action_id"`
+	Text     slackText `json:"text"`
+	Url      string    `json:"url"`
+	Style    string    `json:"style,omitempty"`
+}
+
+func slackMessage(msg api.Message, channel api.SlackSettings, actions []chatAction) slackPayload {
+	text := fmt.Sprintf("*%s*\n%s", chatTitle(msg), msg.Message)
+	if channel.Mention != "" {
+		text = fmt.Sprintf("<@%s> %s", channel.Mention, text)
+	}
+
+	payload := slackPayload{
+		Text:   fmt.Sprintf("%s: %s", chatTitle(msg), msg.Message),
+		Blocks: []slackBlock{{Type: "section", Text: &slackText{Type: "mrkdwn", Text: text}}},
+	}
+	if len(actions) == 0 {
+		return payload
+	}
+
+	buttons := slackBlock{Type: "actions"}
+	for _, action := range actions {
+		button := slackElement{Type: "button", ActionId: action.Id, Text: slackText{Type: "plain_text", Text: action.Label}, Url: action.Url}
+		if action.Id == "finish" {
+			button.Style = "primary"
+		}
+		buttons.Elements = append(buttons.Elements, button)
+	}
+	payload.Blocks = append(payload.Blocks, buttons)
+	return payload
+}
@@ -0,0 +1,700 @@
+package providers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"go.uber.org/zap"
+	_ "modernc.org/sqlite"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+const (
+	SqlDriverSqlite   string = "sqlite"
+	SqlDriverPostgres string = "postgres"
+	SqlDefaultDsn     string = "timerec.db"
+)
+
+// SqlProvider stores the State in a SQL database. SQLite is used for local setups, Postgres if the database is shared.
+// Transactions do not span a whole server operation (Refresh, change, Save). Instead, every Save is version-checked:
+// Refresh reads the version of the partition together with its data, and Save writes the partition in a single transaction,
+// only if the version is unchanged. Otherwise Save returns a VersionConflictError and the operation is retried with fresh data.
+// The TimeService methods read and write in the same transaction and need no version check
+type SqlProvider struct {
+	Driver string
+
+	db     *sql.DB
+	logger *zap.SugaredLogger
+}
+
+// sqlMigrations are applied in order. Applied migrations are tracked in the schema_migrations table, never change an existing entry.
+// {timestamp} is replaced with the timestamp type of the database
+var sqlMigrations = []string{
+	`CREATE TABLE users (
+		name     TEXT PRIMARY KEY,
+		inactive BOOLEAN NOT NULL DEFAULT FALSE,
+		activity TEXT NOT NULL,
+		settings TEXT NOT NULL
+	);
+	CREATE TABLE templates (
+		name        TEXT PRIMARY KEY,
+		project     TEXT NOT NULL,
+		task        TEXT NOT NULL,
+		title       TEXT NOT NULL,
+		description TEXT NOT NULL
+	);
+	CREATE TABLE jobs (
+		owner         TEXT NOT NULL,
+		name          TEXT NOT NULL,
+		created_at    {timestamp} NOT NULL,
+		template_name TEXT NOT NULL,
+		project       TEXT NOT NULL,
+		task          TEXT NOT NULL,
+		title         TEXT NOT NULL,
+		description   TEXT NOT NULL,
+		PRIMARY KEY (owner, name)
+	);
+	CREATE TABLE time_entries (
+		owner      TEXT NOT NULL,
+		job        TEXT NOT NULL,
+		position   INTEGER NOT NULL,
+		comment    TEXT NOT NULL,
+		start_time {timestamp} NOT NULL,
+		end_time   {timestamp} NOT NULL,
+		PRIMARY KEY (owner, job, position)
+	);
+	CREATE TABLE records (
+		id          TEXT PRIMARY KEY,
+		owner       TEXT NOT NULL,
+		job         TEXT NOT NULL,
+		template    TEXT NOT NULL,
+		title       TEXT NOT NULL,
+		description TEXT NOT NULL,
+		project     TEXT NOT NULL,
+		task        TEXT NOT NULL,
+		start_time  {timestamp} NOT NULL,
+		end_time    {timestamp} NOT NULL
+	);
+	CREATE INDEX records_owner_start ON records (owner, start_time);`,
+	`CREATE TABLE outbox (
+		record_id    TEXT PRIMARY KEY,
+		owner        TEXT NOT NULL,
+		record       TEXT NOT NULL,
+		confirmed    TEXT NOT NULL,
+		attempts     INTEGER NOT NULL,
+		next_attempt {timestamp} NOT NULL,
+		last_error   TEXT NOT NULL
+	);`,
+	`CREATE TABLE partitions (
+		name    TEXT PRIMARY KEY,
+		version INTEGER NOT NULL
+	);`,
+	`ALTER TABLE partitions ADD COLUMN state_schema INTEGER NOT NULL DEFAULT 1;`,
+	`ALTER TABLE users ADD COLUMN notified TEXT NOT NULL DEFAULT '{}';`,
+}
+
+// sqlTimestampTypes maps the driver to a column type, that is returned as time.Time
+var sqlTimestampTypes = map[string]string{
+	SqlDriverSqlite:   "TIMESTAMP",
+	SqlDriverPostgres: "TIMESTAMPTZ",
+}
+
+func NewSqlProvider(logger zap.SugaredLogger, driver, dsn string) (*SqlProvider, error) {
+	if driver == "" {
+		driver = SqlDriverSqlite
+	}
+	if driver == SqlDriverSqlite && dsn == "" {
+		dsn = SqlDefaultDsn
+	}
+	if _, ok := sqlTimestampTypes[driver]; !ok {
+		return nil, fmt.Errorf("unsupported sql driver '%s'", driver)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == SqlDriverSqlite {
+		// SQLite allows only a single writer
+		db.SetMaxOpenConns(1)
+	}
+
+	store := &SqlProvider{
+		Driver: driver,
+		db:     db,
+		logger: logger.Named("Sql"),
+	}
+	err = store.Migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// Migrate applies all missing schema migrations
+func (store *SqlProvider) Migrate() error {
+	_, err := store.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at ` + sqlTimestampTypes[store.Driver] + ` NOT NULL)`)
+	if err != nil {
+		return fmt.Errorf("unable to create migrations table: %w", err)
+	}
+
+	var current int
+	err = store.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	for version := current + 1; version <= len(sqlMigrations); version++ {
+		err = store.transaction(func(tx *sql.Tx) error {
+			migration := strings.ReplaceAll(sqlMigrations[version-1], "{timestamp}", sqlTimestampTypes[store.Driver])
+			for _, stmt := range strings.Split(migration, ";") {
+				if strings.TrimSpace(stmt) == "" {
+					continue
+				}
+				if _, err := tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec(store.Rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`), version, time.Now().UTC())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %w", version, err)
+		}
+		store.logger.Infof("Applied schema migration %d", version)
+	}
+	return nil
+}
+
+func (store *SqlProvider) Close() error {
+	return store.db.Close()
+}
+
+// Refresh loads all data of a User. Templates are shared between all Users
+func (store *SqlProvider) Refresh(partition string) (StateV2, error) {
+	state := StateV2{
+		Partition: partition,
+		Users:     []api.User{},
+		Jobs:      []api.Job{},
+		Templates: []api.RecordTemplate{},
+		Records:   []api.Record{},
+		Outbox:    []PendingRecord{},
+	}
+
+	schema := StateSchemaVersion
+	err := store.snapshot(func(tx *sql.Tx) error {
+		version, err := store.version(tx, partition)
+		if err != nil {
+			return err
+		}
+		state.Version = version
+		schema, err = store.schemaVersion(tx, partition)
+		if err != nil {
+			return err
+		}
+		for _, load := range []func(*sql.Tx, *StateV2) error{store.loadUsers, store.loadTemplates, store.loadJobs, store.loadRecords, store.loadOutbox} {
+			if err := load(tx, &state); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		store.logger.Errorf("Error refreshing State: %v", err)
+		return StateV2{}, err
+	}
+	return MigrateState(state, schema)
+}
+
+// Save replaces all data of the partition in a single transaction. The transaction is rolled back, if the version of the partition changed
+func (store *SqlProvider) Save(partition string, state StateV2) error {
+	err := store.transaction(func(tx *sql.Tx) error {
+		if err := store.checkAndIncrementVersion(tx, partition, state.Version); err != nil {
+			return err
+		}
+		if err := store.setSchemaVersion(tx, partition); err != nil {
+			return err
+		}
+		for _, save := range []func(*sql.Tx, string, StateV2) error{store.saveUsers, store.saveTemplates, store.saveJobs, store.saveRecords, store.saveOutbox} {
+			if err := save(tx, partition, state); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		store.logger.Errorf("Error saving State: %v", err)
+	}
+	return err
+}
+
+func (store *SqlProvider) SaveRecord(rec api.Record) (api.Record, error) {
+	if rec.Id == "" {
+		rec.Id = api.RecordId(rec.UserName, rec.JobName, rec.Start, rec.End)
+	}
+
+	var saved api.Record
+	err := store.transaction(func(tx *sql.Tx) error {
+		existing, err := store.queryRecords(tx, `WHERE id = ?`, rec.Id)
+		if err != nil {
+			return err
+		}
+		if len(existing) > 0 {
+			store.logger.Debugf("Record '%s' already saved", rec.Id)
+			saved = existing[0]
+			return nil
+		}
+		saved = rec
+		if err := store.incrementVersion(tx, rec.UserName); err != nil {
+			return err
+		}
+		return store.insertRecord(tx, rec)
+	})
+	if err != nil {
+		return api.Record{}, err
+	}
+	return saved, nil
+}
+
+func (store *SqlProvider) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	return store.queryRecords(store.db, `WHERE owner = ? AND start_time >= ? AND start_time <= ? ORDER BY start_time`, user, from.UTC(), to.UTC())
+}
+
+func (store *SqlProvider) UpdateRecord(rec api.Record) (api.Record, error) {
+	err := store.transaction(func(tx *sql.Tx) error {
+		if err := store.checkRecordOwner(tx, rec); err != nil {
+			return err
+		}
+		if err := store.incrementVersion(tx, rec.UserName); err != nil {
+			return err
+		}
+		_, err := tx.Exec(store.Rebind(`UPDATE records SET title = ?, description = ?, project = ?, task = ?, start_time = ?, end_time = ? WHERE id = ?`),
+			rec.Title, rec.Description, rec.Project, rec.Task, rec.Start.UTC(), rec.End.UTC(), rec.Id)
+		return err
+	})
+	if err != nil {
+		return api.Record{}, err
+	}
+	return rec, nil
+}
+
+func (store *SqlProvider) DeleteRecord(rec api.Record) (api.Record, error) {
+	var deleted api.Record
+	err := store.transaction(func(tx *sql.Tx) error {
+		existing, err := store.queryRecords(tx, `WHERE id = ?`, rec.Id)
+		if err != nil {
+			return err
+		}
+		if err := store.checkRecordOwner(tx, rec); err != nil {
+			return err
+		}
+		deleted = existing[0]
+		if err := store.incrementVersion(tx, rec.UserName); err != nil {
+			return err
+		}
+		_, err = tx.Exec(store.Rebind(`DELETE FROM records WHERE id = ?`), rec.Id)
+		return err
+	})
+	if err != nil {
+		return api.Record{}, err
+	}
+	return deleted, nil
+}
+
+func (store *SqlProvider) checkRecordOwner(tx *sql.Tx, rec api.Record) error {
+	var owner string
+	err := tx.QueryRow(store.Rebind(`SELECT owner FROM records WHERE id = ?`), rec.Id).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return ProviderNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if owner != rec.UserName {
+		return ProviderForbidden
+	}
+	return nil
+}
+
+// version returns the version of a partition. The global scope has a version of its own, which is incremented with every write
+// to any partition (see incrementVersion)
+func (store *SqlProvider) version(tx *sql.Tx, partition string) (string, error) {
+	var version int
+	err := tx.QueryRow(store.Rebind(`SELECT COALESCE(MAX(version), 0) FROM partitions WHERE name = ?`), partition).Scan(&version)
+	if err != nil || version == 0 {
+		return "", err
+	}
+	return strconv.Itoa(version), nil
+}
+
+// checkAndIncrementVersion increments the version of a partition, if it still has the expected version. The check and the
+// increment are a single statement, so concurrent transactions cannot both succeed. Saving the global scope replaces every
+// partition, so all versions are incremented
+func (store *SqlProvider) checkAndIncrementVersion(tx *sql.Tx, partition, expected string) error {
+	var result sql.Result
+	var err error
+	if expected == "" {
+		result, err = tx.Exec(store.Rebind(`INSERT INTO partitions (name, version) VALUES (?, 1) ON CONFLICT (name) DO NOTHING`), partition)
+	} else {
+		result, err = tx.Exec(store.Rebind(`UPDATE partitions SET version = version + 1 WHERE name = ? AND version = ?`), partition, expected)
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		current, _ := store.version(tx, partition)
+		return VersionConflictError{Partition: partition, Expected: expected, Actual: current}
+	}
+
+	if partition == ScopeGlobal {
+		_, err = tx.Exec(store.Rebind(`UPDATE partitions SET version = version + 1 WHERE name <> ?`), ScopeGlobal)
+		return err
+	}
+	return store.incrementVersion(tx, ScopeGlobal)
+}
+
+// schemaVersion returns the oldest schema version of the data in a partition
+func (store *SqlProvider) schemaVersion(tx *sql.Tx, partition string) (int, error) {
+	where, args := scope("name", partition)
+	var schema int
+	err := tx.QueryRow(store.Rebind(`SELECT COALESCE(MIN(state_schema), ?) FROM partitions`+where), append([]interface{}{StateSchemaVersion}, args...)...).Scan(&schema)
+	return schema, err
+}
+
+// setSchemaVersion marks the data of a partition as written with the current schema version
+func (store *SqlProvider) setSchemaVersion(tx *sql.Tx, partition string) error {
+	where, args := scope("name", partition)
+	_, err := tx.Exec(store.Rebind(`UPDATE partitions SET state_schema = ?`+where), append([]interface{}{StateSchemaVersion}, args...)...)
+	return err
+}
+
+// SchemaVersions returns the schema version of every partition
+func (store *SqlProvider) SchemaVersions() (map[string]int, error) {
+	versions := map[string]int{}
+	rows, err := store.db.Query(`SELECT name, state_schema FROM partitions`)
+	if err != nil {
+		return versions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var schema int
+		if err := rows.Scan(&name, &schema); err != nil {
+			return versions, err
+		}
+		versions[name] = schema
+	}
+	return versions, rows.Err()
+}
+
+// incrementVersion marks a partition and the global scope as changed, without checking the current version
+func (store *SqlProvider) incrementVersion(tx *sql.Tx, partition string) error {
+	for _, name := range []string{partition, ScopeGlobal} {
+		_, err := tx.Exec(store.Rebind(`INSERT INTO partitions (name, version) VALUES (?, 1) ON CONFLICT (name) DO UPDATE SET version = partitions.version + 1`), name)
+		if err != nil || partition == ScopeGlobal {
+			return err
+		}
+	}
+	return nil
+}
+
+// transaction runs f in a transaction and commits, if f returns no error
+func (store *SqlProvider) transaction(f func(*sql.Tx) error) error {
+	return store.transactionWithOptions(nil, f)
+}
+
+// snapshot runs f in a transaction, that reads all data as of the same point in time. Postgres needs REPEATABLE READ for this,
+// SQLite transactions are always serializable
+func (store *SqlProvider) snapshot(f func(*sql.Tx) error) error {
+	if store.Driver != SqlDriverPostgres {
+		return store.transaction(f)
+	}
+	return store.transactionWithOptions(&sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}, f)
+}
+
+func (store *SqlProvider) transactionWithOptions(opts *sql.TxOptions, f func(*sql.Tx) error) error {
+	tx, err := store.db.BeginTx(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Rebind replaces ? placeholders with $1, $2, ... for Postgres
+func (store *SqlProvider) Rebind(query string) string {
+	if store.Driver != SqlDriverPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// scope returns a WHERE clause limiting a table to the partition
+func scope(column, partition string) (string, []interface{}) {
+	if partition == ScopeGlobal {
+		return "", []interface{}{}
+	}
+	return " WHERE " + column + " = ?", []interface{}{partition}
+}
+
+func inScope(owner, partition string) bool {
+	return partition == ScopeGlobal || owner == partition
+}
+
+type sqlQuerier interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+}
+
+func (store *SqlProvider) loadUsers(tx *sql.Tx, state *StateV2) error {
+	where, args := scope("name", state.Partition)
+	rows, err := tx.Query(store.Rebind(`SELECT name, inactive, activity, settings, notified FROM users`+where+` ORDER BY name`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user api.User
+		var activity, settings, notified string
+		if err := rows.Scan(&user.Name, &user.Inactive, &activity, &settings, &notified); err != nil {
+			return err
+		}
+		json.Unmarshal([]byte(activity), &user.Activity)
+		json.Unmarshal([]byte(settings), &user.Settings)
+		json.Unmarshal([]byte(notified), &user.Notified)
+		state.Users = append(state.Users, user)
+	}
+	return rows.Err()
+}
+
+func (store *SqlProvider) saveUsers(tx *sql.Tx, partition string, state StateV2) error {
+	where, args := scope("name", partition)
+	if _, err := tx.Exec(store.Rebind(`DELETE FROM users`+where), args...); err != nil {
+		return err
+	}
+	for _, user := range state.Users {
+		if !inScope(user.Name, partition) {
+			continue
+		}
+		activity, _ := json.Marshal(user.Activity)
+		settings, _ := json.Marshal(user.Settings)
+		notified, _ := json.Marshal(user.Notified)
+		_, err := tx.Exec(store.Rebind(`INSERT INTO users (name, inactive, activity, settings, notified) VALUES (?, ?, ?, ?, ?)`), user.Name, user.Inactive, string(activity), string(settings), string(notified))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *SqlProvider) loadTemplates(tx *sql.Tx, state *StateV2) error {
+	rows, err := tx.Query(`SELECT name, project, task, title, description FROM templates ORDER BY name`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t api.RecordTemplate
+		if err := rows.Scan(&t.TemplateName, &t.Project, &t.Task, &t.Title, &t.Description); err != nil {
+			return err
+		}
+		state.Templates = append(state.Templates, t)
+	}
+	return rows.Err()
+}
+
+func (store *SqlProvider) saveTemplates(tx *sql.Tx, partition string, state StateV2) error {
+	if _, err := tx.Exec(`DELETE FROM templates`); err != nil {
+		return err
+	}
+	for _, t := range state.Templates {
+		_, err := tx.Exec(store.Rebind(`INSERT INTO templates (name, project, task, title, description) VALUES (?, ?, ?, ?, ?)`), t.TemplateName, t.Project, t.Task, t.Title, t.Description)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *SqlProvider) loadJobs(tx *sql.Tx, state *StateV2) error {
+	where, args := scope("owner", state.Partition)
+	rows, err := tx.Query(store.Rebind(`SELECT owner, name, created_at, template_name, project, task, title, description FROM jobs`+where+` ORDER BY created_at`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var job api.Job
+		if err := rows.Scan(&job.Owner, &job.Name, &job.CreatedAt, &job.TemplateName, &job.Project, &job.Task, &job.Title, &job.Description); err != nil {
+			return err
+		}
+		job.CreatedAt = job.CreatedAt.Local()
+		state.Jobs = append(state.Jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, job := range state.Jobs {
+		entries, err := tx.Query(store.Rebind(`SELECT comment, start_time, end_time FROM time_entries WHERE owner = ? AND job = ? ORDER BY position`), job.Owner, job.Name)
+		if err != nil {
+			return err
+		}
+		for entries.Next() {
+			var entry api.TimeEntry
+			if err := entries.Scan(&entry.Comment, &entry.Start, &entry.End); err != nil {
+				entries.Close()
+				return err
+			}
+			entry.Start, entry.End = entry.Start.Local(), entry.End.Local()
+			state.Jobs[i].Activities = append(state.Jobs[i].Activities, entry)
+		}
+		entries.Close()
+	}
+	return nil
+}
+
+func (store *SqlProvider) saveJobs(tx *sql.Tx, partition string, state StateV2) error {
+	where, args := scope("owner", partition)
+	if _, err := tx.Exec(store.Rebind(`DELETE FROM time_entries`+where), args...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(store.Rebind(`DELETE FROM jobs`+where), args...); err != nil {
+		return err
+	}
+	for _, job := range state.Jobs {
+		if !inScope(job.Owner, partition) {
+			continue
+		}
+		_, err := tx.Exec(store.Rebind(`INSERT INTO jobs (owner, name, created_at, template_name, project, task, title, description) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+			job.Owner, job.Name, job.CreatedAt.UTC(), job.TemplateName, job.Project, job.Task, job.Title, job.Description)
+		if err != nil {
+			return err
+		}
+		for i, entry := range job.Activities {
+			_, err := tx.Exec(store.Rebind(`INSERT INTO time_entries (owner, job, position, comment, start_time, end_time) VALUES (?, ?, ?, ?, ?, ?)`),
+				job.Owner, job.Name, i, entry.Comment, entry.Start.UTC(), entry.End.UTC())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (store *SqlProvider) queryRecords(q sqlQuerier, where string, args ...interface{}) ([]api.Record, error) {
+	rows, err := q.Query(store.Rebind(`SELECT id, owner, job, template, title, description, project, task, start_time, end_time FROM records `+where), args...)
+	if err != nil {
+		return []api.Record{}, err
+	}
+	defer rows.Close()
+
+	records := []api.Record{}
+	for rows.Next() {
+		var rec api.Record
+		if err := rows.Scan(&rec.Id, &rec.UserName, &rec.JobName, &rec.Template, &rec.Title, &rec.Description, &rec.Project, &rec.Task, &rec.Start, &rec.End); err != nil {
+			return []api.Record{}, err
+		}
+		rec.Start, rec.End = rec.Start.Local(), rec.End.Local()
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+func (store *SqlProvider) insertRecord(tx *sql.Tx, rec api.Record) error {
+	_, err := tx.Exec(store.Rebind(`INSERT INTO records (id, owner, job, template, title, description, project, task, start_time, end_time) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		rec.Id, rec.UserName, rec.JobName, rec.Template, rec.Title, rec.Description, rec.Project, rec.Task, rec.Start.UTC(), rec.End.UTC())
+	return err
+}
+
+func (store *SqlProvider) loadRecords(tx *sql.Tx, state *StateV2) error {
+	where, args := scope("owner", state.Partition)
+	records, err := store.queryRecords(tx, strings.TrimPrefix(where, " ")+` ORDER BY start_time`, args...)
+	if err != nil {
+		return err
+	}
+	state.Records = append(state.Records, records...)
+	return nil
+}
+
+func (store *SqlProvider) saveRecords(tx *sql.Tx, partition string, state StateV2) error {
+	where, args := scope("owner", partition)
+	if _, err := tx.Exec(store.Rebind(`DELETE FROM records`+where), args...); err != nil {
+		return err
+	}
+	for _, rec := range state.Records {
+		if !inScope(rec.UserName, partition) {
+			continue
+		}
+		if err := store.insertRecord(tx, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *SqlProvider) loadOutbox(tx *sql.Tx, state *StateV2) error {
+	where, args := scope("owner", state.Partition)
+	rows, err := tx.Query(store.Rebind(`SELECT record, confirmed, attempts, next_attempt, last_error FROM outbox`+where+` ORDER BY next_attempt`), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p PendingRecord
+		var rec, confirmed string
+		if err := rows.Scan(&rec, &confirmed, &p.Attempts, &p.NextAttempt, &p.LastError); err != nil {
+			return err
+		}
+		json.Unmarshal([]byte(rec), &p.Record)
+		json.Unmarshal([]byte(confirmed), &p.Confirmed)
+		p.NextAttempt = p.NextAttempt.Local()
+		state.Outbox = append(state.Outbox, p)
+	}
+	return rows.Err()
+}
+
+func (store *SqlProvider) saveOutbox(tx *sql.Tx, partition string, state StateV2) error {
+	where, args := scope("owner", partition)
+	if _, err := tx.Exec(store.Rebind(`DELETE FROM outbox`+where), args...); err != nil {
+		return err
+	}
+	for _, p := range state.Outbox {
+		if !inScope(p.Record.UserName, partition) {
+			continue
+		}
+		rec, _ := json.Marshal(p.Record)
+		confirmed, _ := json.Marshal(p.Confirmed)
+		_, err := tx.Exec(store.Rebind(`INSERT INTO outbox (record_id, owner, record, confirmed, attempts, next_attempt, last_error) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+			p.Record.Id, p.Record.UserName, string(rec), string(confirmed), p.Attempts, p.NextAttempt.UTC(), p.LastError)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
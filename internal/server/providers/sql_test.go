@@ -0,0 +1,166 @@
+package providers_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+	"go.uber.org/zap"
+)
+
+func NewSqliteTestProvider(t *testing.T) *providers.SqlProvider {
+	logger, _ := zap.NewDevelopment()
+	store, err := providers.NewSqlProvider(*logger.Sugar(), providers.SqlDriverSqlite, filepath.Join(t.TempDir(), "timerec.db"))
+	if err != nil {
+		t.Fatalf("unable to create sql provider: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSqlStateRoundTrip(t *testing.T) {
+	store := NewSqliteTestProvider(t)
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	state, _ := store.Refresh("me")
+	providers.CreateUser(&state, api.NewDefaultUser("me"))
+	providers.CreateJob(&state, api.Job{
+		Name:           "work",
+		Owner:          "me",
+		CreatedAt:      start,
+		RecordTemplate: api.RecordTemplate{Title: "title", Project: "project"},
+		Activities:     []api.TimeEntry{{Comment: "first", Start: start, End: start.Add(time.Hour)}, {Comment: "second", Start: start.Add(2 * time.Hour), End: start.Add(3 * time.Hour)}},
+	})
+	state.Templates = append(state.Templates, api.RecordTemplate{TemplateName: "meeting", Title: "Meeting"})
+	err := store.Save(state.Partition, state)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	other, _ := store.Refresh("other")
+	if len(other.Users) != 0 || len(other.Jobs) != 0 || len(other.Templates) != 1 {
+		t.Fatalf("incorrect state for other user: %v", other)
+	}
+
+	loaded, _ := store.Refresh("me")
+	if len(loaded.Users) != 1 || loaded.Users[0].Name != "me" || loaded.Users[0].Settings.RoundTo != state.Users[0].Settings.RoundTo {
+		t.Fatalf("incorrect users: got %v expected %v", loaded.Users, state.Users)
+	}
+	if len(loaded.Jobs) != 1 || len(loaded.Jobs[0].Activities) != 2 || loaded.Jobs[0].Activities[1].Comment != "second" {
+		t.Fatalf("incorrect jobs: %v", loaded.Jobs)
+	}
+	if !loaded.Jobs[0].Activities[0].Start.Equal(start) || loaded.Jobs[0].Title != "title" {
+		t.Fatalf("incorrect job: %v", loaded.Jobs[0])
+	}
+
+	providers.DeleteJob(&loaded, api.Job{Name: "work", Owner: "me"})
+	store.Save(loaded.Partition, loaded)
+	global, _ := store.Refresh(providers.ScopeGlobal)
+	if len(global.Users) != 1 || len(global.Jobs) != 0 {
+		t.Fatalf("incorrect global state: %v", global)
+	}
+}
+
+func TestSqlMigrationsAreIdempotent(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	path := filepath.Join(t.TempDir(), "timerec.db")
+	for i := 0; i < 2; i++ {
+		store, err := providers.NewSqlProvider(*logger.Sugar(), providers.SqlDriverSqlite, path)
+		if err != nil {
+			t.Fatalf("expected no error on run %d, got %v", i, err)
+		}
+		store.Close()
+	}
+}
+
+func TestSqlRecords(t *testing.T) {
+	store := NewSqliteTestProvider(t)
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	rec := api.Record{Id: "abc", UserName: "me", Title: "title", Start: start, End: start.Add(time.Hour)}
+	store.SaveRecord(rec)
+	store.SaveRecord(rec)
+
+	records, err := store.ListRecords("me", start.Add(-time.Hour), start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(records) != 1 || !records[0].Start.Equal(start) {
+		t.Fatalf("incorrect records: %v", records)
+	}
+
+	_, err = store.UpdateRecord(api.Record{Id: "abc", UserName: "other", Title: "stolen"})
+	if !errors.Is(err, providers.ProviderForbidden) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderForbidden)
+	}
+	deleted, err := store.DeleteRecord(api.Record{Id: "abc", UserName: "me"})
+	if err != nil || deleted.Title != "title" {
+		t.Fatalf("incorrect delete: got %v, %v", deleted, err)
+	}
+	_, err = store.DeleteRecord(api.Record{Id: "abc", UserName: "me"})
+	if !errors.Is(err, providers.ProviderNotFound) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderNotFound)
+	}
+}
+
+func TestSqlRebindsPostgresPlaceholders(t *testing.T) {
+	store := &providers.SqlProvider{Driver: providers.SqlDriverPostgres}
+	if got := store.Rebind("SELECT * FROM records WHERE owner = ? AND id = ?"); got != "SELECT * FROM records WHERE owner = $1 AND id = $2" {
+		t.Fatalf("incorrect query: %s", got)
+	}
+}
+
+func TestSqlDetectsConcurrentChanges(t *testing.T) {
+	store := NewSqliteTestProvider(t)
+
+	first, _ := store.Refresh("me")
+	second, _ := store.Refresh("me")
+	providers.CreateUser(&first, api.NewDefaultUser("me"))
+	if err := store.Save(first.Partition, first); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	err := store.Save(second.Partition, second)
+	if !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+	loaded, _ := store.Refresh("me")
+	if len(loaded.Users) != 1 {
+		t.Fatalf("incorrect number of users: got %d expected %d", len(loaded.Users), 1)
+	}
+
+	// Records saved by the TimeService change the version as well
+	store.SaveRecord(api.Record{Id: "abc", UserName: "me", Start: time.Now(), End: time.Now()})
+	if err := store.Save(loaded.Partition, loaded); !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+}
+
+func TestSqlGlobalVersionCoversAllPartitions(t *testing.T) {
+	store := NewSqliteTestProvider(t)
+	me, _ := store.Refresh("me")
+	providers.CreateUser(&me, api.NewDefaultUser("me"))
+	store.Save(me.Partition, me)
+
+	global, _ := store.Refresh(providers.ScopeGlobal)
+	me, _ = store.Refresh("me")
+	providers.CreateJob(&me, api.Job{Name: "work", Owner: "me"})
+	if err := store.Save(me.Partition, me); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := store.Save(global.Partition, global); !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+
+	global, _ = store.Refresh(providers.ScopeGlobal)
+	me, _ = store.Refresh("me")
+	if err := store.Save(global.Partition, global); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := store.Save(me.Partition, me); !errors.As(err, &providers.VersionConflictError{}) {
+		t.Fatalf("incorrect error: got %v expected %v", err, providers.ProviderConflict)
+	}
+}
@@ -0,0 +1,351 @@
+package providers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+)
+
+const TogglDefaultUrl string = "https://api.track.toggl.com"
+
+// TogglProvider is a TimeService writing Records as time entries to Toggl Track.
+// Record.Project is mapped to a Toggl project, Record.Task to a task in that project. Since tasks are a paid feature in Toggl,
+// the Task is added as a tag, if the project has no matching task
+type TogglProvider struct {
+	Url       string
+	Token     string
+	Workspace int
+
+	client *http.Client
+	logger *zap.SugaredLogger
+}
+
+type togglNamedItem struct {
+	Id     int    `json:"id"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+type togglTimeEntry struct {
+	Id          int      `json:"id,omitempty"`
+	CreatedWith string   `json:"created_with"`
+	Description string   `json:"description,omitempty"`
+	Start       string   `json:"start"`
+	Stop        string   `json:"stop"`
+	Duration    int      `json:"duration"`
+	WorkspaceId int      `json:"workspace_id"`
+	ProjectId   int      `json:"project_id,omitempty"`
+	TaskId      int      `json:"task_id,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+}
+
+func NewTogglProvider(logger zap.SugaredLogger, url, token string, workspace int) (*TogglProvider, error) {
+	if token == "" || workspace == 0 {
+		return nil, fmt.Errorf("toggl requires an api token and a workspace id")
+	}
+	if url == "" {
+		url = TogglDefaultUrl
+	}
+
+	return &TogglProvider{
+		Url:       strings.TrimSuffix(url, "/"),
+		Token:     token,
+		Workspace: workspace,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		logger:    logger.Named("Toggl"),
+	}, nil
+}
+
+func (toggl *TogglProvider) SaveRecord(rec api.Record) (api.Record, error) {
+	existing, err := toggl.findExisting(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	if existing != 0 {
+		toggl.logger.Infof("Time entry %d for '%s' already exists", existing, rec.Title)
+		return rec, nil
+	}
+
+	entry, err := toggl.entryFromRecord(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	entry.Description = RecordTextWithId(rec)
+
+	var created togglTimeEntry
+	err = toggl.request(http.MethodPost, toggl.workspacePath()+"/time_entries", entry, &created)
+	if err != nil {
+		return api.Record{}, err
+	}
+
+	toggl.logger.Infof("Created time entry %d for '%s'", created.Id, rec.Title)
+	return rec, nil
+}
+
+// ListRecords returns the time entries of the Toggl user in the configured workspace, that were saved for the User. Record.Id is the Id in the marker of the time entry
+func (toggl *TogglProvider) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	projects, err := toggl.listNames(toggl.workspacePath() + "/projects")
+	if err != nil {
+		return []api.Record{}, err
+	}
+
+	entries, err := toggl.listEntries(from, to)
+	if err != nil {
+		return []api.Record{}, err
+	}
+
+	records := []api.Record{}
+	tasks := map[int]map[int]string{}
+	for _, entry := range entries {
+		if entry.Duration < 0 {
+			continue // timer still running
+		}
+		if RecordOwnerFromText(entry.Description) != user {
+			continue
+		}
+		start, _ := time.Parse(time.RFC3339, entry.Start)
+		stop, _ := time.Parse(time.RFC3339, entry.Stop)
+		title, desc := SplitRecordText(entry.Description)
+		task := ""
+		if entry.TaskId != 0 {
+			if _, ok := tasks[entry.ProjectId]; !ok {
+				tasks[entry.ProjectId], err = toggl.listNames(fmt.Sprintf("%s/projects/%d/tasks", toggl.workspacePath(), entry.ProjectId))
+				if err != nil {
+					return []api.Record{}, err
+				}
+			}
+			task = tasks[entry.ProjectId][entry.TaskId]
+			if task == "" {
+				task = strconv.Itoa(entry.TaskId) // unknown tasks keep their ID, which findId accepts
+			}
+		} else if len(entry.Tags) > 0 {
+			task = entry.Tags[0]
+		}
+		records = append(records, api.Record{
+			Id:          RecordIdFromText(entry.Description),
+			UserName:    user,
+			Title:       title,
+			Description: desc,
+			Project:     projects[entry.ProjectId],
+			Task:        task,
+			Start:       start,
+			End:         stop,
+		})
+	}
+	return records, nil
+}
+
+// listEntries returns the time entries of the Toggl user in the configured workspace
+func (toggl *TogglProvider) listEntries(from, to time.Time) ([]togglTimeEntry, error) {
+	var entries []togglTimeEntry
+	query := url.Values{}
+	query.Set("start_date", from.UTC().Format(time.RFC3339))
+	query.Set("end_date", to.UTC().Format(time.RFC3339))
+	err := toggl.request(http.MethodGet, "/api/v9/me/time_entries?"+query.Encode(), nil, &entries)
+	if err != nil {
+		return []togglTimeEntry{}, err
+	}
+
+	filtered := []togglTimeEntry{}
+	for _, entry := range entries {
+		if entry.WorkspaceId == toggl.Workspace {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered, nil
+}
+
+// findExisting returns the ID of a time entry, that was already created for the Record or 0
+func (toggl *TogglProvider) findExisting(rec api.Record) (int, error) {
+	if rec.Id == "" {
+		return 0, nil
+	}
+	entries, err := toggl.listEntries(rec.Start, rec.End)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if RecordIdFromText(entry.Description) == rec.Id {
+			return entry.Id, nil
+		}
+	}
+	return 0, nil
+}
+
+// entryId returns the ID of the time entry of a Record. The time entry is found by the Id in its marker, IDs of time entries
+// (e.g. of Records listed by older versions) are used directly
+func (toggl *TogglProvider) entryId(rec api.Record) (string, error) {
+	if rec.Id == "" {
+		return "", fmt.Errorf("toggl time entry of a record without id: %w", ProviderNotFound)
+	}
+	entries, err := toggl.listEntries(RecordLookupRange(rec))
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if RecordIdFromText(entry.Description) == rec.Id {
+			return strconv.Itoa(entry.Id), nil
+		}
+	}
+	return rec.Id, nil
+}
+
+// checkOwner returns the time entry of the Record, if it belongs to the User of the Record
+func (toggl *TogglProvider) checkOwner(id string, rec api.Record) (togglTimeEntry, error) {
+	var existing togglTimeEntry
+	err := toggl.request(http.MethodGet, "/api/v9/me/time_entries/"+url.PathEscape(id), nil, &existing)
+	if err != nil {
+		return togglTimeEntry{}, err
+	}
+	return existing, CheckRecordOwner(existing.Description, rec)
+}
+
+func (toggl *TogglProvider) UpdateRecord(rec api.Record) (api.Record, error) {
+	id, err := toggl.entryId(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	existing, err := toggl.checkOwner(id, rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	entry, err := toggl.entryFromRecord(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	entry.Description = KeepRecordMarker(entry.Description, existing.Description)
+
+	err = toggl.request(http.MethodPut, toggl.workspacePath()+"/time_entries/"+url.PathEscape(id), entry, nil)
+	if err != nil {
+		return api.Record{}, err
+	}
+	toggl.logger.Infof("Updated time entry %s for '%s'", id, rec.Title)
+	return rec, nil
+}
+
+func (toggl *TogglProvider) DeleteRecord(rec api.Record) (api.Record, error) {
+	id, err := toggl.entryId(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	if _, err := toggl.checkOwner(id, rec); err != nil {
+		return api.Record{}, err
+	}
+	err = toggl.request(http.MethodDelete, toggl.workspacePath()+"/time_entries/"+url.PathEscape(id), nil, nil)
+	if err != nil {
+		return api.Record{}, err
+	}
+	toggl.logger.Infof("Deleted time entry %s", id)
+	return rec, nil
+}
+
+func (toggl *TogglProvider) workspacePath() string {
+	return fmt.Sprintf("/api/v9/workspaces/%d", toggl.Workspace)
+}
+
+func (toggl *TogglProvider) entryFromRecord(rec api.Record) (togglTimeEntry, error) {
+	project, err := toggl.findId(toggl.workspacePath()+"/projects", rec.Project)
+	if err != nil {
+		return togglTimeEntry{}, fmt.Errorf("toggl project '%s': %w", rec.Project, err)
+	}
+
+	entry := togglTimeEntry{
+		CreatedWith: "timerec",
+		Description: RecordText(rec),
+		Start:       rec.Start.UTC().Format(time.RFC3339),
+		Stop:        rec.End.UTC().Format(time.RFC3339),
+		Duration:    int(rec.End.Sub(rec.Start).Seconds()),
+		WorkspaceId: toggl.Workspace,
+		ProjectId:   project,
+	}
+	task, err := toggl.findId(fmt.Sprintf("%s/projects/%d/tasks", toggl.workspacePath(), project), rec.Task)
+	if err == nil {
+		entry.TaskId = task
+	} else if rec.Task != "" {
+		entry.Tags = []string{rec.Task}
+	}
+	return entry, nil
+}
+
+// findId returns the ID of an active item by name. Numeric names are used as ID directly
+func (toggl *TogglProvider) findId(path, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	var items []togglNamedItem
+	err := toggl.request(http.MethodGet, path, nil, &items)
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		if item.Active && strings.EqualFold(item.Name, name) {
+			return item.Id, nil
+		}
+	}
+	return 0, ProviderNotFound
+}
+
+// listNames returns a lookup table from ID to name
+func (toggl *TogglProvider) listNames(path string) (map[int]string, error) {
+	var items []togglNamedItem
+	err := toggl.request(http.MethodGet, path, nil, &items)
+	if err != nil {
+		return map[int]string{}, err
+	}
+
+	names := map[int]string{}
+	for _, item := range items {
+		names[item.Id] = item.Name
+	}
+	return names, nil
+}
+
+func (toggl *TogglProvider) request(method, path string, body interface{}, out interface{}) error {
+	var payload bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&payload).Encode(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, toggl.Url+path, &payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(toggl.Token, "api_token")
+
+	resp, err := toggl.client.Do(req)
+	if err != nil {
+		toggl.logger.Warnf("Request %s %s failed: %v", method, path, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Toggl returns plain-text error messages
+		toggl.logger.Warnf("Request %s %s returned %s: %s", method, path, resp.Status, string(content))
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("toggl returned %s: %w", resp.Status, ProviderNotFound)
+		}
+		return fmt.Errorf("toggl returned %s: %s", resp.Status, strings.TrimSpace(string(content)))
+	}
+
+	if out == nil || len(content) == 0 {
+		return nil
+	}
+	return json.Unmarshal(content, out)
+}
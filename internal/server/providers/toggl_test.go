@@ -0,0 +1,148 @@
+package providers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+	"go.uber.org/zap"
+)
+
+func TestTogglSaveRecord(t *testing.T) {
+	entries := []map[string]interface{}{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v9/workspaces/42/projects", func(rw http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); user != "secret" || pass != "api_token" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		rw.Write([]byte(`[{"id": 5, "name": "ACME", "active": true}]`))
+	})
+	mux.HandleFunc("/api/v9/workspaces/42/projects/5/tasks", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`[{"id": 8, "name": "Development", "active": true}]`))
+	})
+	mux.HandleFunc("/api/v9/workspaces/42/time_entries", func(rw http.ResponseWriter, r *http.Request) {
+		entry := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&entry)
+		entries = append(entries, entry)
+		rw.Write([]byte(`{"id": 1000}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	toggl, _ := providers.NewTogglProvider(*logger.Sugar(), srv.URL, "secret", 42)
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	toggl.SaveRecord(api.Record{Title: "Fix", Project: "acme", Task: "Development", Start: start, End: start.Add(time.Hour)})
+	toggl.SaveRecord(api.Record{Title: "Fix", Project: "acme", Task: "Meeting", Start: start, End: start.Add(time.Hour)})
+
+	if len(entries) != 2 {
+		t.Fatalf("incorrect number of entries: got %d expected %d", len(entries), 2)
+	}
+	if entries[0]["project_id"] != float64(5) || entries[0]["task_id"] != float64(8) || entries[0]["duration"] != float64(3600) {
+		t.Fatalf("incorrect project/task mapping: %v", entries[0])
+	}
+	if _, hasTask := entries[1]["task_id"]; hasTask || entries[1]["tags"] == nil {
+		t.Fatalf("unknown task was not mapped to a tag: %v", entries[1])
+	}
+}
+
+func TestTogglUpdateKeepsRecordId(t *testing.T) {
+	entries := map[int]map[string]interface{}{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v9/workspaces/42/projects", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`[{"id": 5, "name": "ACME", "active": true}]`))
+	})
+	mux.HandleFunc("/api/v9/workspaces/42/projects/5/tasks", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`[]`))
+	})
+	mux.HandleFunc("/api/v9/workspaces/42/time_entries", func(rw http.ResponseWriter, r *http.Request) {
+		entry := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&entry)
+		entry["id"] = float64(1000 + len(entries))
+		entries[1000+len(entries)] = entry
+		json.NewEncoder(rw).Encode(entry)
+	})
+	mux.HandleFunc("/api/v9/workspaces/42/time_entries/", func(rw http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/v9/workspaces/42/time_entries/"))
+		entry := map[string]interface{}{}
+		json.NewDecoder(r.Body).Decode(&entry)
+		entry["id"] = float64(id)
+		entries[id] = entry
+		json.NewEncoder(rw).Encode(entry)
+	})
+	mux.HandleFunc("/api/v9/me/time_entries/", func(rw http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/v9/me/time_entries/"))
+		json.NewEncoder(rw).Encode(entries[id])
+	})
+	mux.HandleFunc("/api/v9/me/time_entries", func(rw http.ResponseWriter, r *http.Request) {
+		list := []map[string]interface{}{}
+		for _, entry := range entries {
+			list = append(list, entry)
+		}
+		json.NewEncoder(rw).Encode(list)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	toggl, _ := providers.NewTogglProvider(*logger.Sugar(), srv.URL, "secret", 42)
+
+	start := time.Date(2022, 3, 1, 9, 0, 0, 0, time.UTC)
+	rec := api.Record{Id: "abc", UserName: "me", Title: "Fix", Project: "ACME", Start: start, End: start.Add(time.Hour)}
+	saved, err := toggl.SaveRecord(rec)
+	if err != nil || saved.Id != rec.Id {
+		t.Fatalf("expected the id of the record, got %v, %v", saved.Id, err)
+	}
+
+	update := saved
+	update.Title = "Fix the bug"
+	if _, err := toggl.UpdateRecord(update); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if text := entries[1000]["description"]; text != "Fix the bug\ntimerec:me/abc" {
+		t.Fatalf("incorrect description after update: %q", text)
+	}
+
+	// A retry of the original save finds the updated entry
+	retried, err := toggl.SaveRecord(rec)
+	if err != nil || retried.Id != saved.Id || len(entries) != 1 {
+		t.Fatalf("expected the existing entry %s, got %v and %d entries, %v", saved.Id, retried.Id, len(entries), err)
+	}
+}
+
+func TestTogglListRecordsMapsTaskNames(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v9/workspaces/42/projects", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`[{"id": 5, "name": "ACME", "active": true}]`))
+	})
+	mux.HandleFunc("/api/v9/workspaces/42/projects/5/tasks", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`[{"id": 8, "name": "Development", "active": true}]`))
+	})
+	mux.HandleFunc("/api/v9/me/time_entries", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(`[
+			{"id": 1000, "description": "Fix\ntimerec:me/abc", "start": "2022-03-01T09:00:00Z", "stop": "2022-03-01T10:00:00Z", "duration": 3600, "workspace_id": 42, "project_id": 5, "task_id": 8},
+			{"id": 1001, "description": "Meet\ntimerec:me/def", "start": "2022-03-01T10:00:00Z", "stop": "2022-03-01T11:00:00Z", "duration": 3600, "workspace_id": 42, "project_id": 5, "tags": ["Meeting"]}
+		]`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	logger, _ := zap.NewDevelopment()
+	toggl, _ := providers.NewTogglProvider(*logger.Sugar(), srv.URL, "secret", 42)
+
+	records, err := toggl.ListRecords("me", time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, 3, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil || len(records) != 2 {
+		t.Fatalf("incorrect records: got %v, %v", records, err)
+	}
+	if records[0].Id != "abc" || records[0].Project != "ACME" || records[0].Task != "Development" || records[1].Task != "Meeting" {
+		t.Fatalf("incorrect records: %v", records)
+	}
+}
@@ -1,55 +1,215 @@
 package providers
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"go.uber.org/zap"
 )
 
+const (
+	WebhookModeBinary     string = "binary"
+	WebhookModeStructured string = "structured"
+
+	WebhookDefaultRetries    int           = 5
+	WebhookDefaultBackoff    time.Duration = time.Second
+	WebhookDefaultDeadLetter string        = "timerec-dead-letters"
+)
+
+// WebhookProvider sends every Event to a CloudEvents sink. Failed deliveries are retried with exponential backoff, Retries 0
+// disables retries. Events, that still cannot be delivered, are kept in the DeadLetter store until they are replayed
 type WebhookProvider struct {
-	Sink string
+	Sink       string
+	Mode       string
+	Retries    int
+	Backoff    time.Duration
+	DeadLetter *DeadLetterStore
+
+	client cloudevents.Client
+	logger *zap.SugaredLogger
 }
 
-func NewWebhookProvider(url string) (*WebhookProvider, error) {
+func NewWebhookProvider(logger zap.SugaredLogger, url, mode string, deadLetter *DeadLetterStore) (*WebhookProvider, error) {
+	if mode == "" {
+		mode = WebhookModeStructured
+	}
+	if mode != WebhookModeBinary && mode != WebhookModeStructured {
+		return nil, fmt.Errorf("unsupported webhook mode '%s'", mode)
+	}
+
+	client, err := cloudevents.NewClientHTTP(
+		cloudevents.WithTarget(url),
+		cehttp.WithIsRetriableFunc(func(status int) bool { return status == 429 || status >= 500 }),
+	)
+	if err != nil {
+		return nil, err
+	}
 	return &WebhookProvider{
-		Sink: url,
+		Sink:       url,
+		Mode:       mode,
+		Retries:    WebhookDefaultRetries,
+		Backoff:    WebhookDefaultBackoff,
+		DeadLetter: deadLetter,
+		client:     client,
+		logger:     logger.Named("Webhook"),
 	}, nil
 }
 
+// NotifyUser sends the Event. If it cannot be delivered, it is added to the DeadLetter store and the delivery error is returned
 func (prov *WebhookProvider) NotifyUser(ev cloudevents.Event) error {
-	jsonBytes, _ := ev.MarshalJSON()
+	err := prov.send(context.Background(), ev)
+	if err == nil || prov.DeadLetter == nil {
+		return err
+	}
+	if dlErr := prov.DeadLetter.Add(ev, prov.Sink, err); dlErr != nil {
+		prov.logger.Errorf("Unable to store undelivered Event %s: %v", ev.ID(), dlErr)
+	}
+	return err
+}
 
-	log.Printf("Sending Cloudevent to '%s'. Data: %s \n", prov.Sink, jsonBytes)
-	resp, err := http.Post(prov.Sink, "application/cloudevents+json", bytes.NewBuffer(jsonBytes))
+func (prov *WebhookProvider) DeadLetters() ([]DeadLetter, error) {
+	if prov.DeadLetter == nil {
+		return []DeadLetter{}, nil
+	}
+	return prov.DeadLetter.List()
+}
+
+// Replay sends all Events in the DeadLetter store again. Delivered Events are removed, all others are kept with the new error
+func (prov *WebhookProvider) Replay(ctx context.Context) (int, error) {
+	if prov.DeadLetter == nil {
+		return 0, nil
+	}
+	letters, err := prov.DeadLetter.List()
 	if err != nil {
-		log.Printf("Failed to send CloudEvent: %v\n", err)
-		return err
+		return 0, err
+	}
+
+	sent := 0
+	for _, letter := range letters {
+		if err := prov.send(ctx, letter.Event); err != nil {
+			letter.Attempts++
+			letter.Error = err.Error()
+			if err := prov.DeadLetter.put(letter); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if err := prov.DeadLetter.Remove(letter.Event.ID()); err != nil {
+			return sent, err
+		}
+		sent++
 	}
-	defer resp.Body.Close()
+	return sent, nil
+}
 
-	if resp.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		log.Printf("Received status: %s - %s", resp.Status, string(body))
-		return fmt.Errorf("server error")
+func (prov *WebhookProvider) send(ctx context.Context, ev cloudevents.Event) error {
+	if prov.Mode == WebhookModeBinary {
+		ctx = cloudevents.WithEncodingBinary(ctx)
+	} else {
+		ctx = cloudevents.WithEncodingStructured(ctx)
+	}
+	if prov.Retries > 0 {
+		ctx = cloudevents.ContextWithRetriesExponentialBackoff(ctx, prov.Backoff, prov.Retries)
 	}
 
-	log.Println("Notification sent")
+	prov.logger.Debugf("Sending CloudEvent %s to '%s'", ev.ID(), prov.Sink)
+	result := prov.client.Send(ctx, ev)
+	if !cloudevents.IsACK(result) {
+		prov.logger.Warnf("Failed to send CloudEvent %s: %v", ev.ID(), result)
+		return fmt.Errorf("failed to send CloudEvent %s: %w", ev.ID(), result)
+	}
+	prov.logger.Debugf("CloudEvent %s sent", ev.ID())
 	return nil
+}
 
-	// client, err := cloudevents.NewClientHTTP(cloudevents.WithTarget(prov.Sink))
-	// if err != nil {
-	// 	return err
-	// }
+// DeadLetter is an Event, that could not be delivered
+type DeadLetter struct {
+	Event    cloudevents.Event `json:"event"`
+	Sink     string            `json:"sink"`
+	Error    string            `json:"error"`
+	FailedAt time.Time         `json:"failed_at"`
+	Attempts int               `json:"attempts"`
+}
 
-	// ctx := cloudevents.ContextWithTarget(context.Background(), prov.Sink)
-	// result := client.Send(ctx, ev)
-	// if cloudevents.IsUndelivered(result) {
-	// 	log.Fatalf("failed to send, %v", result)
-	// }
+// DeadLetterStore keeps every undelivered Event as a JSON file in a directory, so it survives restarts
+type DeadLetterStore struct {
+	Path string
+}
+
+func NewDeadLetterStore(path string) (*DeadLetterStore, error) {
+	if path == "" {
+		path = WebhookDefaultDeadLetter
+	}
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	return &DeadLetterStore{Path: path}, nil
+}
+
+// Add stores an undelivered Event. Events with the same ID are kept only once, with the number of failed attempts
+func (store *DeadLetterStore) Add(ev cloudevents.Event, sink string, cause error) error {
+	letter := DeadLetter{Event: ev, Sink: sink, Error: cause.Error(), FailedAt: time.Now().UTC(), Attempts: 1}
+	if content, err := os.ReadFile(store.file(ev.ID())); err == nil {
+		var existing DeadLetter
+		if err := json.Unmarshal(content, &existing); err == nil {
+			letter.FailedAt = existing.FailedAt
+			letter.Attempts = existing.Attempts + 1
+		}
+	}
+	return store.put(letter)
+}
+
+// List returns all DeadLetters, oldest first
+func (store *DeadLetterStore) List() ([]DeadLetter, error) {
+	files, err := filepath.Glob(filepath.Join(store.Path, "*.json"))
+	if err != nil {
+		return []DeadLetter{}, err
+	}
+
+	letters := []DeadLetter{}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return letters, err
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(content, &letter); err != nil {
+			return letters, fmt.Errorf("unable to parse %s: %w", file, err)
+		}
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].FailedAt.Before(letters[j].FailedAt) })
+	return letters, nil
+}
+
+func (store *DeadLetterStore) Remove(id string) error {
+	err := os.Remove(store.file(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// put writes a temporary file first, so List never reads a partially written DeadLetter
+func (store *DeadLetterStore) put(letter DeadLetter) error {
+	content, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	tmp := store.file(letter.Event.ID()) + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, store.file(letter.Event.ID()))
+}
 
-	// return nil
+func (store *DeadLetterStore) file(id string) string {
+	return filepath.Join(store.Path, filepath.Base(id)+".json")
 }
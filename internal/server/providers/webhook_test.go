@@ -0,0 +1,123 @@
+package providers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// testSink fails the first requests with the given status codes and accepts all others
+type testSink struct {
+	mu       sync.Mutex
+	failures []int
+	received []*http.Request
+}
+
+func (sink *testSink) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.received = append(sink.received, r)
+	if len(sink.failures) > 0 {
+		rw.WriteHeader(sink.failures[0])
+		sink.failures = sink.failures[1:]
+		return
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+func NewWebhookTestProvider(t *testing.T, url, mode string) *providers.WebhookProvider {
+	logger, _ := zap.NewDevelopment()
+	deadLetter, _ := providers.NewDeadLetterStore(t.TempDir())
+	webhook, err := providers.NewWebhookProvider(*logger.Sugar(), url, mode, deadLetter)
+	if err != nil {
+		t.Fatalf("unable to create webhook provider: %v", err)
+	}
+	webhook.Backoff = time.Millisecond
+	return webhook
+}
+
+func TestWebhookRetriesInBinaryMode(t *testing.T) {
+	sink := &testSink{failures: []int{503, 500}}
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	webhook := NewWebhookTestProvider(t, server.URL, providers.WebhookModeBinary)
+	ev := api.MakeMessageEvent(api.EventTypeTimerExpired, "Timer expired", "", "me")
+	if err := webhook.NotifyUser(ev); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(sink.received) != 3 {
+		t.Fatalf("incorrect number of attempts: got %d expected %d", len(sink.received), 3)
+	}
+	if id := sink.received[2].Header.Get("ce-id"); id != ev.ID() {
+		t.Fatalf("incorrect ce-id header: got %q expected %q", id, ev.ID())
+	}
+}
+
+func TestWebhookReplaysDeadLetters(t *testing.T) {
+	sink := &testSink{failures: []int{500, 500, 500, 500, 500, 500}}
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	webhook := NewWebhookTestProvider(t, server.URL, providers.WebhookModeStructured)
+	webhook.Retries = 2 // 3 attempts
+	ev := api.MakeMessageEvent(api.EventTypeNoEntryAlarm, "No entry today", "", "me")
+	if err := webhook.NotifyUser(ev); err == nil {
+		t.Fatal("expected an error for an undelivered event")
+	}
+	if ct := sink.received[0].Header.Get("Content-Type"); ct != "application/cloudevents+json" {
+		t.Fatalf("incorrect content type: got %q expected %q", ct, "application/cloudevents+json")
+	}
+
+	letters, _ := webhook.DeadLetters()
+	if len(letters) != 1 || letters[0].Event.ID() != ev.ID() {
+		t.Fatalf("incorrect dead letters: %v", letters)
+	}
+
+	// The first replay fails as well, the second one is delivered
+	sent, _ := webhook.Replay(context.Background())
+	letters, _ = webhook.DeadLetters()
+	if sent != 0 || len(letters) != 1 || letters[0].Attempts != 2 {
+		t.Fatalf("incorrect dead letters after failed replay: %v", letters)
+	}
+	sent, err := webhook.Replay(context.Background())
+	letters, _ = webhook.DeadLetters()
+	if err != nil || sent != 1 || len(letters) != 0 {
+		t.Fatalf("incorrect replay: got %d sent, %v remaining, %v", sent, letters, err)
+	}
+}
+
+func TestWebhookKeepsRepeatedEventsOnce(t *testing.T) {
+	sink := &testSink{failures: []int{500, 500}}
+	server := httptest.NewServer(sink)
+	defer server.Close()
+
+	webhook := NewWebhookTestProvider(t, server.URL, providers.WebhookModeStructured)
+	webhook.Retries = 0
+	timer := time.Date(2022, 3, 1, 17, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		// Reconcilers send the same notification again, with the same ID
+		ev := api.MakeMessageEvent(api.EventTypeTimerExpired, "Timer expired", "activity@work", "me")
+		ev.SetID(api.EventId("me", api.EventTypeTimerExpired, timer))
+		webhook.NotifyUser(ev)
+	}
+	if len(sink.received) != 2 {
+		t.Fatalf("incorrect number of attempts: got %d expected %d", len(sink.received), 2)
+	}
+
+	letters, _ := webhook.DeadLetters()
+	if len(letters) != 1 || letters[0].Attempts != 2 {
+		t.Fatalf("incorrect dead letters: %v", letters)
+	}
+	if api.EventId("me", api.EventTypeTimerExpired, timer.Add(time.Hour)) == letters[0].Event.ID() {
+		t.Fatal("expected a different ID for a different timer")
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
@@ -27,42 +28,140 @@ const (
 	reconcileUser  reconcileContext = "user"
 )
 
+// ReconcileInterval is the time between two reconciles of all Users, unless a reconciler requests an earlier run
+const ReconcileInterval time.Duration = 5 * time.Minute
+
+// ReconcileForever reconciles all Users periodically. If the State supports it, changes to a User trigger an immediate reconcile of that User,
+// but only if they change the notifications of the User (see notificationState). Other changes, e.g. to Jobs or to the notification log,
+// would only send the same notifications again. Changes to the global scope trigger an immediate reconcile of all Users
 func (mgr *TimerecServer) ReconcileForever(ctx context.Context) {
-	defaultInterval, _ := time.ParseDuration("5m")
+	changes := make(chan string, 100)
+	if watcher, ok := UnwrapState(mgr.StateProvider).(StateWatcher); ok {
+		err := watcher.Watch(ctx, func(partition string) {
+			select {
+			case changes <- partition:
+			default:
+				// The next periodic reconcile picks up the change
+			}
+		})
+		if err != nil {
+			mgr.Logger.Warnf("Unable to watch State, reconciling every %v: %v", ReconcileInterval, err)
+		}
+	}
 
+	reconciled := map[string]string{}
+	next := time.Now()
 	for {
-		result := mgr.ReconcileOnce(ctx)
-
-		if result.Requeue && result.RetryAfter < defaultInterval {
-			SleepWithContext(ctx, result.RetryAfter)
-		} else {
-			SleepWithContext(ctx, defaultInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+			result, users := mgr.reconcileAll(ctx)
+			for _, user := range users {
+				reconciled[user.Name] = notificationState(user)
+			}
+			next = time.Now().Add(nextReconcile(result))
+		case name := <-changes:
+			if name == providers.ScopeGlobal {
+				// Changes outside of a User's partition (e.g. to RecordTemplates) might affect every User
+				next = time.Now()
+				continue
+			}
+			user, err := mgr.reconcileTarget(name)
+			if err != nil {
+				mgr.Logger.Debugf("Not reconciling User '%s': %v", name, err)
+				continue
+			}
+			if reconciled[name] == notificationState(user) {
+				continue
+			}
+			reconciled[name] = notificationState(user)
+			result := mgr.runReconcilers(ctx, []api.User{user}, nil)
+			if userNext := time.Now().Add(nextReconcile(result)); userNext.Before(next) {
+				next = userNext
+			}
 		}
 	}
+}
 
+// notificationState contains everything, that decides which notifications a User gets
+func notificationState(user api.User) string {
+	encoded, _ := json.Marshal(struct {
+		Inactive bool
+		Activity api.Activity
+		Settings api.Settings
+	}{user.Inactive, user.Activity, user.Settings})
+	return string(encoded)
 }
 
-func (mgr *TimerecServer) ReconcileOnce(ctx context.Context) ReconcileResult {
-	// userReconcilers run per User and get a User object in their context
-	userReconcilers := []func(context.Context) ReconcileResult{
+func nextReconcile(result ReconcileResult) time.Duration {
+	if result.Requeue && result.RetryAfter < ReconcileInterval {
+		return result.RetryAfter
+	}
+	return ReconcileInterval
+}
+
+// userReconcilers run per User and get a User object in their context
+func (mgr *TimerecServer) userReconcilers() []func(context.Context) ReconcileResult {
+	return []func(context.Context) ReconcileResult{
 		mgr.reconcileTimer,
 		mgr.reconcileBegin,
+		mgr.reconcileDigest,
 		// mgr.reconcileTest,
 	}
-	// globalReconilers do not depend on a User
-	globalReconcilers := []func(context.Context) ReconcileResult{}
+}
+
+// globalReconilers do not depend on a User
+func (mgr *TimerecServer) globalReconcilers() []func(context.Context) ReconcileResult {
+	return []func(context.Context) ReconcileResult{
+		mgr.reconcileOutbox,
+	}
+}
+
+func (mgr *TimerecServer) ReconcileOnce(ctx context.Context) ReconcileResult {
+	result, _ := mgr.reconcileAll(ctx)
+	return result
+}
 
+// reconcileAll runs all reconcilers and returns the reconciled Users
+func (mgr *TimerecServer) reconcileAll(ctx context.Context) (ReconcileResult, []api.User) {
 	state, err := mgr.StateProvider.Refresh(providers.ScopeGlobal)
+	if err != nil {
+		return ReconcileResult{Requeue: false, Error: err}, []api.User{}
+	}
+
+	userList, _ := providers.ListUsers(&state)
+	return mgr.runReconcilers(ctx, userList, mgr.globalReconcilers()), userList
+}
+
+// ReconcileUser runs only the userReconcilers for a single User
+func (mgr *TimerecServer) ReconcileUser(ctx context.Context, name string) ReconcileResult {
+	user, err := mgr.reconcileTarget(name)
 	if err != nil {
 		return ReconcileResult{Requeue: false, Error: err}
 	}
+	return mgr.runReconcilers(ctx, []api.User{user}, nil)
+}
+
+func (mgr *TimerecServer) reconcileTarget(name string) (api.User, error) {
+	state, err := mgr.StateProvider.Refresh(name)
+	if err != nil {
+		return api.User{}, err
+	}
+
+	user, proverr := providers.GetUser(&state, api.User{Name: name})
+	if proverr != providers.ProviderOk {
+		return api.User{}, proverr
+	}
+	return user, nil
+}
 
+func (mgr *TimerecServer) runReconcilers(ctx context.Context, userList []api.User, globalReconcilers []func(context.Context) ReconcileResult) ReconcileResult {
 	// Start Reconcilers
 	var runningReconcilers int = 0
 	returns := make(chan ReconcileResult)
 
-	userList, _ := providers.ListUsers(&state)
-	for _, f := range userReconcilers {
+	for _, f := range mgr.userReconcilers() {
 		for _, user := range userList {
 			newCtx := context.WithValue(
 				context.WithValue(
@@ -149,6 +248,7 @@ func (mgr *TimerecServer) reconcileTimer(ctx context.Context) ReconcileResult {
 
 	// Timer expired
 	event := api.MakeMessageEvent(api.EventTypeTimerExpired, "Estimated time expired", "activity@"+user.Activity.ActivityName, user.Name)
+	event.SetID(api.EventId(user.Name, api.EventTypeTimerExpired, timer))
 	err2 := mgr.ChatProvider.NotifyUser(event)
 	if err2 != nil {
 		return ReconcileResult{Error: err2}
@@ -189,14 +289,46 @@ func (mgr *TimerecServer) reconcileBegin(ctx context.Context) ReconcileResult {
 	}
 
 	event := api.MakeMessageEvent(api.EventTypeNoEntryAlarm, "No work logged today!", "activity@none", user.Name)
+	event.SetID(api.EventId(user.Name, api.EventTypeNoEntryAlarm, alarm))
 	err = mgr.ChatProvider.NotifyUser(event)
 	if err != nil {
 		return ReconcileResult{Error: err}
 	}
-	snooze, _ := time.ParseDuration("15m") // doesn't do anything, because the default interval is 5m anyway
+	snooze, _ := time.ParseDuration("15m") // doesn't do anything, because the ReconcileInterval is 5m anyway
 	return ReconcileResult{Ok: true, Requeue: true, RetryAfter: snooze}
 }
 
+// reconcileDigest sends the daily digest of a User, if the NotificationService collects Events. The NotificationRouter sends
+// it to the channels of the User, outside of quiet hours. The time of the digest is in the User's timezone
+func (mgr *TimerecServer) reconcileDigest(ctx context.Context) ReconcileResult {
+	user, ok := ctx.Value(reconcileUser).(api.User)
+	if !ok {
+		return ReconcileResult{Error: errors.New("unable to read user from Context")}
+	}
+	digest, ok := mgr.ChatProvider.(DigestSender)
+	if !ok {
+		return ReconcileResult{Ok: true}
+	}
+
+	state, err := mgr.StateProvider.Refresh(user.Name)
+	if err != nil {
+		return ReconcileResult{Error: err}
+	}
+	jobs := []api.Job{}
+	allJobs, _ := providers.ListJobs(&state)
+	for _, job := range allJobs {
+		if job.Owner == user.Name {
+			jobs = append(jobs, job)
+		}
+	}
+
+	next, err := digest.SendDigest(user, jobs, time.Now().In(user.Settings.Notifications.Location()))
+	if err != nil {
+		return ReconcileResult{Requeue: true, RetryAfter: ReconcileInterval, Error: err}
+	}
+	return ReconcileResult{Ok: true, Requeue: true, RetryAfter: time.Until(next)}
+}
+
 // func (mgr *TimerecServer) reconcileTest(_ context.Context) ReconcileResult {
 // 	return ReconcileResult{Requeue: true}
 // }
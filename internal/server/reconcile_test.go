@@ -0,0 +1,120 @@
+package server_test
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// watchedState hands the Watch callback to the test
+type watchedState struct {
+	*providers.FileOrMemoryProvider
+	watching chan func(partition string)
+}
+
+func (s *watchedState) Watch(ctx context.Context, onChange func(partition string)) error {
+	s.watching <- onChange
+	return nil
+}
+
+// lockedNotifier keeps every Event. Reconcilers notify from their own goroutines
+type lockedNotifier struct {
+	mu     sync.Mutex
+	events []cloudevents.Event
+}
+
+func (n *lockedNotifier) NotifyUser(ev cloudevents.Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, ev)
+	return nil
+}
+
+func (n *lockedNotifier) waitFor(t *testing.T, count int) []cloudevents.Event {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		n.mu.Lock()
+		events := append([]cloudevents.Event{}, n.events...)
+		n.mu.Unlock()
+		if len(events) >= count {
+			return events
+		}
+	}
+	t.Fatalf("expected %d events", count)
+	return nil
+}
+
+func TestReconcileOnlyNotifiesForNotificationChanges(t *testing.T) {
+	// The file State is locked, so the test can change it while the reconcilers run
+	mem := providers.NewFileProvider(filepath.Join(t.TempDir(), "db.yaml"))
+	setTimer := func(timer time.Time) {
+		state, _ := mem.Refresh("me")
+		user := api.NewDefaultUser("me")
+		user.Settings.Weekdays = []string{}
+		user.Activity = api.Activity{ActivityName: "work", ActivityStart: timer.Add(-time.Hour), ActivityTimer: timer}
+		state.Users = []api.User{user}
+		mem.Save(state.Partition, state)
+	}
+	setTimer(time.Now().Add(-time.Hour))
+
+	state := &watchedState{FileOrMemoryProvider: mem, watching: make(chan func(string), 1)}
+	notifier := &lockedNotifier{}
+	mgr := NewTestServer(mem)
+	mgr.StateProvider = state
+	mgr.ChatProvider = notifier
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mgr.ReconcileForever(ctx)
+	onChange := <-state.watching
+	first := notifier.waitFor(t, 1)[0]
+
+	// New Jobs do not change the notifications of the User
+	data, _ := mem.Refresh("me")
+	providers.CreateJob(&data, api.Job{Name: "work", Owner: "me"})
+	mem.Save(data.Partition, data)
+	onChange("me")
+
+	setTimer(time.Now().Add(-time.Minute))
+	onChange("me")
+	events := notifier.waitFor(t, 2)
+	if len(events) != 2 || events[1].ID() == first.ID() {
+		t.Fatalf("incorrect events: %v", events)
+	}
+}
+
+func TestReconcileAllUsersForGlobalChanges(t *testing.T) {
+	mem := providers.NewFileProvider(filepath.Join(t.TempDir(), "db.yaml"))
+	setTimer := func(timer time.Time) {
+		state, _ := mem.Refresh("me")
+		user := api.NewDefaultUser("me")
+		user.Settings.Weekdays = []string{}
+		user.Activity = api.Activity{ActivityName: "work", ActivityStart: timer.Add(-time.Hour), ActivityTimer: timer}
+		state.Users = []api.User{user}
+		mem.Save(state.Partition, state)
+	}
+	setTimer(time.Now().Add(-time.Hour))
+
+	state := &watchedState{FileOrMemoryProvider: mem, watching: make(chan func(string), 1)}
+	notifier := &lockedNotifier{}
+	mgr := NewTestServer(mem)
+	mgr.StateProvider = state
+	mgr.ChatProvider = notifier
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go mgr.ReconcileForever(ctx)
+	onChange := <-state.watching
+	notifier.waitFor(t, 1)
+
+	// Only the global scope is reported as changed, the User is reconciled anyway
+	setTimer(time.Now().Add(-time.Minute))
+	onChange(providers.ScopeGlobal)
+	if events := notifier.waitFor(t, 2); len(events) != 2 {
+		t.Fatalf("incorrect events: %v", events)
+	}
+}
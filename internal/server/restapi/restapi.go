@@ -2,11 +2,16 @@ package restapi
 
 import (
 	"context"
+	"crypto/subtle"
 	_ "embed"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"html/template"
+	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	chiprometheus "github.com/766b/chi-prometheus"
@@ -37,6 +42,9 @@ func Run(mgr *server.TimerecServer) {
 	mountUserApi(r, mgr)
 	mountActivityApi(r, mgr)
 	mountJobApi(r, mgr)
+	mountRecordApi(r, mgr)
+	mountAdminApi(r, mgr)
+	mountActionApi(r, mgr)
 
 	mgr.Logger.Infof("Started Webserver on %s", mgr.BindAddress)
 	err := http.ListenAndServe(mgr.BindAddress, r)
@@ -141,10 +149,7 @@ func mountJobApi(r *chi.Mux, mgr *server.TimerecServer) {
 		}
 
 		resp, err := mgr.GetJob(r.Context(), params)
-		if !resp.Success {
-			rw.WriteHeader(404)
-		}
-		ObjectToJsonBytes(r.Context(), rw, resp, err)
+		ObjectToJsonBytesWithStatus(r.Context(), rw, statusUnless(resp.Success, 404), resp, err)
 	})
 	api.Post("/{name}", func(rw http.ResponseWriter, r *http.Request) {
 		params := server.SearchJobParams{
@@ -184,7 +189,240 @@ func mountJobApi(r *chi.Mux, mgr *server.TimerecServer) {
 	r.Mount("/user/{user}/jobs", api)
 }
 
+func mountRecordApi(r *chi.Mux, mgr *server.TimerecServer) {
+	api := chi.NewRouter()
+	api.Use(middleware.Logger)
+	api.Use(middleware.AllowContentType("application/json"))
+	api.Use(middleware.SetHeader("Content-Type", "application/json"))
+
+	api.Get("/", func(rw http.ResponseWriter, r *http.Request) {
+		params := server.SearchRecordParams{
+			UserName: chi.URLParam(r, "user"),
+		}
+		var err1, err2 error
+		if from := r.URL.Query().Get("from"); from != "" {
+			params.From, err1 = time.Parse(time.RFC3339, from)
+		}
+		if to := r.URL.Query().Get("to"); to != "" {
+			params.To, err2 = time.Parse(time.RFC3339, to)
+		}
+		if err1 != nil || err2 != nil {
+			http.Error(rw, http.StatusText(400), 400)
+			return
+		}
+
+		resp, err := mgr.ListRecords(r.Context(), params)
+		ObjectToJsonBytes(r.Context(), rw, resp, err)
+	})
+	api.Put("/{id}", func(rw http.ResponseWriter, r *http.Request) {
+		params := server.UpdateRecordParams{}
+		err := json.NewDecoder(r.Body).Decode(&params)
+		params.UserName = chi.URLParam(r, "user")
+		params.Id = chi.URLParam(r, "id")
+		if err != nil {
+			http.Error(rw, http.StatusText(400), 400)
+			return
+		}
+
+		resp, err := mgr.UpdateRecord(r.Context(), params)
+		ObjectToJsonBytesWithStatus(r.Context(), rw, statusUnless(resp.Success, 404), resp, err)
+	})
+	api.Delete("/{id}", func(rw http.ResponseWriter, r *http.Request) {
+		params := server.DeleteRecordParams{
+			UserName: chi.URLParam(r, "user"),
+			Id:       chi.URLParam(r, "id"),
+		}
+
+		resp, err := mgr.DeleteRecord(r.Context(), params)
+		ObjectToJsonBytesWithStatus(r.Context(), rw, statusUnless(resp.Success, 404), resp, err)
+	})
+
+	r.Mount("/user/{user}/records", api)
+}
+
+// mountAdminApi serves export and import of the whole State. Both are only available with the configured admin token
+func mountAdminApi(r *chi.Mux, mgr *server.TimerecServer) {
+	if mgr.AdminToken == "" {
+		mgr.Logger.Debug("No admin token configured, the admin API is disabled")
+		return
+	}
+	api := chi.NewRouter()
+	api.Use(middleware.Logger)
+	api.Use(requireToken(mgr.AdminToken))
+
+	api.Get("/export", func(rw http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = server.ExportFormatJson
+		}
+		export, err := mgr.ExportState(r.Context())
+		if err != nil {
+			ObjectToJsonBytes(r.Context(), rw, export, err)
+			return
+		}
+		content, err := server.EncodeExport(export, format)
+		if err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/"+format)
+		rw.Write(content)
+	})
+	api.With(middleware.AllowContentType("application/json", "application/yaml")).Post("/import", func(rw http.ResponseWriter, r *http.Request) {
+		content, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(rw, http.StatusText(400), 400)
+			return
+		}
+		data, err := server.DecodeExport(content)
+		if err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+		params := server.ImportParams{
+			Mode:   r.URL.Query().Get("mode"),
+			DryRun: r.URL.Query().Get("dry_run") == "true",
+			Data:   data,
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		resp, err := mgr.ImportState(r.Context(), params)
+		ObjectToJsonBytesWithStatus(r.Context(), rw, statusUnless(resp.Success, 409), resp, err)
+	})
+
+	r.Mount("/admin", api)
+}
+
+// mountActionApi serves the signed action links in notifications. Opening a link (GET) only shows a confirmation page, so
+// link previews and prefetching browsers don't change anything. The action runs on POST: from the confirmation page, or from
+// Mattermost and ntfy buttons, which expect a JSON response with the text to show to the User
+func mountActionApi(r *chi.Mux, mgr *server.TimerecServer) {
+	api := chi.NewRouter()
+	api.Use(middleware.Logger)
+
+	paramsFromRequest := func(r *http.Request) server.ActivityActionParams {
+		return server.ActivityActionParams{
+			UserName:       chi.URLParam(r, "user"),
+			Action:         chi.URLParam(r, "action"),
+			EstimateString: r.URL.Query().Get("estimate"),
+			Expires:        r.URL.Query().Get("expires"),
+			Signature:      r.URL.Query().Get("sig"),
+		}
+	}
+
+	api.Get("/activity/{action}", func(rw http.ResponseWriter, r *http.Request) {
+		params := paramsFromRequest(r)
+		err := mgr.VerifyActivityAction(params)
+
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err != nil {
+			rw.WriteHeader(actionStatus(err))
+		}
+		actionPage.Execute(rw, map[string]interface{}{
+			"Title":   actionTitle(params),
+			"Text":    actionText(params, server.ActivityResponse{}, err),
+			"Confirm": err == nil,
+			"Url":     r.URL.RequestURI(),
+		})
+	})
+	api.Post("/activity/{action}", func(rw http.ResponseWriter, r *http.Request) {
+		params := paramsFromRequest(r)
+		resp, err := mgr.RunActivityAction(r.Context(), params)
+		text := actionText(params, resp, err)
+
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			rw.Header().Set("Content-Type", "application/json")
+			if err != nil && actionStatus(err) == 403 {
+				rw.WriteHeader(403)
+			}
+			json.NewEncoder(rw).Encode(map[string]string{"ephemeral_text": text})
+			return
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err != nil {
+			rw.WriteHeader(actionStatus(err))
+		}
+		actionPage.Execute(rw, map[string]interface{}{"Title": actionTitle(params), "Text": text})
+	})
+
+	r.Mount("/actions/{user}", api)
+}
+
+var actionPage = template.Must(template.New("action").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1"><title>{{ .Title }}</title></head>
+<body>
+<h1>{{ .Title }}</h1>
+{{ if .Confirm }}<form method="post" action="{{ .Url }}"><button type="submit">{{ .Title }}</button></form>{{ else }}<p>{{ .Text }}</p>{{ end }}
+</body>
+</html>
+`))
+
+// actionStatus is the HTTP status of a failed action
+func actionStatus(err error) int {
+	var respErr server.ResponseError
+	if errors.As(err, &respErr) && respErr.Type == server.Forbidden {
+		return 403
+	}
+	return 400
+}
+
+func actionTitle(params server.ActivityActionParams) string {
+	if params.Action == server.ActionExtend && params.EstimateString != "" {
+		return fmt.Sprintf("Extend the Activity of %s by %s", params.UserName, params.EstimateString)
+	}
+	if params.Action == server.ActionFinish {
+		return fmt.Sprintf("Finish the Activity of %s", params.UserName)
+	}
+	return "Timerec"
+}
+
+func actionText(params server.ActivityActionParams, resp server.ActivityResponse, err error) string {
+	var respErr server.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.Message
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if params.Action == server.ActionFinish {
+		if resp.Activity.ActivityName == "" {
+			return "No active Activity"
+		}
+		return fmt.Sprintf("Finished '%s'", resp.Activity.ActivityName)
+	}
+	return fmt.Sprintf("Extended '%s' until %s", resp.Activity.ActivityName, resp.Activity.ActivityTimer.Format("15:04"))
+}
+
+// statusUnless returns 200 for successful responses and status otherwise
+func statusUnless(success bool, status int) int {
+	if success {
+		return http.StatusOK
+	}
+	return status
+}
+
+// requireToken rejects requests without "Authorization: Bearer <token>"
+func requireToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			provided := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte("Bearer "+token)) != 1 {
+				http.Error(rw, http.StatusText(401), 401)
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
 func ObjectToJsonBytes(ctx context.Context, rw http.ResponseWriter, obj interface{}, err error) {
+	ObjectToJsonBytesWithStatus(ctx, rw, http.StatusOK, obj, err)
+}
+
+// ObjectToJsonBytesWithStatus is ObjectToJsonBytes with the status of a successful request, e.g. 404 if nothing was found.
+// The status is written after all headers are set
+func ObjectToJsonBytesWithStatus(ctx context.Context, rw http.ResponseWriter, status int, obj interface{}, err error) {
 	reqid := ctx.Value(middleware.RequestIDKey).(string)
 	rw.Header().Add(middleware.RequestIDHeader, reqid)
 
@@ -195,6 +433,10 @@ func ObjectToJsonBytes(ctx context.Context, rw http.ResponseWriter, obj interfac
 
 		errbytes, jsonerr := json.Marshal(respErr)
 		if jsonerr == nil && isResponseError {
+			if respErr.Type == server.Forbidden {
+				http.Error(rw, string(errbytes), 403)
+				return
+			}
 			http.Error(rw, string(errbytes), 500)
 			return
 		} else {
@@ -209,6 +451,7 @@ func ObjectToJsonBytes(ctx context.Context, rw http.ResponseWriter, obj interfac
 		http.Error(rw, "{ \"error\": \"Encoding error\" }", 500)
 		return
 	}
+	rw.WriteHeader(status)
 	rw.Write(bytes)
 }
 
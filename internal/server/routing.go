@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+	"go.uber.org/zap"
+)
+
+// RoutingRule selects Backends for a Record. Empty fields match everything, non-empty fields are glob patterns (see path.Match)
+type RoutingRule struct {
+	Project  string   `json:"project,omitempty"`
+	Task     string   `json:"task,omitempty"`
+	Template string   `json:"template,omitempty"`
+	Backends []string `json:"backends"`
+}
+
+func (rule RoutingRule) Matches(rec api.Record) bool {
+	return globMatch(rule.Project, rec.Project) && globMatch(rule.Task, rec.Task) && globMatch(rule.Template, rec.Template)
+}
+
+func globMatch(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, value)
+	return ok
+}
+
+// RecordResult reports if a Record was saved to a single Backend
+type RecordResult struct {
+	Backend string     `json:"backend"`
+	Record  api.Record `json:"record"`
+	Success bool       `json:"success"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// RoutingError is returned by TimeServiceRouter.SaveRecord, if at least one Backend failed
+type RoutingError struct {
+	Results []RecordResult
+}
+
+func (e RoutingError) Error() string {
+	var failed []string
+	for _, res := range e.Results {
+		if !res.Success {
+			failed = append(failed, fmt.Sprintf("%s: %s", res.Backend, res.Error))
+		}
+	}
+	return fmt.Sprintf("%d of %d backends failed (%s)", len(failed), len(e.Results), strings.Join(failed, "; "))
+}
+
+// TimeServiceRouter is a TimeService that sends each Record to one or more Backends, depending on the first matching RoutingRule.
+// Records without a matching rule are sent to the Default Backends.
+// Record IDs returned by the router are prefixed with the name of the Backend (e.g. "clockodo:1234")
+type TimeServiceRouter struct {
+	Backends map[string]TimeService
+	Rules    []RoutingRule
+	Default  []string
+
+	logger *zap.SugaredLogger
+}
+
+func NewTimeServiceRouter(logger zap.SugaredLogger, backends map[string]TimeService, rules []RoutingRule, defaults []string) (*TimeServiceRouter, error) {
+	router := &TimeServiceRouter{
+		Backends: backends,
+		Rules:    rules,
+		Default:  defaults,
+		logger:   logger.Named("Router"),
+	}
+
+	if len(defaults) == 0 {
+		return nil, fmt.Errorf("routing requires at least one default backend")
+	}
+	for _, rule := range append([]RoutingRule{{Backends: defaults}}, rules...) {
+		for _, name := range rule.Backends {
+			if _, ok := backends[name]; !ok {
+				return nil, fmt.Errorf("routing uses backend '%s', which is not enabled", name)
+			}
+		}
+	}
+	return router, nil
+}
+
+// Route returns the names of all Backends a Record should be sent to
+func (router *TimeServiceRouter) Route(rec api.Record) []string {
+	for _, rule := range router.Rules {
+		if rule.Matches(rec) {
+			return rule.Backends
+		}
+	}
+	return router.Default
+}
+
+// SaveRecordToBackends sends the Record to every routed Backend, except the ones in skip, and reports the result for each Backend
+func (router *TimeServiceRouter) SaveRecordToBackends(rec api.Record, skip []string) []RecordResult {
+	results := []RecordResult{}
+	for _, name := range router.Route(rec) {
+		if containsString(skip, name) {
+			continue
+		}
+		saved, err := router.Backends[name].SaveRecord(rec)
+		result := RecordResult{Backend: name, Record: rec, Success: err == nil}
+		if err != nil {
+			router.logger.Warnf("Backend '%s' failed to save Record '%s': %v", name, rec.Title, err)
+			result.Error = err.Error()
+		} else {
+			result.Record = prefixRecordId(name, saved)
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (router *TimeServiceRouter) SaveRecord(rec api.Record) (api.Record, error) {
+	results := router.SaveRecordToBackends(rec, nil)
+	for _, res := range results {
+		if !res.Success {
+			return api.Record{}, RoutingError{Results: results}
+		}
+	}
+	return results[0].Record, nil
+}
+
+// ListRecords merges the Records of all Backends, ordered by start time
+func (router *TimeServiceRouter) ListRecords(user string, from, to time.Time) ([]api.Record, error) {
+	records := []api.Record{}
+	for _, name := range router.backendNames() {
+		list, err := router.Backends[name].ListRecords(user, from, to)
+		if err != nil {
+			return []api.Record{}, fmt.Errorf("backend '%s': %w", name, err)
+		}
+		for _, rec := range list {
+			records = append(records, prefixRecordId(name, rec))
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Start.Before(records[j].Start) })
+	return records, nil
+}
+
+func (router *TimeServiceRouter) UpdateRecord(rec api.Record) (api.Record, error) {
+	name, backendRec, err := router.splitRecordId(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	updated, err := router.Backends[name].UpdateRecord(backendRec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	return prefixRecordId(name, updated), nil
+}
+
+func (router *TimeServiceRouter) DeleteRecord(rec api.Record) (api.Record, error) {
+	name, backendRec, err := router.splitRecordId(rec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	deleted, err := router.Backends[name].DeleteRecord(backendRec)
+	if err != nil {
+		return api.Record{}, err
+	}
+	return prefixRecordId(name, deleted), nil
+}
+
+func (router *TimeServiceRouter) backendNames() []string {
+	names := []string{}
+	for name := range router.Backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (router *TimeServiceRouter) splitRecordId(rec api.Record) (string, api.Record, error) {
+	parts := strings.SplitN(rec.Id, ":", 2)
+	if len(parts) != 2 {
+		return "", api.Record{}, fmt.Errorf("record id '%s' has no backend prefix: %w", rec.Id, providers.ProviderNotFound)
+	}
+	if _, ok := router.Backends[parts[0]]; !ok {
+		return "", api.Record{}, fmt.Errorf("unknown backend '%s': %w", parts[0], providers.ProviderNotFound)
+	}
+	rec.Id = parts[1]
+	return parts[0], rec, nil
+}
+
+func prefixRecordId(backend string, rec api.Record) api.Record {
+	rec.Id = backend + ":" + rec.Id
+	return rec
+}
+
+// DefaultBackend is the name reported in RecordResults, if no TimeServiceRouter is used
+const DefaultBackend string = "default"
+
+// saveRecord sends a Record to every Backend of the TimeProvider, that is not already confirmed, and reports the result per Backend
+func (mgr *TimerecServer) saveRecord(rec api.Record, confirmed []string) []RecordResult {
+	if router, ok := mgr.TimeProvider.(*TimeServiceRouter); ok {
+		return router.SaveRecordToBackends(rec, confirmed)
+	}
+	if containsString(confirmed, DefaultBackend) {
+		return []RecordResult{}
+	}
+
+	saved, err := mgr.TimeProvider.SaveRecord(rec)
+	if err != nil {
+		return []RecordResult{{Backend: DefaultBackend, Record: rec, Success: false, Error: err.Error()}}
+	}
+	return []RecordResult{{Backend: DefaultBackend, Record: saved, Success: true}}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+	"go.uber.org/zap"
+)
+
+type failingTimeService struct {
+	*providers.FileOrMemoryProvider
+}
+
+func (f failingTimeService) SaveRecord(rec api.Record) (api.Record, error) {
+	return api.Record{}, errors.New("backend down")
+}
+
+func NewTestRouter(t *testing.T, backends map[string]server.TimeService) *server.TimeServiceRouter {
+	logger, _ := zap.NewDevelopment()
+	router, err := server.NewTimeServiceRouter(*logger.Sugar(), backends, []server.RoutingRule{
+		{Project: "acme", Backends: []string{"clockodo"}},
+		{Task: "OPS-*", Backends: []string{"jira", "clockodo"}},
+	}, []string{"clockodo"})
+	if err != nil {
+		t.Fatalf("unable to create router: %v", err)
+	}
+	return router
+}
+
+func TestRouterUsesFirstMatchingRule(t *testing.T) {
+	clockodo, jira := providers.NewMemoryProvider(), providers.NewMemoryProvider()
+	router := NewTestRouter(t, map[string]server.TimeService{"clockodo": clockodo, "jira": jira})
+
+	testCases := []struct {
+		desc     string
+		rec      api.Record
+		expected int
+	}{
+		{desc: "project", rec: api.Record{Project: "acme", Task: "OPS-1"}, expected: 1},
+		{desc: "task-glob", rec: api.Record{Project: "other", Task: "OPS-1"}, expected: 2},
+		{desc: "default", rec: api.Record{Project: "other", Task: "dev"}, expected: 1},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			if actual := router.Route(tC.rec); len(actual) != tC.expected {
+				t.Fatalf("incorrect backends: got %v expected %d", actual, tC.expected)
+			}
+		})
+	}
+}
+
+func TestRouterRejectsUnknownBackend(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	_, err := server.NewTimeServiceRouter(*logger.Sugar(), map[string]server.TimeService{}, []server.RoutingRule{}, []string{"clockodo"})
+	if err == nil {
+		t.Fatal("expected error for unknown backend, got nil")
+	}
+}
+
+func TestCompleteJobReportsBackendResults(t *testing.T) {
+	mem, clockodo, jira := providers.NewMemoryProvider(), providers.NewMemoryProvider(), providers.NewMemoryProvider()
+	mgr := NewTestServer(mem)
+	router := NewTestRouter(t, map[string]server.TimeService{
+		"clockodo": clockodo,
+		"jira":     failingTimeService{jira},
+	})
+	mgr.TimeProvider = router
+
+	start := time.Now().Add(-time.Hour)
+	providers.CreateJob(&mem.Data, api.Job{
+		Name:           "OPS-1",
+		RecordTemplate: api.RecordTemplate{Title: "ops", Description: "desc", Project: "other", Task: "OPS-1"},
+		Activities:     []api.TimeEntry{{Start: start, End: start.Add(time.Hour)}},
+	})
+
+	res, err := mgr.CompleteJob(context.TODO(), server.CompleteJobParams{SearchJobParams: server.SearchJobParams{Name: "OPS-1"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(res.Records) != 2 || res.Records[0].Success || !res.Records[1].Success || res.Pending != 1 {
+		t.Fatalf("incorrect results: %v (pending %d)", res.Records, res.Pending)
+	}
+	if len(mem.Data.Jobs) != 1 || len(mem.Data.Outbox) != 1 {
+		t.Fatalf("incorrect state: got %d jobs and %d pending records expected 1 and 1", len(mem.Data.Jobs), len(mem.Data.Outbox))
+	}
+
+	// Retry only sends the Record to the failed Backend, once the backoff expired
+	router.Backends["jira"] = jira
+	mem.Data.Outbox[0].NextAttempt = time.Now().Add(-time.Second)
+	res, err = mgr.CompleteJob(context.TODO(), server.CompleteJobParams{SearchJobParams: server.SearchJobParams{Name: "OPS-1"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(res.Records) != 1 || res.Records[0].Backend != "jira" || !res.Records[0].Success || res.Pending != 0 {
+		t.Fatalf("incorrect results: %v (pending %d)", res.Records, res.Pending)
+	}
+	if len(clockodo.Data.Records) != 1 || len(jira.Data.Records) != 1 {
+		t.Fatalf("incorrect number of records: got %d/%d expected 1/1", len(clockodo.Data.Records), len(jira.Data.Records))
+	}
+	if len(mem.Data.Jobs) != 0 || len(mem.Data.Outbox) != 0 {
+		t.Fatalf("incorrect state: got %d jobs and %d pending records expected 0 and 0", len(mem.Data.Jobs), len(mem.Data.Outbox))
+	}
+}
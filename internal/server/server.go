@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	cloudevents "github.com/cloudevents/sdk-go/v2"
 	"github.com/spf13/viper"
@@ -13,6 +16,10 @@ import (
 type TimerecServer struct {
 	Logger      zap.SugaredLogger
 	BindAddress string
+	// AdminToken protects the admin API. Without a token, the admin API is not served
+	AdminToken string
+	// ActionLinks signs the links in notifications. Without a PublicUrl it is nil and notifications have no actions
+	ActionLinks *providers.ActionLinks
 
 	StateProvider State
 	TimeProvider  TimeService
@@ -21,20 +28,112 @@ type TimerecServer struct {
 
 type TimerecServerConfig struct {
 	Listen string `json:"listen,omitempty"`
-	File   struct {
+	// PublicUrl is the address of the server as seen by Users. Notifications link to it, to extend or finish an Activity
+	PublicUrl string `json:"publicurl,omitempty"`
+	Actions   struct {
+		Secret string        `json:"secret,omitempty"`
+		Ttl    time.Duration `json:"ttl,omitempty"`
+	} `json:"actions,omitempty"`
+	Admin struct {
+		Token string `json:"token,omitempty"`
+	} `json:"admin,omitempty"`
+
+	File struct {
 		Enabled bool   `json:"enabled"`
 		Path    string `json:"path"`
+		KeyFile string `json:"keyfile,omitempty"`
 	} `json:"file,omitempty"`
+	Bolt struct {
+		Enabled bool   `json:"enabled,omitempty"`
+		Path    string `json:"path,omitempty"`
+	} `json:"bolt,omitempty"`
+	Git struct {
+		Enabled bool   `json:"enabled,omitempty"`
+		Path    string `json:"path,omitempty"`
+		Remote  string `json:"remote,omitempty"`
+	} `json:"git,omitempty"`
 	Kubernetes struct {
 		Enabled    bool   `json:"enabled"`
 		KubeConfig string `json:"kube_config,omitempty"`
+		Crd        bool   `json:"crd,omitempty"`
 	} `json:"kubernetes,omitempty"`
+	Sql struct {
+		Enabled bool   `json:"enabled,omitempty"`
+		Driver  string `json:"driver,omitempty"`
+		Dsn     string `json:"dsn,omitempty"`
+	} `json:"sql,omitempty"`
 	Clockodo struct {
-		Enabled bool `json:"enabled,omitempty"`
+		Enabled bool   `json:"enabled,omitempty"`
+		Url     string `json:"url,omitempty"`
+		User    string `json:"user,omitempty"`
+		Token   string `json:"token,omitempty"`
 	} `json:"clockodo,omitempty"`
+	Jira struct {
+		Enabled bool   `json:"enabled,omitempty"`
+		Url     string `json:"url,omitempty"`
+		User    string `json:"user,omitempty"`
+		Token   string `json:"token,omitempty"`
+	} `json:"jira,omitempty"`
+	Toggl struct {
+		Enabled   bool   `json:"enabled,omitempty"`
+		Url       string `json:"url,omitempty"`
+		Token     string `json:"token,omitempty"`
+		Workspace int    `json:"workspace,omitempty"`
+	} `json:"toggl,omitempty"`
+	Kimai struct {
+		Enabled bool   `json:"enabled,omitempty"`
+		Url     string `json:"url,omitempty"`
+		User    string `json:"user,omitempty"`
+		Token   string `json:"token,omitempty"`
+	} `json:"kimai,omitempty"`
+	Cache struct {
+		Enabled bool          `json:"enabled,omitempty"`
+		Ttl     time.Duration `json:"ttl,omitempty"`
+		Watch   bool          `json:"watch,omitempty"`
+	} `json:"cache,omitempty"`
+	Routing struct {
+		Enabled bool          `json:"enabled,omitempty"`
+		Default []string      `json:"default,omitempty"`
+		Rules   []RoutingRule `json:"rules,omitempty"`
+	} `json:"routing,omitempty"`
 	Webhook struct {
-		Enabled bool `json:"enabled,omitempty"`
+		Enabled    bool          `json:"enabled,omitempty"`
+		Url        string        `json:"url,omitempty"`
+		Mode       string        `json:"mode,omitempty"`
+		Retries    *int          `json:"retries,omitempty"` // nil uses the default, 0 disables retries
+		Backoff    time.Duration `json:"backoff,omitempty"`
+		DeadLetter string        `json:"deadletter,omitempty"`
 	} `json:"webhook,omitempty"`
+	Slack struct {
+		Enabled bool   `json:"enabled,omitempty"`
+		Webhook string `json:"webhook,omitempty"`
+	} `json:"slack,omitempty"`
+	Mattermost struct {
+		Enabled bool   `json:"enabled,omitempty"`
+		Webhook string `json:"webhook,omitempty"`
+	} `json:"mattermost,omitempty"`
+	Email struct {
+		Enabled  bool          `json:"enabled,omitempty"`
+		Host     string        `json:"host,omitempty"`
+		Port     int           `json:"port,omitempty"`
+		Username string        `json:"username,omitempty"`
+		Password string        `json:"password,omitempty"`
+		From     string        `json:"from,omitempty"`
+		DigestAt time.Duration `json:"digestat,omitempty"`
+	} `json:"email,omitempty"`
+	Ntfy struct {
+		Enabled bool   `json:"enabled,omitempty"`
+		Server  string `json:"server,omitempty"`
+		Token   string `json:"token,omitempty"`
+	} `json:"ntfy,omitempty"`
+	Gotify struct {
+		Enabled bool   `json:"enabled,omitempty"`
+		Server  string `json:"server,omitempty"`
+	} `json:"gotify,omitempty"`
+	Notifications struct {
+		Enabled bool     `json:"enabled,omitempty"`
+		Default []string `json:"default,omitempty"`
+	} `json:"notifications,omitempty"`
 }
 
 type State interface {
@@ -42,8 +141,34 @@ type State interface {
 	Save(string, providers.StateV2) error
 }
 
+// StateWatcher is implemented by States, that notice changes to a User's partition. Changes trigger a reconcile of that User. Changes reported
+// as ScopeGlobal trigger a reconcile of all Users
+type StateWatcher interface {
+	Watch(ctx context.Context, onChange func(partition string)) error
+}
+
+// StateHistory is implemented by States, that keep every change
+type StateHistory interface {
+	History(limit int, patch bool) ([]providers.StateChange, error)
+}
+
+// CompleteState is implemented by States, whose global scope skips some Users (e.g. paused Users on Kubernetes) or Records (e.g. bolt).
+// RefreshAll returns every User and Record, so copying the State loses nothing
+type CompleteState interface {
+	RefreshAll() (providers.StateV2, error)
+}
+
+// SchemaVersioned is implemented by States, that store the schema version of every partition
+type SchemaVersioned interface {
+	SchemaVersions() (map[string]int, error)
+}
+
 type TimeService interface {
 	SaveRecord(api.Record) (api.Record, error)
+	// ListRecords returns all Records of a user, that started between from and to
+	ListRecords(user string, from, to time.Time) ([]api.Record, error)
+	UpdateRecord(api.Record) (api.Record, error)
+	DeleteRecord(api.Record) (api.Record, error)
 }
 type NotificationService interface {
 	// Different Services might have vastly different ideas how messages should look like
@@ -51,6 +176,18 @@ type NotificationService interface {
 	NotifyUser(cloudevents.Event) error
 }
 
+// DigestSender is implemented by NotificationServices, that collect Events and send them as one summary per day.
+// SendDigest is called for every User and returns, when the next digest of that User is due
+type DigestSender interface {
+	SendDigest(user api.User, jobs []api.Job, now time.Time) (time.Time, error)
+}
+
+// DeadLetterReplayer is implemented by NotificationServices, that keep undelivered Events
+type DeadLetterReplayer interface {
+	DeadLetters() ([]providers.DeadLetter, error)
+	Replay(ctx context.Context) (int, error)
+}
+
 type ResponseError struct {
 	Type    ResponseErrorType
 	Message string
@@ -62,12 +199,38 @@ func (r ResponseError) Error() string {
 	return fmt.Sprintf("%s: %v", r.Type, r.Cause)
 }
 
+func (r ResponseError) Unwrap() error {
+	return r.Cause
+}
+
+// StateSaveAttempts is how often an API method is run, if the State was changed concurrently
+const StateSaveAttempts int = 5
+
+// retryOnConflict runs f again, as long as saving the State fails with a VersionConflictError
+func (mgr *TimerecServer) retryOnConflict(f func() error) error {
+	var err error
+	for attempt := 1; attempt <= StateSaveAttempts; attempt++ {
+		err = f()
+		if !errors.As(err, &providers.VersionConflictError{}) {
+			return err
+		}
+		mgr.Logger.Debugf("State changed concurrently, retrying (attempt %d): %v", attempt, err)
+	}
+	mgr.Logger.Errorf("State changed concurrently, giving up after %d attempts: %v", StateSaveAttempts, err)
+	return err
+}
+
 func (mgr *TimerecServer) MakeNewResponseError(t ResponseErrorType, err error, message string, values ...interface{}) ResponseError {
 	respErr := ResponseError{
 		Type:    t,
 		Message: fmt.Sprintf(message, values...),
 		Cause:   err,
 	}
+	if errors.As(err, &providers.VersionConflictError{}) {
+		// Conflicts are retried, retryOnConflict logs them, once all attempts failed
+		mgr.Logger.Debug(respErr)
+		return respErr
+	}
 	mgr.Logger.Error(respErr)
 	return respErr
 }
@@ -77,13 +240,16 @@ const (
 	ValidationError ResponseErrorType = "VALIDATION_FAILED"
 	ProviderError   ResponseErrorType = "BACKEND_ERROR"
 	ServerError     ResponseErrorType = "SERVER_ERROR"
+	Forbidden       ResponseErrorType = "FORBIDDEN"
 )
 
-func NewServer() TimerecServer {
+// NewServer creates the server from the configuration. Notifiers look up User settings through the returned server,
+// so later changes to it (e.g. to its StateProvider) are seen by them
+func NewServer() *TimerecServer {
 	// logger, _ := zap.NewProduction()
 	logger, _ := zap.NewDevelopment()
 	defaultProvider := providers.NewMemoryProvider()
-	server := TimerecServer{
+	server := &TimerecServer{
 		Logger:        *logger.Sugar(),
 		StateProvider: defaultProvider,
 		TimeProvider:  defaultProvider,
@@ -96,36 +262,276 @@ func NewServer() TimerecServer {
 		logger.Warn(fmt.Sprintf("Config File invalid: %v", err))
 	}
 	server.BindAddress = settings.Listen
+	server.AdminToken = settings.Admin.Token
+	server.ActionLinks, err = providers.NewActionLinks(settings.PublicUrl, settings.Actions.Secret)
+	if err != nil {
+		panic(err)
+	}
+	if server.ActionLinks != nil {
+		if settings.Actions.Ttl > 0 {
+			server.ActionLinks.Ttl = settings.Actions.Ttl
+		}
+		if settings.Actions.Secret == "" {
+			logger.Sugar().Warn("No actions.secret configured, links in notifications stop working after a restart")
+		}
+	}
+	timeServices := map[string]TimeService{}
+	notifiers := map[string]NotificationService{}
 
 	// Configure File Provider
 	if settings.File.Enabled {
-		fileProvider := providers.NewFileProvider(settings.File.Path)
+		keys, err := providers.LoadStateKeys(settings.File.KeyFile)
+		if err != nil {
+			panic(err)
+		}
+		fileProvider := providers.NewEncryptedFileProvider(settings.File.Path, keys)
+		if len(keys) > 0 {
+			logger.Sugar().Debugf("Encrypting State with key '%s'", keys[0].Id)
+		}
 		server.StateProvider = fileProvider
 		logger.Sugar().Debug("Using State: File")
 
 		server.TimeProvider = fileProvider
+		timeServices["file"] = fileProvider
 		logger.Sugar().Debug("Using TimeService: File")
 	}
 
+	// Configure Bolt Provider
+	if settings.Bolt.Enabled {
+		boltProvider, err := providers.NewBoltProvider(server.Logger, settings.Bolt.Path)
+		if err != nil {
+			panic(err)
+		}
+		server.StateProvider = boltProvider
+		logger.Sugar().Debugf("Using State: Bolt (%s)", boltProvider.Path)
+
+		server.TimeProvider = boltProvider
+		timeServices["bolt"] = boltProvider
+		logger.Sugar().Debug("Using TimeService: Bolt")
+	}
+
+	// Configure Git Provider
+	if settings.Git.Enabled {
+		gitProvider, err := providers.NewGitProvider(server.Logger, settings.Git.Path, settings.Git.Remote)
+		if err != nil {
+			panic(err)
+		}
+		server.StateProvider = gitProvider
+		logger.Sugar().Debugf("Using State: Git (%s)", gitProvider.Path)
+
+		server.TimeProvider = gitProvider
+		timeServices["git"] = gitProvider
+		logger.Sugar().Debug("Using TimeService: Git")
+	}
+
 	// Configure Kubernetes Provider
-	if settings.Kubernetes.Enabled {
+	if settings.Kubernetes.Enabled && !settings.Kubernetes.Crd {
 		kubernetesProvider, err := providers.NewKubernetesProvider(server.Logger, viper.GetString("kubernetes.kubeconfig"))
 		if err != nil {
 			panic(err)
 		}
+		err = kubernetesProvider.StartCache(context.Background(), providers.KubernetesCacheSyncTimeout)
+		if err != nil {
+			logger.Sugar().Warnf("Reading State from the API server without cache: %v", err)
+		}
 		server.StateProvider = kubernetesProvider
 		logger.Sugar().Debug("Using State: Kubernetes")
 
 		server.TimeProvider = kubernetesProvider
+		timeServices["kubernetes"] = kubernetesProvider
 		logger.Sugar().Debug("Using TimeService: Kubernetes")
 	}
 
+	// Configure Kubernetes CRD Provider
+	if settings.Kubernetes.Enabled && settings.Kubernetes.Crd {
+		crdProvider, err := providers.NewKubernetesCrdProvider(server.Logger, viper.GetString("kubernetes.kubeconfig"))
+		if err != nil {
+			panic(err)
+		}
+		server.StateProvider = crdProvider
+		logger.Sugar().Debug("Using State: Kubernetes CRDs")
+
+		server.TimeProvider = crdProvider
+		timeServices["kubernetes"] = crdProvider
+		logger.Sugar().Debug("Using TimeService: Kubernetes CRDs")
+	}
+
+	// Configure SQL Provider
+	if settings.Sql.Enabled {
+		sqlProvider, err := providers.NewSqlProvider(server.Logger, settings.Sql.Driver, settings.Sql.Dsn)
+		if err != nil {
+			panic(err)
+		}
+		server.StateProvider = sqlProvider
+		logger.Sugar().Debugf("Using State: SQL (%s)", sqlProvider.Driver)
+
+		server.TimeProvider = sqlProvider
+		timeServices["sql"] = sqlProvider
+		logger.Sugar().Debug("Using TimeService: SQL")
+	}
+
+	// Configure Cache in front of the State
+	if settings.Cache.Enabled {
+		cachedState := NewCachedState(server.StateProvider, settings.Cache.Ttl)
+		if settings.Cache.Watch {
+			err := cachedState.StartWatch(context.Background())
+			if err != nil {
+				panic(err)
+			}
+		} else if cachedState.Ttl <= 0 {
+			cachedState.Ttl = StateCacheTtl
+		}
+		server.StateProvider = cachedState
+		server.TimeProvider = cachedState.TimeService(server.TimeProvider)
+		for name, ts := range timeServices {
+			timeServices[name] = cachedState.TimeService(ts)
+		}
+		logger.Sugar().Debugf("Using State Cache (ttl: %v, watch: %v)", cachedState.Ttl, settings.Cache.Watch)
+	}
+
+	// Configure Clockodo Provider
+	if settings.Clockodo.Enabled {
+		clockodoProvider, err := providers.NewClockodoProvider(server.Logger, settings.Clockodo.Url, settings.Clockodo.User, settings.Clockodo.Token)
+		if err != nil {
+			panic(err)
+		}
+		server.TimeProvider = clockodoProvider
+		timeServices["clockodo"] = clockodoProvider
+		logger.Sugar().Debug("Using TimeService: Clockodo")
+	}
+
+	// Configure Jira Provider
+	if settings.Jira.Enabled {
+		jiraProvider, err := providers.NewJiraProvider(server.Logger, settings.Jira.Url, settings.Jira.User, settings.Jira.Token)
+		if err != nil {
+			panic(err)
+		}
+		server.TimeProvider = jiraProvider
+		timeServices["jira"] = jiraProvider
+		logger.Sugar().Debug("Using TimeService: Jira")
+	}
+
+	// Configure Toggl Provider
+	if settings.Toggl.Enabled {
+		togglProvider, err := providers.NewTogglProvider(server.Logger, settings.Toggl.Url, settings.Toggl.Token, settings.Toggl.Workspace)
+		if err != nil {
+			panic(err)
+		}
+		server.TimeProvider = togglProvider
+		timeServices["toggl"] = togglProvider
+		logger.Sugar().Debug("Using TimeService: Toggl")
+	}
+
+	// Configure Kimai Provider
+	if settings.Kimai.Enabled {
+		kimaiProvider, err := providers.NewKimaiProvider(server.Logger, settings.Kimai.Url, settings.Kimai.User, settings.Kimai.Token)
+		if err != nil {
+			panic(err)
+		}
+		server.TimeProvider = kimaiProvider
+		timeServices["kimai"] = kimaiProvider
+		logger.Sugar().Debug("Using TimeService: Kimai")
+	}
+
+	// Configure Routing between TimeServices
+	if settings.Routing.Enabled {
+		router, err := NewTimeServiceRouter(server.Logger, timeServices, settings.Routing.Rules, settings.Routing.Default)
+		if err != nil {
+			panic(err)
+		}
+		server.TimeProvider = router
+		logger.Sugar().Debugf("Using TimeService: Routing to %d backends", len(timeServices))
+	}
+
 	// Configure RocketChatBridge Provider
 	if settings.Webhook.Enabled {
-		webhookProvider, _ := providers.NewWebhookProvider(viper.GetString("webhook.url"))
+		deadLetter, err := providers.NewDeadLetterStore(settings.Webhook.DeadLetter)
+		if err != nil {
+			panic(err)
+		}
+		webhookProvider, err := providers.NewWebhookProvider(server.Logger, settings.Webhook.Url, settings.Webhook.Mode, deadLetter)
+		if err != nil {
+			panic(err)
+		}
+		if settings.Webhook.Retries != nil {
+			webhookProvider.Retries = *settings.Webhook.Retries
+		}
+		if settings.Webhook.Backoff > 0 {
+			webhookProvider.Backoff = settings.Webhook.Backoff
+		}
 		server.ChatProvider = webhookProvider
+		notifiers["webhook"] = webhookProvider
 		logger.Sugar().Debug("Using Chat: Webhook")
 	}
 
+	// Configure Slack Provider
+	if settings.Slack.Enabled {
+		slackProvider, err := providers.NewSlackProvider(server.Logger, settings.Slack.Webhook, server.ActionLinks, server.UserSettings)
+		if err != nil {
+			panic(err)
+		}
+		server.ChatProvider = slackProvider
+		notifiers["slack"] = slackProvider
+		logger.Sugar().Debug("Using Chat: Slack")
+	}
+
+	// Configure Mattermost Provider
+	if settings.Mattermost.Enabled {
+		mattermostProvider, err := providers.NewMattermostProvider(server.Logger, settings.Mattermost.Webhook, server.ActionLinks, server.UserSettings)
+		if err != nil {
+			panic(err)
+		}
+		server.ChatProvider = mattermostProvider
+		notifiers["mattermost"] = mattermostProvider
+		logger.Sugar().Debug("Using Chat: Mattermost")
+	}
+
+	// Configure Email Provider
+	if settings.Email.Enabled {
+		emailProvider, err := providers.NewEmailProvider(server.Logger, settings.Email.Host, settings.Email.Port, settings.Email.Username, settings.Email.Password, settings.Email.From, server.ActionLinks, server.UserSettings)
+		if err != nil {
+			panic(err)
+		}
+		if settings.Email.DigestAt > 0 {
+			emailProvider.DigestAt = settings.Email.DigestAt
+		}
+		emailProvider.Log = server
+		server.ChatProvider = emailProvider
+		notifiers["email"] = emailProvider
+		logger.Sugar().Debugf("Using Chat: Email (%s)", emailProvider.Host)
+	}
+
+	// Configure ntfy Provider
+	if settings.Ntfy.Enabled {
+		ntfyProvider, err := providers.NewNtfyProvider(server.Logger, settings.Ntfy.Server, settings.Ntfy.Token, server.ActionLinks, server.UserSettings)
+		if err != nil {
+			panic(err)
+		}
+		server.ChatProvider = ntfyProvider
+		notifiers["ntfy"] = ntfyProvider
+		logger.Sugar().Debugf("Using Chat: ntfy (%s)", ntfyProvider.Server)
+	}
+
+	// Configure Gotify Provider
+	if settings.Gotify.Enabled {
+		gotifyProvider, err := providers.NewGotifyProvider(server.Logger, settings.Gotify.Server, server.ActionLinks, server.UserSettings)
+		if err != nil {
+			panic(err)
+		}
+		server.ChatProvider = gotifyProvider
+		notifiers["gotify"] = gotifyProvider
+		logger.Sugar().Debugf("Using Chat: Gotify (%s)", gotifyProvider.Server)
+	}
+
+	// Configure Routing between NotificationServices
+	if settings.Notifications.Enabled {
+		router, err := NewNotificationRouter(server.Logger, notifiers, settings.Notifications.Default, server.UserSettings)
+		if err != nil {
+			panic(err)
+		}
+		server.ChatProvider = router
+		logger.Sugar().Debugf("Using Chat: Routing to %d channels", len(notifiers))
+	}
+
 	return server
 }
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// StateCacheTtl is how long a cached partition is used, if the cache neither has a TTL nor watches the State
+const StateCacheTtl time.Duration = 5 * time.Second
+
+// CachedState keeps the result of Refresh for every partition. Save is always written to the State and drops the cached partition,
+// so the next Refresh reads the new version. Changes by other processes are noticed after the TTL or through Watch.
+// Saving a partition, that changed in the meantime, fails with a VersionConflictError as usual and is retried with fresh data
+type CachedState struct {
+	State State
+	Ttl   time.Duration
+
+	mu         sync.Mutex
+	entries    map[string]cachedPartition
+	generation int
+}
+
+type cachedPartition struct {
+	state   providers.StateV2
+	expires time.Time
+}
+
+func NewCachedState(state State, ttl time.Duration) *CachedState {
+	return &CachedState{
+		State:   state,
+		Ttl:     ttl,
+		entries: map[string]cachedPartition{},
+	}
+}
+
+// UnwrapState returns the State behind a cache, e.g. to check for optional interfaces like StateHistory
+func UnwrapState(state State) State {
+	if cached, ok := state.(*CachedState); ok {
+		return cached.State
+	}
+	return state
+}
+
+func (c *CachedState) Refresh(partition string) (providers.StateV2, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[partition]
+	generation := c.generation
+	c.mu.Unlock()
+	if ok && (entry.expires.IsZero() || time.Now().Before(entry.expires)) {
+		return entry.state.DeepCopy(), nil
+	}
+
+	state, err := c.State.Refresh(partition)
+	if err != nil {
+		return state, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A partition, that was invalidated while reading, might already be outdated
+	if c.generation == generation {
+		entry := cachedPartition{state: state.DeepCopy()}
+		if c.Ttl > 0 {
+			entry.expires = time.Now().Add(c.Ttl)
+		}
+		c.entries[partition] = entry
+	}
+	return state, nil
+}
+
+func (c *CachedState) Save(partition string, state providers.StateV2) error {
+	err := c.State.Save(partition, state)
+	c.Invalidate(partition)
+	return err
+}
+
+// Invalidate drops a partition and the global scope, which contains the partition. Invalidating the global scope drops everything
+func (c *CachedState) Invalidate(partition string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if partition == providers.ScopeGlobal {
+		c.entries = map[string]cachedPartition{}
+		return
+	}
+	delete(c.entries, partition)
+	delete(c.entries, providers.ScopeGlobal)
+}
+
+// TimeService returns a TimeService, that drops the User's partition after writing a Record. Use it, if the TimeService stores
+// Records in the State behind the cache (e.g. file, git or kubernetes), otherwise it is returned unchanged
+func (c *CachedState) TimeService(ts TimeService) TimeService {
+	if interface{}(ts) != interface{}(c.State) {
+		return ts
+	}
+	return cachedTimeService{TimeService: ts, cache: c}
+}
+
+// cachedTimeService invalidates the cache on every write of the TimeService
+type cachedTimeService struct {
+	TimeService
+	cache *CachedState
+}
+
+func (ts cachedTimeService) SaveRecord(rec api.Record) (api.Record, error) {
+	defer ts.cache.Invalidate(rec.UserName)
+	return ts.TimeService.SaveRecord(rec)
+}
+
+func (ts cachedTimeService) UpdateRecord(rec api.Record) (api.Record, error) {
+	defer ts.cache.Invalidate(rec.UserName)
+	return ts.TimeService.UpdateRecord(rec)
+}
+
+func (ts cachedTimeService) DeleteRecord(rec api.Record) (api.Record, error) {
+	defer ts.cache.Invalidate(rec.UserName)
+	return ts.TimeService.DeleteRecord(rec)
+}
+
+// StartWatch invalidates partitions, as soon as the State notices a change. Cached partitions do not expire without TTL
+func (c *CachedState) StartWatch(ctx context.Context) error {
+	watcher, ok := c.State.(StateWatcher)
+	if !ok {
+		return fmt.Errorf("the State does not support watching for changes")
+	}
+	return watcher.Watch(ctx, c.Invalidate)
+}
@@ -0,0 +1,102 @@
+package server_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/thomasbuchinger/timerec/api"
+	"github.com/thomasbuchinger/timerec/internal/server"
+	"github.com/thomasbuchinger/timerec/internal/server/providers"
+)
+
+// countingState counts every Refresh and notifies Watch callers on demand
+type countingState struct {
+	*providers.FileOrMemoryProvider
+	refreshes int
+	onChange  func(partition string)
+}
+
+func (s *countingState) Refresh(partition string) (providers.StateV2, error) {
+	s.refreshes++
+	return s.FileOrMemoryProvider.Refresh(partition)
+}
+
+func (s *countingState) Watch(ctx context.Context, onChange func(partition string)) error {
+	s.onChange = onChange
+	return nil
+}
+
+func TestCachedStateServesRefreshFromCache(t *testing.T) {
+	inner := &countingState{FileOrMemoryProvider: providers.NewMemoryProvider()}
+	cache := server.NewCachedState(inner, time.Hour)
+
+	state, _ := cache.Refresh("me")
+	providers.CreateUser(&state, api.NewDefaultUser("me"))
+	cached, _ := cache.Refresh("me")
+	if inner.refreshes != 1 || len(cached.Users) != 0 {
+		t.Fatalf("incorrect cached state: got %d refreshes and %v", inner.refreshes, cached.Users)
+	}
+
+	if err := cache.Save("me", state); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	saved, _ := cache.Refresh("me")
+	if inner.refreshes != 2 || len(saved.Users) != 1 {
+		t.Fatalf("incorrect state after save: got %d refreshes and %v", inner.refreshes, saved.Users)
+	}
+
+	// Cached partitions are used for the next Save and fail, if the State changed in the meantime
+	inner.FileOrMemoryProvider.Save("me", saved)
+	stale, _ := cache.Refresh("me")
+	if err := cache.Save("me", stale); err == nil {
+		t.Fatal("expected a conflict for a stale partition")
+	}
+	fresh, _ := cache.Refresh("me")
+	if err := cache.Save("me", fresh); err != nil {
+		t.Fatalf("expected no error after the conflict, got %v", err)
+	}
+}
+
+func TestCachedStateExpiresAndWatches(t *testing.T) {
+	inner := &countingState{FileOrMemoryProvider: providers.NewMemoryProvider()}
+	cache := server.NewCachedState(inner, time.Millisecond)
+	cache.Refresh("me")
+	time.Sleep(2 * time.Millisecond)
+	cache.Refresh("me")
+	if inner.refreshes != 2 {
+		t.Fatalf("incorrect number of refreshes: got %d expected %d", inner.refreshes, 2)
+	}
+
+	cache = server.NewCachedState(inner, 0)
+	if err := cache.StartWatch(context.TODO()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	cache.Refresh("me")
+	cache.Refresh("me")
+	inner.onChange("me")
+	cache.Refresh("me")
+	if inner.refreshes != 4 {
+		t.Fatalf("incorrect number of refreshes: got %d expected %d", inner.refreshes, 4)
+	}
+	if server.UnwrapState(cache) != inner {
+		t.Fatal("expected UnwrapState to return the cached State")
+	}
+}
+
+func TestCachedStateInvalidatesOnTimeServiceWrites(t *testing.T) {
+	mem := providers.NewMemoryProvider()
+	providers.CreateUser(&mem.Data, api.NewDefaultUser("me"))
+	cache := server.NewCachedState(mem, time.Hour)
+	other := providers.NewMemoryProvider()
+	if cache.TimeService(other) != server.TimeService(other) {
+		t.Fatal("expected other TimeServices to be returned unchanged")
+	}
+
+	cache.Refresh("me")
+	cache.TimeService(mem).SaveRecord(api.Record{Id: "rec", UserName: "me"})
+	state, _ := cache.Refresh("me")
+	if len(state.Records) != 1 {
+		t.Fatalf("incorrect number of records: got %d expected %d", len(state.Records), 1)
+	}
+}